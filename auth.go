@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+// keyringService is the service sdcli's secrets are stored under in the OS
+// keyring.
+const keyringService = "sdcli"
+
+// keyringAPIKeyUser is the keyring entry holding the Stability API key.
+const keyringAPIKeyUser = "api_key"
+
+type AuthCommand struct {
+	Login  AuthLoginCommand  `cmd:"" help:"Store the API key in the OS keyring."`
+	Logout AuthLogoutCommand `cmd:"" help:"Remove the API key from the OS keyring."`
+}
+
+type AuthLoginCommand struct{}
+
+func (a AuthLoginCommand) Run(ctx *Context) error {
+	apiKey, err := readSecret("API key: ")
+	if err != nil {
+		ctx.Logger.Fatal("failed to read API key", zap.Error(err))
+	}
+
+	if apiKey == "" {
+		ctx.Logger.Fatal("API key is empty, exiting")
+	}
+
+	err = keyring.Set(keyringService, keyringAPIKeyUser, apiKey)
+	if err != nil {
+		ctx.Logger.Fatal("failed to store API key in the keyring", zap.Error(err))
+	}
+
+	ctx.Logger.Info("stored API key in the keyring; set \"api_key_keyring\": true in your config to use it")
+
+	return nil
+}
+
+type AuthLogoutCommand struct{}
+
+func (a AuthLogoutCommand) Run(ctx *Context) error {
+	err := keyring.Delete(keyringService, keyringAPIKeyUser)
+	if errors.Is(err, keyring.ErrNotFound) {
+		ctx.Logger.Info("no API key is stored in the keyring")
+
+		return nil
+	} else if err != nil {
+		ctx.Logger.Fatal("failed to remove API key from the keyring", zap.Error(err))
+	}
+
+	ctx.Logger.Info("removed API key from the keyring")
+
+	return nil
+}
+
+// readSecret prompts for a secret on stderr and reads it from stdin, without
+// echoing it if stdin is a terminal.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+
+		return strings.TrimSpace(string(secret)), err
+	}
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && secret == "" {
+		return "", err
+	}
+
+	return strings.TrimSpace(secret), nil
+}
+
+// keyringAPIKey returns the API key stored in the OS keyring by auth login.
+func keyringAPIKey() (string, error) {
+	apiKey, err := keyring.Get(keyringService, keyringAPIKeyUser)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", errors.New("no API key is stored in the keyring, run sdcli auth login")
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read API key from the keyring: %w", err)
+	}
+
+	return apiKey, nil
+}
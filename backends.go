@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/units"
+	"github.com/SethCurry/sdcli/pkg/a1111"
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/bfl"
+	"github.com/SethCurry/sdcli/pkg/mock"
+	"github.com/SethCurry/sdcli/pkg/openai"
+	"github.com/SethCurry/sdcli/pkg/stability"
+)
+
+type A1111Config struct {
+	// The URL of the WebUI.  Defaults to http://127.0.0.1:7860.  The WebUI must be
+	// started with the --api flag.
+	BaseURL string `json:"base_url"`
+
+	// The number of sampling steps.  Defaults to the WebUI's default.
+	Steps int `json:"steps"`
+
+	// The sampler to use, e.g. "DPM++ 2M".  Defaults to the WebUI's default.
+	Sampler string `json:"sampler"`
+
+	// The upscaler to use for "sdcli upscale".  Defaults to "R-ESRGAN 4x+".
+	Upscaler string `json:"upscaler"`
+}
+
+type OpenAIConfig struct {
+	// The OpenAI API key to use.
+	APIKey string `json:"api_key"`
+
+	// The organization to bill requests to, for keys that belong to several.
+	Organization string `json:"organization"`
+
+	// The base URL of the API.  Defaults to https://api.openai.com/v1.
+	BaseURL string `json:"base_url"`
+}
+
+type BFLConfig struct {
+	// The Black Forest Labs API key to use.
+	APIKey string `json:"api_key"`
+
+	// The base URL of the API.  Defaults to https://api.bfl.ai/v1.
+	BaseURL string `json:"base_url"`
+}
+
+// PollingConfig sets how backends that generate asynchronously, e.g. bfl, poll
+// for their results.
+type PollingConfig struct {
+	// How long to wait before polling for a result, e.g. "2s".  Defaults to 1
+	// second.
+	Interval units.Duration `json:"interval"`
+
+	// How long to wait for a result before giving up, e.g. "10m" for slow jobs.
+	// Defaults to 5 minutes.
+	MaxWait units.Duration `json:"max_wait"`
+
+	// How much to multiply the interval by after each poll, e.g. 1.5 to poll less
+	// often the longer a job takes.  Defaults to 1, a fixed interval.
+	Backoff float64 `json:"backoff"`
+}
+
+// validate checks that the backoff doesn't shrink the interval.
+func (p PollingConfig) validate() error {
+	if p.Backoff != 0 && p.Backoff < 1 {
+		return errors.New("backoff must be at least 1")
+	}
+
+	return nil
+}
+
+// bflOptions returns the options of the bfl client for the settings that are
+// set, leaving the rest at the client's defaults.
+func (p PollingConfig) bflOptions() []bfl.ClientOption {
+	var opts []bfl.ClientOption
+
+	if p.Interval > 0 || p.MaxWait > 0 {
+		interval, maxWait := time.Duration(p.Interval), time.Duration(p.MaxWait)
+
+		if interval == 0 {
+			interval = bfl.DefaultPollInterval
+		}
+
+		if maxWait == 0 {
+			maxWait = bfl.DefaultMaxWait
+		}
+
+		opts = append(opts, bfl.WithPolling(interval, maxWait))
+	}
+
+	if p.Backoff > 0 {
+		opts = append(opts, bfl.WithPollBackoff(p.Backoff))
+	}
+
+	return opts
+}
+
+// backendNames are the names of every backend, as used in config and the
+// --backend flag.
+var backendNames = []string{"stability", "a1111", "openai", "bfl", "mock"}
+
+// overrideBaseURL sets the base URL of the named backend, e.g. from --base-url.
+func overrideBaseURL(config *Config, name string, baseURL string) error {
+	switch name {
+	case "", "stability":
+		config.BaseURL = baseURL
+	case "a1111":
+		config.A1111.BaseURL = baseURL
+	case "openai":
+		config.OpenAI.BaseURL = baseURL
+	case "bfl":
+		config.BFL.BaseURL = baseURL
+	case "mock":
+		return fmt.Errorf("the mock backend doesn't call an API, so has no base URL")
+	default:
+		return fmt.Errorf("unknown backend %q", name)
+	}
+
+	return nil
+}
+
+// newBackend creates the backend with the given name.  An empty name selects the
+// Stability backend.
+func newBackend(name string, config Config) (backend.Backend, error) {
+	switch name {
+	case "", "stability":
+		var opts []stability.ClientOption
+
+		if config.BaseURL != "" {
+			opts = append(opts, stability.WithBaseURL(config.BaseURL))
+		}
+
+		if config.Organization != "" {
+			opts = append(opts, stability.WithOrganization(config.Organization))
+		}
+
+		clientID, clientVersion := "sdcli", version
+		if config.ClientID != "" {
+			clientID, clientVersion = config.ClientID, config.ClientVersion
+		}
+
+		opts = append(opts, stability.WithClientID(clientID, clientVersion))
+
+		if config.LowMemory {
+			opts = append(opts, stability.WithLowMemory())
+		}
+
+		return stability.NewClient(config.APIKey, opts...), nil
+	case "a1111":
+		opts := []a1111.ClientOption{
+			a1111.WithSteps(config.A1111.Steps),
+			a1111.WithSampler(config.A1111.Sampler),
+		}
+
+		if config.A1111.BaseURL != "" {
+			opts = append(opts, a1111.WithBaseURL(config.A1111.BaseURL))
+		}
+
+		if config.A1111.Upscaler != "" {
+			opts = append(opts, a1111.WithUpscaler(config.A1111.Upscaler))
+		}
+
+		return a1111.NewClient(opts...), nil
+	case "openai":
+		if config.OpenAI.APIKey == "" {
+			return nil, fmt.Errorf("openai.api_key must be set in the config to use the openai backend")
+		}
+
+		opts := []openai.ClientOption{openai.WithOrganization(config.OpenAI.Organization)}
+
+		if config.OpenAI.BaseURL != "" {
+			opts = append(opts, openai.WithBaseURL(config.OpenAI.BaseURL))
+		}
+
+		return openai.NewClient(config.OpenAI.APIKey, opts...), nil
+	case "bfl":
+		if config.BFL.APIKey == "" {
+			return nil, fmt.Errorf("bfl.api_key must be set in the config to use the bfl backend")
+		}
+
+		opts := config.Polling.bflOptions()
+
+		if config.BFL.BaseURL != "" {
+			opts = append(opts, bfl.WithBaseURL(config.BFL.BaseURL))
+		}
+
+		return bfl.NewClient(config.BFL.APIKey, opts...), nil
+	case "mock":
+		return mock.NewClient(), nil
+	}
+
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptrace"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"go.uber.org/zap"
+)
+
+// defaultBenchPrompt is generated with when bench isn't given a prompt.
+const defaultBenchPrompt = "A lighthouse on a rocky cliff at dusk"
+
+var errBenchImageRequired = errors.New("--image is required to benchmark upscales and edits")
+
+type BenchCommand struct {
+	Engine      []string `optional:"engine" help:"The model or operation to benchmark, e.g. sd3-large-turbo, upscale/fast, or edit/remove-background.  Can be given more than once.  Defaults to the backend's default model."`
+	Count       int      `optional:"count" default:"10" help:"The number of requests to send to each engine."`
+	Concurrency int      `optional:"concurrency" default:"1" help:"The number of requests to have in flight at once."`
+	Image       string   `optional:"image" type:"existingfile" help:"The image to send to upscale and edit engines."`
+	PromptParts []string `arg:"" optional:"" help:"The prompt to send.  Defaults to a fixed prompt."`
+}
+
+// benchSample is the timing of a single request.
+type benchSample struct {
+	// How long the request took, from sending it to having the image.
+	Total time.Duration
+
+	// How long it took to get a connection, including DNS, TCP, and TLS, which is
+	// near zero when a connection is reused.
+	Connect time.Duration
+
+	// How long the server took to start responding once the request was sent.
+	// This is mostly the API generating the image.
+	Wait time.Duration
+
+	// Whether Connect and Wait were measured.  They aren't for backends that
+	// don't make HTTP requests, like the mock.
+	Traced bool
+
+	Err error
+}
+
+func (b BenchCommand) Run(ctx *Context) error {
+	if b.Count < 1 {
+		ctx.Logger.Fatal("count must be at least 1", zap.Int("count", b.Count))
+	}
+
+	if b.Concurrency < 1 {
+		ctx.Logger.Fatal("concurrency must be at least 1", zap.Int("concurrency", b.Concurrency))
+	}
+
+	engines := b.Engine
+	if len(engines) == 0 {
+		engines = []string{defaultModel(ctx.Backend.Capabilities())}
+	}
+
+	var image []byte
+
+	for _, v := range engines {
+		err := b.checkEngine(ctx, v)
+		if err != nil {
+			ctx.Logger.Fatal("unable to benchmark", zap.String("engine", v), zap.Error(err))
+		}
+
+		if isGenerateEngine(v) || image != nil {
+			continue
+		}
+
+		image, err = imageSource{Path: b.Image}.readForUpload(ctx)
+		if err != nil {
+			ctx.Logger.Fatal("failed to read image", zap.Error(err))
+		}
+	}
+
+	prompt := strings.Join(b.PromptParts, " ")
+	if prompt == "" {
+		prompt = defaultBenchPrompt
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ENGINE\tREQUESTS\tFAILED\tP50\tP95\tMAX\tCONNECT P50\tWAIT P50\tPER MINUTE")
+
+	failures := make(map[string]int)
+
+	for _, engine := range engines {
+		started := time.Now()
+		samples := b.runEngine(ctx, engine, prompt, image)
+		elapsed := time.Since(started)
+
+		var (
+			totals, connects, waits []time.Duration
+			failed                  int
+		)
+
+		for _, v := range samples {
+			if v.Err != nil {
+				failed++
+				failures[fmt.Sprintf("%s: %s", engine, v.Err)]++
+
+				continue
+			}
+
+			totals = append(totals, v.Total)
+
+			if v.Traced {
+				connects = append(connects, v.Connect)
+				waits = append(waits, v.Wait)
+			}
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%.1f\n",
+			engine,
+			len(samples),
+			failed,
+			formatLatency(percentile(totals, 50)),
+			formatLatency(percentile(totals, 95)),
+			formatLatency(percentile(totals, 100)),
+			formatLatency(percentile(connects, 50)),
+			formatLatency(percentile(waits, 50)),
+			float64(len(totals))/elapsed.Minutes())
+
+		if ctx.Ctx.Err() != nil {
+			break
+		}
+	}
+
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(failures) > 0 {
+		reasons := make([]string, 0, len(failures))
+		for k := range failures {
+			reasons = append(reasons, k)
+		}
+
+		sort.Strings(reasons)
+
+		fmt.Println("\nFailures:")
+
+		for _, v := range reasons {
+			fmt.Printf("  %dx %s\n", failures[v], v)
+		}
+	}
+
+	return ctx.Ctx.Err()
+}
+
+// isGenerateEngine reports whether an engine is a model to generate with, rather
+// than an upscale or edit operation.
+func isGenerateEngine(engine string) bool {
+	return !strings.HasPrefix(engine, "upscale/") && !strings.HasPrefix(engine, "edit/")
+}
+
+// checkEngine returns an error if the backend can't run engine.
+func (b BenchCommand) checkEngine(ctx *Context, engine string) error {
+	if mode, ok := strings.CutPrefix(engine, "upscale/"); ok {
+		if b.Image == "" {
+			return invalid(errBenchImageRequired)
+		}
+
+		return ctx.requireUpscaleMode(mode)
+	}
+
+	if op, ok := strings.CutPrefix(engine, "edit/"); ok {
+		if b.Image == "" {
+			return invalid(errBenchImageRequired)
+		}
+
+		return ctx.requireEditOperation(op)
+	}
+
+	return ctx.requireModel(engine)
+}
+
+// runEngine sends --count requests to an engine, --concurrency at a time, and
+// returns their timings.  It stops early if sdcli is interrupted.
+func (b BenchCommand) runEngine(ctx *Context, engine string, prompt string, image []byte) []benchSample {
+	samples := make([]benchSample, 0, b.Count)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		jobs = make(chan struct{})
+	)
+
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range jobs {
+				sample := b.request(ctx, engine, prompt, image)
+
+				// Requests cut off by an interrupt didn't fail.
+				if sample.Err != nil && ctx.Ctx.Err() != nil {
+					continue
+				}
+
+				mu.Lock()
+				samples = append(samples, sample)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < b.Count && ctx.Ctx.Err() == nil; i++ {
+		jobs <- struct{}{}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return samples
+}
+
+// request sends a single request to an engine and times it.  The cost of the
+// request is reserved from the credit budget like any other, but the image is
+// thrown away.
+func (b BenchCommand) request(ctx *Context, engine string, prompt string, image []byte) benchSample {
+	var (
+		sample                                benchSample
+		mu                                    sync.Mutex
+		started, gotConn, wroteReq, firstByte time.Time
+	)
+
+	// Backends that poll for results make several requests, so only the first
+	// connection and response are timed.
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if started.IsZero() {
+				started = time.Now()
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if gotConn.IsZero() {
+				gotConn = time.Now()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if wroteReq.IsZero() {
+				wroteReq = time.Now()
+			}
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if firstByte.IsZero() {
+				firstByte = time.Now()
+			}
+		},
+	}
+
+	credits, release, err := ctx.reserveCredits(engine)
+	if err != nil {
+		sample.Err = err
+
+		return sample
+	}
+
+	reqCtx := httptrace.WithClientTrace(ctx.Ctx, trace)
+	begin := time.Now()
+
+	result, err := b.send(reqCtx, ctx.Backend, engine, prompt, image)
+
+	sample.Total = time.Since(begin)
+
+	if err != nil {
+		release()
+
+		sample.Err = err
+
+		return sample
+	}
+
+	ctx.settleCredits(credits, result)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !gotConn.IsZero() && !firstByte.IsZero() {
+		sample.Traced = true
+		sample.Connect = gotConn.Sub(started)
+		sample.Wait = firstByte.Sub(wroteReq)
+	}
+
+	return sample
+}
+
+// send sends the request for an engine to the backend.
+func (b BenchCommand) send(ctx context.Context, to backend.Backend, engine string, prompt string, image []byte) (*backend.Result, error) {
+	if mode, ok := strings.CutPrefix(engine, "upscale/"); ok {
+		return to.Upscale(ctx, backend.UpscaleRequest{
+			Image:        bytes.NewReader(image),
+			Mode:         mode,
+			Prompt:       prompt,
+			OutputFormat: "png",
+		})
+	}
+
+	if op, ok := strings.CutPrefix(engine, "edit/"); ok {
+		return to.Edit(ctx, backend.EditRequest{
+			Image:        bytes.NewReader(image),
+			Operation:    op,
+			Prompt:       prompt,
+			OutputFormat: "png",
+		})
+	}
+
+	return to.Generate(ctx, backend.GenerateRequest{
+		Prompt:       prompt,
+		Model:        engine,
+		AspectRatio:  "1:1",
+		OutputFormat: "png",
+	})
+}
+
+// percentile returns the p-th percentile of durations by the nearest-rank
+// method, or zero if there are none.
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+
+	rank := (p*len(sorted) + 99) / 100
+
+	return sorted[max(rank, 1)-1]
+}
+
+// formatLatency formats a latency to the millisecond, or "-" if it wasn't
+// measured.
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+
+	return d.Round(time.Millisecond).String()
+}
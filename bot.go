@@ -0,0 +1,20 @@
+package main
+
+// The defaults used by the bots when a user doesn't specify an option.
+const (
+	botDefaultRatio        = "1:1"
+	botDefaultOutputFormat = "png"
+)
+
+type BotCommand struct {
+	Discord  BotDiscordCommand  `cmd:"" help:"Run a Discord bot that generates images with the /imagine command."`
+	Telegram BotTelegramCommand `cmd:"" help:"Run a Telegram bot that generates images with the /imagine command."`
+}
+
+func valueOrDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
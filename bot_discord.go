@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/SethCurry/sdcli/internal/discord"
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"go.uber.org/zap"
+)
+
+type DiscordConfig struct {
+	// The application ID from the Discord developer portal.
+	ApplicationID string `json:"application_id"`
+
+	// The hex-encoded public key from the Discord developer portal.  It is used to
+	// verify that interactions were sent by Discord.
+	PublicKey string `json:"public_key"`
+
+	// The bot token, used to register the slash command.
+	BotToken string `json:"bot_token"`
+
+	// The address to listen for interactions on, e.g. ":8080".  Discord must be
+	// able to reach this address over HTTPS, which usually means putting it
+	// behind a reverse proxy.
+	ListenAddress string `json:"listen_address"`
+}
+
+type BotDiscordCommand struct {
+	SkipRegister bool `optional:"skip-register" help:"Don't register the /imagine command with Discord on startup."`
+}
+
+// discordMaxChoices is the maximum number of choices Discord allows per option.
+const discordMaxChoices = 25
+
+func discordChoices(values []string) []discord.CommandOptionChoice {
+	if len(values) > discordMaxChoices {
+		values = values[:discordMaxChoices]
+	}
+
+	choices := make([]discord.CommandOptionChoice, 0, len(values))
+	for _, v := range values {
+		choices = append(choices, discord.CommandOptionChoice{Name: v, Value: v})
+	}
+
+	return choices
+}
+
+func discordCommands(caps backend.Capabilities) []discord.Command {
+	modelChoices := discordChoices(caps.Models)
+	ratioChoices := discordChoices(caps.AspectRatios)
+
+	return []discord.Command{
+		{
+			Name:        "imagine",
+			Description: "Generate an image",
+			Options: []discord.CommandOption{
+				{
+					Type:        discord.OptionTypeString,
+					Name:        "prompt",
+					Description: "The prompt to use for generation.",
+					Required:    true,
+				},
+				{
+					Type:        discord.OptionTypeString,
+					Name:        "model",
+					Description: "The model to use.",
+					Choices:     modelChoices,
+				},
+				{
+					Type:        discord.OptionTypeString,
+					Name:        "ratio",
+					Description: "The aspect ratio to use when generating.",
+					Choices:     ratioChoices,
+				},
+				{
+					Type:        discord.OptionTypeString,
+					Name:        "negative",
+					Description: "The negative prompt to use during generation.",
+				},
+			},
+		},
+	}
+}
+
+func (b BotDiscordCommand) Run(ctx *Context) error {
+	cfg := ctx.Config.Discord
+
+	if cfg.ApplicationID == "" || cfg.PublicKey == "" || cfg.ListenAddress == "" {
+		return fmt.Errorf("discord.application_id, discord.public_key, and discord.listen_address must be set in the config")
+	}
+
+	client := discord.NewClient(cfg.ApplicationID, cfg.BotToken)
+
+	if !b.SkipRegister {
+		if cfg.BotToken == "" {
+			return fmt.Errorf("discord.bot_token must be set in the config to register commands")
+		}
+
+		err := client.RegisterCommands(ctx.Ctx, discordCommands(ctx.Backend.Capabilities()))
+		if err != nil {
+			return fmt.Errorf("failed to register commands: %w", err)
+		}
+
+		ctx.Logger.Info("registered Discord commands")
+	}
+
+	handler, err := discord.NewHandler(cfg.PublicKey, func(interaction discord.Interaction) {
+		handleDiscordImagine(ctx, client, interaction)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create interaction handler: %w", err)
+	}
+
+	ctx.Logger.Info("listening for Discord interactions", zap.String("address", cfg.ListenAddress))
+
+	server := &http.Server{Addr: cfg.ListenAddress, Handler: handler}
+
+	go func() {
+		<-ctx.Ctx.Done()
+
+		// Stop accepting interactions.  Images already being generated are left to
+		// finish in the background until sdcli exits.
+		err := server.Shutdown(context.Background())
+		if err != nil {
+			ctx.Logger.Error("failed to shut down the Discord bot", zap.Error(err))
+		}
+	}()
+
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func handleDiscordImagine(ctx *Context, client *discord.Client, interaction discord.Interaction) {
+	logger := ctx.Logger.With(
+		zap.String("interaction", interaction.ID),
+		zap.String("user", interaction.Invoker().Username))
+
+	bgCtx := context.Background()
+
+	if interaction.Data.Name != "imagine" {
+		logger.Warn("received unknown command", zap.String("command", interaction.Data.Name))
+		return
+	}
+
+	gen := generation{
+		Prompt:         interaction.Data.StringOption("prompt"),
+		NegativePrompt: interaction.Data.StringOption("negative"),
+		Model:          valueOrDefault(interaction.Data.StringOption("model"), defaultModel(ctx.Backend.Capabilities())),
+		Ratio:          valueOrDefault(interaction.Data.StringOption("ratio"), botDefaultRatio),
+		OutputFormat:   botDefaultOutputFormat,
+	}
+
+	logger.Info("generating image", zap.String("prompt", gen.Prompt), zap.String("model", gen.Model))
+
+	ctx = ctx.forRequest(
+		"bot discord imagine",
+		interaction.Invoker().Username,
+		"prompt="+gen.Prompt,
+		"negative="+gen.NegativePrompt,
+		"model="+gen.Model,
+		"ratio="+gen.Ratio)
+
+	reply := func(content string, files ...discord.File) {
+		err := client.EditOriginalResponse(bgCtx, interaction.Token, content, files...)
+		if err != nil {
+			logger.Error("failed to reply to interaction", zap.Error(err))
+		}
+	}
+
+	var result *generationResult
+
+	// An unknown negative prompt bundle is reported like a failed generation.
+	negative, err := ctx.Config.expandNegative(gen.NegativePrompt)
+	if err == nil {
+		gen.NegativePrompt = negative
+		result, err = ctx.generate(bgCtx, gen)
+	}
+
+	if runErr := ctx.Run.finish(err); runErr != nil {
+		logger.Error("failed to write run log", zap.Error(runErr))
+	}
+
+	if err != nil {
+		logger.Error("failed to generate image", zap.Error(err))
+		reply(fmt.Sprintf("Failed to generate image: %s", err))
+
+		return
+	}
+
+	reply(
+		fmt.Sprintf("**%s**\nModel: `%s` | Seed: `%d`", gen.Prompt, result.Model, result.Seed),
+		discord.File{Name: path.Base(result.Path), Data: result.Image})
+}
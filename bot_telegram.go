@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/budget"
+	"github.com/SethCurry/sdcli/internal/ratelimit"
+	"github.com/SethCurry/sdcli/internal/telegram"
+	"go.uber.org/zap"
+)
+
+const (
+	// telegramPollTimeout is how many seconds to long-poll Telegram for updates.
+	telegramPollTimeout = 30
+
+	// telegramMaxCaptionPrompt is how much of the prompt to include in a photo's
+	// caption, in UTF-16 code units.  Telegram limits captions to 1024 characters,
+	// counted in UTF-16 code units.
+	telegramMaxCaptionPrompt = 900
+
+	// telegramRetryDelay is how long to wait before polling again after failing
+	// to get updates.
+	telegramRetryDelay = 5 * time.Second
+)
+
+type TelegramConfig struct {
+	// The bot token from BotFather.
+	BotToken string `json:"bot_token"`
+
+	// The IDs of the chats the bot will respond in.  Messages from any other chat
+	// are ignored.  If this is empty, the bot will respond in every chat.
+	AllowedChatIDs []int64 `json:"allowed_chat_ids"`
+
+	// The maximum number of images each user can generate per hour.  Zero or less
+	// disables the limit.
+	ImagesPerUserPerHour int `json:"images_per_user_per_hour"`
+}
+
+type BotTelegramCommand struct{}
+
+// parseTelegramImagine extracts the prompt from an "/imagine" command.  Commands may
+// be addressed to a specific bot, e.g. "/imagine@my_bot a cat".  The second return
+// value is false if the text is not an "/imagine" command.
+func parseTelegramImagine(text string) (string, bool) {
+	command, prompt, _ := strings.Cut(text, " ")
+	command, _, _ = strings.Cut(command, "@")
+
+	if command != "/imagine" {
+		return "", false
+	}
+
+	return strings.TrimSpace(prompt), true
+}
+
+func (b BotTelegramCommand) Run(ctx *Context) error {
+	cfg := ctx.Config.Telegram
+
+	if cfg.BotToken == "" {
+		return fmt.Errorf("telegram.bot_token must be set in the config")
+	}
+
+	client := telegram.NewClient(cfg.BotToken)
+	limiter := ratelimit.New(cfg.ImagesPerUserPerHour, time.Hour)
+
+	ctx.Logger.Info("polling Telegram for messages")
+
+	var offset int64
+
+	for {
+		updates, err := client.GetUpdates(ctx.Ctx, offset, telegramPollTimeout)
+		if ctx.Ctx.Err() != nil {
+			// Interrupted, so stop polling.  Requests already being handled are
+			// left to finish in the background until sdcli exits.
+			return nil
+		} else if err != nil {
+			ctx.Logger.Error("failed to get updates from Telegram", zap.Error(err))
+
+			select {
+			case <-ctx.Ctx.Done():
+				return nil
+			case <-time.After(telegramRetryDelay):
+			}
+
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+
+			if update.Message == nil || update.Message.From == nil {
+				continue
+			}
+
+			prompt, ok := parseTelegramImagine(update.Message.Text)
+			if !ok {
+				continue
+			}
+
+			if len(cfg.AllowedChatIDs) > 0 && !slices.Contains(cfg.AllowedChatIDs, update.Message.Chat.ID) {
+				ctx.Logger.Warn("ignoring message from chat that is not allowed", zap.Int64("chat", update.Message.Chat.ID))
+				continue
+			}
+
+			go handleTelegramImagine(ctx, client, limiter, *update.Message, prompt)
+		}
+	}
+}
+
+// truncateCaption shortens text to at most maxLength UTF-16 code units, as
+// Telegram counts them, followed by "..." if it was shortened.  It cuts between
+// characters, since Telegram refuses captions that aren't valid UTF-8.
+func truncateCaption(text string, maxLength int) string {
+	length := 0
+
+	for i, v := range text {
+		// Characters outside the Basic Multilingual Plane, e.g. most emoji, are
+		// written as surrogate pairs.
+		length++
+		if v > 0xffff {
+			length++
+		}
+
+		if length > maxLength {
+			return text[:i] + "..."
+		}
+	}
+
+	return text
+}
+
+func handleTelegramImagine(ctx *Context, client *telegram.Client, limiter *ratelimit.Limiter, msg telegram.Message, prompt string) {
+	logger := ctx.Logger.With(
+		zap.Int64("chat", msg.Chat.ID),
+		zap.Int64("user", msg.From.ID),
+		zap.String("username", msg.From.Username))
+
+	bgCtx := context.Background()
+
+	reply := func(text string) {
+		err := client.SendMessage(bgCtx, msg.Chat.ID, msg.MessageID, text)
+		if err != nil {
+			logger.Error("failed to reply to message", zap.Error(err))
+		}
+	}
+
+	if prompt == "" {
+		reply("Usage: /imagine <prompt>")
+		return
+	}
+
+	user := strconv.FormatInt(msg.From.ID, 10)
+
+	if ok, wait := limiter.Allow(user); !ok {
+		reply(fmt.Sprintf("You've hit the hourly image limit, try again in %s.", wait.Round(time.Minute)))
+		return
+	}
+
+	gen := generation{
+		Prompt:       prompt,
+		Model:        defaultModel(ctx.Backend.Capabilities()),
+		Ratio:        botDefaultRatio,
+		OutputFormat: botDefaultOutputFormat,
+	}
+
+	logger.Info("generating image", zap.String("prompt", gen.Prompt), zap.String("model", gen.Model))
+
+	ctx = ctx.forRequest("bot telegram imagine", msg.From.Username, "prompt="+gen.Prompt, "model="+gen.Model, "ratio="+gen.Ratio)
+
+	result, err := ctx.generate(bgCtx, gen)
+
+	if runErr := ctx.Run.finish(err); runErr != nil {
+		logger.Error("failed to write run log", zap.Error(runErr))
+	}
+
+	if err != nil {
+		logger.Error("failed to generate image", zap.Error(err))
+
+		// Failed requests don't count against the user's limit.
+		limiter.Refund(user)
+
+		if errors.Is(err, budget.ErrBudgetExceeded) {
+			reply("The credit budget for this month has been used up.")
+		} else {
+			reply("Failed to generate the image, sorry!")
+		}
+
+		return
+	}
+
+	caption := fmt.Sprintf("%s\nModel: %s | Seed: %d", truncateCaption(gen.Prompt, telegramMaxCaptionPrompt), result.Model, result.Seed)
+
+	err = client.SendPhoto(bgCtx, msg.Chat.ID, msg.MessageID, path.Base(result.Path), result.Image, caption)
+	if err != nil {
+		logger.Error("failed to send photo", zap.Error(err))
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateCaption(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxLength int
+		want      string
+	}{
+		{"short", "a cat", 10, "a cat"},
+		{"exact", "a cat", 5, "a cat"},
+		{"ascii", "a cat in a hat", 5, "a cat..."},
+		{"multi-byte", "Übermensch", 3, "Übe..."},
+		{"not split", strings.Repeat("é", 6), 5, strings.Repeat("é", 5) + "..."},
+		{"surrogate pairs", "🐱🐱🐱", 5, "🐱🐱..."},
+		{"surrogate pair at the limit", "a🐱", 2, "a..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateCaption(tt.text, tt.maxLength)
+			if got != tt.want {
+				t.Errorf("truncateCaption(%q, %d) = %q, want %q", tt.text, tt.maxLength, got, tt.want)
+			}
+
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateCaption(%q, %d) = %q, which isn't valid UTF-8", tt.text, tt.maxLength, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/SethCurry/sdcli/internal/objectstore"
+	"github.com/SethCurry/sdcli/internal/policy"
+	"github.com/alecthomas/kong"
+	"github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v3"
+)
+
+// getConfigDir returns the directory sdcli keeps its config and state, e.g. the
+// history, in.  This is %APPDATA%\sdcli on Windows, and $XDG_CONFIG_HOME/sdcli or
+// ~/.config/sdcli elsewhere.  For backward compatibility, ~/.config/sdcli is used
+// on every platform if it exists and the preferred directory doesn't.
+func getConfigDir() (string, error) {
+	legacy, err := legacyConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	preferred := legacy
+
+	if runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			preferred = filepath.Join(appData, "sdcli")
+		}
+	} else if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(xdgConfigHome) {
+		preferred = filepath.Join(xdgConfigHome, "sdcli")
+	}
+
+	if !isDir(preferred) && isDir(legacy) {
+		return legacy, nil
+	}
+
+	return preferred, nil
+}
+
+// legacyConfigDir returns ~/.config/sdcli, where sdcli kept its config on every
+// platform before it followed the platform's conventions.
+func legacyConfigDir() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+
+	return filepath.Join(home, ".config", "sdcli"), nil
+}
+
+// isDir reports whether path is an existing directory.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+
+	return err == nil && info.IsDir()
+}
+
+// configFileNames are the names of the config files sdcli looks for in the config
+// directory, in order.
+var configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// findConfigFile returns the path of the config file to load.  In order, this is:
+//
+//  1. The path given with --config or $SDCLI_CONFIG.
+//  2. config.json, config.yaml, config.yml, or config.toml in the directory
+//     returned by getConfigDir.
+//
+// The returned file may not exist.
+func findConfigFile(explicit string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range configFileNames {
+		configPath := filepath.Join(configDir, v)
+
+		if _, err := os.Stat(configPath); err == nil {
+			return configPath, nil
+		}
+	}
+
+	return filepath.Join(configDir, configFileNames[0]), nil
+}
+
+// configToJSON converts a YAML or TOML config, detected by the file's extension,
+// to JSON so it can be unmarshaled with the same field names as config.json.
+// Other configs are returned as is.
+func configToJSON(path string, data []byte) ([]byte, error) {
+	var (
+		parsed map[string]any
+		err    error
+	)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &parsed)
+	case ".toml":
+		err = toml.Unmarshal(data, &parsed)
+	default:
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Base(path), err)
+	}
+
+	return json.Marshal(parsed)
+}
+
+// loadConfig loads the config file at path, then applies the named profile, if
+// any, and any overrides from the environment.  A missing config file is only an
+// error if it was required, e.g. because it was passed with --config; otherwise
+// sdcli can be configured entirely with environment variables, e.g. in CI.
+func loadConfig(path string, required bool, profile string) (Config, error) {
+	var config Config
+
+	configData, err := os.ReadFile(path)
+	if err == nil {
+		converted, err := configToJSON(path, configData)
+		if err != nil {
+			return config, err
+		}
+
+		isJSON := bytes.Equal(converted, configData)
+
+		migrated, changed, err := migrateConfig(converted)
+		if err != nil {
+			return config, err
+		}
+
+		// YAML and TOML files can't be rewritten without losing their comments,
+		// so they are only migrated in memory.
+		if changed && isJSON {
+			err = saveMigratedConfig(path, configData, migrated)
+			if err != nil {
+				return config, err
+			}
+		}
+
+		// Positions are only meaningful in the file as written, not in a YAML or
+		// TOML file that was converted to JSON, or a migrated one.
+		err = decodeStrict(migrated, &config, isJSON && !changed)
+		if err != nil {
+			return config, fmt.Errorf("failed to unmarshal config: %w", err)
+		}
+
+		err = config.checkProfiles()
+		if err != nil {
+			return config, err
+		}
+	} else if required || !errors.Is(err, fs.ErrNotExist) {
+		return config, fmt.Errorf("failed to read config data: %w", err)
+	}
+
+	if profile != "" {
+		err = config.applyProfile(profile)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err = applyEnvOverrides(&config)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config from the environment: %w", err)
+	}
+
+	return config, nil
+}
+
+// ErrUnknownProfile is returned when the selected profile isn't in the config.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// applyProfile overrides the config with the settings of a named profile.  Only
+// the settings in the profile are changed, so profiles only need to hold what
+// differs from the rest of the config.
+func (c *Config) applyProfile(name string) error {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for k := range c.Profiles {
+			names = append(names, k)
+		}
+
+		sort.Strings(names)
+
+		return fmt.Errorf("%w %q, profiles are: %s", ErrUnknownProfile, name, strings.Join(names, ", "))
+	}
+
+	err := decodeStrict(profile, c, false)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal profile %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// checkProfiles checks that every profile can be applied, so that a typo in a
+// profile is found even when it isn't the selected one.
+func (c Config) checkProfiles() error {
+	for name, profile := range c.Profiles {
+		var config Config
+
+		err := decodeStrict(profile, &config, false)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal profile %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// decodeStrict unmarshals JSON into v, rejecting fields that v doesn't have, e.g.
+// a misspelled setting.  If withPosition is true, errors include the line and
+// column they were found at.
+func decodeStrict(data []byte, v any, withPosition bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err == nil || !withPosition {
+		return err
+	}
+
+	offset := decoder.InputOffset()
+
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) {
+		offset = typeErr.Offset
+	} else if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		// The decoder doesn't say where unknown fields are, and has read past
+		// them by now, so find the field's first use instead.
+		if index := bytes.Index(data, []byte(field)); index >= 0 {
+			offset = int64(index)
+		}
+	}
+
+	offset = min(max(offset, 0), int64(len(data)))
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := offset - int64(bytes.LastIndexByte(data[:offset], '\n'))
+
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// validate checks the config for mistakes that would otherwise only show up
+// later, reporting all of them at once.  backendCommand is whether the command
+// being run sends requests with the configured backend, and so needs its API key
+// and saves images to the output directory.
+func (c Config) validate(backendName string, backendCommand bool) error {
+	var problems []error
+
+	if backendCommand && (backendName == "" || backendName == "stability") && c.APIKey == "" {
+		problems = append(problems, errors.New(
+			"no API key is configured, set api_key, $SDCLI_API_KEY, api_key_file, api_key_command, or api_key_keyring"))
+	}
+
+	if _, err := policy.New(c.PromptPolicy); err != nil {
+		problems = append(problems, fmt.Errorf("invalid prompt_policy: %w", err))
+	}
+
+	if _, err := newPostProcessor(c.PostProcess); err != nil {
+		problems = append(problems, fmt.Errorf("invalid post_process: %w", err))
+	}
+
+	if c.PromptEnhancer.Enabled && !c.PromptEnhancer.configured() {
+		problems = append(problems, errNoPromptEnhancer)
+	}
+
+	if err := c.FilterRetry.validate(c.PromptEnhancer); err != nil {
+		problems = append(problems, fmt.Errorf("invalid filter_retry: %w", err))
+	}
+
+	if err := c.Polling.validate(); err != nil {
+		problems = append(problems, fmt.Errorf("invalid polling: %w", err))
+	}
+
+	if c.HTTPOutput.URL != "" {
+		if err := c.HTTPOutput.validate(); err != nil {
+			problems = append(problems, fmt.Errorf("invalid http_output: %w", err))
+		}
+	}
+
+	if backendCommand && !objectstore.IsURL(c.OutputDirectory) && !c.HTTPOutput.uploadOnly() {
+		err := checkWritable(c.OutputDirectory)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// defaultBalanceCheckInterval is how long the account's balance is cached for
+// when balance_check_interval isn't set.
+const defaultBalanceCheckInterval = 15 * time.Minute
+
+// balanceCheckInterval returns balance_check_interval, or the default if it isn't
+// set.
+func (c Config) balanceCheckInterval() time.Duration {
+	if c.BalanceCheckInterval == nil {
+		return defaultBalanceCheckInterval
+	}
+
+	return time.Duration(*c.BalanceCheckInterval)
+}
+
+// checkWritable checks that files can be created in a directory.  Directories
+// that don't exist yet are assumed to be writable once they are created.
+func checkWritable(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	fd, err := os.CreateTemp(dir, ".sdcli-check-*")
+	if err != nil {
+		return fmt.Errorf("output directory %q is not writable: %w", dir, err)
+	}
+
+	fd.Close()
+
+	return os.Remove(fd.Name())
+}
+
+// configLoader loads the config, at most once.  The config is needed while the
+// command line is still being parsed, to resolve flag defaults, and again once
+// it has been.
+type configLoader struct {
+	loaded bool
+	config Config
+	path   string
+	err    error
+}
+
+// load finds and loads the config, given the values of the --config and
+// --profile flags.  It returns the config and the path it was loaded from.
+func (l *configLoader) load(configFlag string, profile string) (Config, string, error) {
+	if l.loaded {
+		return l.config, l.path, l.err
+	}
+
+	l.loaded = true
+
+	l.path, l.err = findConfigFile(configFlag)
+	if l.err != nil {
+		return l.config, l.path, l.err
+	}
+
+	l.config, l.err = loadConfig(l.path, configFlag != "", profile)
+
+	return l.config, l.path, l.err
+}
+
+// defaultsResolver returns a kong resolver that fills in flags that weren't
+// passed on the command line from the defaults in the config.
+func (l *configLoader) defaultsResolver() kong.Resolver {
+	return kong.ResolverFunc(func(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+		if parent.Command == nil {
+			return nil, nil
+		}
+
+		config, _, err := l.load(stringFlag(ctx, "config"), stringFlag(ctx, "profile"))
+		if err != nil {
+			// The error is reported once parsing is done and the config is
+			// loaded again.
+			return nil, nil
+		}
+
+		defaults := config.Defaults[parent.Command.Path()]
+
+		// Flags can be given defaults by their name or an alias, e.g. gen-3's
+		// aspect_ratio, with the name taking precedence.
+		for _, v := range append([]string{flag.Name}, flag.Aliases...) {
+			if value, ok := defaults[v]; ok {
+				return value, nil
+			}
+		}
+
+		return nil, nil
+	})
+}
+
+// stringFlag returns the value of a global string flag as parsed so far.
+func stringFlag(ctx *kong.Context, name string) string {
+	for _, v := range ctx.Flags() {
+		if v.Name == name {
+			value, _ := ctx.FlagValue(v).(string)
+			return value
+		}
+	}
+
+	return ""
+}
+
+// resolveAPIKey reads the API key from wherever the config says it is kept, if it
+// isn't set directly.  In order, this is APIKeyFile, APIKeyCommand, and the OS
+// keyring.  An API key in the config file or the environment takes precedence.
+func (c *Config) resolveAPIKey() error {
+	if c.APIKey != "" {
+		return nil
+	}
+
+	var (
+		apiKey string
+		err    error
+	)
+
+	switch {
+	case c.APIKeyFile != "":
+		apiKey, err = readAPIKeyFile(c.APIKeyFile)
+	case c.APIKeyCommand != "":
+		apiKey, err = runAPIKeyCommand(c.APIKeyCommand)
+	case c.APIKeyKeyring:
+		apiKey, err = keyringAPIKey()
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if apiKey == "" {
+		return errors.New("API key is empty")
+	}
+
+	c.APIKey = apiKey
+
+	return nil
+}
+
+// readAPIKeyFile reads an API key from a file, ignoring surrounding whitespace.
+func readAPIKeyFile(path string) (string, error) {
+	expanded, err := homedir.Expand(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %q: %w", path, err)
+	}
+
+	data, err := os.ReadFile(expanded)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API key file: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runAPIKeyCommand runs a command with the shell and returns the first line of
+// its output, as password managers like pass print the secret first.
+func runAPIKeyCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run API key command %q: %w", command, err)
+	}
+
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+
+	return strings.TrimSpace(firstLine), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// currentConfigVersion is the version of the config layout this sdcli reads.
+// Configs without a version are from before versioning and have the layout of
+// version 1.
+const currentConfigVersion = 1
+
+// configMigrations upgrade a config from the version they are keyed by to the
+// next one.  They operate on the decoded config, so that they can move settings
+// that no longer exist in Config.
+var configMigrations = map[int]func(config map[string]any) error{}
+
+// migrateConfig upgrades a JSON config to currentConfigVersion.  It returns the
+// upgraded config, and whether it was changed.
+func migrateConfig(data []byte) ([]byte, bool, error) {
+	var config map[string]any
+
+	err := json.Unmarshal(data, &config)
+	if err != nil {
+		// Leave reporting syntax errors to the strict decoding that follows.
+		return data, false, nil
+	}
+
+	version := 1
+
+	if raw, ok := config["version"]; ok {
+		number, ok := raw.(float64)
+		if !ok || number != float64(int(number)) {
+			return nil, false, fmt.Errorf("invalid config version %v", raw)
+		}
+
+		version = int(number)
+	}
+
+	if version > currentConfigVersion {
+		return nil, false, fmt.Errorf(
+			"config version %d is newer than this sdcli supports (%d), upgrade sdcli",
+			version, currentConfigVersion)
+	}
+
+	if version == currentConfigVersion {
+		return data, false, nil
+	}
+
+	for ; version < currentConfigVersion; version++ {
+		migrate, ok := configMigrations[version]
+		if !ok {
+			continue
+		}
+
+		err = migrate(config)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to migrate config from version %d: %w", version, err)
+		}
+	}
+
+	config["version"] = currentConfigVersion
+
+	migrated, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal migrated config: %w", err)
+	}
+
+	return migrated, true, nil
+}
+
+// saveMigratedConfig replaces the config at path with its migrated version,
+// keeping the original at path + ".bak".
+func saveMigratedConfig(path string, original []byte, migrated []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to check config file: %w", err)
+	}
+
+	err = os.WriteFile(path+".bak", original, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to back up config file: %w", err)
+	}
+
+	err = os.WriteFile(path, migrated, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to write migrated config file: %w", err)
+	}
+
+	return nil
+}
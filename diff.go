@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/compare"
+	"go.uber.org/zap"
+)
+
+type DiffCommand struct {
+	Mode   string `optional:"mode" default:"side-by-side" enum:"side-by-side,blend,difference" help:"How to show the images: next to each other, blended together, or as their amplified difference."`
+	Output string `optional:"output" short:"o" type:"path" help:"Where to save the comparison.  Defaults to the names of both images joined by -vs-, next to the first image."`
+	A      string `arg:"" type:"existingfile" help:"The first image."`
+	B      string `arg:"" type:"existingfile" help:"The second image."`
+}
+
+// diffOutputPath returns where to save the comparison of two images by default,
+// e.g. "cat-vs-dog.png" for "cat.png" and "dog.jpg".
+func diffOutputPath(a string, b string) string {
+	base := func(name string) string {
+		return strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+
+	return filepath.Join(filepath.Dir(a), base(a)+"-vs-"+base(b)+".png")
+}
+
+func (d DiffCommand) Run(ctx *Context) error {
+	a, err := decodeImageFile(d.A)
+	if err != nil {
+		ctx.Logger.Fatal("failed to read image", zap.String("path", d.A), zap.Error(err))
+	}
+
+	b, err := decodeImageFile(d.B)
+	if err != nil {
+		ctx.Logger.Fatal("failed to read image", zap.String("path", d.B), zap.Error(err))
+	}
+
+	// The metrics compare pixel by pixel, so the second image is scaled to the
+	// size of the first.
+	scaled := b
+	if a.Bounds().Size() != b.Bounds().Size() {
+		ctx.Logger.Warn(
+			"images are different sizes, scaling the second to match the first",
+			zap.String("first", a.Bounds().Size().String()),
+			zap.String("second", b.Bounds().Size().String()))
+
+		scaled = compare.Resize(b, a.Bounds().Size())
+	}
+
+	psnr, err := compare.PSNR(a, scaled)
+	if err != nil {
+		ctx.Logger.Fatal("failed to compute PSNR", zap.Error(err))
+	}
+
+	ssim, err := compare.SSIM(a, scaled)
+	if err != nil {
+		ctx.Logger.Fatal("failed to compute SSIM", zap.Error(err))
+	}
+
+	var comparison image.Image
+
+	switch d.Mode {
+	case "side-by-side":
+		comparison = compare.SideBySide(a, b)
+	case "blend":
+		comparison, err = compare.Blend(a, scaled)
+	case "difference":
+		comparison, err = compare.Difference(a, scaled)
+	}
+
+	if err != nil {
+		ctx.Logger.Fatal("failed to compare images", zap.Error(err))
+	}
+
+	output := d.Output
+	if output == "" {
+		output = diffOutputPath(d.A, d.B)
+	}
+
+	err = writePNG(output, comparison)
+	if err != nil {
+		ctx.Logger.Fatal("failed to save comparison", zap.String("path", output), zap.Error(err))
+	}
+
+	ctx.Logger.Info("saved comparison", zap.String("path", output))
+
+	if math.IsInf(psnr, 1) {
+		fmt.Println("PSNR: identical")
+	} else {
+		fmt.Printf("PSNR: %.2f dB\n", psnr)
+	}
+
+	fmt.Printf("SSIM: %.4f\n", ssim)
+
+	return nil
+}
+
+// decodeImageFile reads and decodes an image.
+func decodeImageFile(path string) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return img, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/alecthomas/kong"
+	"go.uber.org/zap"
+)
+
+type EditCommand struct {
+	Operation      string   `optional:"op" default:"inpaint" enum:"inpaint,erase,search-and-replace,remove-background" help:"The edit to perform."`
+	Mask           string   `optional:"mask" type:"path" help:"A mask image; white areas are edited, black areas are kept."`
+	DrawMask       bool     `optional:"draw-mask" help:"Mark the areas to edit before editing, by painting them in the mask_editor from the config, or by typing rectangles if it isn't set.  The mask is saved next to the image.  Only used by inpaint and erase."`
+	Search         string   `optional:"search" help:"What to replace in the image.  Only used by search-and-replace."`
+	NegativePrompt string   `optional:"negative" help:"The negative prompt to use during generation."`
+	OutputFormat   string   `optional:"format" default:"png" help:"The format of the returned image.  Must be one the backend supports, as listed by sdcli engines."`
+	SaveAs         string   `optional:"save-as" enum:",png,jpeg" default:"" help:"Convert the image to this format before saving it, e.g. to request a lossless png and save a smaller jpeg.  Must be png or jpeg."`
+	ImageDir       string   `optional:"image-dir" type:"existingdir" help:"Edit every image in this directory and its subdirectories, saving the results in the same structure in the output directory.  The image argument is left out."`
+	Image          string   `arg:"" optional:"" help:"The image to edit."`
+	PromptParts    []string `arg:"" optional:"" help:"The prompt describing the result of the edit."`
+}
+
+// editParameters are the parameters of an edit, as written to sidecars.
+type editParameters struct {
+	Operation      string `json:"operation"`
+	Image          string `json:"image"`
+	Mask           string `json:"mask,omitempty"`
+	Search         string `json:"search,omitempty"`
+	Prompt         string `json:"prompt,omitempty"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	OutputFormat   string `json:"output_format"`
+	SaveAs         string `json:"save_as,omitempty"`
+}
+
+func (e EditCommand) Run(ctx *Context) error {
+	err := ctx.requireOperation(backend.OperationEdit)
+	if err != nil {
+		ctx.Logger.Fatal("unable to edit", zap.Error(err))
+	}
+
+	err = ctx.requireOutputFormat(e.OutputFormat)
+	if err != nil {
+		ctx.Logger.Fatal("unable to edit", zap.Error(err))
+	}
+
+	e.NegativePrompt, err = ctx.Config.expandNegative(e.NegativePrompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to edit", zap.Error(err))
+	}
+
+	if e.DrawMask {
+		err = e.checkDrawMask()
+		if err != nil {
+			ctx.Logger.Fatal("unable to edit", zap.Error(err))
+		}
+	}
+
+	promptParts := e.PromptParts
+
+	// With --image-dir there is no image argument, so the first word of the
+	// prompt ends up in Image.
+	if e.ImageDir != "" && e.Image != "" {
+		promptParts = append([]string{e.Image}, promptParts...)
+	} else if e.ImageDir == "" && e.Image == "" {
+		ctx.Logger.Fatal("an image to edit, or --image-dir, is required")
+	}
+
+	prompt := strings.Join(promptParts, " ")
+
+	err = ctx.requirePromptLength(prompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to edit", zap.Error(err))
+	}
+
+	err = ctx.checkPrompt(prompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to edit", zap.Error(err))
+	}
+
+	if e.ImageDir != "" {
+		// The post-generation command isn't run, since it would be run for every
+		// image.
+		results, err := ctx.forEachImage(e.ImageDir, func(imagePath string, outputName string) ([]*generationResult, error) {
+			result, err := e.edit(ctx, imageSource{Path: imagePath}, prompt, outputName)
+			if err != nil {
+				return nil, err
+			}
+
+			return []*generationResult{result}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return filteredError(results...)
+	}
+
+	imagePath := kong.ExpandPath(e.Image)
+
+	if e.DrawMask {
+		e.Mask, err = drawMask(ctx, imagePath)
+		if err != nil {
+			ctx.Logger.Fatal("failed to draw mask", zap.Error(err))
+		}
+	}
+
+	saved, err := e.edit(ctx, imageSource{Path: imagePath}, prompt, "")
+	if err != nil && ctx.Ctx.Err() != nil {
+		return ctx.Ctx.Err()
+	} else if err != nil {
+		ctx.Logger.Fatal("failed to edit image", zap.Error(err))
+	}
+
+	ctx.runPostGenerationCommand(saved.Path)
+
+	return filteredError(saved)
+}
+
+// edit edits a single image and saves the result under outputName, or the
+// default name if it is empty.
+func (e EditCommand) edit(ctx *Context, source imageSource, prompt string, outputName string) (*generationResult, error) {
+	original, err := source.read()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ctx.prepareUpload(ctx.Ctx, source.Path, original)
+	if err != nil {
+		return nil, err
+	}
+
+	req := backend.EditRequest{
+		Operation:      e.Operation,
+		Image:          bytes.NewReader(data),
+		Prompt:         prompt,
+		NegativePrompt: e.NegativePrompt,
+		SearchPrompt:   e.Search,
+		OutputFormat:   e.OutputFormat,
+	}
+
+	if e.Mask != "" {
+		mask, closer, err := ctx.openInitImage(ctx.Ctx, e.Mask)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mask: %w", err)
+		}
+		defer closer.Close()
+
+		req.Mask = mask
+	}
+
+	credits, release, err := ctx.reserveCredits("edit/" + e.Operation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve credits: %w", err)
+	}
+
+	started := time.Now()
+
+	result, err := ctx.Backend.Edit(ctx.Ctx, req)
+	if err != nil {
+		release()
+
+		return nil, err
+	}
+
+	editOperation := e.Operation
+	if e.Search != "" {
+		editOperation += " " + strconv.Quote(e.Search)
+	}
+
+	saved := &generationResult{
+		Operation:       "edit",
+		Prompt:          prompt,
+		NegativePrompt:  e.NegativePrompt,
+		Backend:         ctx.Backend.Name(),
+		Model:           result.Model,
+		Seed:            result.Seed,
+		FinishReason:    result.FinishReason,
+		Duration:        time.Since(started),
+		Credits:         ctx.settleCredits(credits, result),
+		CreditsReported: result.Credits > 0,
+		Edit:            describeEdit(editOperation, prompt),
+		Source:          ctx.readSourceMetadata(source.Path, original),
+		Parameters: editParameters{
+			Operation:      e.Operation,
+			Image:          source.Path,
+			Mask:           e.Mask,
+			Search:         e.Search,
+			Prompt:         prompt,
+			NegativePrompt: e.NegativePrompt,
+			OutputFormat:   e.OutputFormat,
+			SaveAs:         e.SaveAs,
+		},
+		outputName: outputName,
+	}
+
+	converted, format, err := convertForSaving(result.Image, e.OutputFormat, e.SaveAs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+
+	// The image has been paid for, so save it even if sdcli is being interrupted.
+	err = ctx.saveResult(context.WithoutCancel(ctx.Ctx), converted, format, saved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+
+	return saved, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/stability"
+)
+
+type EnginesCommand struct {
+	All bool `optional:"all" help:"Also list backends that aren't configured."`
+}
+
+// configuredBackend creates the named backend, returning an error if the config
+// doesn't have what it needs to be used.
+func configuredBackend(name string, config Config) (backend.Backend, error) {
+	if name == "stability" && config.APIKey == "" {
+		return nil, errors.New("no API key is configured")
+	}
+
+	return newBackend(name, config)
+}
+
+func (e EnginesCommand) Run(ctx *Context) error {
+	var (
+		backends      []backend.Backend
+		notConfigured []string
+	)
+
+	for _, name := range backendNames {
+		b, err := configuredBackend(name, ctx.Config)
+		if err != nil && !e.All {
+			notConfigured = append(notConfigured, fmt.Sprintf("%s (%s)", name, err))
+
+			continue
+		} else if err != nil {
+			// The backend can't be used, but its capabilities are still known.
+			config := ctx.Config
+			config.APIKey, config.OpenAI.APIKey, config.BFL.APIKey = "unset", "unset", "unset"
+
+			b, err = newBackend(name, config)
+			if err != nil {
+				return err
+			}
+		}
+
+		backends = append(backends, b)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	header := []string{"BACKEND"}
+	for _, op := range backend.AllOperations {
+		header = append(header, strings.ToUpper(string(op)))
+	}
+
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+
+	for _, b := range backends {
+		caps := b.Capabilities()
+		row := []string{b.Name()}
+
+		for _, op := range backend.AllOperations {
+			if caps.Supports(op) {
+				row = append(row, "yes")
+			} else {
+				row = append(row, "-")
+			}
+		}
+
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range backends {
+		caps := b.Capabilities()
+
+		fmt.Printf("\n%s\n", b.Name())
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(writer, "  models:\t%s\n", listOrUnknown(caps.Models))
+		fmt.Fprintf(writer, "  aspect ratios:\t%s\n", listOrUnknown(caps.AspectRatios))
+		fmt.Fprintf(writer, "  max pixels:\t%s\n", formatPixels(caps.MaxPixels))
+		fmt.Fprintf(writer, "  output formats:\t%s\n", listOrUnknown(caps.OutputFormats))
+
+		if caps.MaxPromptLength > 0 {
+			fmt.Fprintf(writer, "  max prompt length:\t%d\n", caps.MaxPromptLength)
+		}
+
+		if caps.Supports(backend.OperationUpscale) {
+			fmt.Fprintf(writer, "  upscale modes:\t%s\n", listOrUnknown(caps.UpscaleModes))
+		}
+
+		if caps.Supports(backend.OperationEdit) {
+			fmt.Fprintf(writer, "  edit operations:\t%s\n", listOrUnknown(caps.EditOperations))
+		}
+
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+
+		if b.Name() == "stability" {
+			err = printStabilityEndpoints()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(notConfigured) > 0 {
+		fmt.Printf("\nNot configured, pass --all to list them anyway: %s\n", strings.Join(notConfigured, ", "))
+	}
+
+	return nil
+}
+
+// printStabilityEndpoints lists the models and operations of the Stability API,
+// with what each accepts and costs.
+func printStabilityEndpoints() error {
+	fmt.Println()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "  ENDPOINT\tCREDITS\tFORMATS\tMAX PROMPT\tASYNC")
+
+	for _, v := range stability.Endpoints() {
+		maxPrompt := "-"
+		if v.MaxPromptLength > 0 {
+			maxPrompt = strconv.Itoa(v.MaxPromptLength)
+		}
+
+		async := "no"
+		if v.Async {
+			async = "yes"
+		}
+
+		fmt.Fprintf(writer, "  %s\t%g\t%s\t%s\t%s\n", v.Name, v.Credits, strings.Join(v.OutputFormats, ", "), maxPrompt, async)
+	}
+
+	return writer.Flush()
+}
+
+// listOrUnknown joins values for display, or says they are unknown if there are
+// none, e.g. because a backend's models depend on what is installed.
+func listOrUnknown(values []string) string {
+	if len(values) == 0 {
+		return "depends on the server"
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// formatPixels formats a number of pixels in megapixels.
+func formatPixels(pixels int) string {
+	if pixels == 0 {
+		return "depends on the model"
+	}
+
+	return fmt.Sprintf("%d (%.1f MP)", pixels, float64(pixels)/1e6)
+}
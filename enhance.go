@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SethCurry/sdcli/internal/enhance"
+)
+
+type PromptEnhancerConfig struct {
+	// Whether to enhance prompts by default.  Can be overridden with --enhance and
+	// --no-enhance.
+	Enabled bool `json:"enabled"`
+
+	// The base URL of an OpenAI-compatible API, e.g. "https://api.openai.com/v1"
+	// or "http://localhost:11434/v1" for Ollama.  Requests are sent to its
+	// /chat/completions endpoint.
+	BaseURL string `json:"base_url"`
+
+	// The API key to send as a bearer token.  Not sent if empty.
+	APIKey string `json:"api_key"`
+
+	// The model to enhance prompts with, e.g. "gpt-4o-mini" or "llama3".
+	Model string `json:"model"`
+
+	// The instruction given to the model.  Defaults to asking for a single,
+	// detailed, comma-separated Stable Diffusion prompt.
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// errNoPromptEnhancer is returned when prompt enhancement is requested but
+// prompt_enhancer isn't configured.
+var errNoPromptEnhancer = errors.New("prompt enhancement requires prompt_enhancer.base_url and prompt_enhancer.model to be set")
+
+// configured reports whether enough of the prompt enhancer is set up to use it.
+func (p PromptEnhancerConfig) configured() bool {
+	return p.BaseURL != "" && p.Model != ""
+}
+
+// enhancePrompt expands a prompt with the configured prompt enhancer.
+func (c *Context) enhancePrompt(ctx context.Context, prompt string) (string, error) {
+	client, err := c.promptEnhancer(c.Config.PromptEnhancer.SystemPrompt)
+	if err != nil {
+		return "", err
+	}
+
+	return client.Enhance(ctx, prompt)
+}
+
+// promptEnhancer returns a client for the configured prompt enhancer, giving it
+// systemPrompt as its instruction, or the default if it is empty.
+func (c *Context) promptEnhancer(systemPrompt string) (*enhance.Client, error) {
+	config := c.Config.PromptEnhancer
+	if !config.configured() {
+		return nil, invalid(errNoPromptEnhancer)
+	}
+
+	options := []enhance.ClientOption{enhance.WithAPIKey(config.APIKey)}
+
+	if systemPrompt != "" {
+		options = append(options, enhance.WithSystemPrompt(systemPrompt))
+	}
+
+	return enhance.NewClient(config.BaseURL, config.Model, options...), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// envOverride is an environment variable that overrides a config value.
+type envOverride struct {
+	Name  string
+	Apply func(config *Config, value string) error
+}
+
+func stringOverride(name string, field func(*Config) *string) envOverride {
+	return envOverride{
+		Name: name,
+		Apply: func(config *Config, value string) error {
+			*field(config) = value
+			return nil
+		},
+	}
+}
+
+func boolOverride(name string, field func(*Config) *bool) envOverride {
+	return envOverride{
+		Name: name,
+		Apply: func(config *Config, value string) error {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+
+			*field(config) = parsed
+
+			return nil
+		},
+	}
+}
+
+func floatOverride(name string, field func(*Config) *float64) envOverride {
+	return envOverride{
+		Name: name,
+		Apply: func(config *Config, value string) error {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+
+			*field(config) = parsed
+
+			return nil
+		},
+	}
+}
+
+// envOverrides are the environment variables that override config.json, e.g. for
+// CI machines and containers where secrets are passed in the environment.
+var envOverrides = []envOverride{
+	stringOverride("SDCLI_API_KEY", func(c *Config) *string { return &c.APIKey }),
+	stringOverride("SDCLI_BASE_URL", func(c *Config) *string { return &c.BaseURL }),
+	stringOverride("SDCLI_OUTPUT_DIR", func(c *Config) *string { return &c.OutputDirectory }),
+	stringOverride("SDCLI_OUTPUT_LAYOUT", func(c *Config) *string { return &c.OutputLayout }),
+	stringOverride("SDCLI_RUN_LOG", func(c *Config) *string { return &c.RunLog }),
+	stringOverride("SDCLI_BACKEND", func(c *Config) *string { return &c.Backend }),
+	stringOverride("SDCLI_POST_GENERATION_COMMAND", func(c *Config) *string { return &c.PostGenerationCommand }),
+	stringOverride("SDCLI_MASK_EDITOR", func(c *Config) *string { return &c.MaskEditor }),
+	boolOverride("SDCLI_SIDECARS", func(c *Config) *bool { return &c.Sidecars }),
+	boolOverride("SDCLI_LOW_MEMORY", func(c *Config) *bool { return &c.LowMemory }),
+	boolOverride("SDCLI_KEEP_INPUT_METADATA", func(c *Config) *bool { return &c.KeepInputMetadata }),
+	floatOverride("SDCLI_CREDIT_BUDGET", func(c *Config) *float64 { return &c.CreditBudget }),
+	stringOverride("SDCLI_A1111_BASE_URL", func(c *Config) *string { return &c.A1111.BaseURL }),
+	stringOverride("SDCLI_OPENAI_API_KEY", func(c *Config) *string { return &c.OpenAI.APIKey }),
+	stringOverride("SDCLI_BFL_API_KEY", func(c *Config) *string { return &c.BFL.APIKey }),
+	stringOverride("SDCLI_PROMPT_ENHANCER_API_KEY", func(c *Config) *string { return &c.PromptEnhancer.APIKey }),
+	stringOverride("SDCLI_WEBHOOK_URL", func(c *Config) *string { return &c.Webhook.URL }),
+	stringOverride("SDCLI_WEBHOOK_SECRET", func(c *Config) *string { return &c.Webhook.Secret }),
+	stringOverride("SDCLI_DISCORD_BOT_TOKEN", func(c *Config) *string { return &c.Discord.BotToken }),
+	stringOverride("SDCLI_TELEGRAM_BOT_TOKEN", func(c *Config) *string { return &c.Telegram.BotToken }),
+}
+
+// applyEnvOverrides overrides config values with any of envOverrides that are set
+// in the environment.
+func applyEnvOverrides(config *Config) error {
+	for _, v := range envOverrides {
+		value, ok := os.LookupEnv(v.Name)
+		if !ok {
+			continue
+		}
+
+		err := v.Apply(config, value)
+		if err != nil {
+			return fmt.Errorf("failed to parse $%s: %w", v.Name, err)
+		}
+	}
+
+	return nil
+}
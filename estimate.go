@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/SethCurry/sdcli/pkg/stability"
+	"go.uber.org/zap"
+)
+
+type EstimateCommand struct {
+	Engine         string  `optional:"engine" default:"sd3-large" help:"The model or operation to estimate the cost of, e.g. sd3-large-turbo or upscale/conservative."`
+	Count          int     `optional:"count" default:"1" help:"The number of images in the planned run."`
+	PricePerCredit float64 `optional:"price-per-credit" help:"The price of a credit in dollars.  Defaults to Stability's list price."`
+}
+
+func (e EstimateCommand) Run(ctx *Context) error {
+	endpoint, ok := stability.LookupEndpoint(e.Engine)
+	if !ok {
+		ctx.Logger.Fatal(
+			"unknown engine",
+			zap.String("engine", e.Engine),
+			zap.String("engines", strings.Join(stability.CreditedOperations(), ", ")))
+	}
+
+	if e.Count < 1 {
+		ctx.Logger.Fatal("count must be at least 1", zap.Int("count", e.Count))
+	}
+
+	price := e.PricePerCredit
+	if price <= 0 {
+		price = stability.DollarsPerCredit
+	}
+
+	perImage := endpoint.Credits
+	credits := perImage * float64(e.Count)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "Engine:\t%s (%s)\n", e.Engine, endpoint.Path)
+	fmt.Fprintf(writer, "Images:\t%d\n", e.Count)
+	fmt.Fprintf(writer, "Credits:\t%g (%g each)\n", credits, perImage)
+	fmt.Fprintf(writer, "Cost:\t$%.2f\n", credits*price)
+
+	remaining, ok, err := ctx.Budget.Remaining()
+	if err != nil {
+		ctx.Logger.Warn("failed to read the credit budget", zap.Error(err))
+	} else if ok {
+		fits := "fits in"
+		if credits > remaining {
+			fits = "exceeds"
+		}
+
+		fmt.Fprintf(writer, "Budget:\t%g credits left this month, the run %s it\n", remaining, fits)
+	}
+
+	return writer.Flush()
+}
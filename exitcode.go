@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+
+	"github.com/SethCurry/sdcli/internal/history"
+	"github.com/SethCurry/sdcli/internal/policy"
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"go.uber.org/zap/zapcore"
+)
+
+// The exit codes sdcli fails with, so scripts can tell a bad prompt from the
+// network being down.  They are documented in the README, so don't change them.
+const (
+	exitFailure         = 1
+	exitInvalid         = 2
+	exitAPI             = 3
+	exitContentFiltered = 4
+	exitRateLimited     = 5
+	exitIO              = 6
+
+	// exitInterrupted follows the shell convention of 128 plus the signal number
+	// of SIGINT.
+	exitInterrupted = 130
+)
+
+// invalidError marks an error as caused by invalid arguments or config, rather
+// than something going wrong while running the command.
+type invalidError struct {
+	err error
+}
+
+func (e invalidError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidError) Unwrap() error {
+	return e.err
+}
+
+// invalid marks err as caused by invalid arguments or config.
+func invalid(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return invalidError{err: err}
+}
+
+// exitCode returns the exit code for a fatal error.  A nil error also means
+// invalid arguments, since the only fatal errors logged without an error are
+// commands rejecting their arguments.
+func exitCode(err error) int {
+	var (
+		apiErr     *backend.APIError
+		urlErr     *url.Error
+		pathErr    *fs.PathError
+		linkErr    *os.LinkError
+		syscallErr *os.SyscallError
+		invalidErr invalidError
+	)
+
+	switch {
+	case err == nil:
+		return exitInvalid
+	case errors.Is(err, backend.ErrContentFiltered), errors.Is(err, policy.ErrBlocked):
+		return exitContentFiltered
+	case errors.As(err, &apiErr) && apiErr.RateLimited():
+		return exitRateLimited
+	case errors.As(err, &apiErr), errors.As(err, &urlErr), errors.Is(err, backend.ErrUnexpectedContent):
+		return exitAPI
+	case errors.As(err, &pathErr), errors.As(err, &linkErr), errors.As(err, &syscallErr):
+		return exitIO
+	case errors.As(err, &invalidErr),
+		errors.Is(err, backend.ErrUnsupported),
+		errors.Is(err, history.ErrNotFound),
+		errors.Is(err, ErrUnknownProfile):
+		return exitInvalid
+	}
+
+	return exitFailure
+}
+
+// fatalHook exits with the exit code for the error a fatal log entry was logged
+// with, recording the invocation as failed in the run log first.
+type fatalHook struct {
+	run *runRecorder
+}
+
+func (h fatalHook) OnWrite(entry *zapcore.CheckedEntry, fields []zapcore.Field) {
+	var err error
+
+	for _, v := range fields {
+		if fieldErr, ok := v.Interface.(error); ok && v.Type == zapcore.ErrorType {
+			err = fieldErr
+		}
+	}
+
+	message := entry.Message
+	if err != nil {
+		message += ": " + err.Error()
+	}
+
+	// The process is exiting either way, so there is nothing to do with an error.
+	_ = h.run.finish(errors.New(message))
+
+	os.Exit(exitCode(err))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type ExperimentCommand struct {
+	Grid           string   `required:"" help:"The parameters to vary, as key=value,value,... separated by semicolons, e.g. 'model=sd3-large,sd3-medium;cfg=4,7;seed=1,2'.  Keys are model, cfg, seed, ratio, and negative."`
+	Name           string   `optional:"name" help:"The name of the directory under experiments/ in the output directory to save the results in.  Defaults to the current time."`
+	Model          string   `optional:"model" help:"The model to use when the grid doesn't vary it."`
+	Ratio          string   `optional:"ratio" default:"1:1" help:"The aspect ratio to use when the grid doesn't vary it."`
+	OutputFormat   string   `optional:"format" default:"png" help:"The format of the returned images.  Must be one the backend supports, as listed by sdcli engines."`
+	NegativePrompt string   `optional:"negative" help:"The negative prompt to use when the grid doesn't vary it."`
+	PromptParts    []string `arg:"" help:"The prompt to use for every generation."`
+}
+
+// gridAxis is a parameter varied by an experiment, and the values it takes.
+type gridAxis struct {
+	Key    string
+	Values []string
+}
+
+// experimentKeys are the parameters an experiment can vary.
+var experimentKeys = []string{"model", "cfg", "seed", "ratio", "negative"}
+
+// parseGrid parses a grid like "model=sd3-large,sd3-medium;cfg=4,7".  The axes
+// are returned in the order they were given.
+func parseGrid(spec string) ([]gridAxis, error) {
+	var axes []gridAxis
+
+	for _, v := range strings.Split(spec, ";") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+
+		key, values, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid grid axis %q, must be key=value,value,...", v)
+		}
+
+		key = strings.TrimSpace(key)
+		if !slices.Contains(experimentKeys, key) {
+			return nil, fmt.Errorf("unknown grid key %q, must be one of %s", key, strings.Join(experimentKeys, ", "))
+		}
+
+		if slices.ContainsFunc(axes, func(axis gridAxis) bool { return axis.Key == key }) {
+			return nil, fmt.Errorf("grid key %q is given more than once", key)
+		}
+
+		axis := gridAxis{Key: key}
+
+		for _, value := range strings.Split(values, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return nil, fmt.Errorf("grid key %q has an empty value", key)
+			}
+
+			// Check the value parses now, rather than partway through the run.
+			err := applyGridValue(&generation{}, key, value)
+			if err != nil {
+				return nil, err
+			}
+
+			axis.Values = append(axis.Values, value)
+		}
+
+		axes = append(axes, axis)
+	}
+
+	if len(axes) == 0 {
+		return nil, errors.New("grid is empty")
+	}
+
+	return axes, nil
+}
+
+// applyGridValue sets the parameter of a generation named by key.
+func applyGridValue(gen *generation, key string, value string) error {
+	switch key {
+	case "model":
+		gen.Model = value
+	case "cfg":
+		cfg, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("invalid cfg %q: %w", value, err)
+		}
+
+		gen.CFGScale = float32(cfg)
+	case "seed":
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid seed %q: %w", value, err)
+		}
+
+		gen.Seed = seed
+	case "ratio":
+		gen.Ratio = value
+	case "negative":
+		gen.NegativePrompt = value
+	}
+
+	return nil
+}
+
+// gridCombinations returns every combination of the axes' values, varying the
+// last axis fastest.
+func gridCombinations(axes []gridAxis) [][]string {
+	combinations := [][]string{{}}
+
+	for _, axis := range axes {
+		next := make([][]string, 0, len(combinations)*len(axis.Values))
+
+		for _, combination := range combinations {
+			for _, value := range axis.Values {
+				next = append(next, append(slices.Clone(combination), value))
+			}
+		}
+
+		combinations = next
+	}
+
+	return combinations
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+// combinationName names the image of a combination, e.g.
+// "003_model-sd3-large_cfg-7".
+func combinationName(index int, axes []gridAxis, values []string) string {
+	parts := []string{fmt.Sprintf("%03d", index+1)}
+
+	for i, axis := range axes {
+		value := strings.Trim(unsafeNameChars.ReplaceAllString(values[i], "-"), "-")
+		if len(value) > 32 {
+			value = value[:32]
+		}
+
+		parts = append(parts, axis.Key+"-"+value)
+	}
+
+	return strings.Join(parts, "_")
+}
+
+func (e ExperimentCommand) Run(ctx *Context) error {
+	prompt := strings.Join(e.PromptParts, " ")
+	if prompt == "" {
+		ctx.Logger.Fatal("prompt is empty, exiting")
+	}
+
+	axes, err := parseGrid(e.Grid)
+	if err != nil {
+		ctx.Logger.Fatal("invalid --grid", zap.Error(invalid(err)))
+	}
+
+	for _, axis := range axes {
+		switch axis.Key {
+		case "model":
+			for _, v := range axis.Values {
+				err = ctx.requireModel(v)
+				if err != nil {
+					ctx.Logger.Fatal("unknown model", zap.Error(err))
+				}
+			}
+		case "negative":
+			// Bundles are only checked here, so the grid is labeled with the
+			// references rather than the prompts they stand for.
+			for _, v := range axis.Values {
+				_, err = ctx.Config.expandNegative(v)
+				if err != nil {
+					ctx.Logger.Fatal("unable to generate", zap.Error(err))
+				}
+			}
+		}
+	}
+
+	e.NegativePrompt, err = ctx.Config.expandNegative(e.NegativePrompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
+	}
+
+	err = ctx.requireOutputFormat(e.OutputFormat)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
+	}
+
+	err = ctx.requireAspectRatio(e.Ratio)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
+	}
+
+	model := e.Model
+	if model == "" {
+		model = defaultModel(ctx.Backend.Capabilities())
+	}
+
+	name := e.Name
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+
+	dir := path.Join("experiments", name)
+	combinations := gridCombinations(axes)
+
+	ctx.Logger.Info("running experiment", zap.String("directory", dir), zap.Int("generations", len(combinations)))
+
+	rows := make([][]string, 0, len(combinations))
+
+	report := experimentReport{
+		Name:           name,
+		Prompt:         prompt,
+		NegativePrompt: e.NegativePrompt,
+		Model:          model,
+		Ratio:          e.Ratio,
+		Grid:           axes,
+		Backend:        ctx.Backend.Name(),
+		StartedAt:      time.Now(),
+		Combinations:   len(combinations),
+	}
+
+	var (
+		results []*generationResult
+		failed  []error
+	)
+
+	for i, values := range combinations {
+		if ctx.Ctx.Err() != nil {
+			break
+		}
+
+		gen := generation{
+			Prompt:         prompt,
+			NegativePrompt: e.NegativePrompt,
+			Model:          model,
+			Ratio:          e.Ratio,
+			OutputFormat:   e.OutputFormat,
+			OutputName:     path.Join(dir, combinationName(i, axes, values)),
+		}
+
+		for j, axis := range axes {
+			// The values were checked by parseGrid.
+			_ = applyGridValue(&gen, axis.Key, values[j])
+		}
+
+		// The bundles were checked above.
+		gen.NegativePrompt, _ = ctx.Config.expandNegative(gen.NegativePrompt)
+
+		result, err := ctx.generate(ctx.Ctx, gen)
+		if err != nil && ctx.Ctx.Err() != nil {
+			break
+		}
+
+		rows = append(rows, manifestRow(values, result, err))
+		report.Outcomes = append(report.Outcomes, experimentOutcome{Values: values, Result: result, Err: err})
+
+		if err != nil {
+			ctx.Logger.Error("generation failed", zap.Strings("values", values), zap.Error(err))
+
+			failed = append(failed, err)
+
+			// Every other generation would fail the same way.
+			if stopsBatch(err) {
+				break
+			}
+
+			continue
+		}
+
+		ctx.Logger.Info("generated image", zap.Int("number", i+1), zap.Int("of", len(combinations)), zap.String("path", result.Path))
+
+		results = append(results, result)
+	}
+
+	// Write the manifest even if the experiment was cut short, so the images
+	// that were generated can still be analyzed.
+	manifest, err := ctx.writeManifest(context.WithoutCancel(ctx.Ctx), path.Join(dir, "manifest.csv"), axes, rows)
+	if err != nil {
+		ctx.Logger.Fatal("failed to write manifest", zap.Error(err))
+	}
+
+	ctx.Logger.Info("wrote manifest", zap.String("path", manifest))
+
+	reportPath, err := ctx.writeReport(context.WithoutCancel(ctx.Ctx), path.Join(dir, "report.md"), report)
+	if err != nil {
+		ctx.Logger.Fatal("failed to write report", zap.Error(err))
+	}
+
+	ctx.Logger.Info("wrote report", zap.String("path", reportPath))
+
+	if err := ctx.Ctx.Err(); err != nil {
+		ctx.Logger.Warn("stopped early", zap.Int("generated", len(rows)), zap.Int("count", len(combinations)))
+
+		return err
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d generations failed: %w", len(failed), len(combinations), errors.Join(failed...))
+	}
+
+	return filteredError(results...)
+}
+
+// manifestHeader is the header of the manifest, after the columns for the
+// experiment's axes.
+var manifestHeader = []string{"model_used", "seed_used", "finish_reason", "credits", "latency_ms", "error"}
+
+// manifestRow returns the row of the manifest for a generation.
+func manifestRow(values []string, result *generationResult, err error) []string {
+	row := []string{""}
+	row = append(row, values...)
+
+	if err != nil {
+		return append(row, "", "", "", "", "", err.Error())
+	}
+
+	row[0] = outputBaseName(result.Path)
+
+	return append(row,
+		result.Model,
+		strconv.FormatInt(result.Seed, 10),
+		result.FinishReason,
+		strconv.FormatFloat(result.Credits, 'g', -1, 64),
+		strconv.FormatInt(result.Duration.Milliseconds(), 10),
+		"")
+}
+
+// writeManifest writes a CSV mapping the images of an experiment to the
+// parameters they were generated with, and returns where it was written.
+func (c *Context) writeManifest(ctx context.Context, name string, axes []gridAxis, rows [][]string) (string, error) {
+	header := []string{"file"}
+	for _, v := range axes {
+		header = append(header, v.Key)
+	}
+
+	header = append(header, manifestHeader...)
+
+	var buf bytes.Buffer
+
+	writer := csv.NewWriter(&buf)
+
+	err := writer.WriteAll(append([][]string{header}, rows...))
+	if err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return c.Output.Write(ctx, name, buf.Bytes())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportThumbnailWidth is the width, in pixels, that images are shown at in an
+// experiment's report.
+const reportThumbnailWidth = 256
+
+// experimentOutcome is the result of one combination of an experiment, for its
+// report.
+type experimentOutcome struct {
+	Values []string
+	Result *generationResult
+	Err    error
+}
+
+// experimentReport describes an experiment for its report.
+type experimentReport struct {
+	Name           string
+	Prompt         string
+	NegativePrompt string
+	Model          string
+	Ratio          string
+	Grid           []gridAxis
+	Backend        string
+	StartedAt      time.Time
+
+	// The number of combinations in the grid, which may be more than the number
+	// of outcomes if the experiment was cut short.
+	Combinations int
+	Outcomes     []experimentOutcome
+}
+
+// markdown renders the report as Markdown, with the images linked relative to
+// the experiment's directory, so it can be shared with them, e.g. in a pull
+// request or a wiki.
+func (r experimentReport) markdown() []byte {
+	var (
+		b       strings.Builder
+		credits float64
+		failed  int
+	)
+
+	for _, v := range r.Outcomes {
+		if v.Err != nil {
+			failed++
+		} else {
+			credits += v.Result.Credits
+		}
+	}
+
+	fmt.Fprintf(&b, "# Experiment %s\n\n", r.Name)
+
+	b.WriteString("| Parameter | Value |\n| --- | --- |\n")
+	fmt.Fprintf(&b, "| Prompt | %s |\n", markdownCell(r.Prompt))
+
+	if r.NegativePrompt != "" {
+		fmt.Fprintf(&b, "| Negative prompt | %s |\n", markdownCell(r.NegativePrompt))
+	}
+
+	if r.Model != "" {
+		fmt.Fprintf(&b, "| Model | %s |\n", markdownCell(r.Model))
+	}
+
+	fmt.Fprintf(&b, "| Aspect ratio | %s |\n", markdownCell(r.Ratio))
+
+	for _, v := range r.Grid {
+		fmt.Fprintf(&b, "| Grid: %s | %s |\n", v.Key, markdownCell(strings.Join(v.Values, ", ")))
+	}
+
+	fmt.Fprintf(&b, "| Backend | %s |\n", markdownCell(r.Backend))
+	fmt.Fprintf(&b, "| Started | %s |\n", r.StartedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "| Generated | %d of %d |\n", len(r.Outcomes)-failed, r.Combinations)
+	fmt.Fprintf(&b, "| Credits | %s |\n", strconv.FormatFloat(credits, 'g', -1, 64))
+
+	b.WriteString("\n## Results\n\n| Image |")
+
+	for _, v := range r.Grid {
+		fmt.Fprintf(&b, " %s |", v.Key)
+	}
+
+	b.WriteString(" Seed used | Finish reason |\n| --- |")
+	b.WriteString(strings.Repeat(" --- |", len(r.Grid)+2))
+	b.WriteString("\n")
+
+	for _, v := range r.Outcomes {
+		if v.Err != nil {
+			continue
+		}
+
+		// The image is saved next to the report, under the name it was saved as.
+		file := url.PathEscape(path.Base(v.Result.Name))
+		fmt.Fprintf(&b, "| [<img src=\"%s\" width=\"%d\">](%s) |", file, reportThumbnailWidth, file)
+
+		for _, value := range v.Values {
+			fmt.Fprintf(&b, " %s |", markdownCell(value))
+		}
+
+		fmt.Fprintf(&b, " %d | %s |\n", v.Result.Seed, markdownCell(v.Result.FinishReason))
+	}
+
+	if failed > 0 {
+		b.WriteString("\n## Failures\n\n|")
+
+		for _, v := range r.Grid {
+			fmt.Fprintf(&b, " %s |", v.Key)
+		}
+
+		b.WriteString(" Error |\n|")
+		b.WriteString(strings.Repeat(" --- |", len(r.Grid)+1))
+		b.WriteString("\n")
+
+		for _, v := range r.Outcomes {
+			if v.Err == nil {
+				continue
+			}
+
+			b.WriteString("|")
+
+			for _, value := range v.Values {
+				fmt.Fprintf(&b, " %s |", markdownCell(value))
+			}
+
+			fmt.Fprintf(&b, " %s |\n", markdownCell(v.Err.Error()))
+		}
+	}
+
+	return []byte(b.String())
+}
+
+// markdownCell escapes a value to be put in a Markdown table cell.
+func markdownCell(value string) string {
+	value = strings.ReplaceAll(value, "|", "\\|")
+	value = strings.ReplaceAll(value, "\r", "")
+
+	return strings.ReplaceAll(value, "\n", "<br>")
+}
+
+// writeReport writes the report of an experiment, and returns where it was
+// written.
+func (c *Context) writeReport(ctx context.Context, name string, report experimentReport) (string, error) {
+	return c.Output.Write(ctx, name, report.markdown())
+}
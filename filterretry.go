@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"go.uber.org/zap"
+)
+
+type FilterRetryConfig struct {
+	// The number of times to retry a generation that content moderation filtered,
+	// with a rewritten prompt, so that an occasional false positive doesn't ruin
+	// an unattended batch.  Zero disables retrying.  Can be overridden with
+	// gen-3 --retry-filtered.
+	Attempts int `json:"attempts"`
+
+	// A command, run with the shell, that rewrites prompts.  It is given the
+	// filtered prompt on stdin and prints the new prompt.  If empty, prompts are
+	// rewritten by the prompt enhancer, which must be configured.
+	Command string `json:"command"`
+
+	// The instruction given to the prompt enhancer when rewriting a prompt.
+	// Defaults to asking for the same image without anything a moderation filter
+	// could mistake for objectionable content.
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// defaultRewriteSystemPrompt is the instruction sent to the prompt enhancer when
+// rewriting a filtered prompt, unless filter_retry.system_prompt is set.
+const defaultRewriteSystemPrompt = "The following Stable Diffusion prompt was rejected by a content " +
+	"moderation filter, most likely by mistake.  Rewrite it to describe the same image while " +
+	"avoiding words that could be mistaken for violent, sexual, or otherwise objectionable " +
+	"content.  Reply with the prompt only, without quotes or commentary."
+
+// errNoPromptRewriter is returned when filtered generations are to be retried, but
+// there is nothing to rewrite their prompts with.
+var errNoPromptRewriter = errors.New(
+	"retrying filtered generations requires filter_retry.command, or prompt_enhancer.base_url and prompt_enhancer.model, to be set")
+
+// validate returns an error if retries are enabled without a way to rewrite
+// prompts.
+func (f FilterRetryConfig) validate(enhancer PromptEnhancerConfig) error {
+	if f.Attempts < 0 {
+		return fmt.Errorf("attempts must not be negative, got %d", f.Attempts)
+	}
+
+	if f.Attempts > 0 && f.Command == "" && !enhancer.configured() {
+		return errNoPromptRewriter
+	}
+
+	return nil
+}
+
+// wasFiltered reports whether a generation was stopped by content moderation,
+// whether the backend refused it or returned a blurred image.
+func wasFiltered(result *generationResult, err error) bool {
+	if err != nil {
+		return errors.Is(err, backend.ErrContentFiltered)
+	}
+
+	return result.FinishReason == finishReasonFiltered
+}
+
+// generateRetryingFiltered runs a generation, and if content moderation filters
+// it, rewrites the prompt and tries again up to filter_retry.attempts times.  The
+// prompts that were filtered are recorded with the image that finally succeeds,
+// and any blurred images are saved as usual.
+func (c *Context) generateRetryingFiltered(ctx context.Context, gen generation) (*generationResult, error) {
+	attempts := c.Config.FilterRetry.Attempts
+
+	for retries := 0; ; retries++ {
+		result, err := c.generateOnce(ctx, gen)
+		if retries >= attempts || ctx.Err() != nil || !wasFiltered(result, err) {
+			return result, err
+		}
+
+		c.Logger.Warn(
+			"generation was filtered, retrying with a rewritten prompt",
+			zap.String("prompt", gen.Prompt),
+			zap.Int("retry", retries+1),
+			zap.Int("attempts", attempts))
+
+		rewritten, rewriteErr := c.rewritePrompt(ctx, gen.Prompt)
+		if rewriteErr != nil {
+			c.Logger.Error("failed to rewrite prompt, not retrying", zap.Error(rewriteErr))
+
+			return result, err
+		}
+
+		c.Logger.Info("rewrote prompt", zap.String("prompt", rewritten))
+
+		gen.FilteredPrompts = append(gen.FilteredPrompts, gen.Prompt)
+		gen.Prompt = rewritten
+	}
+}
+
+// rewritePrompt rewrites a filtered prompt with filter_retry.command, or the
+// prompt enhancer if no command is configured.
+func (c *Context) rewritePrompt(ctx context.Context, prompt string) (string, error) {
+	config := c.Config.FilterRetry
+
+	if config.Command == "" {
+		systemPrompt := config.SystemPrompt
+		if systemPrompt == "" {
+			systemPrompt = defaultRewriteSystemPrompt
+		}
+
+		client, err := c.promptEnhancer(systemPrompt)
+		if err != nil {
+			return "", err
+		}
+
+		return client.Enhance(ctx, prompt)
+	}
+
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", config.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", config.Command)
+	}
+
+	cmd.Stdin = strings.NewReader(prompt)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run prompt rewrite command %q: %w", config.Command, err)
+	}
+
+	rewritten := string(bytes.TrimSpace(output))
+	if rewritten == "" {
+		return "", fmt.Errorf("prompt rewrite command %q printed an empty prompt", config.Command)
+	}
+
+	return rewritten, nil
+}
@@ -0,0 +1,1069 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/SethCurry/sdcli/internal/balance"
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/imagemeta"
+	"github.com/SethCurry/sdcli/pkg/stability"
+	"go.uber.org/zap"
+)
+
+type ExifConfig struct {
+	// The Artist tag to write.  Defaults to "Stable Diffusion".
+	Artist string `json:"artist"`
+
+	// The Copyright tag to write, e.g. license text.  Not written if empty.
+	Copyright string `json:"copyright"`
+
+	// Extra tags to write.  Keys that are standard Exif text tags, like "Software",
+	// are written as those tags; anything else is written to the UserComment.
+	Extra map[string]string `json:"extra"`
+
+	// Whether to split the prompt into keywords on commas, and write them as
+	// XPKeywords and XMP dc:subject so asset managers can search by them.
+	Keywords bool `json:"keywords"`
+
+	// Whether to embed a small thumbnail in the Exif of JPEG images, so file
+	// managers can show previews without decoding the whole image.
+	Thumbnails bool `json:"thumbnails"`
+
+	// Whether to save the image without metadata, along with a sidecar, if writing
+	// the metadata corrupts it.  By default the image isn't saved at all.
+	KeepOriginalOnError bool `json:"keep_original_on_error"`
+}
+
+// generation holds the parameters for a single generation.  It is shared by the
+// CLI commands and the chat bots so that they all produce images the same way.
+type generation struct {
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	Model          string  `json:"model"`
+	Ratio          string  `json:"aspect_ratio,omitempty"`
+	OutputFormat   string  `json:"output_format"`
+	Strength       float32 `json:"strength,omitempty"`
+	Seed           int64   `json:"seed,omitempty"`
+	CFGScale       float32 `json:"cfg_scale,omitempty"`
+
+	// The path to an image to use for image-to-image generation.
+	Image string `json:"image,omitempty"`
+
+	// The paths of images to generate in the style of, with gen-3 --ref.
+	StyleReferences []string `json:"style_references,omitempty"`
+
+	// Whether StyleReferences are averaged into one image before they are sent.
+	AverageStyle bool `json:"average_style,omitempty"`
+
+	// How closely the image follows the style of StyleReferences, from 0 to 1.
+	Fidelity float32 `json:"fidelity,omitempty"`
+
+	// The prompt as it was given, if Prompt was expanded by the prompt enhancer.
+	OriginalPrompt string `json:"original_prompt,omitempty"`
+
+	// The random tokens appended to Prompt by --seasoning.
+	Seasoning []string `json:"seasoning,omitempty"`
+
+	// The prompts that content moderation filtered before Prompt, when retried
+	// with filter_retry.
+	FilteredPrompts []string `json:"filtered_prompts,omitempty"`
+
+	// The name to save the image under, relative to the output directory and
+	// without an extension, e.g. "experiments/run/001".  Defaults to the Unix
+	// time, in a subdirectory given by output_layout.
+	OutputName string `json:"-"`
+
+	// The format to convert the image to before saving it, if it differs from
+	// OutputFormat.
+	SaveAs string `json:"save_as,omitempty"`
+
+	// The number of images to generate with one request, with gen-3 --samples.
+	// Zero or one generates one.
+	Samples int `json:"samples,omitempty"`
+}
+
+// generationResult describes an image that was generated, upscaled, or edited
+// and saved.
+type generationResult struct {
+	// The path or URL the image was saved to.
+	Path string
+
+	// The name the image was saved under, relative to the output directory, e.g.
+	// "2024/06/19/1718822400.png".
+	Name string
+
+	// The image as it was saved, including its metadata.
+	Image []byte
+
+	// The operation that produced the image: "generate", "upscale", or "edit".
+	Operation string
+
+	Prompt         string
+	NegativePrompt string
+	AspectRatio    string
+	Backend        string
+	Model          string
+	Seed           int64
+	FinishReason   string
+
+	// The prompt as it was given, if Prompt was expanded by the prompt enhancer.
+	OriginalPrompt string
+
+	// The random tokens appended to Prompt by --seasoning.
+	Seasoning []string
+
+	// The prompts that content moderation filtered before Prompt, when retried
+	// with filter_retry.
+	FilteredPrompts []string
+
+	// How long the backend took to return the image.
+	Duration time.Duration
+
+	// The number of credits the image cost, as reported by the backend if
+	// CreditsReported, or estimated otherwise.
+	Credits         float64
+	CreditsReported bool
+
+	// When the image was saved.
+	CreatedAt time.Time
+
+	// The parameters of the request, e.g. a generation.  This is written to
+	// sidecars as is, so it must marshal to JSON.
+	Parameters any
+
+	// Describes the upscale or edit that produced the image, e.g. "upscale fast".
+	// Empty for generations.
+	Edit string
+
+	// The metadata of the image that was upscaled or edited, if it had any.  It is
+	// merged into the metadata of the new image.
+	Source *imagemeta.Metadata
+
+	// The ID of the invisible watermark embedded in the image, if watermarking is
+	// enabled.
+	WatermarkID string
+
+	// Describes the post-processing applied to the image, if any, e.g.
+	// "palette of 16 colors".
+	PostProcessing string
+
+	// The hex SHA-256 of the image as the backend returned it.
+	Hash string
+
+	// The history ID of an identical image, if the image wasn't saved because it
+	// was a duplicate.
+	DuplicateOf int64
+
+	// Set when the metadata couldn't be embedded in the image, so a sidecar
+	// is written even if sidecars are disabled.
+	forceSidecar bool
+
+	// The name to save the image under instead of the default, without an
+	// extension.
+	outputName string
+
+	// The other images generated by the same request, with --samples, and the
+	// index of this one among them.
+	samples     []*generationResult
+	sampleIndex int
+}
+
+// withSamples returns the result followed by the other images generated by the
+// same request, if any.
+func (r *generationResult) withSamples() []*generationResult {
+	return append([]*generationResult{r}, r.samples...)
+}
+
+// defaultModel returns the default model of a backend, or an empty string if the
+// backend doesn't list its models.
+func defaultModel(caps backend.Capabilities) string {
+	if len(caps.Models) == 0 {
+		return ""
+	}
+
+	return caps.Models[0]
+}
+
+// reserveCredits reserves the estimated cost of a model or operation from the
+// credit budget, returning the number of credits reserved.  The returned function
+// gives the credits back, and should be called if the request fails.
+//
+// Only the Stability backend spends credits; other backends reserve nothing.
+func (c *Context) reserveCredits(modelOrOperation string) (float64, func(), error) {
+	if c.Backend.Name() != "stability" {
+		return 0, func() {}, nil
+	}
+
+	credits, _ := stability.EstimateCredits(modelOrOperation)
+
+	err := c.checkBalance(credits)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = c.Budget.Reserve(credits)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.spendBalance(credits)
+
+	return credits, func() {
+		if releaseErr := c.Budget.Release(credits); releaseErr != nil {
+			c.Logger.Error("failed to release reserved credits", zap.Error(releaseErr))
+		}
+
+		c.spendBalance(-credits)
+	}, nil
+}
+
+// settleCredits corrects the credits reserved for a request to what the backend
+// reports it cost, if it does, and returns the credits the request cost.
+func (c *Context) settleCredits(estimated float64, result *backend.Result) float64 {
+	if result.Credits <= 0 || c.Backend.Name() != "stability" {
+		return estimated
+	}
+
+	err := c.Budget.Adjust(result.Credits - estimated)
+	if err != nil {
+		c.Logger.Error("failed to correct reserved credits", zap.Error(err))
+	}
+
+	c.spendBalance(result.Credits - estimated)
+
+	return result.Credits
+}
+
+// checkBalance warns if the account's balance is below warn_below_credits, and
+// returns an error wrapping balance.ErrTooLow if spending cost would leave it
+// below fail_below_credits, or waits until it wouldn't with wait_for_credits.
+// If the balance can't be fetched, the generation goes ahead anyway.
+func (c *Context) checkBalance(cost float64) error {
+	if c.Balance == nil {
+		return nil
+	}
+
+	credits, err := c.Balance.Get(c.Ctx)
+	if err != nil {
+		c.Logger.Warn("failed to check credit balance", zap.Error(err))
+
+		return nil
+	}
+
+	for c.Config.FailBelowCredits > 0 && credits-cost < c.Config.FailBelowCredits {
+		if !c.Config.WaitForCredits {
+			return fmt.Errorf("%w: %g credits left, spending %g more would leave less than fail_below_credits of %g",
+				balance.ErrTooLow, credits, cost, c.Config.FailBelowCredits)
+		}
+
+		credits, err = c.waitForCredits(credits, cost)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Config.WarnBelowCredits > 0 && credits < c.Config.WarnBelowCredits {
+		fmt.Fprintf(os.Stderr, "WARNING: only %g credits left on your Stability account\n", credits)
+	}
+
+	return nil
+}
+
+// waitForCredits waits for the account to be topped up, fetching its balance
+// every balance_check_interval, and returns the balance once it has changed.  It
+// returns the context's error if sdcli is interrupted while waiting.
+func (c *Context) waitForCredits(credits float64, cost float64) (float64, error) {
+	interval := c.Config.balanceCheckInterval()
+
+	fmt.Fprintf(os.Stderr, "Waiting for credits: %g left, %g more are needed to stay above fail_below_credits of %g.  Checking again every %s.\n",
+		credits, c.Config.FailBelowCredits+cost-credits, c.Config.FailBelowCredits, interval)
+
+	for {
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-c.Ctx.Done():
+			timer.Stop()
+
+			return 0, c.Ctx.Err()
+		case <-timer.C:
+		}
+
+		refreshed, err := c.Balance.Refresh(c.Ctx)
+		if err != nil {
+			c.Logger.Warn("failed to check credit balance", zap.Error(err))
+
+			continue
+		}
+
+		if refreshed != credits {
+			return refreshed, nil
+		}
+	}
+}
+
+// spendBalance deducts credits from the cached balance until it is next fetched.
+func (c *Context) spendBalance(credits float64) {
+	if c.Balance == nil {
+		return
+	}
+
+	err := c.Balance.Spend(credits)
+	if err != nil {
+		c.Logger.Error("failed to update cached credit balance", zap.Error(err))
+	}
+}
+
+// generate runs a generation against the configured backend, embeds the prompt in
+// the image's Exif metadata, and saves it to the configured output directory.  If
+// filter_retry is configured, filtered generations are retried with rewritten
+// prompts.
+func (c *Context) generate(ctx context.Context, gen generation) (*generationResult, error) {
+	return c.generateRetryingFiltered(ctx, gen)
+}
+
+// generateOnce runs a single generation and saves the image.  If saving one of
+// several samples fails, the samples already saved are returned with the error.
+//
+// The estimated cost of the generation is reserved from the credit budget before
+// the request is sent, and returned to it if the request fails.
+func (c *Context) generateOnce(ctx context.Context, gen generation) (*generationResult, error) {
+	caps := c.Backend.Capabilities()
+
+	if gen.Image != "" && !caps.Supports(backend.OperationImageToImage) {
+		c.Logger.Warn(
+			"backend does not support image-to-image, ignoring the initial image",
+			zap.String("backend", c.Backend.Name()),
+			zap.String("image", gen.Image))
+
+		gen.Image = ""
+	}
+
+	req := backend.GenerateRequest{
+		Prompt:         gen.Prompt,
+		NegativePrompt: gen.NegativePrompt,
+		Model:          gen.Model,
+		AspectRatio:    gen.Ratio,
+		OutputFormat:   gen.OutputFormat,
+		Strength:       gen.Strength,
+		Seed:           gen.Seed,
+		CFGScale:       gen.CFGScale,
+		Samples:        gen.Samples,
+	}
+
+	if gen.Image != "" {
+		initImage, closer, err := c.openInitImage(ctx, gen.Image)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+
+		req.Image = initImage
+
+		if gen.Ratio == "" && len(caps.AspectRatios) > 0 {
+			gen.Ratio, err = detectAspectRatio(initImage, gen.Image, caps.AspectRatios)
+			if err != nil {
+				return nil, err
+			}
+
+			req.AspectRatio = gen.Ratio
+
+			c.Logger.Info("using the aspect ratio nearest the initial image's",
+				zap.String("image", gen.Image),
+				zap.String("ratio", gen.Ratio))
+		}
+	}
+
+	// Style control has no choice of model, and its own price.
+	costKey := gen.Model
+
+	if len(gen.StyleReferences) > 0 {
+		styleImages, closer, err := c.openStyleReferences(ctx, gen)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+
+		req.StyleImages = styleImages
+		req.StyleFidelity = gen.Fidelity
+		costKey = stability.StyleModel
+	}
+
+	err := c.checkPrompt(gen.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	credits, release, err := c.reserveCredits(costKey)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+
+	gotImages, err := backend.GenerateSamples(ctx, c.Backend, req)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to generate image: %w", err)
+	}
+
+	duration := time.Since(started)
+
+	var first *generationResult
+
+	for i, gotImage := range gotImages {
+		result, err := c.saveGenerated(ctx, gen, gotImage, duration, credits)
+		if err != nil && first != nil {
+			// The samples saved so far are paid for and recorded, so they are
+			// returned along with the error rather than lost.
+			return first, fmt.Errorf("failed to save image %d of %d: %w", i+1, len(gotImages), err)
+		} else if err != nil {
+			return nil, err
+		}
+
+		// The request is paid for once, so later samples don't count it again.
+		credits = 0
+
+		if i == 0 {
+			first = result
+		} else {
+			result.sampleIndex = i
+			first.samples = append(first.samples, result)
+		}
+	}
+
+	return first, nil
+}
+
+// saveGenerated saves an image returned by the backend for a generation, given
+// how long the request took and the credits reserved for it.
+func (c *Context) saveGenerated(ctx context.Context, gen generation, gotImage *backend.Result, duration time.Duration, credits float64) (*generationResult, error) {
+	model := gotImage.Model
+	if model == "" {
+		model = gen.Model
+	}
+
+	result := &generationResult{
+		Operation:       "generate",
+		Prompt:          gen.Prompt,
+		NegativePrompt:  gen.NegativePrompt,
+		OriginalPrompt:  gen.OriginalPrompt,
+		Seasoning:       gen.Seasoning,
+		FilteredPrompts: gen.FilteredPrompts,
+		AspectRatio:     gen.Ratio,
+		Backend:         c.Backend.Name(),
+		Model:           model,
+		Seed:            gotImage.Seed,
+		FinishReason:    gotImage.FinishReason,
+		Duration:        duration,
+		Credits:         c.settleCredits(credits, gotImage),
+		CreditsReported: gotImage.Credits > 0,
+		Parameters:      gen,
+		outputName:      gen.OutputName,
+	}
+
+	data, format, err := convertForSaving(gotImage.Image, gen.OutputFormat, gen.SaveAs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The image has been paid for, so save it even if sdcli is being interrupted.
+	err = c.saveResult(context.WithoutCancel(ctx), data, format, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// saveResult saves an image returned by the backend and fills in the result's
+// Path, Image, and CreatedAt.  It then writes the sidecar, if enabled, records
+// the image in the history, and notifies the webhook.
+func (c *Context) saveResult(ctx context.Context, image []byte, format string, result *generationResult) error {
+	// Never save something that isn't an image with an image's extension, e.g. an
+	// error page from a proxy that slipped past the backend.
+	err := backend.VerifyImage(image, "", format)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(image)
+	result.Hash = hex.EncodeToString(hash[:])
+
+	if c.Config.Deduplicate {
+		saved, err := c.saveDuplicate(result)
+		if err != nil {
+			c.Logger.Warn("failed to check for duplicate images", zap.Error(err))
+		} else if saved {
+			c.Run.addResult(result)
+			c.notifyWebhook(ctx, result)
+
+			return nil
+		}
+	}
+
+	outputFile, savedImage, err := c.saveImage(ctx, image, format, result)
+	if err != nil {
+		return err
+	}
+
+	result.Path = outputFile
+	result.Image = savedImage
+	result.CreatedAt = time.Now()
+
+	if c.Config.Sidecars || result.forceSidecar {
+		err = c.writeSidecar(ctx, result)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.recordHistory(result)
+	c.Run.addResult(result)
+	c.trimOutputDirectory(result.Path)
+	c.notifyWebhook(ctx, result)
+
+	return nil
+}
+
+// saveImage embeds the result's prompt and parameters in the image's metadata and
+// saves it to the configured output destination.  It returns the path or URL it
+// was saved to, along with the image as it was saved.
+func (c *Context) saveImage(ctx context.Context, image []byte, format string, result *generationResult) (string, []byte, error) {
+	// Post-process before watermarking, since quantizing would wipe out the
+	// watermark.
+	if c.PostProcess != nil {
+		processed, err := c.PostProcess.apply(image, format)
+		if err != nil {
+			c.Logger.Warn("failed to post-process image, saving it as is", zap.Error(err))
+		} else {
+			image = processed
+			result.PostProcessing = c.PostProcess.description
+		}
+	}
+
+	if c.Config.Watermark.Enabled {
+		watermarked, id, err := c.addWatermark(image, format)
+		if err != nil {
+			c.Logger.Warn("failed to watermark image, saving it without one", zap.Error(err))
+		} else {
+			image = watermarked
+			result.WatermarkID = id
+		}
+	}
+
+	meta := c.imageMetadata(result)
+
+	if format == "jpeg" && c.Config.Exif.Thumbnails {
+		thumbnail, err := makeThumbnail(image)
+		if err != nil {
+			c.Logger.Warn("failed to make thumbnail, saving the image without one", zap.Error(err))
+		} else {
+			meta.Thumbnail = thumbnail
+		}
+	}
+
+	now := time.Now()
+	name := c.defaultImageName(result, now) + "." + format
+
+	if result.outputName != "" {
+		name = result.outputName + "." + format
+	} else if c.Config.OutputLayout != "" {
+		name = path.Join(now.Format(c.Config.OutputLayout), name)
+	}
+
+	if output, ok := c.Output.(streamingOutput); ok && format == "jpeg" && c.Config.LowMemory {
+		return c.streamJPEG(ctx, output, name, image, meta, result)
+	}
+
+	var writeOptions []imagemeta.WriteOption
+	if c.Config.LowMemory {
+		writeOptions = append(writeOptions, imagemeta.WithHeaderOnlyVerify())
+	}
+
+	imageWithNewExif, err := imagemeta.Write(image, format, meta, writeOptions...)
+	if errors.Is(err, imagemeta.ErrUnsupportedFormat) {
+		// The metadata can't be embedded, so save the image as is and make sure
+		// the metadata ends up in a sidecar instead.
+		c.Logger.Warn(
+			"unable to embed metadata in this format, writing a sidecar instead",
+			zap.String("format", format))
+
+		imageWithNewExif = image
+		result.forceSidecar = true
+	} else if errors.Is(err, imagemeta.ErrCorrupted) && c.Config.Exif.KeepOriginalOnError {
+		c.Logger.Warn(
+			"writing metadata corrupted the image, saving the original with a sidecar instead",
+			zap.Error(err))
+
+		imageWithNewExif = image
+		result.forceSidecar = true
+	} else if err != nil {
+		return "", nil, fmt.Errorf("failed to add new exif metadata: %w", err)
+	}
+
+	outputFile, err := c.Output.Write(ctx, name, imageWithNewExif)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The output may have saved the image under a different name to avoid
+	// overwriting an existing file, so the sidecar has to follow the saved name.
+	result.Name = savedName(name, outputFile)
+
+	return outputFile, imageWithNewExif, nil
+}
+
+// streamJPEG saves a JPEG image with its metadata inserted as it is written to
+// the output file, rather than into a copy of the image in memory first.  The
+// image is returned as it was given, without the metadata, which is only in the
+// saved file.
+func (c *Context) streamJPEG(ctx context.Context, output streamingOutput, name string, image []byte, meta imagemeta.Metadata, result *generationResult) (string, []byte, error) {
+	outputFile, err := output.WriteFrom(ctx, name, func(w io.Writer) error {
+		return imagemeta.StreamJPEG(w, bytes.NewReader(image), meta)
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to save image with new exif metadata: %w", err)
+	}
+
+	result.Name = savedName(name, outputFile)
+
+	return outputFile, image, nil
+}
+
+// promptSlugWords is how many words of the prompt go in the default filename.
+const promptSlugWords = 4
+
+// maxPromptSlugLength is the longest a prompt slug can be, so long words don't
+// make long filenames.
+const maxPromptSlugLength = 48
+
+// defaultImageName returns the name to save an image under, without an
+// extension, when it wasn't given one: the Unix time, a slug of the first words
+// of the prompt, and the seed, e.g. "1718822400-castle-in-fog-s1234".  With
+// timestamp_filenames, it is only the Unix time.
+func (c *Context) defaultImageName(result *generationResult, now time.Time) string {
+	name := strconv.FormatInt(now.Unix(), 10)
+
+	if c.Config.TimestampFilenames {
+		return name
+	}
+
+	// The prompt as it was given reads better than an enhanced one.
+	prompt := result.OriginalPrompt
+	if prompt == "" {
+		prompt = result.Prompt
+	}
+
+	if slug := promptSlug(prompt); slug != "" {
+		name += "-" + slug
+	}
+
+	if result.Seed != 0 {
+		name += "-s" + strconv.FormatInt(result.Seed, 10)
+	}
+
+	return name
+}
+
+// promptSlug returns the first promptSlugWords words of a prompt, lowercased and
+// joined with hyphens, e.g. "castle-in-fog" for "A castle in fog".  Only
+// letters and digits are kept, so punctuation, e.g. from prompt weights like
+// "(castle:1.2)", can't end up in paths.  Leading articles are dropped.
+func promptSlug(prompt string) string {
+	words := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) > 1 && (words[0] == "a" || words[0] == "an" || words[0] == "the") {
+		words = words[1:]
+	}
+
+	slug := ""
+
+	for i, v := range words {
+		if i == promptSlugWords || len(slug)+len(v)+1 > maxPromptSlugLength {
+			break
+		}
+
+		if slug != "" {
+			slug += "-"
+		}
+
+		slug += v
+	}
+
+	return slug
+}
+
+// savedName returns the name an image was saved under, given the name it was
+// written as and the path or URL the output returned.  Outputs add a suffix to
+// avoid overwriting files, e.g. "1718822400-1.png", but uploads may return a URL
+// unrelated to the name, e.g. from a Location header, which is ignored.
+func savedName(name string, outputFile string) string {
+	base, saved := path.Base(name), outputBaseName(outputFile)
+	ext := path.Ext(base)
+
+	if saved != base && !(strings.HasPrefix(saved, strings.TrimSuffix(base, ext)+"-") && path.Ext(saved) == ext) {
+		return name
+	}
+
+	return path.Join(path.Dir(name), saved)
+}
+
+// makeThumbnail decodes an image and makes a thumbnail of it.
+func makeThumbnail(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return imagemeta.Thumbnail(img)
+}
+
+// imageMetadata returns the metadata to embed in a result's image.
+//
+// When the result is an upscale or edit of an image that has metadata, that
+// metadata is kept: the original prompt and parameters are preserved, and the
+// upscale or edit is appended to the list of edits.
+func (c *Context) imageMetadata(result *generationResult) imagemeta.Metadata {
+	meta := imagemeta.Metadata{
+		Prompt:    result.Prompt,
+		Artist:    c.Config.Exif.Artist,
+		Copyright: c.Config.Exif.Copyright,
+		Extra:     c.Config.Exif.Extra,
+		Software:  "sdcli " + version,
+		CreatedAt: time.Now(),
+		Params: imagemeta.Params{
+			NegativePrompt: result.NegativePrompt,
+			OriginalPrompt: result.OriginalPrompt,
+			Seasoning:      result.Seasoning,
+			Backend:        result.Backend,
+			Model:          result.Model,
+			Seed:           result.Seed,
+			AspectRatio:    result.AspectRatio,
+		},
+	}
+
+	if result.Edit != "" {
+		meta = c.mergeSourceMetadata(meta, result)
+	}
+
+	if result.WatermarkID != "" || result.PostProcessing != "" {
+		meta.Extra = maps.Clone(meta.Extra)
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+
+		if result.WatermarkID != "" {
+			meta.Extra["Watermark"] = result.WatermarkID
+		}
+
+		if result.PostProcessing != "" {
+			meta.Extra["Post-processing"] = result.PostProcessing
+		}
+	}
+
+	if c.Config.Exif.Keywords {
+		meta.Keywords = imagemeta.Keywords(meta.Prompt)
+	}
+
+	return meta
+}
+
+// mergeSourceMetadata merges the metadata of the image that was upscaled or
+// edited into meta, and records the upscale or edit.
+func (c *Context) mergeSourceMetadata(meta imagemeta.Metadata, result *generationResult) imagemeta.Metadata {
+	source := result.Source
+	if source == nil {
+		meta.Params.Edits = []string{result.Edit}
+		return meta
+	}
+
+	meta.Prompt = source.Prompt
+	meta.Params = source.Params
+	meta.Params.Edits = append(slices.Clone(source.Params.Edits), result.Edit)
+
+	if meta.Artist == "" {
+		meta.Artist = source.Artist
+	}
+
+	if meta.Copyright == "" {
+		meta.Copyright = source.Copyright
+	}
+
+	extra := maps.Clone(source.Extra)
+	if extra == nil {
+		extra = make(map[string]string)
+	}
+
+	maps.Copy(extra, c.Config.Exif.Extra)
+	meta.Extra = extra
+
+	return meta
+}
+
+// describeEdit describes an upscale or edit for the image's metadata, e.g.
+// "inpaint: a red hat".
+func describeEdit(operation string, prompt string) string {
+	if prompt == "" {
+		return operation
+	}
+
+	return operation + ": " + prompt
+}
+
+// imageSource is an image that is being upscaled or edited.
+type imageSource struct {
+	// The path or URL of the image, as recorded in sidecars.
+	Path string
+
+	// The image, or nil to read it from Path.  This is set when the image was
+	// just saved by an earlier step, which may have uploaded it to object
+	// storage.
+	Data []byte
+}
+
+// read returns the image, reading it from Path if it isn't already loaded.
+func (s imageSource) read() ([]byte, error) {
+	if s.Data != nil {
+		return s.Data, nil
+	}
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	return data, nil
+}
+
+// readForUpload returns the image like read, prepared to be sent to the API
+// with prepareUpload.
+func (s imageSource) readForUpload(ctx *Context) ([]byte, error) {
+	data, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return ctx.prepareUpload(ctx.Ctx, s.Path, data)
+}
+
+// readSourceMetadata reads the metadata of an image that is being upscaled or
+// edited.  It returns nil if the image has no metadata or it can't be read.
+func (c *Context) readSourceMetadata(path string, data []byte) *imagemeta.Metadata {
+	meta, err := imagemeta.Read(data)
+	if err != nil {
+		if !errors.Is(err, imagemeta.ErrNoMetadata) {
+			c.Logger.Warn("failed to read image metadata", zap.String("path", path), zap.Error(err))
+		}
+
+		return nil
+	}
+
+	return meta
+}
+
+// runPostGenerationCommand runs the configured post-generation command, if any,
+// with the path to a newly saved image.  When saving to object storage, the
+// command is given the object's URL instead.
+func (c *Context) runPostGenerationCommand(path string) {
+	if c.Config.PostGenerationCommand == "" {
+		return
+	}
+
+	cmd := exec.Command(c.Config.PostGenerationCommand, path)
+
+	err := cmd.Run()
+	if err != nil {
+		c.Logger.Error(
+			"post-generation command failed",
+			zap.String("command", fmt.Sprintf("%s %q", c.Config.PostGenerationCommand, path)))
+	}
+}
+
+// convertForSaving converts an image returned in format to saveAs, e.g. so that
+// a lossless PNG from the API can be saved as a smaller JPEG.  It returns the
+// image and the format to save it in.  An empty saveAs keeps the image as is.
+func convertForSaving(data []byte, format string, saveAs string) ([]byte, string, error) {
+	if saveAs == "" || saveAs == format {
+		return data, format, nil
+	}
+
+	converted, err := backend.ConvertImage(data, saveAs)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to convert image from %s to %s: %w", format, saveAs, err)
+	}
+
+	return converted, saveAs, nil
+}
+
+// detectAspectRatio returns the aspect ratio in ratios nearest to an initial
+// image's, so that image-to-image results aren't stretched.  The image is
+// rewound afterwards so it can be sent.
+func detectAspectRatio(img io.ReadSeeker, path string, ratios []string) (string, error) {
+	config, _, err := image.DecodeConfig(img)
+	if err != nil {
+		return "", fmt.Errorf("failed to read size of image %q: %w", path, err)
+	}
+
+	_, err = img.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewind image %q: %w", path, err)
+	}
+
+	return backend.NearestAspectRatio(config.Width, config.Height, ratios)
+}
+
+// requireOutputFormat returns an error if the configured backend can't return
+// images in format.
+func (c *Context) requireOutputFormat(format string) error {
+	formats := c.Backend.Capabilities().OutputFormats
+	if len(formats) > 0 && !slices.Contains(formats, format) {
+		return invalid(fmt.Errorf("backend %q does not support output format %q, supported formats are %s",
+			c.Backend.Name(), format, strings.Join(formats, ", ")))
+	}
+
+	return nil
+}
+
+// requireAspectRatio returns an error if the configured backend can't generate
+// images with the aspect ratio.
+func (c *Context) requireAspectRatio(ratio string) error {
+	ratios := c.Backend.Capabilities().AspectRatios
+	if len(ratios) > 0 && !slices.Contains(ratios, ratio) {
+		return invalid(fmt.Errorf("backend %q does not support aspect ratio %q, supported ratios are %s",
+			c.Backend.Name(), ratio, strings.Join(ratios, ", ")))
+	}
+
+	return nil
+}
+
+// requirePromptLength returns an error if prompt is longer than the configured
+// backend accepts.
+func (c *Context) requirePromptLength(prompt string) error {
+	maxLength := c.Backend.Capabilities().MaxPromptLength
+	if maxLength > 0 && len(prompt) > maxLength {
+		return invalid(fmt.Errorf("prompt of length %d is too long for backend %q, it must be %d characters or less",
+			len(prompt), c.Backend.Name(), maxLength))
+	}
+
+	return nil
+}
+
+// requireSamples returns an error if the configured backend can't generate
+// samples images with one request.
+func (c *Context) requireSamples(samples int) error {
+	if samples <= 1 {
+		return nil
+	}
+
+	maxSamples := c.Backend.Capabilities().MaxSamples
+
+	if _, ok := c.Backend.(backend.MultiSampler); !ok || maxSamples <= 1 {
+		return invalid(fmt.Errorf("backend %q can only generate one image per request, use --count instead of --samples", c.Backend.Name()))
+	} else if samples > maxSamples {
+		return invalid(fmt.Errorf("backend %q can generate at most %d images per request", c.Backend.Name(), maxSamples))
+	}
+
+	return nil
+}
+
+// requireModel returns an error if the configured backend doesn't have the
+// model, suggesting the models it may have been a typo of.
+func (c *Context) requireModel(model string) error {
+	models := c.Backend.Capabilities().Models
+	if len(models) == 0 || slices.Contains(models, model) {
+		return nil
+	}
+
+	if suggestions := suggest(model, models); len(suggestions) > 0 {
+		return invalid(fmt.Errorf("backend %q has no model %q, did you mean %s?",
+			c.Backend.Name(), model, strings.Join(suggestions, " or ")))
+	}
+
+	return invalid(fmt.Errorf("backend %q has no model %q, its models are %s",
+		c.Backend.Name(), model, strings.Join(models, ", ")))
+}
+
+// requireUpscaleMode returns an error if the configured backend can't upscale,
+// or doesn't have the upscaler mode.
+func (c *Context) requireUpscaleMode(mode string) error {
+	err := c.requireOperation(backend.OperationUpscale)
+	if err != nil {
+		return err
+	}
+
+	modes := c.Backend.Capabilities().UpscaleModes
+	if len(modes) > 0 && !slices.Contains(modes, mode) {
+		return invalid(fmt.Errorf("backend %q does not support the %s upscaler, supported upscalers are %s",
+			c.Backend.Name(), mode, strings.Join(modes, ", ")))
+	}
+
+	return nil
+}
+
+// requireEditOperation returns an error if the configured backend can't edit
+// images, or doesn't support the edit operation op.
+func (c *Context) requireEditOperation(op string) error {
+	err := c.requireOperation(backend.OperationEdit)
+	if err != nil {
+		return err
+	}
+
+	ops := c.Backend.Capabilities().EditOperations
+	if len(ops) > 0 && !slices.Contains(ops, op) {
+		return invalid(fmt.Errorf("backend %q does not support the %s edit, supported edits are %s",
+			c.Backend.Name(), op, strings.Join(ops, ", ")))
+	}
+
+	return nil
+}
+
+// finishReasonFiltered is the finish reason of images that the backend blurred
+// because of content moderation.
+const finishReasonFiltered = "CONTENT_FILTERED"
+
+// filteredError returns an error wrapping backend.ErrContentFiltered if any of the
+// results were filtered, so that sdcli exits with a distinct code.  The images
+// are still saved, since they were paid for.
+func filteredError(results ...*generationResult) error {
+	filtered := 0
+
+	for _, v := range results {
+		if v.FinishReason == finishReasonFiltered {
+			filtered++
+		}
+	}
+
+	if filtered == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d of %d images were filtered", backend.ErrContentFiltered, filtered, len(results))
+}
+
+// requireOperation returns an error if the configured backend doesn't support op.
+func (c *Context) requireOperation(op backend.Operation) error {
+	if !c.Backend.Capabilities().Supports(op) {
+		return backend.Unsupported(c.Backend, op)
+	}
+
+	return nil
+}
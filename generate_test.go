@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/mock"
+	"github.com/SethCurry/sdcli/pkg/stability"
+	"go.uber.org/zap"
+)
+
+func TestRequireCapabilities(t *testing.T) {
+	mockCtx := &Context{Backend: mock.NewClient()}
+	stabilityCtx := &Context{Backend: stability.NewClient("key")}
+
+	tests := []struct {
+		name    string
+		ctx     *Context
+		require func(*Context) error
+		valid   bool
+	}{
+		{"supported ratio", mockCtx, func(c *Context) error { return c.requireAspectRatio("16:9") }, true},
+		{"unsupported ratio", mockCtx, func(c *Context) error { return c.requireAspectRatio("7:3") }, false},
+		{"ratio with spaces", mockCtx, func(c *Context) error { return c.requireAspectRatio(" 1:1") }, false},
+		{"supported format", mockCtx, func(c *Context) error { return c.requireOutputFormat("jpeg") }, true},
+		{"format the backend lacks", mockCtx, func(c *Context) error { return c.requireOutputFormat("webp") }, false},
+		{"format from the endpoint table", stabilityCtx, func(c *Context) error { return c.requireOutputFormat("webp") }, true},
+		{"ratio from the endpoint table", stabilityCtx, func(c *Context) error { return c.requireAspectRatio("21:9") }, true},
+		{"unknown format", stabilityCtx, func(c *Context) error { return c.requireOutputFormat("gif") }, false},
+		{"supported upscaler", mockCtx, func(c *Context) error { return c.requireUpscaleMode("fast") }, true},
+		{"upscaler the backend lacks", mockCtx, func(c *Context) error { return c.requireUpscaleMode("conservative") }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.require(tt.ctx)
+
+			if tt.valid && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !tt.valid && (err == nil || exitCode(err) != exitInvalid) {
+				t.Errorf("expected an invalid argument error, got %v", err)
+			}
+		})
+	}
+}
+
+// brokenSampleBackend is the mock backend, except that the sample at index
+// broken isn't an image.
+type brokenSampleBackend struct {
+	*mock.Client
+	broken int
+}
+
+func (b brokenSampleBackend) GenerateSamples(ctx context.Context, req backend.GenerateRequest) ([]*backend.Result, error) {
+	results, err := b.Client.GenerateSamples(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	results[b.broken].Image = []byte("<html>Bad gateway</html>")
+
+	return results, nil
+}
+
+func TestGenerateKeepsSavedSamples(t *testing.T) {
+	dir := t.TempDir()
+
+	ctx := &Context{
+		Logger:  zap.NewNop(),
+		Backend: brokenSampleBackend{Client: mock.NewClient(), broken: 2},
+		Output:  localOutput{dir: dir},
+	}
+
+	result, err := ctx.generateOnce(context.Background(), generation{
+		Prompt:       "A bear riding a unicycle",
+		OutputFormat: "png",
+		Samples:      4,
+	})
+	if err == nil {
+		t.Fatal("expected saving the broken sample to fail")
+	}
+
+	if result == nil {
+		t.Fatal("expected the samples saved before the broken one to be returned")
+	}
+
+	saved := result.withSamples()
+	if len(saved) != 2 {
+		t.Fatalf("expected 2 saved samples, got %d", len(saved))
+	}
+
+	for i, v := range saved {
+		if _, err := os.Stat(v.Path); err != nil {
+			t.Errorf("expected sample %d to be saved at %s: %v", i, v.Path, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != len(saved) {
+		t.Errorf("expected only the saved samples in the output directory, got %d files", len(entries))
+	}
+}
@@ -3,21 +3,26 @@ module github.com/SethCurry/sdcli
 go 1.22.2
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/alecthomas/kong v0.9.0
 	github.com/dsoprea/go-exif/v3 v3.0.0-20210428042052-dca55bf8ca15
-	github.com/dsoprea/go-jpeg-image-structure/v2 v2.0.0-20221012074422-4f3f7e934102
 	github.com/dsoprea/go-png-image-structure/v2 v2.0.0-20210512210324-29b889a6093d
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/zalando/go-keyring v0.2.5
 	go.uber.org/zap v1.27.0
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.21.0
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/dsoprea/go-iptc v0.0.0-20200609062250-162ae6b44feb // indirect
+	github.com/alessio/shellescape v1.4.1 // indirect
+	github.com/danieljoos/wincred v1.2.0 // indirect
 	github.com/dsoprea/go-logging v0.0.0-20200710184922-b02d349568dd // indirect
-	github.com/dsoprea/go-photoshop-info-format v0.0.0-20200609050348-3db9b63b202c // indirect
 	github.com/dsoprea/go-utility/v2 v2.0.0-20200717064901-2fccff4aa15e // indirect
 	github.com/go-errors/errors v1.1.1 // indirect
-	github.com/go-xmlfmt/xmlfmt v0.0.0-20191208150333-d5b6f63a941b // indirect
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/golang/geo v0.0.0-20200319012246-673a6f80352d // indirect
 	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381 // indirect
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/contactsheet"
+)
+
+// saveContactSheet composes the results' images into a grid labeled with their
+// seeds and parameters, and saves it next to them.  It returns the path or URL
+// the grid was saved to.
+func (c *Context) saveContactSheet(ctx context.Context, results []*generationResult) (string, error) {
+	cells := make([]contactsheet.Cell, 0, len(results))
+
+	for i, v := range results {
+		img, _, err := image.Decode(bytes.NewReader(v.Image))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode %q: %w", v.Path, err)
+		}
+
+		cells = append(cells, contactsheet.Cell{
+			Image: img,
+			Label: []string{
+				fmt.Sprintf("#%d seed %d", i+1, v.Seed),
+				strings.TrimSpace(v.Model + " " + v.AspectRatio),
+				outputBaseName(v.Path),
+			},
+		})
+	}
+
+	sheet, err := contactsheet.Compose(cells)
+	if err != nil {
+		return "", fmt.Errorf("failed to compose contact sheet: %w", err)
+	}
+
+	data, err := backend.EncodeImage(sheet, "png")
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	name := strconv.FormatInt(now.Unix(), 10) + "-grid.png"
+
+	if c.Config.OutputLayout != "" {
+		name = path.Join(now.Format(c.Config.OutputLayout), name)
+	}
+
+	return c.Output.Write(ctx, name, data)
+}
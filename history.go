@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/history"
+	"github.com/SethCurry/sdcli/internal/objectstore"
+	"github.com/SethCurry/sdcli/pkg/imagemeta"
+	"go.uber.org/zap"
+)
+
+type HistoryCommand struct {
+	List   HistoryListCommand   `cmd:"" help:"List previously generated images."`
+	Import HistoryImportCommand `cmd:"" help:"Add existing images in a directory to the history."`
+}
+
+type HistoryListCommand struct {
+	Limit     int    `optional:"limit" default:"20" help:"The number of images to list, newest first.  0 lists every image."`
+	Search    string `optional:"search" help:"Only list images whose prompt contains this text."`
+	Tag       string `optional:"tag" help:"Only list images with this tag."`
+	Favorites bool   `optional:"favorites" help:"Only list favorite images."`
+}
+
+// matches reports whether an entry passes the list's filters.
+func (h HistoryListCommand) matches(entry history.Entry) bool {
+	if h.Search != "" && !strings.Contains(strings.ToLower(entry.Prompt), strings.ToLower(h.Search)) {
+		return false
+	}
+
+	if h.Tag != "" && !entry.HasTag(h.Tag) {
+		return false
+	}
+
+	if h.Favorites && !entry.Favorite {
+		return false
+	}
+
+	return true
+}
+
+func (h HistoryListCommand) Run(ctx *Context) error {
+	entries, err := ctx.History.List()
+	if err != nil {
+		ctx.Logger.Fatal("failed to read history", zap.Error(err))
+	}
+
+	// Imported images can be older than ones already in the history, so sort
+	// by when they were made rather than when they were added.
+	sort.SliceStable(entries, func(i int, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tCREATED\tBACKEND\tMODEL\tPROMPT\tTAGS\tPATH")
+
+	listed := 0
+
+	for _, entry := range entries {
+		if h.Limit > 0 && listed >= h.Limit {
+			break
+		}
+
+		if !h.matches(entry) {
+			continue
+		}
+
+		id := strconv.FormatInt(entry.ID, 10)
+		if entry.Favorite {
+			id += "*"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			id,
+			entry.CreatedAt.Local().Format("2006-01-02 15:04"),
+			entry.Backend,
+			entry.Model,
+			truncate(singleLinePrompt(entry.Prompt), 60),
+			strings.Join(entry.Tags, ","),
+			entry.Path)
+
+		listed++
+	}
+
+	return writer.Flush()
+}
+
+// singleLinePrompt collapses the lines of a prompt so it fits in a table.
+func singleLinePrompt(prompt string) string {
+	return strings.Join(strings.Fields(prompt), " ")
+}
+
+// truncate shortens s to at most length runes, ending it with "..." if it was
+// shortened.
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+
+	return string(runes[:length-3]) + "..."
+}
+
+type HistoryImportCommand struct {
+	Directory string `arg:"" type:"existingdir" help:"The directory to scan for images."`
+}
+
+// importableExtensions are the extensions of images that history import reads.
+var importableExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".webp": true,
+}
+
+func (h HistoryImportCommand) Run(ctx *Context) error {
+	existing, err := ctx.History.List()
+	if err != nil {
+		ctx.Logger.Fatal("failed to read history", zap.Error(err))
+	}
+
+	known := make(map[string]bool, len(existing))
+	for _, v := range existing {
+		known[v.Path] = true
+	}
+
+	var (
+		entries []history.Entry
+		skipped int
+	)
+
+	err = filepath.WalkDir(h.Directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !importableExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %q: %w", path, err)
+		}
+
+		if known[absPath] {
+			return nil
+		}
+
+		entry, err := importImage(absPath)
+		if err != nil {
+			if !errors.Is(err, imagemeta.ErrNoMetadata) {
+				ctx.Logger.Warn("failed to read image metadata", zap.String("path", absPath), zap.Error(err))
+			}
+
+			skipped++
+
+			return nil
+		}
+
+		entries = append(entries, *entry)
+
+		return nil
+	})
+	if err != nil {
+		ctx.Logger.Fatal("failed to scan directory", zap.String("directory", h.Directory), zap.Error(err))
+	}
+
+	if len(entries) > 0 {
+		_, err = ctx.History.Add(entries...)
+		if err != nil {
+			ctx.Logger.Fatal("failed to add images to history", zap.Error(err))
+		}
+	}
+
+	ctx.Logger.Info(
+		"imported images",
+		zap.Int("imported", len(entries)),
+		zap.Int("skipped", skipped),
+		zap.String("directory", h.Directory))
+
+	return nil
+}
+
+// importImage reads the metadata of an image made by sdcli or another tool into a
+// history entry.
+func importImage(path string) (*history.Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := imagemeta.ReadAny(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Prompt == "" {
+		return nil, imagemeta.ErrNoMetadata
+	}
+
+	createdAt := meta.CreatedAt
+	if createdAt.IsZero() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		createdAt = info.ModTime()
+	}
+
+	return &history.Entry{
+		CreatedAt:      createdAt,
+		Path:           path,
+		Prompt:         meta.Prompt,
+		NegativePrompt: meta.Params.NegativePrompt,
+		OriginalPrompt: meta.Params.OriginalPrompt,
+		Backend:        meta.Params.Backend,
+		Model:          meta.Params.Model,
+		Seed:           meta.Params.Seed,
+		AspectRatio:    meta.Params.AspectRatio,
+		WatermarkID:    meta.Extra["Watermark"],
+		Seasoning:      meta.Params.Seasoning,
+		Imported:       true,
+		Extra:          meta.Extra,
+	}, nil
+}
+
+// recordHistory adds a saved result to the history.  Failures are logged rather
+// than returned, since the image has already been saved.
+func (c *Context) recordHistory(result *generationResult) {
+	if c.History == nil {
+		return
+	}
+
+	_, err := c.History.Add(history.Entry{
+		CreatedAt:       result.CreatedAt,
+		Path:            result.Path,
+		Operation:       result.Operation,
+		Prompt:          result.Prompt,
+		NegativePrompt:  result.NegativePrompt,
+		OriginalPrompt:  result.OriginalPrompt,
+		Backend:         result.Backend,
+		Model:           result.Model,
+		Seed:            result.Seed,
+		AspectRatio:     result.AspectRatio,
+		Credits:         result.Credits,
+		CreditsReported: result.CreditsReported,
+		WatermarkID:     result.WatermarkID,
+		Seasoning:       result.Seasoning,
+		FilteredPrompts: result.FilteredPrompts,
+		Hash:            result.Hash,
+		DuplicateOf:     result.DuplicateOf,
+	})
+	if err != nil {
+		c.Logger.Error("failed to record image in history", zap.String("path", result.Path), zap.Error(err))
+	}
+}
+
+// saveDuplicate checks the history for a saved image identical to the result's.
+// If there is one, the result is recorded as a duplicate of it instead of being
+// saved again, and saveDuplicate returns true.
+func (c *Context) saveDuplicate(result *generationResult) (bool, error) {
+	if c.History == nil {
+		return false, nil
+	}
+
+	entries, err := c.History.List()
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range entries {
+		if v.Hash != result.Hash || v.DuplicateOf != 0 || objectstore.IsURL(v.Path) {
+			continue
+		}
+
+		// The original may have been deleted or moved since it was saved.
+		data, err := os.ReadFile(v.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("failed to read %q: %w", v.Path, err)
+		}
+
+		c.Logger.Info(
+			"image is identical to one already saved, not saving it again",
+			zap.Int64("id", v.ID),
+			zap.String("path", v.Path))
+
+		result.Path = v.Path
+		result.Image = data
+		result.CreatedAt = time.Now()
+		result.WatermarkID = v.WatermarkID
+		result.DuplicateOf = v.ID
+
+		c.recordHistory(result)
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+type TagCommand struct {
+	Remove bool     `optional:"remove" help:"Remove the tags instead of adding them."`
+	Image  string   `arg:"" help:"The history ID or path of the image to tag."`
+	Tags   []string `arg:"" help:"The tags to add."`
+}
+
+func (t TagCommand) Run(ctx *Context) error {
+	id, err := ctx.resolveHistoryID(t.Image)
+	if err != nil {
+		ctx.Logger.Fatal("failed to find image", zap.String("image", t.Image), zap.Error(err))
+	}
+
+	entry, err := ctx.History.Update(id, func(entry *history.Entry) {
+		for _, tag := range t.Tags {
+			if t.Remove {
+				entry.Tags = slices.DeleteFunc(entry.Tags, func(v string) bool {
+					return strings.EqualFold(v, tag)
+				})
+			} else if !entry.HasTag(tag) {
+				entry.Tags = append(entry.Tags, tag)
+			}
+		}
+	})
+	if err != nil {
+		ctx.Logger.Fatal("failed to tag image", zap.Error(err))
+	}
+
+	ctx.Logger.Info("updated tags", zap.Int64("id", entry.ID), zap.Strings("tags", entry.Tags))
+
+	return nil
+}
+
+type FavCommand struct {
+	Remove bool   `optional:"remove" help:"Unmark the image as a favorite."`
+	Image  string `arg:"" help:"The history ID or path of the image."`
+}
+
+func (f FavCommand) Run(ctx *Context) error {
+	id, err := ctx.resolveHistoryID(f.Image)
+	if err != nil {
+		ctx.Logger.Fatal("failed to find image", zap.String("image", f.Image), zap.Error(err))
+	}
+
+	entry, err := ctx.History.Update(id, func(entry *history.Entry) {
+		entry.Favorite = !f.Remove
+	})
+	if err != nil {
+		ctx.Logger.Fatal("failed to update image", zap.Error(err))
+	}
+
+	ctx.Logger.Info("updated favorite", zap.Int64("id", entry.ID), zap.Bool("favorite", entry.Favorite))
+
+	return nil
+}
+
+// resolveHistoryID returns the history ID of an image, given either its ID or
+// its path.
+func (c *Context) resolveHistoryID(image string) (int64, error) {
+	if id, err := strconv.ParseInt(image, 10, 64); err == nil {
+		return id, nil
+	}
+
+	absPath, err := filepath.Abs(image)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %q: %w", image, err)
+	}
+
+	entries, err := c.History.List()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, v := range entries {
+		if v.Path == image || v.Path == absPath {
+			return v.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", history.ErrNotFound, image)
+}
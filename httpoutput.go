@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/units"
+)
+
+// defaultUploadTimeout is how long an upload may take when http_output.timeout
+// isn't set.
+const defaultUploadTimeout = 5 * time.Minute
+
+type HTTPOutputConfig struct {
+	// The URL to upload every image, sidecar, and contact sheet to, e.g.
+	// "https://assets.example.com/upload/{name}".  {name} is replaced with the
+	// file's name relative to the output directory, e.g.
+	// "2024/06/19/1718822400.png".  The name is also sent in the
+	// X-Sdcli-Filename header.
+	URL string `json:"url"`
+
+	// The method to upload with, "PUT" or "POST".  Defaults to "PUT".
+	Method string `json:"method"`
+
+	// Extra headers to send with every upload, e.g. for authentication.
+	Headers map[string]string `json:"headers"`
+
+	// Whether to also save files to the output directory.  By default they are
+	// only uploaded.
+	KeepLocal bool `json:"keep_local"`
+
+	// How long an upload may take before it is abandoned, e.g. "30s".  Defaults
+	// to 5 minutes.
+	Timeout units.Duration `json:"timeout"`
+}
+
+// HTTPFilenameHeader is the header that carries the name of an uploaded file.
+const HTTPFilenameHeader = "X-Sdcli-Filename"
+
+// method returns the configured upload method, or PUT if none is configured.
+func (c HTTPOutputConfig) method() string {
+	if c.Method == "" {
+		return http.MethodPut
+	}
+
+	return strings.ToUpper(c.Method)
+}
+
+// timeout returns the configured upload timeout, or defaultUploadTimeout if none
+// is configured.
+func (c HTTPOutputConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultUploadTimeout
+	}
+
+	return time.Duration(c.Timeout)
+}
+
+// uploadOnly reports whether files are only uploaded, and not saved to the
+// output directory.
+func (c HTTPOutputConfig) uploadOnly() bool {
+	return c.URL != "" && !c.KeepLocal
+}
+
+// validate checks that the URL and method can be uploaded with.
+func (c HTTPOutputConfig) validate() error {
+	parsed, err := url.Parse(strings.ReplaceAll(c.URL, "{name}", "name"))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an http or https URL, got %q", c.URL)
+	}
+
+	if method := c.method(); method != http.MethodPut && method != http.MethodPost {
+		return fmt.Errorf("method must be PUT or POST, got %q", c.Method)
+	}
+
+	return nil
+}
+
+// httpOutput uploads files to a URL with a PUT or POST request, e.g. to hand
+// images straight to an asset server.
+type httpOutput struct {
+	config HTTPOutputConfig
+	client *http.Client
+}
+
+// Write uploads data as name, returning the URL it was uploaded to.  If the
+// server responds with a Location header, that is returned instead.
+func (h httpOutput) Write(ctx context.Context, name string, data []byte) (string, error) {
+	segments := strings.Split(name, "/")
+	for i, v := range segments {
+		segments[i] = url.PathEscape(v)
+	}
+
+	target := strings.ReplaceAll(h.config.URL, "{name}", strings.Join(segments, "/"))
+
+	ctx, cancel := context.WithTimeout(ctx, h.config.timeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, h.config.method(), target, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload request: %w", err)
+	}
+
+	for k, v := range h.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HTTPFilenameHeader, name)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %q: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("upload of %q returned unexpected status code %d. Response: %s", name, resp.StatusCode, string(respBody))
+	}
+
+	location, err := resp.Location()
+	if errors.Is(err, http.ErrNoLocation) {
+		return target, nil
+	} else if err != nil {
+		return "", fmt.Errorf("upload of %q returned an invalid Location: %w", name, err)
+	}
+
+	return location.String(), nil
+}
+
+// mirroredOutput saves files to the output directory and uploads them over HTTP
+// as well.
+type mirroredOutput struct {
+	primary outputDestination
+	upload  httpOutput
+}
+
+// Write saves data as name, then uploads it under the name it was saved as,
+// which may have a suffix added to avoid overwriting an existing file.  It
+// returns where the file was saved.
+func (m mirroredOutput) Write(ctx context.Context, name string, data []byte) (string, error) {
+	saved, err := m.primary.Write(ctx, name, data)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = m.upload.Write(ctx, savedName(name, saved), data)
+	if err != nil {
+		return "", fmt.Errorf("saved %s, but failed to upload it: %w", saved, err)
+	}
+
+	return saved, nil
+}
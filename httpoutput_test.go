@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/units"
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+func TestHTTPOutputTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read.
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	upload := httpOutput{
+		config: HTTPOutputConfig{
+			URL:     server.URL + "/{name}",
+			Timeout: units.Duration(50 * time.Millisecond),
+		},
+		client: backend.NewHTTPClient(),
+	}
+
+	_, err := upload.Write(context.Background(), "image.png", []byte("image"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the upload to time out, got %v", err)
+	}
+}
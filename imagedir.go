@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/SethCurry/sdcli/internal/balance"
+	"github.com/SethCurry/sdcli/internal/budget"
+	"github.com/SethCurry/sdcli/internal/policy"
+	"go.uber.org/zap"
+)
+
+// imageExtensions are the extensions of the files --image-dir picks up.
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".webp", ".tif", ".tiff", ".bmp", ".heic", ".heif"}
+
+// findImages returns the paths of the images in dir and its subdirectories,
+// relative to dir, in lexical order.  Hidden files and directories are skipped.
+func findImages(dir string) ([]string, error) {
+	var images []string
+
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p != dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if entry.IsDir() || !slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(p))) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		images = append(images, rel)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images in %q: %w", dir, err)
+	}
+
+	return images, nil
+}
+
+// mirroredName returns the name to save the result for an image under, so that
+// the output directory mirrors the image directory, e.g. "shoot/day1/img01" for
+// "shoot/day1/img01.jpg".
+func mirroredName(rel string) string {
+	return path.Clean(filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel))))
+}
+
+// stopsBatch reports whether an error would fail every other request in a batch
+// too, so there is no point carrying on.
+func stopsBatch(err error) bool {
+	return errors.Is(err, budget.ErrBudgetExceeded) || errors.Is(err, balance.ErrTooLow) || errors.Is(err, policy.ErrBlocked)
+}
+
+// forEachImage calls fn for every image in dir, with the image's path and the
+// name to save its results under.  A failure doesn't stop the other images from
+// being processed, but is logged and included in the returned error.  If sdcli
+// is interrupted, it stops and returns the context's error.
+func (c *Context) forEachImage(dir string, fn func(imagePath string, outputName string) ([]*generationResult, error)) ([]*generationResult, error) {
+	images, err := findImages(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return nil, invalid(fmt.Errorf("no images found in %q", dir))
+	}
+
+	var (
+		results []*generationResult
+		failed  []error
+	)
+
+	for i, v := range images {
+		if c.Ctx.Err() != nil {
+			break
+		}
+
+		imageResults, err := fn(filepath.Join(dir, v), mirroredName(v))
+		results = append(results, imageResults...)
+
+		if err != nil && c.Ctx.Err() != nil {
+			break
+		} else if err != nil {
+			c.Logger.Error("failed to process image", zap.String("image", v), zap.Error(err))
+
+			failed = append(failed, fmt.Errorf("%s: %w", v, err))
+
+			if stopsBatch(err) {
+				break
+			}
+
+			continue
+		}
+
+		c.Logger.Info("processed image", zap.String("image", v), zap.Int("number", i+1), zap.Int("of", len(images)))
+	}
+
+	if err := c.Ctx.Err(); err != nil {
+		c.Logger.Warn("stopped early", zap.Int("processed", len(results)), zap.Int("images", len(images)))
+
+		return results, err
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("%d of %d images failed: %w", len(failed), len(images), errors.Join(failed...))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/imagemeta"
+)
+
+// heicConverter is a command that converts a HEIC image to JPEG.
+type heicConverter struct {
+	Name string
+	Args func(in string, out string) []string
+}
+
+// heicConverters are the commands tried, in order, to convert HEIC images, since
+// there's no decoder for them in Go.
+var heicConverters = []heicConverter{
+	// From libheif, e.g. the libheif-examples package on Debian.
+	{Name: "heif-convert", Args: func(in string, out string) []string { return []string{"-q", "95", in, out} }},
+	{Name: "magick", Args: func(in string, out string) []string { return []string{in, out} }},
+	// Built into macOS.
+	{Name: "sips", Args: func(in string, out string) []string { return []string{"-s", "format", "jpeg", in, "--out", out} }},
+}
+
+// errNoHEICConverter is returned when a HEIC image is given, but none of
+// heicConverters are installed.
+var errNoHEICConverter = errors.New(
+	"converting HEIC images requires heif-convert (from libheif), ImageMagick, or sips to be installed")
+
+// initImageSniffLength is how much of an initial image is read to detect its
+// format.
+const initImageSniffLength = 16
+
+// openInitImage opens an initial image to send to the backend.  Images are read
+// into memory to be converted to a format the APIs accept, e.g. HEIC photos from
+// phones, and to have their metadata stripped.  With keep_input_metadata, images
+// the APIs accept are streamed from the file instead, and with low_memory, JPEG
+// and PNG images are stripped into a temporary file.  The returned closer must
+// be called once the image has been sent.
+func (c *Context) openInitImage(ctx context.Context, path string) (io.ReadSeeker, io.Closer, error) {
+	if c.Config.LowMemory && !c.Config.KeepInputMetadata {
+		spool, err := spoolStrippedImage(path)
+		if err == nil {
+			return spool, spool, nil
+		} else if !errors.Is(err, imagemeta.ErrUnsupportedStrip) {
+			return nil, nil, err
+		}
+
+		// Other formats may need converting, which is done in memory.
+	}
+
+	if !c.Config.KeepInputMetadata {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read image %q: %w", path, err)
+		}
+
+		data, err = c.prepareUpload(ctx, path, data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reader := bytes.NewReader(data)
+
+		return reader, io.NopCloser(reader), nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open image %q: %w", path, err)
+	}
+
+	header := make([]byte, initImageSniffLength)
+
+	n, err := io.ReadFull(fd, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		fd.Close()
+		return nil, nil, fmt.Errorf("failed to read image %q: %w", path, err)
+	}
+
+	if slices.Contains(backend.UploadFormats, backend.DetectFormat(header[:n])) {
+		_, err = fd.Seek(0, io.SeekStart)
+		if err != nil {
+			fd.Close()
+			return nil, nil, fmt.Errorf("failed to rewind image %q: %w", path, err)
+		}
+
+		return fd, fd, nil
+	}
+
+	fd.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read image %q: %w", path, err)
+	}
+
+	data, err = normalizeInitImage(ctx, path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader := bytes.NewReader(data)
+
+	return reader, io.NopCloser(reader), nil
+}
+
+// tempFile is a temporary file that is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (t tempFile) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+
+	return err
+}
+
+// spoolStrippedImage copies the JPEG or PNG image at path to a temporary file
+// with its metadata stripped, without reading the whole image into memory.  It
+// returns imagemeta.ErrUnsupportedStrip for images in other formats.
+func spoolStrippedImage(path string) (*tempFile, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %q: %w", path, err)
+	}
+	defer fd.Close()
+
+	spool, err := os.CreateTemp("", "sdcli-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file for %q: %w", path, err)
+	}
+
+	stripped := &tempFile{spool}
+
+	err = imagemeta.StripTo(spool, fd)
+	if errors.Is(err, imagemeta.ErrUnsupportedStrip) {
+		stripped.Close()
+		return nil, err
+	} else if err != nil {
+		stripped.Close()
+		return nil, fmt.Errorf("failed to strip metadata from %q, use --keep-input-metadata to send it as is: %w", path, err)
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		stripped.Close()
+		return nil, fmt.Errorf("failed to rewind image %q: %w", path, err)
+	}
+
+	return stripped, nil
+}
+
+// prepareUpload converts an image read from path to a format the APIs accept,
+// and strips its metadata unless keep_input_metadata is set, so that e.g. the
+// GPS position of a photo isn't sent to the API.
+func (c *Context) prepareUpload(ctx context.Context, path string, data []byte) ([]byte, error) {
+	data, err := normalizeInitImage(ctx, path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Config.KeepInputMetadata {
+		return data, nil
+	}
+
+	stripped, err := imagemeta.Strip(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to strip metadata from %q, use --keep-input-metadata to send it as is: %w", path, err)
+	}
+
+	return stripped, nil
+}
+
+// normalizeInitImage converts an initial image read from path to a format the
+// APIs accept, if it isn't in one already.  TIFF and BMP images are converted to
+// PNG, and HEIC images to JPEG with one of heicConverters.
+func normalizeInitImage(ctx context.Context, path string, data []byte) ([]byte, error) {
+	if backend.DetectFormat(data) != "heic" {
+		normalized, err := backend.NormalizeImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use %q as an image: %w", path, err)
+		}
+
+		return normalized, nil
+	}
+
+	return convertHEIC(ctx, path)
+}
+
+// convertHEIC converts the HEIC image at path to JPEG with the first of
+// heicConverters that is installed.
+func convertHEIC(ctx context.Context, path string) ([]byte, error) {
+	for _, v := range heicConverters {
+		command, err := exec.LookPath(v.Name)
+		if err != nil {
+			continue
+		}
+
+		dir, err := os.MkdirTemp("", "sdcli-heic-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+
+		out := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+".jpg")
+
+		cmd := exec.CommandContext(ctx, command, v.Args(path, out)...)
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert HEIC image %q with %s: %w: %s",
+				path, v.Name, err, bytes.TrimSpace(output))
+		}
+
+		data, err := os.ReadFile(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read converted image: %w", err)
+		}
+
+		return data, nil
+	}
+
+	return nil, invalid(errNoHEICConverter)
+}
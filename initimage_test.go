@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SethCurry/sdcli/internal/testutil"
+	"github.com/SethCurry/sdcli/pkg/imagemeta"
+)
+
+func TestSpoolStrippedImage(t *testing.T) {
+	withMeta, err := imagemeta.AddToJPEG(testutil.JPEG(16, 16), imagemeta.Metadata{Prompt: "A bear"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+
+	err = os.WriteFile(path, withMeta, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := spoolStrippedImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := imagemeta.Strip(withMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Error("expected the spooled image to be stripped like Strip does")
+	}
+
+	err = spool.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(spool.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the temporary file to be removed on close, got %v", err)
+	}
+}
+
+func TestSpoolStrippedImageUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "photo.webp")
+
+	err := os.WriteFile(path, []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = spoolStrippedImage(path)
+	if !errors.Is(err, imagemeta.ErrUnsupportedStrip) {
+		t.Errorf("expected ErrUnsupportedStrip, got %v", err)
+	}
+}
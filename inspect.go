@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/imagemeta"
+	"go.uber.org/zap"
+)
+
+type InspectCommand struct {
+	Images []string `arg:"" type:"existingfile" help:"The images to inspect."`
+}
+
+func (i InspectCommand) Run(ctx *Context) error {
+	var failed []error
+
+	for n, v := range i.Images {
+		if n > 0 {
+			fmt.Println()
+		}
+
+		err := inspectImage(ctx, os.Stdout, v)
+		if err != nil {
+			ctx.Logger.Error("failed to inspect image", zap.String("path", v), zap.Error(err))
+			failed = append(failed, fmt.Errorf("%s: %w", v, err))
+		}
+	}
+
+	// The errors are attached so that sdcli exits with the code for them, e.g.
+	// exitIO if an image couldn't be read.
+	if len(failed) > 0 {
+		ctx.Logger.Fatal(
+			"failed to inspect some images",
+			zap.Error(errors.Join(failed...)),
+			zap.Int("failed", len(failed)),
+			zap.Int("images", len(i.Images)))
+	}
+
+	return nil
+}
+
+// inspectImage prints what sdcli knows about an image: its format, size, how it
+// fits the backend's aspect ratios and size limits, and any metadata sdcli
+// wrote to it.
+func inspectImage(ctx *Context, w io.Writer, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+
+	format := backend.DetectFormat(data)
+	if format == "" {
+		return errors.New("not an image in a known format")
+	}
+
+	// HEIC, TIFF, and BMP images are measured as they would be sent.
+	upload, err := normalizeInitImage(ctx.Ctx, path, data)
+	if err != nil {
+		return err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(upload))
+	if err != nil {
+		return fmt.Errorf("failed to read image size: %w", err)
+	}
+
+	caps := ctx.Backend.Capabilities()
+	name := ctx.Backend.Name()
+
+	fmt.Fprintln(w, path)
+
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	if slices.Contains(backend.UploadFormats, format) {
+		fmt.Fprintf(writer, "  format:\t%s\n", format)
+	} else {
+		fmt.Fprintf(writer, "  format:\t%s, converted to %s before it is sent\n", format, backend.DetectFormat(upload))
+	}
+
+	fmt.Fprintf(writer, "  dimensions:\t%dx%d\n", config.Width, config.Height)
+	fmt.Fprintf(writer, "  aspect ratio:\t%s\n", describeAspectRatio(config.Width, config.Height, caps.AspectRatios, name))
+	fmt.Fprintf(writer, "  file size:\t%s\n", formatFileSize(int64(len(data))))
+	fmt.Fprintf(writer, "  pixels:\t%s\n", describeInputSize(config.Width, config.Height, caps, name))
+
+	meta, err := imagemeta.Read(data)
+	if err != nil && !errors.Is(err, imagemeta.ErrNoMetadata) {
+		ctx.Logger.Warn("failed to read image metadata", zap.String("path", path), zap.Error(err))
+	}
+
+	if meta == nil {
+		fmt.Fprintf(writer, "  metadata:\tnone\n")
+	} else {
+		writeInspectedMetadata(writer, meta)
+	}
+
+	return writer.Flush()
+}
+
+// describeAspectRatio describes an image's aspect ratio and the nearest one the
+// backend supports, e.g. "3:2, matches stability's 3:2" or "4:3, nearest
+// stability ratio is 5:4, 6.7% off".
+func describeAspectRatio(width int, height int, ratios []string, backendName string) string {
+	divisor := gcd(width, height)
+	ratio := fmt.Sprintf("%d:%d", width/divisor, height/divisor)
+
+	nearest, err := backend.NearestAspectRatio(width, height, ratios)
+	if err != nil {
+		return ratio
+	}
+
+	// The ratios were checked by NearestAspectRatio.
+	nearestWidth, nearestHeight := backend.MustParseAspectRatio(nearest)
+
+	stretch := math.Abs(math.Log(float64(width)/float64(height)) - math.Log(float64(nearestWidth)/float64(nearestHeight)))
+	if stretch < 0.01 {
+		return fmt.Sprintf("%s, matches %s's %s", ratio, backendName, nearest)
+	}
+
+	return fmt.Sprintf("%s, nearest %s ratio is %s, %.1f%% off", ratio, backendName, nearest, (math.Exp(stretch)-1)*100)
+}
+
+// describeInputSize describes the number of pixels in an image against the
+// backend's limits on input images.
+func describeInputSize(width int, height int, caps backend.Capabilities, backendName string) string {
+	pixels := width * height
+	description := fmt.Sprintf("%d (%.1f MP)", pixels, float64(pixels)/1e6)
+
+	switch {
+	case caps.MinInputSide > 0 && min(width, height) < caps.MinInputSide:
+		return fmt.Sprintf("%s, too small for %s, whose images need sides of at least %d pixels",
+			description, backendName, caps.MinInputSide)
+	case caps.MaxInputPixels > 0 && pixels > caps.MaxInputPixels:
+		return fmt.Sprintf("%s, over %s's limit of %s", description, backendName, formatPixels(caps.MaxInputPixels))
+	case caps.MaxInputPixels > 0:
+		return fmt.Sprintf("%s, within %s's limit of %s", description, backendName, formatPixels(caps.MaxInputPixels))
+	}
+
+	return description
+}
+
+// writeInspectedMetadata writes the generation metadata embedded in an image.
+func writeInspectedMetadata(w io.Writer, meta *imagemeta.Metadata) {
+	seed := ""
+	if meta.Params.Seed != 0 {
+		seed = fmt.Sprint(meta.Params.Seed)
+	}
+
+	created := ""
+	if !meta.CreatedAt.IsZero() {
+		created = meta.CreatedAt.Local().Format("2006-01-02 15:04:05")
+	}
+
+	fields := [][2]string{
+		{"prompt", meta.Prompt},
+		{"original prompt", meta.Params.OriginalPrompt},
+		{"negative prompt", meta.Params.NegativePrompt},
+		{"backend", meta.Params.Backend},
+		{"model", meta.Params.Model},
+		{"seed", seed},
+		{"aspect ratio", meta.Params.AspectRatio},
+		{"seasoning", strings.Join(meta.Params.Seasoning, ", ")},
+		{"edits", strings.Join(meta.Params.Edits, ", ")},
+		{"keywords", strings.Join(meta.Keywords, ", ")},
+		{"artist", meta.Artist},
+		{"copyright", meta.Copyright},
+		{"software", meta.Software},
+		{"created", created},
+	}
+
+	for _, v := range fields {
+		if v[1] != "" {
+			fmt.Fprintf(w, "  %s:\t%s\n", v[0], v[1])
+		}
+	}
+}
+
+// formatFileSize formats a number of bytes with the largest unit it has at least
+// one of, e.g. "2.1 MB".
+func formatFileSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+
+	value := float64(size)
+	unit := 0
+
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
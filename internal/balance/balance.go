@@ -0,0 +1,155 @@
+package balance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/filelock"
+)
+
+// ErrTooLow is returned when the balance is below the minimum needed to start a
+// generation, or would drop below it if the generation went ahead.
+var ErrTooLow = errors.New("credit balance too low")
+
+// FetchFunc fetches the current balance of an account, in credits.
+type FetchFunc func(ctx context.Context) (float64, error)
+
+type state struct {
+	Credits   float64   `json:"credits"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Cache caches an account's balance, so it isn't fetched before every
+// generation.  The balance is persisted to a JSON file so that it is shared
+// between invocations, and the file is locked while it is used so that several
+// processes can share it safely.
+type Cache struct {
+	path   string
+	maxAge time.Duration
+	fetch  FetchFunc
+	mu     sync.Mutex
+}
+
+// NewCache creates a new Cache that stores the balance at path, and fetches it
+// again once it is older than maxAge.
+func NewCache(path string, maxAge time.Duration, fetch FetchFunc) *Cache {
+	return &Cache{
+		path:   path,
+		maxAge: maxAge,
+		fetch:  fetch,
+	}
+}
+
+// lock locks the cache against other goroutines and processes, returning a
+// function that unlocks it.
+func (c *Cache) lock() (func(), error) {
+	c.mu.Lock()
+
+	fileLock, err := filelock.Acquire(c.path + ".lock")
+	if err != nil {
+		c.mu.Unlock()
+
+		return nil, fmt.Errorf("failed to lock balance: %w", err)
+	}
+
+	return func() {
+		fileLock.Release()
+		c.mu.Unlock()
+	}, nil
+}
+
+func (c *Cache) load() (state, bool) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return state{}, false
+	}
+
+	var stored state
+
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return state{}, false
+	}
+
+	return stored, true
+}
+
+func (c *Cache) save(s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal balance: %w", err)
+	}
+
+	err = filelock.WriteFile(c.path, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write balance: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the cached balance, fetching it first if it is missing or stale.
+func (c *Cache) Get(ctx context.Context) (float64, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if s, ok := c.load(); ok && time.Since(s.FetchedAt) < c.maxAge {
+		return s.Credits, nil
+	}
+
+	return c.refresh(ctx)
+}
+
+// Refresh fetches the balance, even if the cached balance isn't stale, e.g. to
+// see whether the account has been topped up.
+func (c *Cache) Refresh(ctx context.Context) (float64, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	return c.refresh(ctx)
+}
+
+// refresh fetches the balance and caches it.  The cache must be locked.
+func (c *Cache) refresh(ctx context.Context) (float64, error) {
+	credits, err := c.fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.save(state{Credits: credits, FetchedAt: time.Now()})
+	if err != nil {
+		return credits, err
+	}
+
+	return credits, nil
+}
+
+// Spend deducts credits from the cached balance, so that it stays roughly
+// accurate until it is fetched again.
+func (c *Cache) Spend(credits float64) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, ok := c.load()
+	if !ok {
+		return nil
+	}
+
+	s.Credits -= credits
+
+	return c.save(s)
+}
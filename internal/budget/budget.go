@@ -0,0 +1,200 @@
+package budget
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/filelock"
+)
+
+// ErrBudgetExceeded is returned by Guard.Reserve when spending the requested credits
+// would exceed the budget.
+var ErrBudgetExceeded = errors.New("credit budget exceeded")
+
+const monthLayout = "2006-01"
+
+type state struct {
+	// The month the spent credits were counted in, formatted as "2006-01".
+	Month string `json:"month"`
+
+	Spent float64 `json:"spent"`
+}
+
+// Guard tracks the credits spent in the current calendar month and refuses to
+// spend more than the configured limit.  The spent credits are persisted to a
+// JSON file so that they are shared between invocations, and the file is locked
+// while it is used so that several processes can share it safely.
+type Guard struct {
+	path  string
+	limit float64
+	mu    sync.Mutex
+}
+
+// NewGuard creates a new Guard that stores its state at path.  A limit of zero or
+// less disables the guard.
+func NewGuard(path string, limit float64) *Guard {
+	return &Guard{
+		path:  path,
+		limit: limit,
+	}
+}
+
+// lock locks the guard against other goroutines and processes, returning a
+// function that unlocks it.
+func (g *Guard) lock() (func(), error) {
+	g.mu.Lock()
+
+	fileLock, err := filelock.Acquire(g.path + ".lock")
+	if err != nil {
+		g.mu.Unlock()
+
+		return nil, fmt.Errorf("failed to lock budget state: %w", err)
+	}
+
+	return func() {
+		fileLock.Release()
+		g.mu.Unlock()
+	}, nil
+}
+
+func (g *Guard) load() (state, error) {
+	current := state{Month: time.Now().Format(monthLayout)}
+
+	data, err := os.ReadFile(g.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return current, nil
+		}
+
+		return current, fmt.Errorf("failed to read budget state: %w", err)
+	}
+
+	var stored state
+
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return current, fmt.Errorf("failed to unmarshal budget state: %w", err)
+	}
+
+	if stored.Month != current.Month {
+		return current, nil
+	}
+
+	return stored, nil
+}
+
+func (g *Guard) save(s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal budget state: %w", err)
+	}
+
+	err = filelock.WriteFile(g.path, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write budget state: %w", err)
+	}
+
+	return nil
+}
+
+// Reserve records credits as spent, or returns ErrBudgetExceeded if doing so would
+// go over the budget.
+func (g *Guard) Reserve(credits float64) error {
+	if g.limit <= 0 {
+		return nil
+	}
+
+	unlock, err := g.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := g.load()
+	if err != nil {
+		return err
+	}
+
+	if s.Spent+credits > g.limit {
+		return fmt.Errorf("%w: %.1f of %.1f credits spent this month", ErrBudgetExceeded, s.Spent, g.limit)
+	}
+
+	s.Spent += credits
+
+	return g.save(s)
+}
+
+// Release returns previously reserved credits to the budget, e.g. because the
+// generation they were reserved for failed.
+func (g *Guard) Release(credits float64) error {
+	if g.limit <= 0 {
+		return nil
+	}
+
+	unlock, err := g.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := g.load()
+	if err != nil {
+		return err
+	}
+
+	s.Spent -= credits
+	if s.Spent < 0 {
+		s.Spent = 0
+	}
+
+	return g.save(s)
+}
+
+// Adjust adds credits to those spent this month, or takes them away if negative,
+// without checking the budget.  It corrects a reservation once the real cost of
+// a request is known, since that has already been spent.
+func (g *Guard) Adjust(credits float64) error {
+	if g.limit <= 0 || credits == 0 {
+		return nil
+	}
+
+	unlock, err := g.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := g.load()
+	if err != nil {
+		return err
+	}
+
+	s.Spent = max(s.Spent+credits, 0)
+
+	return g.save(s)
+}
+
+// Remaining returns the number of credits left in this month's budget.  It returns
+// false if the guard is disabled.
+func (g *Guard) Remaining() (float64, bool, error) {
+	if g.limit <= 0 {
+		return 0, false, nil
+	}
+
+	unlock, err := g.lock()
+	if err != nil {
+		return 0, false, err
+	}
+	defer unlock()
+
+	s, err := g.load()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return max(0, g.limit-s.Spent), true, nil
+}
@@ -0,0 +1,136 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+const defaultBaseURL = "https://discord.com/api/v10"
+
+// Client is a minimal client for the parts of the Discord REST API that the bot needs.
+type Client struct {
+	baseURL       string
+	applicationID string
+	botToken      string
+	httpClient    *http.Client
+}
+
+func NewClient(applicationID string, botToken string) *Client {
+	return &Client{
+		baseURL:       defaultBaseURL,
+		applicationID: applicationID,
+		botToken:      botToken,
+		httpClient:    backend.NewHTTPClient(),
+	}
+}
+
+// File is a file to attach to a message.
+type File struct {
+	Name string
+	Data []byte
+}
+
+func (c *Client) do(req *http.Request) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("got unexpected status code %d from Discord. Response: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// RegisterCommands overwrites the application's global commands with the given commands.
+func (c *Client) RegisterCommands(ctx context.Context, commands []Command) error {
+	body, err := json.Marshal(commands)
+	if err != nil {
+		return fmt.Errorf("failed to marshal commands: %w", err)
+	}
+
+	reqURL := fmt.Sprintf("%s/applications/%s/commands", c.baseURL, c.applicationID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bot "+c.botToken)
+
+	return c.do(req)
+}
+
+// EditOriginalResponse replaces the original (usually deferred) response to an
+// interaction with the given content and attachments.
+func (c *Client) EditOriginalResponse(ctx context.Context, interactionToken string, content string, files ...File) error {
+	var formBuf bytes.Buffer
+
+	writer := multipart.NewWriter(&formBuf)
+
+	type attachment struct {
+		ID       int    `json:"id"`
+		Filename string `json:"filename"`
+	}
+
+	payload := struct {
+		Content     string       `json:"content"`
+		Attachments []attachment `json:"attachments"`
+	}{
+		Content:     content,
+		Attachments: []attachment{},
+	}
+
+	for i, f := range files {
+		payload.Attachments = append(payload.Attachments, attachment{ID: i, Filename: f.Name})
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message payload: %w", err)
+	}
+
+	err = writer.WriteField("payload_json", string(payloadJSON))
+	if err != nil {
+		return fmt.Errorf("failed to write payload to request: %w", err)
+	}
+
+	for i, f := range files {
+		part, err := writer.CreateFormFile(fmt.Sprintf("files[%d]", i), f.Name)
+		if err != nil {
+			return fmt.Errorf("failed to create file field in request: %w", err)
+		}
+
+		_, err = part.Write(f.Data)
+		if err != nil {
+			return fmt.Errorf("failed to write file %q to request: %w", f.Name, err)
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	reqURL := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", c.baseURL, c.applicationID, interactionToken)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, reqURL, &formBuf)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return c.do(req)
+}
@@ -0,0 +1,102 @@
+package discord
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxBodySize is the largest interaction the handler reads.  Interactions are a
+// few KB, and the body is read before its signature can be checked, so anyone
+// could otherwise make the bot buffer as much as they like.
+const maxBodySize = 64 << 10
+
+// Handler is an http.Handler that receives interactions from Discord's outgoing
+// webhooks.  Every request is verified against the application's public key before
+// it is processed.
+//
+// Application commands are acknowledged with a deferred response immediately, and
+// OnCommand is invoked in a new goroutine.  OnCommand is expected to follow up with
+// Client.EditOriginalResponse once it is done.
+type Handler struct {
+	publicKey ed25519.PublicKey
+	onCommand func(Interaction)
+}
+
+// NewHandler creates a new Handler.  publicKey is the hex-encoded public key from
+// the Discord developer portal.
+func NewHandler(publicKey string, onCommand func(Interaction)) (*Handler, error) {
+	key, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key has invalid length %d; expected %d", len(key), ed25519.PublicKeySize)
+	}
+
+	return &Handler{
+		publicKey: ed25519.PublicKey(key),
+		onCommand: onCommand,
+	}, nil
+}
+
+func (h *Handler) verify(r *http.Request, body []byte) bool {
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+
+	return ed25519.Verify(h.publicKey, append([]byte(timestamp), body...), sig)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if errors.As(err, new(*http.MaxBytesError)) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.verify(r, body) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction Interaction
+
+	err = json.Unmarshal(body, &interaction)
+	if err != nil {
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+
+	switch interaction.Type {
+	case InteractionTypePing:
+		writeResponse(w, responseTypePong)
+	case InteractionTypeApplicationCommand:
+		writeResponse(w, responseTypeDeferredChannelMessageWithSource)
+
+		go h.onCommand(interaction)
+	default:
+		http.Error(w, "unsupported interaction type", http.StatusBadRequest)
+	}
+}
+
+func writeResponse(w http.ResponseWriter, responseType int) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"type": responseType})
+}
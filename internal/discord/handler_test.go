@@ -0,0 +1,59 @@
+package discord
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewHandler(hex.EncodeToString(public), func(Interaction) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const timestamp = "1718822400"
+
+	sign := func(body []byte) string {
+		return hex.EncodeToString(ed25519.Sign(private, append([]byte(timestamp), body...)))
+	}
+
+	ping := []byte(`{"type":1}`)
+	oversized := []byte(`{"type":1,"padding":"` + strings.Repeat("a", maxBodySize) + `"}`)
+
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+		want      int
+	}{
+		{"signed ping", ping, sign(ping), http.StatusOK},
+		{"bad signature", ping, sign([]byte(`{"type":2}`)), http.StatusUnauthorized},
+		{"unsigned", ping, "", http.StatusUnauthorized},
+		{"oversized", oversized, sign(oversized), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/interactions", bytes.NewReader(tt.body))
+			req.Header.Set("X-Signature-Ed25519", tt.signature)
+			req.Header.Set("X-Signature-Timestamp", timestamp)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
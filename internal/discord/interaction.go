@@ -0,0 +1,109 @@
+package discord
+
+import (
+	"fmt"
+)
+
+// InteractionType is the type of an interaction sent by Discord.
+type InteractionType int
+
+const (
+	InteractionTypePing               InteractionType = 1
+	InteractionTypeApplicationCommand InteractionType = 2
+)
+
+// The types of interaction responses that are used by the bot.
+const (
+	responseTypePong                             = 1
+	responseTypeDeferredChannelMessageWithSource = 5
+)
+
+// OptionTypeString is the option type for string options in application commands.
+const OptionTypeString = 3
+
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type Member struct {
+	User User `json:"user"`
+}
+
+// Interaction is an incoming interaction from Discord, e.g. a slash command being invoked.
+type Interaction struct {
+	ID            string          `json:"id"`
+	ApplicationID string          `json:"application_id"`
+	Type          InteractionType `json:"type"`
+	Token         string          `json:"token"`
+	Data          InteractionData `json:"data"`
+
+	// Member is set when the interaction was invoked in a guild.
+	Member *Member `json:"member"`
+
+	// User is set when the interaction was invoked in a DM.
+	User *User `json:"user"`
+}
+
+// Invoker returns the user that invoked the interaction, regardless of whether it
+// was invoked in a guild or a DM.
+func (i Interaction) Invoker() User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+
+	if i.User != nil {
+		return *i.User
+	}
+
+	return User{}
+}
+
+type InteractionData struct {
+	Name    string              `json:"name"`
+	Options []InteractionOption `json:"options"`
+}
+
+type InteractionOption struct {
+	Name  string `json:"name"`
+	Type  int    `json:"type"`
+	Value any    `json:"value"`
+}
+
+// StringOption returns the value of the string option with the given name, or an
+// empty string if the option was not provided.
+func (d InteractionData) StringOption(name string) string {
+	for _, v := range d.Options {
+		if v.Name != name {
+			continue
+		}
+
+		if s, ok := v.Value.(string); ok {
+			return s
+		}
+
+		return fmt.Sprint(v.Value)
+	}
+
+	return ""
+}
+
+// Command is the definition of an application command that is registered with Discord.
+type Command struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Options     []CommandOption `json:"options,omitempty"`
+}
+
+type CommandOption struct {
+	Type        int                   `json:"type"`
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Required    bool                  `json:"required,omitempty"`
+	Choices     []CommandOptionChoice `json:"choices,omitempty"`
+}
+
+type CommandOptionChoice struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
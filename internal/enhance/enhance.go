@@ -0,0 +1,146 @@
+// Package enhance expands short prompts into detailed Stable Diffusion prompts
+// with an LLM behind an OpenAI-compatible chat completions API.
+package enhance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// DefaultSystemPrompt is the instruction sent to the LLM when none is configured.
+const DefaultSystemPrompt = "You expand short image ideas into detailed prompts for Stable Diffusion. " +
+	"Describe the subject, setting, composition, lighting, style, and medium in a single " +
+	"comma-separated prompt of at most 75 words.  Reply with the prompt only, without " +
+	"quotes or commentary."
+
+// Client sends prompts to a chat completions endpoint to be enhanced.
+type Client struct {
+	baseURL      string
+	apiKey       string
+	model        string
+	systemPrompt string
+	httpClient   *http.Client
+}
+
+type ClientOption func(*Client)
+
+// WithAPIKey sets the bearer token sent with every request.  Local servers, e.g.
+// Ollama, usually don't need one.
+func WithAPIKey(apiKey string) ClientOption {
+	return func(c *Client) {
+		c.apiKey = apiKey
+	}
+}
+
+// WithSystemPrompt replaces DefaultSystemPrompt.
+func WithSystemPrompt(systemPrompt string) ClientOption {
+	return func(c *Client) {
+		c.systemPrompt = systemPrompt
+	}
+}
+
+// WithHTTPClient sets the HTTP client requests are sent with, e.g. for different
+// timeouts.  Defaults to backend.NewHTTPClient().
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// NewClient creates a client for the API at baseURL, e.g.
+// "https://api.openai.com/v1" or "http://localhost:11434/v1", using model.
+func NewClient(baseURL string, model string, options ...ClientOption) *Client {
+	client := &Client{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		model:        model,
+		systemPrompt: DefaultSystemPrompt,
+		httpClient:   backend.NewHTTPClient(),
+	}
+
+	for _, v := range options {
+		v(client)
+	}
+
+	return client
+}
+
+type message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model    string    `json:"model"`
+	Messages []message `json:"messages"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message message `json:"message"`
+	} `json:"choices"`
+}
+
+// Enhance returns a detailed version of prompt.
+func (c *Client) Enhance(ctx context.Context, prompt string) (string, error) {
+	body, err := json.Marshal(chatRequest{
+		Model: c.model,
+		Messages: []message{
+			{Role: "system", Content: c.systemPrompt},
+			{Role: "user", Content: prompt},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := backend.ReadBody(resp)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &backend.APIError{StatusCode: resp.StatusCode, URL: "/chat/completions", Body: string(respBody)}
+	}
+
+	var parsed chatResponse
+
+	err = json.Unmarshal(respBody, &parsed)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if len(parsed.Choices) == 0 {
+		return "", errors.New("response did not contain any choices")
+	}
+
+	enhanced := strings.Trim(strings.TrimSpace(parsed.Choices[0].Message.Content), `"`)
+	if enhanced == "" {
+		return "", errors.New("response contained an empty prompt")
+	}
+
+	return enhanced, nil
+}
@@ -0,0 +1,74 @@
+// Package filelock provides advisory locks on files, so that several sdcli
+// processes running at once, e.g. a cron job and manual use, don't overwrite each
+// other's changes to the state files in the config directory.
+package filelock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Lock is an exclusive lock held on a file.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire blocks until it holds an exclusive lock on the file at path.  The lock
+// file is created if it doesn't exist, and should be separate from the file it
+// protects, since that file is replaced when it is written.
+func Acquire(path string) (*Lock, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %q: %w", path, err)
+	}
+
+	err = lock(fd)
+	if err != nil {
+		fd.Close()
+
+		return nil, fmt.Errorf("failed to lock %q: %w", path, err)
+	}
+
+	return &Lock{file: fd}, nil
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	err := unlock(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// WriteFile writes data to a temporary file next to path, then renames it over
+// path, so readers never see a partially written file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package filelock
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lock(fd *os.File) error {
+	for {
+		err := unix.Flock(int(fd.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+func unlock(fd *os.File) error {
+	return unix.Flock(int(fd.Fd()), unix.LOCK_UN)
+}
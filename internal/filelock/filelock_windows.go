@@ -0,0 +1,27 @@
+//go:build windows
+
+package filelock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockBytes is the number of bytes locked.  Windows locks byte ranges rather than
+// whole files, so lock as much as possible.
+const lockBytes = ^uint32(0)
+
+func lock(fd *os.File) error {
+	return windows.LockFileEx(
+		windows.Handle(fd.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK,
+		0,
+		lockBytes,
+		lockBytes,
+		new(windows.Overlapped))
+}
+
+func unlock(fd *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(fd.Fd()), 0, lockBytes, lockBytes, new(windows.Overlapped))
+}
@@ -0,0 +1,255 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/filelock"
+)
+
+// Entry is an image in the history.
+type Entry struct {
+	// The ID of the entry, assigned when it is added.
+	ID int64 `json:"id"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// The path or URL of the image.
+	Path string `json:"path"`
+
+	// The operation that produced the image, e.g. "generate".  Empty for images
+	// that were imported.
+	Operation string `json:"operation,omitempty"`
+
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	OriginalPrompt string  `json:"original_prompt,omitempty"`
+	Backend        string  `json:"backend,omitempty"`
+	Model          string  `json:"model,omitempty"`
+	Seed           int64   `json:"seed,omitempty"`
+	AspectRatio    string  `json:"aspect_ratio,omitempty"`
+	Credits        float64 `json:"credits,omitempty"`
+	WatermarkID    string  `json:"watermark_id,omitempty"`
+
+	// Whether Credits is what the API reported the image cost, rather than an
+	// estimate.
+	CreditsReported bool `json:"credits_reported,omitempty"`
+
+	// The random tokens that were appended to the prompt with --seasoning.
+	Seasoning []string `json:"seasoning,omitempty"`
+
+	// The prompts that content moderation filtered before Prompt was generated.
+	FilteredPrompts []string `json:"filtered_prompts,omitempty"`
+
+	// The SHA-256 of the image as the backend returned it, before any metadata
+	// was added, used to find duplicate images.
+	Hash string `json:"hash,omitempty"`
+
+	// The ID of the entry this image is identical to.  Duplicates aren't saved
+	// again, so Path is the path of the original.
+	DuplicateOf int64 `json:"duplicate_of,omitempty"`
+
+	// Whether the entry was imported from an existing image, rather than
+	// recorded when the image was generated.
+	Imported bool `json:"imported,omitempty"`
+
+	// Other settings, e.g. the sampler of an image imported from another tool.
+	Extra map[string]string `json:"extra,omitempty"`
+
+	// Tags added by the user, e.g. "wallpaper".
+	Tags []string `json:"tags,omitempty"`
+
+	// Whether the user marked the image as a favorite.
+	Favorite bool `json:"favorite,omitempty"`
+}
+
+// HasTag reports whether the entry has a tag, ignoring case.
+func (e Entry) HasTag(tag string) bool {
+	for _, v := range e.Tags {
+		if strings.EqualFold(v, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrNotFound is returned when an entry isn't in the history.
+var ErrNotFound = errors.New("image not found in history")
+
+type state struct {
+	NextID  int64   `json:"next_id"`
+	Entries []Entry `json:"entries"`
+}
+
+// Store is the history of generated images.  Entries are persisted to a JSON
+// file so that they are shared between invocations, and the file is locked while
+// it is used so that several processes can share it safely.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewStore creates a new Store that keeps its entries at path.
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// lock locks the store against other goroutines and processes, returning a
+// function that unlocks it.
+func (s *Store) lock() (func(), error) {
+	s.mu.Lock()
+
+	fileLock, err := filelock.Acquire(s.path + ".lock")
+	if err != nil {
+		s.mu.Unlock()
+
+		return nil, fmt.Errorf("failed to lock history: %w", err)
+	}
+
+	return func() {
+		fileLock.Release()
+		s.mu.Unlock()
+	}, nil
+}
+
+func (s *Store) load() (state, error) {
+	current := state{NextID: 1}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return current, nil
+		}
+
+		return current, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	err = json.Unmarshal(data, &current)
+	if err != nil {
+		return current, fmt.Errorf("failed to unmarshal history: %w", err)
+	}
+
+	return current, nil
+}
+
+func (s *Store) save(st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+
+	err = filelock.WriteFile(s.path, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	return nil
+}
+
+// Add adds entries to the history, assigning their IDs.  It returns the entries
+// as they were added.
+func (s *Store) Add(entries ...Entry) ([]Entry, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	added := make([]Entry, 0, len(entries))
+
+	for _, v := range entries {
+		v.ID = st.NextID
+		st.NextID++
+
+		st.Entries = append(st.Entries, v)
+		added = append(added, v)
+	}
+
+	err = s.save(st)
+	if err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// List returns every entry in the history, oldest first.
+func (s *Store) List() ([]Entry, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return st.Entries, nil
+}
+
+// Update calls update with the entry with the given ID, and saves the changes it
+// makes.  It returns ErrNotFound if there is no such entry.
+func (s *Store) Update(id int64, update func(*Entry)) (Entry, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return Entry{}, err
+	}
+	defer unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	for i := range st.Entries {
+		if st.Entries[i].ID != id {
+			continue
+		}
+
+		update(&st.Entries[i])
+
+		err = s.save(st)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		return st.Entries[i], nil
+	}
+
+	return Entry{}, fmt.Errorf("%w: %d", ErrNotFound, id)
+}
+
+// Remove removes the entries with the given IDs from the history.  IDs that
+// aren't in the history are ignored.
+func (s *Store) Remove(ids ...int64) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	st.Entries = slices.DeleteFunc(st.Entries, func(v Entry) bool {
+		return slices.Contains(ids, v.ID)
+	})
+
+	return s.save(st)
+}
@@ -0,0 +1,276 @@
+// Package objectstore uploads objects to S3 and S3-compatible object storage,
+// including Google Cloud Storage through its XML API and HMAC keys.
+//
+// Only the small subset of the API that sdcli needs is implemented, signed with
+// AWS Signature Version 4.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+const (
+	gcsEndpoint = "https://storage.googleapis.com"
+
+	// gcsRegion is the region GCS expects in signatures.
+	gcsRegion = "auto"
+
+	defaultS3Region = "us-east-1"
+)
+
+// ErrExists is returned by Put when an object with the name already exists.
+var ErrExists = errors.New("object already exists")
+
+// Credentials are the credentials used to sign requests.  For GCS these are HMAC
+// keys for a service account.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Store is a bucket, and optionally a prefix within it, that objects are written to.
+type Store struct {
+	scheme string
+	bucket string
+	prefix string
+
+	// endpoint is the base URL of the service.  If it is empty, AWS's
+	// virtual-hosted endpoints are used.
+	endpoint string
+	region   string
+
+	credentials Credentials
+	httpClient  *http.Client
+}
+
+// IsURL returns true if location is an object storage URL rather than a local path.
+func IsURL(location string) bool {
+	return strings.HasPrefix(location, "s3://") || strings.HasPrefix(location, "gs://")
+}
+
+// New creates a Store from an s3:// or gs:// URL, e.g. "s3://bucket/some/prefix".
+// endpoint and region may be empty to use the defaults for the URL's scheme.
+func New(location string, endpoint string, region string, credentials Credentials) (*Store, error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse object storage URL %q: %w", location, err)
+	}
+
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("object storage URL %q has no bucket", location)
+	}
+
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no credentials were provided for %q", location)
+	}
+
+	store := &Store{
+		scheme:      parsed.Scheme,
+		bucket:      parsed.Host,
+		prefix:      strings.Trim(parsed.Path, "/"),
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      region,
+		credentials: credentials,
+		httpClient:  backend.NewHTTPClient(),
+	}
+
+	switch parsed.Scheme {
+	case "s3":
+		if store.region == "" {
+			store.region = defaultS3Region
+		}
+	case "gs":
+		if store.endpoint == "" {
+			store.endpoint = gcsEndpoint
+		}
+
+		if store.region == "" {
+			store.region = gcsRegion
+		}
+	default:
+		return nil, fmt.Errorf("unsupported object storage scheme %q", parsed.Scheme)
+	}
+
+	return store, nil
+}
+
+// key returns the full key of an object with the given name.
+func (s *Store) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+
+	return s.prefix + "/" + name
+}
+
+// URL returns the s3:// or gs:// URL of an object with the given name.
+func (s *Store) URL(name string) string {
+	return fmt.Sprintf("%s://%s/%s", s.scheme, s.bucket, s.key(name))
+}
+
+func (s *Store) objectURL(key string) *url.URL {
+	objectURL := &url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, s.region),
+		Path:   "/" + key,
+	}
+
+	if s.endpoint != "" {
+		base, _ := url.Parse(s.endpoint)
+
+		objectURL.Scheme = base.Scheme
+		objectURL.Host = base.Host
+		objectURL.Path = base.Path + "/" + s.bucket + "/" + key
+	}
+
+	// Make sure the path that is sent is exactly the one that is signed.
+	objectURL.RawPath = encodePath(objectURL.Path)
+
+	return objectURL
+}
+
+// Put uploads data as an object with the given name, returning its URL.  Existing
+// objects aren't overwritten; ErrExists is returned instead.
+func (s *Store) Put(ctx context.Context, name string, data []byte, contentType string) (string, error) {
+	objectURL := s.objectURL(s.key(name))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	// Only create the object if it doesn't exist yet.  GCS's XML API uses its own
+	// header for this.
+	if s.scheme == "gs" {
+		req.Header.Set("X-Goog-If-Generation-Match", "0")
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	s.sign(req, data, time.Now().UTC())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", s.URL(name), err)
+	}
+	defer resp.Body.Close()
+
+	// S3 returns 409 Conflict when another conditional write to the same name is
+	// in progress.
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		return "", fmt.Errorf("%w: %s", ErrExists, s.URL(name))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("got unexpected status code %d while uploading %s. Response: %s", resp.StatusCode, s.URL(name), string(body))
+	}
+
+	return s.URL(name), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodePath URI-encodes everything in a path except unreserved characters and
+// slashes, as required by SigV4.
+func encodePath(path string) string {
+	var b strings.Builder
+
+	for _, c := range []byte(path) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *Store) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if s.credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.credentials.SessionToken)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	headerValues := map[string]string{
+		"content-type":         req.Header.Get("Content-Type"),
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+
+	if s.credentials.SessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+		headerValues["x-amz-security-token"] = s.credentials.SessionToken
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, v := range signedHeaders {
+		canonicalHeaders.WriteString(v + ":" + strings.TrimSpace(headerValues[v]) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		encodePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.credentials.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.credentials.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
@@ -0,0 +1,315 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The types of steps a pipeline file can declare.
+const (
+	TypeGenerate         = "generate"
+	TypeEdit             = "edit"
+	TypeUpscale          = "upscale"
+	TypeRemoveBackground = "remove-bg"
+	TypeSave             = "save"
+	TypeHook             = "hook"
+)
+
+// stepValues are the values each type of step outputs, which later steps can
+// refer to.
+var stepValues = map[string][]string{
+	TypeGenerate:         {"path", "prompt", "model", "seed"},
+	TypeEdit:             {"path", "prompt", "model", "seed"},
+	TypeUpscale:          {"path", "prompt", "model", "seed"},
+	TypeRemoveBackground: {"path", "prompt", "model", "seed"},
+	TypeSave:             {"path"},
+	TypeHook:             {"output"},
+}
+
+// File is a pipeline declared in a YAML file, e.g.
+//
+//	params:
+//	  subject: a lighthouse
+//	steps:
+//	  - name: base
+//	    type: generate
+//	    prompt: ${params.subject} at dusk
+//	  - name: big
+//	    type: upscale
+//	    input: base
+//
+// Strings in steps can refer to the file's params as ${params.<name>}, and to
+// the values output by other steps as ${steps.<step>.<value>}.  A step that
+// refers to another step needs it, so it runs after it.
+type File struct {
+	// Parameters of the pipeline and their defaults.
+	Params map[string]string `yaml:"params"`
+
+	// The steps of the pipeline.
+	Steps []StepSpec `yaml:"steps"`
+}
+
+// StepSpec is a step declared in a pipeline file.  Which fields are used depends
+// on the step's type.
+type StepSpec struct {
+	// The name of the step, used to refer to it from other steps.
+	Name string `yaml:"name"`
+
+	// What the step does: generate, edit, upscale, remove-bg, save, or hook.
+	Type string `yaml:"type"`
+
+	// Steps to run before this one, besides those it refers to.
+	Needs []string `yaml:"needs"`
+
+	// The step whose image to use, for edit, upscale, remove-bg, and save.
+	Input string `yaml:"input"`
+
+	// An image file to use instead of a step's image.
+	Image string `yaml:"image"`
+
+	Prompt         string `yaml:"prompt"`
+	NegativePrompt string `yaml:"negative_prompt"`
+	Model          string `yaml:"model"`
+	Ratio          string `yaml:"ratio"`
+	Seed           string `yaml:"seed"`
+	CFGScale       string `yaml:"cfg_scale"`
+	OutputFormat   string `yaml:"output_format"`
+
+	// The edit to perform, for edit steps: inpaint, erase, or
+	// search-and-replace.
+	Operation string `yaml:"operation"`
+
+	// What to replace, for search-and-replace edits.
+	Search string `yaml:"search"`
+
+	// A mask image, for inpaint and erase edits.
+	Mask string `yaml:"mask"`
+
+	// The upscaler, for upscale steps.
+	Mode string `yaml:"mode"`
+
+	// Where to copy the image to, for save steps.
+	Path string `yaml:"path"`
+
+	// The command and its arguments, for hook steps.
+	Command []string `yaml:"command"`
+}
+
+var (
+	stepNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	referencePattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+)
+
+// Parse parses and checks a pipeline file.
+func Parse(data []byte) (*File, error) {
+	var file File
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline: %w", err)
+	}
+
+	if len(file.Steps) == 0 {
+		return nil, errors.New("pipeline has no steps")
+	}
+
+	types := make(map[string]string, len(file.Steps))
+
+	for _, v := range file.Steps {
+		if !stepNamePattern.MatchString(v.Name) {
+			return nil, fmt.Errorf("invalid step name %q, must be letters, digits, - and _", v.Name)
+		}
+
+		types[v.Name] = v.Type
+	}
+
+	for _, v := range file.Steps {
+		err := v.check()
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", v.Name, err)
+		}
+
+		if types[v.Input] == TypeHook {
+			return nil, fmt.Errorf("step %q: input %q is a hook, which has no image", v.Name, v.Input)
+		}
+
+		for _, ref := range v.references() {
+			err := file.checkReference(ref, types)
+			if err != nil {
+				return nil, fmt.Errorf("step %q: %w", v.Name, err)
+			}
+		}
+	}
+
+	return &file, nil
+}
+
+// SetParams overrides the defaults of the file's params.  Every param must be
+// declared in the file, to catch typos.
+func (f *File) SetParams(params map[string]string) error {
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+
+	slices.Sort(names)
+
+	for _, k := range names {
+		if _, ok := f.Params[k]; !ok {
+			return fmt.Errorf("unknown param %q", k)
+		}
+
+		f.Params[k] = params[k]
+	}
+
+	return nil
+}
+
+// check returns an error if the step is missing a field its type requires.
+func (s StepSpec) check() error {
+	if _, ok := stepValues[s.Type]; !ok {
+		return fmt.Errorf("unknown type %q, must be one of generate, edit, upscale, remove-bg, save, or hook", s.Type)
+	}
+
+	switch s.Type {
+	case TypeGenerate:
+		if s.Prompt == "" {
+			return errors.New("prompt is required")
+		}
+	case TypeHook:
+		if len(s.Command) == 0 {
+			return errors.New("command is required")
+		}
+	default:
+		if (s.Input == "") == (s.Image == "") {
+			return errors.New("exactly one of input or image is required")
+		}
+	}
+
+	switch s.Type {
+	case TypeEdit:
+		if !slices.Contains([]string{"", "inpaint", "erase", "search-and-replace"}, s.Operation) {
+			return fmt.Errorf("unknown operation %q, must be inpaint, erase, or search-and-replace", s.Operation)
+		}
+
+		if s.Operation == "search-and-replace" && s.Search == "" {
+			return errors.New("search is required for search-and-replace")
+		}
+	case TypeSave:
+		if s.Path == "" {
+			return errors.New("path is required")
+		}
+	}
+
+	return nil
+}
+
+// fields returns pointers to the step's strings that may refer to params and
+// other steps.
+func (s *StepSpec) fields() []*string {
+	fields := []*string{
+		&s.Image, &s.Prompt, &s.NegativePrompt, &s.Model, &s.Ratio, &s.Seed,
+		&s.CFGScale, &s.OutputFormat, &s.Search, &s.Mask, &s.Mode, &s.Path,
+	}
+
+	for i := range s.Command {
+		fields = append(fields, &s.Command[i])
+	}
+
+	return fields
+}
+
+// references returns the references in the step's strings, e.g.
+// "steps.base.seed".
+func (s StepSpec) references() []string {
+	var refs []string
+
+	for _, v := range s.fields() {
+		for _, match := range referencePattern.FindAllStringSubmatch(*v, -1) {
+			refs = append(refs, match[1])
+		}
+	}
+
+	return refs
+}
+
+// StepNeeds returns the names of the steps a step needs: those in its needs,
+// its input, and those it refers to.
+func (s StepSpec) StepNeeds() []string {
+	needs := slices.Clone(s.Needs)
+
+	if s.Input != "" {
+		needs = append(needs, s.Input)
+	}
+
+	for _, v := range s.references() {
+		parts := strings.Split(v, ".")
+		if parts[0] == "steps" {
+			needs = append(needs, parts[1])
+		}
+	}
+
+	slices.Sort(needs)
+
+	return slices.Compact(needs)
+}
+
+// checkReference returns an error if ref doesn't name a param of the file, or a
+// value of one of its steps.  types maps the names of the steps to their types.
+func (f *File) checkReference(ref string, types map[string]string) error {
+	parts := strings.Split(ref, ".")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "params":
+		if _, ok := f.Params[parts[1]]; !ok {
+			return fmt.Errorf("${%s} refers to an unknown param", ref)
+		}
+	case len(parts) == 3 && parts[0] == "steps":
+		stepType, ok := types[parts[1]]
+		if !ok {
+			return fmt.Errorf("${%s} refers to an unknown step", ref)
+		}
+
+		if !slices.Contains(stepValues[stepType], parts[2]) {
+			return fmt.Errorf("${%s} refers to an unknown value, %s steps output %s", ref, stepType, strings.Join(stepValues[stepType], ", "))
+		}
+	default:
+		return fmt.Errorf("invalid reference ${%s}, must be ${params.<name>} or ${steps.<step>.<value>}", ref)
+	}
+
+	return nil
+}
+
+// Expand returns a copy of the step with the references in its strings replaced
+// by the file's params and the values output by the steps it needs.
+func (f *File) Expand(s StepSpec, inputs map[string]*Output) StepSpec {
+	expanded := s
+	expanded.Command = slices.Clone(s.Command)
+
+	for _, v := range expanded.fields() {
+		*v = referencePattern.ReplaceAllStringFunc(*v, func(match string) string {
+			parts := strings.Split(match[2:len(match)-1], ".")
+
+			if parts[0] == "params" {
+				return f.Params[parts[1]]
+			}
+
+			if output, ok := inputs[parts[1]]; ok {
+				return output.Values[parts[2]]
+			}
+
+			return ""
+		})
+	}
+
+	return expanded
+}
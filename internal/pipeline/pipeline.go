@@ -0,0 +1,150 @@
+// Package pipeline runs workflows made of several steps, e.g. generating an
+// image, upscaling it, and then editing it, where each step can use the outputs
+// of the steps before it.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Output is what a step produced.
+type Output struct {
+	// The path or URL of the image the step saved, if any.
+	Path string
+
+	// The image the step saved, if any, so later steps don't have to read it
+	// back from Path.
+	Image []byte
+
+	// Values that later steps can refer to, e.g. "seed" or "prompt".
+	Values map[string]string
+}
+
+// Step is a step of a pipeline.
+type Step struct {
+	// The name of the step, unique within its pipeline.
+	Name string
+
+	// The names of the steps whose outputs this step uses.  They are run first.
+	Needs []string
+
+	// Runs the step, given the outputs of the steps it needs, keyed by name.
+	Run func(ctx context.Context, inputs map[string]*Output) (*Output, error)
+}
+
+// Pipeline is a set of steps, ordered so that every step runs after the steps
+// it needs.
+type Pipeline struct {
+	steps []Step
+}
+
+// New checks that the steps' names are unique, that the steps they need exist,
+// and that no step needs itself, even indirectly, and returns them as a
+// pipeline.  Steps run in the order they are given, except where a step has to
+// wait for a step it needs.
+func New(steps ...Step) (*Pipeline, error) {
+	byName := make(map[string]Step, len(steps))
+
+	for _, v := range steps {
+		if v.Name == "" {
+			return nil, errors.New("every step must have a name")
+		}
+
+		if _, ok := byName[v.Name]; ok {
+			return nil, fmt.Errorf("step %q is defined more than once", v.Name)
+		}
+
+		byName[v.Name] = v
+	}
+
+	for _, v := range steps {
+		for _, need := range v.Needs {
+			if _, ok := byName[need]; !ok {
+				return nil, fmt.Errorf("step %q needs unknown step %q", v.Name, need)
+			}
+		}
+	}
+
+	ordered := make([]Step, 0, len(steps))
+	done := make(map[string]bool, len(steps))
+
+	var visit func(step Step, path []string) error
+
+	visit = func(step Step, path []string) error {
+		if done[step.Name] {
+			return nil
+		}
+
+		if slices.Contains(path, step.Name) {
+			return fmt.Errorf("steps depend on each other in a cycle: %s", strings.Join(append(path, step.Name), " -> "))
+		}
+
+		path = append(path, step.Name)
+
+		for _, need := range step.Needs {
+			err := visit(byName[need], path)
+			if err != nil {
+				return err
+			}
+		}
+
+		done[step.Name] = true
+		ordered = append(ordered, step)
+
+		return nil
+	}
+
+	for _, v := range steps {
+		err := visit(v, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Pipeline{steps: ordered}, nil
+}
+
+// Steps returns the names of the steps in the order they run.
+func (p *Pipeline) Steps() []string {
+	names := make([]string, 0, len(p.steps))
+	for _, v := range p.steps {
+		names = append(names, v.Name)
+	}
+
+	return names
+}
+
+// Run runs the steps in order, stopping at the first one that fails.  It returns
+// the outputs of the steps that succeeded, keyed by name, along with the error
+// of the step that failed, if any.
+func (p *Pipeline) Run(ctx context.Context) (map[string]*Output, error) {
+	outputs := make(map[string]*Output, len(p.steps))
+
+	for _, v := range p.steps {
+		if err := ctx.Err(); err != nil {
+			return outputs, err
+		}
+
+		inputs := make(map[string]*Output, len(v.Needs))
+		for _, need := range v.Needs {
+			inputs[need] = outputs[need]
+		}
+
+		output, err := v.Run(ctx, inputs)
+		if err != nil {
+			return outputs, fmt.Errorf("step %q failed: %w", v.Name, err)
+		}
+
+		if output == nil {
+			output = &Output{}
+		}
+
+		outputs[v.Name] = output
+	}
+
+	return outputs, nil
+}
@@ -0,0 +1,134 @@
+// Package policy checks prompts against a local list of banned words and
+// patterns, so prompts that are likely to be refused by an API's content
+// moderation can be caught before they are paid for.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrBlocked is returned when a prompt matches a rule whose action is
+// ActionBlock.
+var ErrBlocked = errors.New("prompt blocked by policy")
+
+// The actions a rule can take when it matches.
+const (
+	// ActionBlock refuses the prompt.
+	ActionBlock = "block"
+
+	// ActionWarn lets the prompt through, but reports the match.
+	ActionWarn = "warn"
+)
+
+// Rule is a word, phrase, or pattern that prompts are checked for.
+type Rule struct {
+	// The word or phrase to look for.  It is matched case-insensitively, and only
+	// as a whole word, so "ass" doesn't match "class".  If Regex is set, it is a
+	// regular expression instead, matched as is.
+	Pattern string `json:"pattern"`
+
+	// Whether Pattern is a regular expression.  Use (?i) to make it
+	// case-insensitive.
+	Regex bool `json:"regex"`
+
+	// What to do when the rule matches: "block" or "warn".  Defaults to "block".
+	Action string `json:"action"`
+
+	// Why the rule exists, e.g. "graphic violence", shown when it matches.
+	Reason string `json:"reason"`
+}
+
+// Violation is a match of a rule in a prompt.
+type Violation struct {
+	Rule Rule
+
+	// The text of the prompt that matched.
+	Match string
+}
+
+func (v Violation) String() string {
+	if v.Rule.Reason == "" {
+		return fmt.Sprintf("%q", v.Match)
+	}
+
+	return fmt.Sprintf("%q (%s)", v.Match, v.Rule.Reason)
+}
+
+type compiledRule struct {
+	rule    Rule
+	pattern *regexp.Regexp
+}
+
+// Policy is a compiled set of rules.
+type Policy struct {
+	rules []compiledRule
+}
+
+// New compiles a set of rules.
+func New(rules []Rule) (*Policy, error) {
+	policy := &Policy{rules: make([]compiledRule, 0, len(rules))}
+
+	for i, v := range rules {
+		if v.Pattern == "" {
+			return nil, fmt.Errorf("rule %d has no pattern", i+1)
+		}
+
+		switch v.Action {
+		case "":
+			v.Action = ActionBlock
+		case ActionBlock, ActionWarn:
+		default:
+			return nil, fmt.Errorf("rule %d has unknown action %q, must be %q or %q", i+1, v.Action, ActionBlock, ActionWarn)
+		}
+
+		expr := v.Pattern
+		if !v.Regex {
+			expr = `(?i)\b` + regexp.QuoteMeta(v.Pattern) + `\b`
+		}
+
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d has an invalid pattern: %w", i+1, err)
+		}
+
+		policy.rules = append(policy.rules, compiledRule{rule: v, pattern: pattern})
+	}
+
+	return policy, nil
+}
+
+// Check checks a prompt against the policy.  It returns the matches of rules
+// that only warn, and an error wrapping ErrBlocked describing the matches of
+// rules that block, if there were any.
+func (p *Policy) Check(prompt string) ([]Violation, error) {
+	var warnings, blocked []Violation
+
+	for _, v := range p.rules {
+		match := v.pattern.FindString(prompt)
+		if match == "" {
+			continue
+		}
+
+		violation := Violation{Rule: v.rule, Match: match}
+
+		if v.rule.Action == ActionWarn {
+			warnings = append(warnings, violation)
+		} else {
+			blocked = append(blocked, violation)
+		}
+	}
+
+	if len(blocked) == 0 {
+		return warnings, nil
+	}
+
+	matches := make([]string, 0, len(blocked))
+	for _, v := range blocked {
+		matches = append(matches, v.String())
+	}
+
+	return warnings, fmt.Errorf("%w: matched %s", ErrBlocked, strings.Join(matches, ", "))
+}
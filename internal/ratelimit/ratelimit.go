@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a sliding-window rate limiter that allows a fixed number of events
+// per key within a window.
+type Limiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+// New creates a Limiter allowing limit events per key within window.  A limit of
+// zero or less allows everything.
+func New(limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key if it is within the limit.  If it isn't, Allow
+// returns false along with how long the caller has to wait until the next event
+// would be allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+
+	recent := l.events[key][:0]
+	for _, v := range l.events[key] {
+		if v.After(cutoff) {
+			recent = append(recent, v)
+		}
+	}
+
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false, recent[0].Sub(cutoff)
+	}
+
+	l.events[key] = append(recent, now)
+
+	return true, 0
+}
+
+// Refund forgets the most recent event allowed for key, e.g. because what it was
+// allowed for failed, so it doesn't count against the limit.
+func (l *Limiter) Refund(key string) {
+	if l.limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if events := l.events[key]; len(events) > 0 {
+		l.events[key] = events[:len(events)-1]
+	}
+}
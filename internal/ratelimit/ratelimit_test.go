@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterRefund(t *testing.T) {
+	limiter := New(2, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("alice"); !ok {
+			t.Fatalf("event %d was refused", i+1)
+		}
+	}
+
+	if ok, _ := limiter.Allow("alice"); ok {
+		t.Fatal("event over the limit was allowed")
+	}
+
+	limiter.Refund("alice")
+
+	if ok, _ := limiter.Allow("alice"); !ok {
+		t.Fatal("event after a refund was refused")
+	}
+
+	if ok, _ := limiter.Allow("bob"); !ok {
+		t.Fatal("another key's events were limited")
+	}
+
+	// Refunding a key without events does nothing.
+	limiter.Refund("carol")
+	limiter.Refund("carol")
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	limiter := New(0, time.Hour)
+
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.Allow("alice"); !ok {
+			t.Fatal("unlimited limiter refused an event")
+		}
+	}
+
+	limiter.Refund("alice")
+}
@@ -0,0 +1,100 @@
+// Package runlog appends a record of every sdcli invocation to a JSON Lines file,
+// for auditing who generated what when several people share an API key.  Unlike
+// the history, entries are never changed or removed.
+package runlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/filelock"
+)
+
+// Result is an image saved during an invocation.
+type Result struct {
+	// The path or URL the image was saved to.
+	Path string `json:"path"`
+
+	Operation      string  `json:"operation,omitempty"`
+	Prompt         string  `json:"prompt,omitempty"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	OriginalPrompt string  `json:"original_prompt,omitempty"`
+	Backend        string  `json:"backend,omitempty"`
+	Model          string  `json:"model,omitempty"`
+	Seed           int64   `json:"seed,omitempty"`
+	AspectRatio    string  `json:"aspect_ratio,omitempty"`
+	Credits        float64 `json:"credits,omitempty"`
+}
+
+// Entry is a single invocation.
+type Entry struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration_seconds"`
+
+	// The OS user and machine that ran sdcli.
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	// The chat user who asked the bot for an image, for bot requests.
+	Requester string `json:"requester,omitempty"`
+
+	// The command that was run, e.g. "gen-3", and its arguments.
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+
+	Profile string `json:"profile,omitempty"`
+	Backend string `json:"backend,omitempty"`
+
+	Results []Result `json:"results,omitempty"`
+
+	// The error the invocation failed with, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Log is a JSON Lines file that entries are appended to.  The file is locked while
+// it is written so that several processes can share it safely.
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+// New creates a Log that appends to the file at path.
+func New(path string) *Log {
+	return &Log{path: path}
+}
+
+// Append appends an entry to the log as a single line.
+func (l *Log) Append(entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run log entry: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fileLock, err := filelock.Acquire(l.path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock run log: %w", err)
+	}
+	defer fileLock.Release()
+
+	fd, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open run log: %w", err)
+	}
+
+	_, err = fd.Write(append(data, '\n'))
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write run log: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+const defaultBaseURL = "https://api.telegram.org"
+
+// Client is a minimal client for the parts of the Telegram Bot API that the bot needs.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(token string) *Client {
+	return &Client{
+		baseURL:    defaultBaseURL,
+		token:      token,
+		httpClient: backend.NewHTTPClient(),
+	}
+}
+
+type User struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+type Message struct {
+	MessageID int64  `json:"message_id"`
+	From      *User  `json:"from"`
+	Chat      Chat   `json:"chat"`
+	Text      string `json:"text"`
+}
+
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message"`
+}
+
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+func (c *Client) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", c.baseURL, c.token, method)
+}
+
+func (c *Client) do(req *http.Request, result any) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var parsed apiResponse
+
+	err = json.Unmarshal(body, &parsed)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response with status code %d: %w", resp.StatusCode, err)
+	}
+
+	if !parsed.OK {
+		return fmt.Errorf("telegram returned an error with status code %d: %s", resp.StatusCode, parsed.Description)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(parsed.Result, result)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal result: %w", err)
+	}
+
+	return nil
+}
+
+// GetUpdates long-polls for new updates, waiting up to timeoutSeconds for one to arrive.
+// offset should be one greater than the highest update ID that has been processed.
+func (c *Client) GetUpdates(ctx context.Context, offset int64, timeoutSeconds int) ([]Update, error) {
+	query := url.Values{}
+	query.Set("offset", strconv.FormatInt(offset, 10))
+	query.Set("timeout", strconv.Itoa(timeoutSeconds))
+	query.Set("allowed_updates", `["message"]`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.methodURL("getUpdates")+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	var updates []Update
+
+	err = c.do(req, &updates)
+	if err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
+
+// SendMessage sends a text message to a chat.  If replyTo is non-zero, the message
+// is sent as a reply to that message.
+func (c *Client) SendMessage(ctx context.Context, chatID int64, replyTo int64, text string) error {
+	form := url.Values{}
+	form.Set("chat_id", strconv.FormatInt(chatID, 10))
+	form.Set("text", text)
+
+	if replyTo != 0 {
+		form.Set("reply_to_message_id", strconv.FormatInt(replyTo, 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.methodURL("sendMessage"), bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return c.do(req, nil)
+}
+
+// SendPhoto uploads a photo to a chat with an optional caption.  If replyTo is
+// non-zero, the photo is sent as a reply to that message.
+func (c *Client) SendPhoto(ctx context.Context, chatID int64, replyTo int64, filename string, photo []byte, caption string) error {
+	var formBuf bytes.Buffer
+
+	writer := multipart.NewWriter(&formBuf)
+
+	fields := map[string]string{
+		"chat_id": strconv.FormatInt(chatID, 10),
+		"caption": caption,
+	}
+
+	if replyTo != 0 {
+		fields["reply_to_message_id"] = strconv.FormatInt(replyTo, 10)
+	}
+
+	for k, v := range fields {
+		err := writer.WriteField(k, v)
+		if err != nil {
+			return fmt.Errorf("failed to write field %q to request: %w", k, err)
+		}
+	}
+
+	part, err := writer.CreateFormFile("photo", filename)
+	if err != nil {
+		return fmt.Errorf("failed to create photo field in request: %w", err)
+	}
+
+	_, err = part.Write(photo)
+	if err != nil {
+		return fmt.Errorf("failed to write photo to request: %w", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.methodURL("sendPhoto"), &formBuf)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return c.do(req, nil)
+}
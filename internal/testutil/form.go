@@ -0,0 +1,185 @@
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// UpdateGoldenEnv is the environment variable that makes Golden write fixtures
+// instead of comparing against them, e.g. after a deliberate change to a form.
+const UpdateGoldenEnv = "SDCLI_UPDATE_GOLDEN"
+
+// FormOption writes fields to a multipart form, like stability.FormOption.
+type FormOption = func(*multipart.Writer) error
+
+// Inputs are the files a test sends in forms, e.g. images from PNG and JPEG, by
+// name.  Parts holding one of them are recorded by its name rather than by their
+// bytes, which depend on the version of the standard library's image encoders.
+type Inputs map[string][]byte
+
+// CaptureForm builds a multipart form from options, as a client would send it,
+// and returns it in canonical form.
+func CaptureForm(inputs Inputs, options ...FormOption) ([]byte, error) {
+	var body bytes.Buffer
+
+	writer := multipart.NewWriter(&body)
+
+	for _, v := range options {
+		err := v(writer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	return CanonicalForm(writer.FormDataContentType(), &body, inputs)
+}
+
+// CaptureRequest returns the multipart form a request was sent with in
+// canonical form, e.g. in the handler of an httptest.Server standing in for an
+// API.  The method and path are included, so a request sent to the wrong
+// endpoint doesn't match.
+func CaptureRequest(req *http.Request, inputs Inputs) ([]byte, error) {
+	form, err := CanonicalForm(req.Header.Get("Content-Type"), req.Body, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(req.Method+" "+req.URL.Path+"\n"), form...), nil
+}
+
+// formPart is a part of a multipart form, as it is written in canonical form.
+type formPart struct {
+	name        string
+	fileName    string
+	contentType string
+	content     []byte
+}
+
+// CanonicalForm reads a multipart form and returns it as text that doesn't
+// depend on its boundary or the order of differently named parts, so it can be
+// compared with a golden file.  Parts with the same name are kept in the order
+// they were sent, since e.g. several images may be sent as repeated fields.
+// Parts holding one of the inputs are written as the input's name, text values
+// as is, and other binary content by its length alone.
+func CanonicalForm(contentType string, body io.Reader, inputs Inputs) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content type %q: %w", contentType, err)
+	}
+
+	if mediaType != "multipart/form-data" {
+		return nil, fmt.Errorf("content type %q is not a multipart form", mediaType)
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+
+	var parts []formPart
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read form: %w", err)
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read form field %q: %w", part.FormName(), err)
+		}
+
+		parts = append(parts, formPart{
+			name:        part.FormName(),
+			fileName:    part.FileName(),
+			contentType: part.Header.Get("Content-Type"),
+			content:     content,
+		})
+	}
+
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].name < parts[j].name
+	})
+
+	var b strings.Builder
+
+	for _, v := range parts {
+		fmt.Fprintf(&b, "--- %s", v.name)
+
+		if v.fileName != "" {
+			fmt.Fprintf(&b, " filename=%q", v.fileName)
+		}
+
+		if v.contentType != "" {
+			fmt.Fprintf(&b, " content-type=%s", v.contentType)
+		}
+
+		if input, ok := inputs.find(v.content); ok {
+			fmt.Fprintf(&b, "\n<input %q>\n", input)
+		} else if utf8.Valid(v.content) && !bytes.ContainsRune(v.content, 0) {
+			fmt.Fprintf(&b, "\n%s\n", v.content)
+		} else {
+			fmt.Fprintf(&b, "\n<%d bytes matching no input>\n", len(v.content))
+		}
+	}
+
+	return []byte(b.String()), nil
+}
+
+// find returns the name of the input content is exactly, if any.  Names are
+// tried in order, so identical inputs are always recorded by the same name.
+func (i Inputs) find(content []byte) (string, bool) {
+	names := make([]string, 0, len(i))
+	for name := range i {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if bytes.Equal(content, i[name]) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// Golden compares got with the golden file at path, failing the test if they
+// differ.  With SDCLI_UPDATE_GOLDEN=1 set, the golden file is written instead.
+func Golden(tb testing.TB, path string, got []byte) {
+	tb.Helper()
+
+	if os.Getenv(UpdateGoldenEnv) == "1" {
+		err := os.WriteFile(path, got, 0o644)
+		if err != nil {
+			tb.Fatalf("failed to update golden file: %v", err)
+		}
+
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("failed to read golden file, run with %s=1 to create it: %v", UpdateGoldenEnv, err)
+	}
+
+	if !bytes.Equal(got, want) {
+		tb.Errorf("%s doesn't match, run with %s=1 to update it if the change is deliberate\ngot:\n%s\nwant:\n%s",
+			path, UpdateGoldenEnv, got, want)
+	}
+}
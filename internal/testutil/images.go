@@ -0,0 +1,124 @@
+// Package testutil generates image fixtures for tests of the code that reads,
+// writes, and uploads images, e.g. pkg/imagemeta and the backend clients, so
+// they don't depend on binary files checked into the repository.
+//
+// The valid fixtures decode with the standard library.  The broken variants are
+// built from valid ones, and fail to decode in the way their names say, e.g. a
+// PNG whose chunk checksum is wrong.
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// JPEGQuality is the quality JPEG fixtures are encoded with.
+const JPEGQuality = 90
+
+// Image returns an opaque image of the given size, filled with a gradient so that
+// resizing, cropping, and encoding have something to work with.  It panics if
+// either side is less than 1.
+func Image(width int, height int) *image.NRGBA {
+	if width < 1 || height < 1 {
+		panic(fmt.Sprintf("testutil: invalid image size %dx%d", width, height))
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / max(width-1, 1)),
+				G: uint8(y * 255 / max(height-1, 1)),
+				B: 128,
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
+
+// PNG returns a valid PNG of the given size.
+func PNG(width int, height int) []byte {
+	return encodePNG(Image(width, height))
+}
+
+// TransparentPNG returns a valid PNG of the given size whose left half is
+// transparent, e.g. for building masks from an image's alpha channel.
+func TransparentPNG(width int, height int) []byte {
+	img := Image(width, height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width/2; x++ {
+			img.Pix[img.PixOffset(x, y)+3] = 0
+		}
+	}
+
+	return encodePNG(img)
+}
+
+// JPEG returns a valid baseline JPEG of the given size.
+func JPEG(width int, height int) []byte {
+	var buf bytes.Buffer
+
+	err := jpeg.Encode(&buf, Image(width, height), &jpeg.Options{Quality: JPEGQuality})
+	if err != nil {
+		panic(fmt.Sprintf("testutil: failed to encode JPEG: %v", err))
+	}
+
+	return buf.Bytes()
+}
+
+func encodePNG(img image.Image) []byte {
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, img)
+	if err != nil {
+		panic(fmt.Sprintf("testutil: failed to encode PNG: %v", err))
+	}
+
+	return buf.Bytes()
+}
+
+// Truncated returns the first half of an image, as if a download or upload
+// was cut short.  Its format can still be recognized from its signature, but it
+// doesn't decode.
+func Truncated(imgBytes []byte) []byte {
+	return bytes.Clone(imgBytes[:len(imgBytes)/2])
+}
+
+// BadMagic returns an image with its signature overwritten, so that its format
+// isn't recognized.
+func BadMagic(imgBytes []byte) []byte {
+	broken := bytes.Clone(imgBytes)
+	copy(broken, "XXXX")
+
+	return broken
+}
+
+// pngIHDRChecksum is the offset of the checksum of a PNG's IHDR chunk, which
+// always follows the 8 byte signature and the 13 bytes of the chunk's data.
+const pngIHDRChecksum = 8 + 8 + 13
+
+// BadPNGChecksum returns a PNG of the given size whose IHDR chunk has the wrong
+// checksum.
+func BadPNGChecksum(width int, height int) []byte {
+	broken := PNG(width, height)
+	broken[pngIHDRChecksum] ^= 0xff
+
+	return broken
+}
+
+// JPEGWithoutEOI returns a JPEG of the given size without its end of image
+// marker, as some cameras and encoders write them.  Its size can be read, and
+// lenient decoders accept it, but image/jpeg doesn't.
+func JPEGWithoutEOI(width int, height int) []byte {
+	valid := JPEG(width, height)
+
+	return valid[:len(valid)-2]
+}
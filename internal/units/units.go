@@ -0,0 +1,197 @@
+// Package units parses the human-friendly durations and sizes used in the config
+// and on the command line, e.g. "90s", "30d", and "2GB".
+//
+// Duration and Size can be used directly as config fields and kong flags: they
+// are parsed, and so validated, as the config or arguments are decoded.
+package units
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Units of time that ParseDuration accepts in addition to time.ParseDuration's.
+const (
+	Day  = 24 * time.Hour
+	Week = 7 * Day
+)
+
+// ParseDuration parses a duration like time.ParseDuration, but also accepts days
+// and weeks, e.g. "30d" or "2w".  Negative durations are rejected.
+func ParseDuration(s string) (time.Duration, error) {
+	trimmed := strings.TrimSpace(s)
+
+	for suffix, unit := range map[string]time.Duration{"d": Day, "w": Week} {
+		count, ok := strings.CutSuffix(trimmed, suffix)
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseFloat(count, 64)
+		if err != nil || parsed < 0 {
+			return 0, fmt.Errorf("failed to parse %q as a duration", s)
+		}
+
+		return time.Duration(parsed * float64(unit)), nil
+	}
+
+	parsed, err := time.ParseDuration(trimmed)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("failed to parse %q as a duration", s)
+	}
+
+	return parsed, nil
+}
+
+// ParseSize parses a size in bytes with an optional unit, e.g. "500MB" or "10G".
+// Units are powers of 1024, whether they are written "GB" or "GiB".  Sizes must
+// be positive.
+func ParseSize(s string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(s))
+	trimmed = strings.TrimSuffix(strings.TrimSuffix(trimmed, "IB"), "B")
+
+	multiplier := int64(1)
+
+	if trimmed != "" {
+		switch trimmed[len(trimmed)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+	}
+
+	if multiplier > 1 {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+
+	count, err := strconv.ParseFloat(strings.TrimSpace(trimmed), 64)
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("failed to parse %q as a size", s)
+	}
+
+	return int64(count * float64(multiplier)), nil
+}
+
+// Duration is a time.Duration that is written as a string like "90s" or "2w",
+// parsed by ParseDuration.  In JSON it may also be a number of seconds.
+type Duration time.Duration
+
+// UnmarshalText parses a duration with ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// MarshalText writes the duration in time.Duration's format, e.g. "15m0s".
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON parses a string with ParseDuration, or a number as seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+
+	if !bytes.HasPrefix(data, []byte(`"`)) && json.Unmarshal(data, &seconds) == nil {
+		if seconds < 0 {
+			return fmt.Errorf("duration must not be negative, got %v seconds", seconds)
+		}
+
+		*d = Duration(seconds * float64(time.Second))
+
+		return nil
+	}
+
+	var text string
+
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("a duration must be a string like \"90s\" or a number of seconds, got %s", data)
+	}
+
+	return d.UnmarshalText([]byte(text))
+}
+
+// String formats the duration like time.Duration.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Size is a number of bytes that is written as a string like "500MB", parsed by
+// ParseSize.  In JSON it may also be a number of bytes.
+type Size int64
+
+// UnmarshalText parses a size with ParseSize.
+func (s *Size) UnmarshalText(text []byte) error {
+	parsed, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+
+	*s = Size(parsed)
+
+	return nil
+}
+
+// MarshalText writes the size with the largest unit that divides it, e.g. "2GB".
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalJSON parses a string with ParseSize, or a number as bytes.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var count int64
+
+	if !bytes.HasPrefix(data, []byte(`"`)) && json.Unmarshal(data, &count) == nil {
+		if count <= 0 {
+			return fmt.Errorf("size must be positive, got %d bytes", count)
+		}
+
+		*s = Size(count)
+
+		return nil
+	}
+
+	var text string
+
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("a size must be a string like \"500MB\" or a number of bytes, got %s", data)
+	}
+
+	return s.UnmarshalText([]byte(text))
+}
+
+// String formats the size with the largest unit that divides it, e.g. "2GB" or
+// "1536KB".
+func (s Size) String() string {
+	for _, v := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+	} {
+		if s != 0 && int64(s)%v.size == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/v.size, v.suffix)
+		}
+	}
+
+	return fmt.Sprintf("%dB", int64(s))
+}
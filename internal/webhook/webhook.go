@@ -0,0 +1,95 @@
+// Package webhook sends signed JSON notifications to a URL.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// SignatureHeader is the header that carries the signature of the request, as
+// returned by Sign.
+const SignatureHeader = "X-Sdcli-Signature"
+
+// TimestampHeader is the header that carries the Unix time the request was sent
+// at.  It is signed along with the body, so receivers can reject old requests
+// that are replayed.
+const TimestampHeader = "X-Sdcli-Timestamp"
+
+// Client sends payloads to a webhook.
+type Client struct {
+	url        string
+	secret     string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+// New creates a new Client.  If secret is empty, requests are not signed.
+func New(url string, secret string, headers map[string]string) *Client {
+	return &Client{
+		url:        url,
+		secret:     secret,
+		headers:    headers,
+		httpClient: backend.NewHTTPClient(),
+	}
+}
+
+// Sign returns the signature of a request sent at timestamp, as sent in
+// SignatureHeader: the HMAC-SHA256 of the timestamp, a ".", and the body,
+// formatted as "sha256=<hex>".
+func Sign(secret string, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Send marshals payload to JSON and POSTs it to the webhook.
+func (c *Client) Send(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+
+	if c.secret != "" {
+		req.Header.Set(SignatureHeader, Sign(c.secret, timestamp, body))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("webhook returned unexpected status code %d. Response: %s", resp.StatusCode, string(respBody))
+	}
+
+	return nil
+}
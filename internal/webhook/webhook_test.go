@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendSignsTimestampAndBody(t *testing.T) {
+	var (
+		header http.Header
+		body   []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret", map[string]string{"Authorization": "Bearer token"})
+
+	err := client.Send(context.Background(), map[string]string{"event": "generation.completed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := header.Get(TimestampHeader)
+	if timestamp == "" {
+		t.Fatalf("expected the %s header to be set", TimestampHeader)
+	}
+
+	want := Sign("secret", timestamp, body)
+	if got := header.Get(SignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+
+	// A replayed body with a new timestamp doesn't match the old signature.
+	if Sign("secret", timestamp+"0", body) == want {
+		t.Error("expected the signature to depend on the timestamp")
+	}
+
+	if got := header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// Computed independently with:
+	//   printf '1718822400.{}' | openssl dgst -sha256 -hmac secret
+	const want = "sha256=0f69b70cc2a5b5a6acd71250a87f32a8a70ffcc71f6483f453ae3d972b65403b"
+
+	if got := Sign("secret", "1718822400", []byte("{}")); got != want {
+		t.Errorf("Sign() = %q, want %q", got, want)
+	}
+}
+
+func TestSendUnsigned(t *testing.T) {
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	err := New(server.URL, "", nil).Send(context.Background(), struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := header.Get(SignatureHeader); got != "" {
+		t.Errorf("expected no signature without a secret, got %q", got)
+	}
+}
+
+func TestSendErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	err := New(server.URL, "", nil).Send(context.Background(), struct{}{})
+	if err == nil {
+		t.Fatal("expected an error for a 502 response")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/stability"
+	"go.uber.org/zap/zapcore"
+)
+
+// exitKinds names the exit codes in JSON errors, so programs don't have to
+// know the numbers.
+var exitKinds = map[int]string{
+	exitFailure:         "failure",
+	exitInvalid:         "invalid",
+	exitAPI:             "api",
+	exitContentFiltered: "content_filtered",
+	exitRateLimited:     "rate_limited",
+	exitIO:              "io",
+	exitInterrupted:     "interrupted",
+}
+
+// jsonError is an error as it is written to stdout with --json.
+type jsonError struct {
+	// What failed, e.g. "failed to generate image".
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+
+	// The kind of error, e.g. "rate_limited", and the exit code sdcli exits
+	// with, or would exit with if the error was fatal.
+	Code     string `json:"code"`
+	ExitCode int    `json:"exit_code"`
+
+	// The API endpoint that failed, its status code, and the error message in
+	// its response, if the error came from an API.
+	Endpoint   string `json:"endpoint,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	APIMessage string `json:"api_message,omitempty"`
+
+	// Whether the same request may succeed if it is sent again later.
+	Retryable bool `json:"retryable"`
+
+	// Whether sdcli exits because of the error.  Failures in a batch that didn't
+	// stop it, e.g. one line of --stdin, aren't fatal.
+	Fatal bool `json:"fatal"`
+
+	// The other fields that were logged with the error, e.g. the prompt.
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// newJSONError describes an error logged with message.  err may be nil, e.g.
+// when a command rejected its arguments.
+func newJSONError(message string, err error, fatal bool) jsonError {
+	code := exitCode(err)
+
+	described := jsonError{
+		Message:  message,
+		Code:     exitKinds[code],
+		ExitCode: code,
+		Fatal:    fatal,
+	}
+
+	if err == nil {
+		return described
+	}
+
+	described.Error = err.Error()
+
+	var (
+		apiErr *backend.APIError
+		urlErr *url.Error
+	)
+
+	switch {
+	case errors.As(err, &apiErr):
+		described.Endpoint = apiErr.URL
+		described.StatusCode = apiErr.StatusCode
+		described.APIMessage = apiErr.Message()
+	case errors.As(err, &urlErr):
+		// The request didn't get a response, e.g. the network is down.
+		described.Endpoint = urlErr.URL
+	}
+
+	described.Retryable = stability.IsRetryable(err)
+
+	return described
+}
+
+// jsonErrorCore writes errors logged at the error level or above to stdout as
+// JSON objects, one per line, instead of to the log, for --json.  Other entries
+// are logged as usual.
+type jsonErrorCore struct {
+	zapcore.Core
+
+	out    zapcore.WriteSyncer
+	fields []zapcore.Field
+}
+
+// newJSONErrorCore wraps core to write errors to out as JSON.
+func newJSONErrorCore(core zapcore.Core, out zapcore.WriteSyncer) zapcore.Core {
+	return &jsonErrorCore{Core: core, out: zapcore.Lock(out)}
+}
+
+func (c *jsonErrorCore) With(fields []zapcore.Field) zapcore.Core {
+	return &jsonErrorCore{
+		Core:   c.Core.With(fields),
+		out:    c.out,
+		fields: append(slices.Clip(c.fields), fields...),
+	}
+}
+
+func (c *jsonErrorCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Level < zapcore.ErrorLevel {
+		return c.Core.Check(entry, checked)
+	}
+
+	return checked.AddCore(entry, c)
+}
+
+func (c *jsonErrorCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	var err error
+
+	extra := zapcore.NewMapObjectEncoder()
+
+	for _, v := range append(slices.Clip(c.fields), fields...) {
+		if fieldErr, ok := v.Interface.(error); ok && v.Type == zapcore.ErrorType {
+			err = fieldErr
+			continue
+		}
+
+		v.AddTo(extra)
+	}
+
+	fatal := entry.Level >= zapcore.DPanicLevel
+
+	// Errors that aren't fatal and were logged without an error only add
+	// context, so they are logged as usual.
+	if err == nil && !fatal {
+		return c.Core.Write(entry, fields)
+	}
+
+	described := newJSONError(entry.Message, err, fatal)
+	if len(extra.Fields) > 0 {
+		described.Fields = extra.Fields
+	}
+
+	data, err := json.Marshal(described)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.out.Write(append(data, '\n'))
+
+	return err
+}
+
+func (c *jsonErrorCore) Sync() error {
+	return errors.Join(c.Core.Sync(), c.out.Sync())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/mask"
+	"go.uber.org/zap"
+)
+
+type MaskCommand struct {
+	Make MaskMakeCommand `cmd:"" help:"Build an inpainting mask from an image."`
+}
+
+type MaskMakeCommand struct {
+	From      string `optional:"from" default:"alpha" enum:"alpha,color,threshold" help:"What to build the mask from: the image's transparent areas, the areas close to --color, or the areas at least as light as --threshold."`
+	Color     string `optional:"color" default:"#00ff00" help:"The key color to mask, as hex.  Only used with --from color."`
+	Tolerance uint8  `optional:"tolerance" default:"32" help:"How far, from 0 to 255, each channel may be from --color and still be masked.  Only used with --from color."`
+	Threshold uint8  `optional:"threshold" default:"128" help:"The luminance, from 0 to 255, at or above which pixels are masked.  Only used with --from threshold."`
+	Invert    bool   `optional:"invert" help:"Keep the masked areas and edit everything else."`
+	Output    string `optional:"output" short:"o" type:"path" help:"Where to save the mask.  Defaults to the image's name with -mask.png."`
+	Image     string `arg:"" type:"existingfile" help:"The image to build the mask from."`
+}
+
+// maskOutputPath returns where to save the mask of an image by default, e.g.
+// "photo-mask.png" for "photo.jpg".
+func maskOutputPath(imagePath string) string {
+	return strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + "-mask.png"
+}
+
+func (m MaskMakeCommand) Run(ctx *Context) error {
+	data, err := os.ReadFile(m.Image)
+	if err != nil {
+		ctx.Logger.Fatal("failed to read image", zap.String("path", m.Image), zap.Error(err))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		ctx.Logger.Fatal("failed to decode image", zap.String("path", m.Image), zap.Error(err))
+	}
+
+	var built *image.Gray
+
+	switch m.From {
+	case "alpha":
+		built, err = mask.FromAlpha(img)
+		if err != nil {
+			ctx.Logger.Fatal("unable to build mask, use --from color or --from threshold instead", zap.Error(invalid(err)))
+		}
+	case "color":
+		key, err := mask.ParseColor(m.Color)
+		if err != nil {
+			ctx.Logger.Fatal("invalid --color", zap.Error(invalid(err)))
+		}
+
+		built = mask.FromColorKey(img, key, m.Tolerance)
+	case "threshold":
+		built = mask.FromThreshold(img, m.Threshold)
+	}
+
+	if m.Invert {
+		mask.Invert(built)
+	}
+
+	coverage := mask.Coverage(built)
+	if coverage == 0 || coverage == 1 {
+		ctx.Logger.Warn("the mask covers none or all of the image", zap.Float64("coverage", coverage))
+	}
+
+	output := m.Output
+	if output == "" {
+		output = maskOutputPath(m.Image)
+	}
+
+	err = writePNG(output, built)
+	if err != nil {
+		ctx.Logger.Fatal("failed to save mask", zap.String("path", output), zap.Error(err))
+	}
+
+	ctx.Logger.Info("saved mask", zap.String("path", output), zap.String("coverage", fmt.Sprintf("%.1f%%", coverage*100)))
+
+	return nil
+}
+
+// writePNG saves an image as a PNG, refusing to overwrite an existing file.
+func writePNG(path string, img image.Image) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(fd, img)
+	if err != nil {
+		fd.Close()
+		os.Remove(path)
+
+		return fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	return fd.Close()
+}
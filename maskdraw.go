@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/mask"
+	"go.uber.org/zap"
+)
+
+// maskEditorColor is the color to paint the areas to edit with in the mask
+// editor, and maskEditorTolerance how far from it painted pixels may be, e.g.
+// after antialiasing.
+var (
+	maskEditorColor     = color.RGBA{G: 255, A: 255}
+	maskEditorTolerance = uint8(32)
+)
+
+var errDrawMaskFlags = errors.New("--draw-mask can't be combined with --mask or --image-dir")
+
+// checkDrawMask returns an error if a mask can't be drawn with the given flags.
+func (e EditCommand) checkDrawMask() error {
+	if e.Mask != "" || e.ImageDir != "" {
+		return invalid(errDrawMaskFlags)
+	}
+
+	if e.Operation != "inpaint" && e.Operation != "erase" {
+		return invalid(fmt.Errorf("--draw-mask is only used by inpaint and erase, not %s", e.Operation))
+	}
+
+	return nil
+}
+
+// drawMask lets the user mark the areas of an image to edit, by painting them in
+// the configured mask editor, or by typing rectangles if there is none.  The
+// mask is saved next to the image, so it can be reused with --mask, and its path
+// is returned.
+func drawMask(ctx *Context, imagePath string) (string, error) {
+	output := maskOutputPath(imagePath)
+
+	_, err := os.Stat(output)
+	if err == nil {
+		return "", invalid(fmt.Errorf("%s already exists, pass it with --mask or remove it to draw a new mask", output))
+	}
+
+	data, err := imageSource{Path: imagePath}.readForUpload(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var built *image.Gray
+
+	if ctx.Config.MaskEditor != "" {
+		built, err = paintMask(ctx, img, imagePath)
+	} else {
+		built, err = promptMask(os.Stdin, os.Stderr, imagePath, img.Bounds())
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	coverage := mask.Coverage(built)
+	if coverage == 0 {
+		return "", invalid(errors.New("the mask is empty, no areas were marked to edit"))
+	}
+
+	err = writePNG(output, built)
+	if err != nil {
+		return "", fmt.Errorf("failed to save mask: %w", err)
+	}
+
+	ctx.Logger.Info("saved mask", zap.String("path", output), zap.String("coverage", fmt.Sprintf("%.1f%%", coverage*100)))
+
+	return output, nil
+}
+
+// paintMask opens a copy of img in the configured mask editor, waits for it to
+// exit, and builds a mask from the areas painted in maskEditorColor.  Areas of
+// that color in the original image aren't masked.
+func paintMask(ctx *Context, img image.Image, imagePath string) (*image.Gray, error) {
+	dir, err := os.MkdirTemp("", "sdcli-mask-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	canvas := filepath.Join(dir, strings.TrimSuffix(filepath.Base(imagePath), filepath.Ext(imagePath))+"-paint.png")
+
+	err = writePNG(canvas, img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image to paint: %w", err)
+	}
+
+	ctx.Logger.Info("paint the areas to edit #00ff00, then save the image and close the editor",
+		zap.String("editor", ctx.Config.MaskEditor), zap.String("path", canvas))
+
+	cmd := exec.CommandContext(ctx.Ctx, ctx.Config.MaskEditor, canvas)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("mask editor %q failed: %w", ctx.Config.MaskEditor, err)
+	}
+
+	data, err := os.ReadFile(canvas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read painted image: %w", err)
+	}
+
+	painted, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode painted image: %w", err)
+	}
+
+	if painted.Bounds().Size() != img.Bounds().Size() {
+		return nil, fmt.Errorf("the image was resized in the mask editor, from %v to %v",
+			img.Bounds().Size(), painted.Bounds().Size())
+	}
+
+	built := mask.FromColorKey(painted, maskEditorColor, maskEditorTolerance)
+	original := mask.FromColorKey(img, maskEditorColor, maskEditorTolerance)
+
+	for i, v := range original.Pix {
+		if v != 0 {
+			built.Pix[i] = 0
+		}
+	}
+
+	return built, nil
+}
+
+// promptMask asks for the areas of an image to edit as rectangles, reading them
+// from r until they parse, and builds a mask from them.
+func promptMask(r io.Reader, w io.Writer, imagePath string, bounds image.Rectangle) (*image.Gray, error) {
+	fmt.Fprintf(w, "%s is %dx%d.  Enter the areas to edit as x,y,width,height in pixels or\n"+
+		"percentages, separated by spaces, e.g. 10%%,20%%,30%%,40%%\n",
+		imagePath, bounds.Dx(), bounds.Dy())
+
+	reader := bufio.NewReader(r)
+
+	for {
+		fmt.Fprint(w, "> ")
+
+		line, err := reader.ReadString('\n')
+		if err != nil && strings.TrimSpace(line) == "" {
+			if errors.Is(err, io.EOF) {
+				return nil, invalid(errors.New("no areas to edit were given"))
+			}
+
+			return nil, fmt.Errorf("failed to read areas to edit: %w", err)
+		}
+
+		rects, parseErr := parseMaskRectangles(line, bounds.Dx(), bounds.Dy())
+		if parseErr == nil {
+			return mask.FromRectangles(bounds.Dx(), bounds.Dy(), rects...), nil
+		}
+
+		fmt.Fprintln(w, parseErr)
+
+		if err != nil {
+			return nil, invalid(parseErr)
+		}
+	}
+}
+
+// parseMaskRectangles parses rectangles written as x,y,width,height and
+// separated by spaces, e.g. "10,20,300,200 50%,50%,25%,25%".  Percentages are of
+// the image's width for x and width, and of its height for y and height.
+func parseMaskRectangles(s string, width int, height int) ([]image.Rectangle, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("no areas were given")
+	}
+
+	rects := make([]image.Rectangle, 0, len(fields))
+
+	for _, field := range fields {
+		parts := strings.Split(field, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid area %q, must be x,y,width,height", field)
+		}
+
+		var values [4]int
+
+		for i, part := range parts {
+			size := width
+			if i%2 == 1 {
+				size = height
+			}
+
+			value, err := parseMaskCoordinate(part, size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid area %q: %w", field, err)
+			}
+
+			values[i] = value
+		}
+
+		rect := image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])
+		if rect.Intersect(image.Rect(0, 0, width, height)).Empty() {
+			return nil, fmt.Errorf("area %q is outside the %dx%d image", field, width, height)
+		}
+
+		rects = append(rects, rect)
+	}
+
+	return rects, nil
+}
+
+// parseMaskCoordinate parses a number of pixels, or a percentage of size.
+func parseMaskCoordinate(s string, size int) (int, error) {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("%q is not a valid percentage", s)
+		}
+
+		return int(value / 100 * float64(size)), nil
+	}
+
+	value, err := strconv.Atoi(s)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%q is not a valid number of pixels", s)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// negativeReference matches a reference to a negative prompt bundle, e.g.
+// "@photo", at the start of a negative prompt or after a space or comma.
+var negativeReference = regexp.MustCompile(`(^|[\s,])@([\w-]+)`)
+
+// expandNegative replaces references to the negative prompt bundles in the
+// config, e.g. "@photo", with their prompts, so that bundles can be combined
+// with each other and with inline negative prompts, e.g. "@photo, extra fingers".
+// It returns an error if a bundle isn't in the config.
+func (c Config) expandNegative(negative string) (string, error) {
+	var (
+		expanded strings.Builder
+		last     int
+	)
+
+	for _, match := range negativeReference.FindAllStringSubmatchIndex(negative, -1) {
+		// The name starts after the separator and the @.
+		name := negative[match[4]:match[5]]
+
+		bundle, ok := c.Negatives[name]
+		if !ok {
+			return "", invalid(c.unknownNegative(name))
+		}
+
+		expanded.WriteString(negative[last:match[3]])
+		expanded.WriteString(bundle)
+
+		last = match[1]
+	}
+
+	expanded.WriteString(negative[last:])
+
+	return expanded.String(), nil
+}
+
+// unknownNegative returns the error for a reference to a negative prompt bundle
+// that isn't in the config.
+func (c Config) unknownNegative(name string) error {
+	if len(c.Negatives) == 0 {
+		return fmt.Errorf("no negative prompt bundles are configured, so @%s can't be used", name)
+	}
+
+	names := make([]string, 0, len(c.Negatives))
+	for k := range c.Negatives {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	if suggestions := suggest(name, names); len(suggestions) > 0 {
+		return fmt.Errorf("unknown negative prompt bundle @%s, did you mean @%s?", name, strings.Join(suggestions, " or @"))
+	}
+
+	return fmt.Errorf("unknown negative prompt bundle @%s, the bundles are @%s", name, strings.Join(names, ", @"))
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/SethCurry/sdcli/internal/objectstore"
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/mitchellh/go-homedir"
+)
+
+// outputDestination is where generated images are written to.
+type outputDestination interface {
+	// Write saves data with the given file name, returning the path or URL it was
+	// saved to.
+	Write(ctx context.Context, name string, data []byte) (string, error)
+}
+
+// streamingOutput is an outputDestination that can save a file as it is
+// produced, without the whole file being held in memory first.
+type streamingOutput interface {
+	outputDestination
+
+	// WriteFrom saves what write writes with the given file name, like Write.
+	WriteFrom(ctx context.Context, name string, write func(w io.Writer) error) (string, error)
+}
+
+type ObjectStorageConfig struct {
+	// The endpoint of an S3-compatible service, e.g. "https://minio.example.com".
+	// Defaults to AWS for s3:// URLs and Google Cloud Storage for gs:// URLs.
+	Endpoint string `json:"endpoint"`
+
+	// The region of the bucket.  Defaults to $AWS_REGION, or "us-east-1".
+	Region string `json:"region"`
+
+	// The credentials to upload with.  For s3:// URLs these default to the
+	// standard AWS environment variables.  For gs:// URLs they must be HMAC keys
+	// for a service account.
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+}
+
+// The modes images and directories are created with when none are configured.
+// The umask is applied to them as usual.
+const (
+	defaultFileMode      fs.FileMode = 0o644
+	defaultDirectoryMode fs.FileMode = 0o755
+)
+
+// localOutput writes images to a directory on disk.
+type localOutput struct {
+	dir string
+
+	// The modes to create files and directories with, or zero for the defaults.
+	// Configured modes are set exactly, ignoring the umask.
+	fileMode      fs.FileMode
+	directoryMode fs.FileMode
+
+	// Fail instead of creating dir if it doesn't exist.  The directory is only
+	// created once an image is saved, so commands that don't save any leave the
+	// disk alone.
+	noCreate bool
+}
+
+// mkdirAll creates dir and any missing parents, like os.MkdirAll, using the
+// configured directory mode.
+func (l localOutput) mkdirAll(dir string) error {
+	if l.directoryMode == 0 {
+		return os.MkdirAll(dir, defaultDirectoryMode)
+	}
+
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+
+		return nil
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		err = l.mkdirAll(parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Mkdir(dir, l.directoryMode)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return os.Chmod(dir, l.directoryMode)
+}
+
+// maxNameAttempts is how many suffixed names localOutput tries before giving up
+// on finding an unused one.
+const maxNameAttempts = 1000
+
+// Write saves data to name in the output directory.  If a file with that name
+// already exists, e.g. because two images were saved in the same second, a
+// suffix is added to the name instead, so "1718822400.png" becomes
+// "1718822400-1.png".
+func (l localOutput) Write(ctx context.Context, name string, data []byte) (string, error) {
+	return l.WriteFrom(ctx, name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteFrom saves what write writes to name in the output directory, adding a
+// suffix to the name if it is taken, like Write.  If write fails, the partially
+// written file is removed.
+func (l localOutput) WriteFrom(_ context.Context, name string, write func(w io.Writer) error) (string, error) {
+	target := filepath.Join(l.dir, name)
+
+	if l.noCreate {
+		_, err := os.Stat(l.dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("output directory %q does not exist", l.dir)
+		}
+	}
+
+	err := l.mkdirAll(filepath.Dir(target))
+	if err != nil {
+		return "", fmt.Errorf("failed to create output directory for %q: %w", target, err)
+	}
+
+	fileMode := l.fileMode
+	if fileMode == 0 {
+		fileMode = defaultFileMode
+	}
+
+	for i := 0; i < maxNameAttempts; i++ {
+		outputFile := suffixedName(target, i)
+
+		// O_EXCL makes finding an unused name and claiming it atomic, so
+		// concurrent saves can't overwrite each other.
+		fd, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("failed to create output file %q: %w", outputFile, err)
+		}
+
+		if l.fileMode != 0 {
+			err = fd.Chmod(l.fileMode)
+			if err != nil {
+				fd.Close()
+				os.Remove(outputFile)
+
+				return "", fmt.Errorf("failed to set the mode of output file %q: %w", outputFile, err)
+			}
+		}
+
+		err = write(fd)
+		if closeErr := fd.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			// Don't leave a partially written image behind.
+			os.Remove(outputFile)
+
+			return "", fmt.Errorf("failed while writing to output file %q: %w", outputFile, err)
+		}
+
+		return outputFile, nil
+	}
+
+	return "", fmt.Errorf("failed to find an unused name for output file %q", target)
+}
+
+// objectStoreOutput uploads images straight to object storage without writing
+// them to disk.
+type objectStoreOutput struct {
+	store *objectstore.Store
+}
+
+// Write uploads data as name.  Like localOutput, if an object with that name
+// already exists a suffix is added to the name instead.
+func (o objectStoreOutput) Write(ctx context.Context, name string, data []byte) (string, error) {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	for i := 0; i < maxNameAttempts; i++ {
+		objectURL, err := o.store.Put(ctx, suffixedName(name, i), data, contentType)
+		if errors.Is(err, objectstore.ErrExists) {
+			continue
+		}
+
+		return objectURL, err
+	}
+
+	return "", fmt.Errorf("failed to find an unused name for %q", o.store.URL(name))
+}
+
+// suffixedName returns the name to try on the given attempt at finding an unused
+// one, adding a suffix after the first, e.g. "1718822400-1.png".
+func suffixedName(name string, attempt int) string {
+	if attempt == 0 {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), attempt, ext)
+}
+
+func envOrDefault(value string, envVar string) string {
+	if value != "" {
+		return value
+	}
+
+	return os.Getenv(envVar)
+}
+
+// newOutputDestination creates the output destination for the config: the output
+// directory, an HTTP upload, or both.
+func newOutputDestination(config Config) (outputDestination, error) {
+	if config.HTTPOutput.URL == "" {
+		return newDirectoryOutput(config)
+	}
+
+	upload := httpOutput{config: config.HTTPOutput, client: backend.NewHTTPClient()}
+
+	if config.HTTPOutput.uploadOnly() {
+		return upload, nil
+	}
+
+	primary, err := newDirectoryOutput(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return mirroredOutput{primary: primary, upload: upload}, nil
+}
+
+// newDirectoryOutput creates the output destination for the configured output
+// directory, which may be a local path or an s3:// or gs:// URL.
+func newDirectoryOutput(config Config) (outputDestination, error) {
+	if !objectstore.IsURL(config.OutputDirectory) {
+		fileMode, err := parseFileMode(config.OutputFileMode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output_file_mode: %w", err)
+		}
+
+		directoryMode, err := parseFileMode(config.OutputDirectoryMode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output_directory_mode: %w", err)
+		}
+
+		dir := config.OutputDirectory
+		if dir == "" {
+			// Save to the working directory, as before the directory was created
+			// when missing.
+			dir = "."
+		}
+
+		// Images are recorded in the history by the path they were saved to, which
+		// has to be absolute for prune to find them from another directory.
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve output directory: %w", err)
+		}
+
+		return localOutput{
+			dir:           dir,
+			fileMode:      fileMode,
+			directoryMode: directoryMode,
+			noCreate:      config.NoCreateOutputDirectory,
+		}, nil
+	}
+
+	storageConfig := config.ObjectStorage
+	credentials := objectstore.Credentials{
+		AccessKeyID:     storageConfig.AccessKeyID,
+		SecretAccessKey: storageConfig.SecretAccessKey,
+		SessionToken:    storageConfig.SessionToken,
+	}
+	region := storageConfig.Region
+
+	if strings.HasPrefix(config.OutputDirectory, "s3://") {
+		credentials.AccessKeyID = envOrDefault(credentials.AccessKeyID, "AWS_ACCESS_KEY_ID")
+		credentials.SecretAccessKey = envOrDefault(credentials.SecretAccessKey, "AWS_SECRET_ACCESS_KEY")
+		credentials.SessionToken = envOrDefault(credentials.SessionToken, "AWS_SESSION_TOKEN")
+		region = envOrDefault(region, "AWS_REGION")
+	}
+
+	store, err := objectstore.New(config.OutputDirectory, storageConfig.Endpoint, region, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return objectStoreOutput{store: store}, nil
+}
+
+// expandOutputDirectory expands environment variables, e.g. $HOME, in the
+// configured output directory, and a leading ~ to the user's home directory.
+func expandOutputDirectory(dir string) (string, error) {
+	expanded, err := homedir.Expand(os.ExpandEnv(dir))
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %q: %w", dir, err)
+	}
+
+	return expanded, nil
+}
+
+// parseFileMode parses an octal file mode, e.g. "0664".  An empty mode parses
+// as zero.
+func parseFileMode(mode string) (fs.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %q as an octal mode: %w", mode, err)
+	}
+
+	if parsed == 0 || parsed > 0o7777 {
+		return 0, fmt.Errorf("mode %q is out of range", mode)
+	}
+
+	fileMode := fs.FileMode(parsed) & fs.ModePerm
+
+	// The special bits are stored differently in an fs.FileMode than in a Unix
+	// mode, e.g. for the setgid bit of a shared directory.
+	if parsed&0o4000 != 0 {
+		fileMode |= fs.ModeSetuid
+	}
+
+	if parsed&0o2000 != 0 {
+		fileMode |= fs.ModeSetgid
+	}
+
+	if parsed&0o1000 != 0 {
+		fileMode |= fs.ModeSticky
+	}
+
+	return fileMode, nil
+}
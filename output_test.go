@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SethCurry/sdcli/internal/testutil"
+	"github.com/SethCurry/sdcli/pkg/imagemeta"
+)
+
+func TestLocalOutputWriteFrom(t *testing.T) {
+	output := localOutput{dir: t.TempDir()}
+	ctx := context.Background()
+
+	first, err := output.Write(ctx, "image.jpeg", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := output.WriteFrom(ctx, "image.jpeg", func(w io.Writer) error {
+		_, err := w.Write([]byte("second"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(first) != "image.jpeg" || filepath.Base(second) != "image-1.jpeg" {
+		t.Errorf("got %q and %q, want image.jpeg and image-1.jpeg", first, second)
+	}
+
+	data, err := os.ReadFile(second)
+	if err != nil || string(data) != "second" {
+		t.Errorf("expected %s to hold what was written, got %q (%v)", second, data, err)
+	}
+
+	errWrite := errors.New("write failed")
+
+	_, err = output.WriteFrom(ctx, "broken.jpeg", func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(output.dir, "broken.jpeg")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the partially written file to be removed, got %v", err)
+	}
+}
+
+func TestStreamJPEGToOutput(t *testing.T) {
+	ctx := &Context{}
+	output := localOutput{dir: t.TempDir()}
+	image := testutil.JPEG(32, 32)
+	meta := imagemeta.Metadata{Prompt: "A bear riding a unicycle in space"}
+
+	saved, returned, err := ctx.streamJPEG(context.Background(), output, "bear.jpeg", image, meta, &generationResult{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(returned, image) {
+		t.Error("expected the image to be returned as it was given")
+	}
+
+	data, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := imagemeta.AddToJPEG(image, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, want) {
+		t.Error("expected the saved image to match one with the metadata added in memory")
+	}
+}
+
+func TestLocalOutputCreatesDirectoryLazily(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "images", "sdcli")
+
+	output, err := newDirectoryOutput(Config{OutputDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the output directory not to be created before an image is saved, got %v", err)
+	}
+
+	_, err = output.Write(context.Background(), "bear.png", testutil.PNG(8, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "bear.png")); err != nil {
+		t.Errorf("expected the image to be saved in the created directory: %v", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "unmounted")
+
+	output, err = newDirectoryOutput(Config{OutputDirectory: missing, NoCreateOutputDirectory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = output.Write(context.Background(), "bear.png", testutil.PNG(8, 8))
+	if err == nil {
+		t.Error("expected saving to fail with no_create_output_directory")
+	}
+
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the output directory not to be created, got %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/pipeline"
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"go.uber.org/zap"
+)
+
+type PipelineCommand struct {
+	Run PipelineRunCommand `cmd:"" help:"Run the steps of a pipeline file."`
+}
+
+type PipelineRunCommand struct {
+	Set  map[string]string `optional:"set" help:"Override a param of the pipeline, as key=value."`
+	Name string            `optional:"name" help:"The name of the directory under pipelines/ in the output directory to save the images in.  Defaults to the pipeline file's name and the current time."`
+	File string            `arg:"" type:"existingfile" help:"The pipeline file, in YAML."`
+}
+
+func (p PipelineRunCommand) Run(ctx *Context) error {
+	data, err := os.ReadFile(p.File)
+	if err != nil {
+		ctx.Logger.Fatal("failed to read pipeline", zap.String("path", p.File), zap.Error(err))
+	}
+
+	file, err := pipeline.Parse(data)
+	if err != nil {
+		ctx.Logger.Fatal("invalid pipeline", zap.String("path", p.File), zap.Error(invalid(err)))
+	}
+
+	err = file.SetParams(p.Set)
+	if err != nil {
+		ctx.Logger.Fatal("invalid --set", zap.Error(invalid(err)))
+	}
+
+	// Check everything the steps need before paying for any of them.
+	for _, v := range file.Steps {
+		err = checkPipelineStep(ctx, v)
+		if err != nil {
+			ctx.Logger.Fatal("unable to run pipeline", zap.String("step", v.Name), zap.Error(err))
+		}
+	}
+
+	name := p.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(p.File), filepath.Ext(p.File)) + "-" + time.Now().Format("20060102-150405")
+	}
+
+	runner := pipelineRunner{
+		ctx:  ctx,
+		file: file,
+		dir:  filepath.Dir(p.File),
+		out:  path.Join("pipelines", name),
+	}
+
+	steps := make([]pipeline.Step, 0, len(file.Steps))
+	for _, v := range file.Steps {
+		steps = append(steps, runner.step(v))
+	}
+
+	built, err := pipeline.New(steps...)
+	if err != nil {
+		ctx.Logger.Fatal("invalid pipeline", zap.String("path", p.File), zap.Error(invalid(err)))
+	}
+
+	ctx.Logger.Info("running pipeline", zap.String("directory", runner.out), zap.Strings("steps", built.Steps()))
+
+	_, err = built.Run(ctx.Ctx)
+	if err != nil && ctx.Ctx.Err() != nil {
+		return ctx.Ctx.Err()
+	} else if err != nil {
+		ctx.Logger.Fatal("pipeline failed", zap.Error(err))
+	}
+
+	return nil
+}
+
+// checkPipelineStep returns an error if the backend can't run a step.  Fields
+// that refer to params or other steps are only known once the pipeline runs, so
+// they aren't checked.
+func checkPipelineStep(ctx *Context, step pipeline.StepSpec) error {
+	literal := func(s string) bool {
+		return s != "" && !strings.Contains(s, "${")
+	}
+
+	if literal(step.OutputFormat) {
+		err := ctx.requireOutputFormat(step.OutputFormat)
+		if err != nil {
+			return err
+		}
+	}
+
+	if literal(step.NegativePrompt) {
+		_, err := ctx.Config.expandNegative(step.NegativePrompt)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch step.Type {
+	case pipeline.TypeGenerate:
+		if literal(step.Model) {
+			err := ctx.requireModel(step.Model)
+			if err != nil {
+				return err
+			}
+		}
+
+		return ctx.requireOperation(backend.OperationTextToImage)
+	case pipeline.TypeUpscale:
+		if !literal(step.Mode) {
+			return ctx.requireOperation(backend.OperationUpscale)
+		}
+
+		return ctx.requireUpscaleMode(step.Mode)
+	case pipeline.TypeEdit:
+		return ctx.requireEditOperation(editOperation(step))
+	case pipeline.TypeRemoveBackground:
+		return ctx.requireEditOperation("remove-background")
+	}
+
+	return nil
+}
+
+// editOperation returns the operation of an edit step, which defaults to
+// inpaint like sdcli edit.
+func editOperation(step pipeline.StepSpec) string {
+	if step.Operation == "" {
+		return "inpaint"
+	}
+
+	return step.Operation
+}
+
+// pipelineRunner runs the steps of a pipeline file.
+type pipelineRunner struct {
+	ctx  *Context
+	file *pipeline.File
+
+	// The directory of the pipeline file, which relative paths in it are
+	// relative to.
+	dir string
+
+	// The directory in the output directory to save the steps' images in.
+	out string
+}
+
+// step returns the pipeline step that runs spec.
+func (r pipelineRunner) step(spec pipeline.StepSpec) pipeline.Step {
+	return pipeline.Step{
+		Name:  spec.Name,
+		Needs: spec.StepNeeds(),
+		Run: func(runCtx context.Context, inputs map[string]*pipeline.Output) (*pipeline.Output, error) {
+			expanded := r.file.Expand(spec, inputs)
+
+			switch spec.Type {
+			case pipeline.TypeGenerate:
+				return r.generate(runCtx, expanded)
+			case pipeline.TypeEdit:
+				return r.edit(expanded, editOperation(expanded), inputs)
+			case pipeline.TypeRemoveBackground:
+				return r.edit(expanded, "remove-background", inputs)
+			case pipeline.TypeUpscale:
+				return r.upscale(expanded, inputs)
+			case pipeline.TypeSave:
+				return r.save(expanded, inputs)
+			case pipeline.TypeHook:
+				return r.hook(runCtx, expanded)
+			}
+
+			return nil, fmt.Errorf("unknown step type %q", spec.Type)
+		},
+	}
+}
+
+// resolve returns a path from the pipeline file relative to the file's
+// directory.
+func (r pipelineRunner) resolve(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(r.dir, name)
+}
+
+// source returns the image a step uses: either another step's image, or a file.
+func (r pipelineRunner) source(step pipeline.StepSpec, inputs map[string]*pipeline.Output) (imageSource, error) {
+	if step.Input == "" {
+		return imageSource{Path: r.resolve(step.Image)}, nil
+	}
+
+	input := inputs[step.Input]
+	if input.Path == "" {
+		return imageSource{}, fmt.Errorf("step %q has no image", step.Input)
+	}
+
+	return outputSource(input), nil
+}
+
+// outputFormat returns the output format of a step, which defaults to png.
+func outputFormat(step pipeline.StepSpec) string {
+	if step.OutputFormat == "" {
+		return "png"
+	}
+
+	return step.OutputFormat
+}
+
+func (r pipelineRunner) generate(runCtx context.Context, step pipeline.StepSpec) (*pipeline.Output, error) {
+	negative, err := r.ctx.Config.expandNegative(step.NegativePrompt)
+	if err != nil {
+		return nil, err
+	}
+
+	gen := generation{
+		Prompt:         step.Prompt,
+		NegativePrompt: negative,
+		Model:          step.Model,
+		Ratio:          step.Ratio,
+		OutputFormat:   outputFormat(step),
+		OutputName:     path.Join(r.out, step.Name),
+	}
+
+	if gen.Model == "" {
+		gen.Model = defaultModel(r.ctx.Backend.Capabilities())
+	}
+
+	if gen.Ratio == "" {
+		gen.Ratio = "1:1"
+	}
+
+	if step.Seed != "" {
+		seed, err := strconv.ParseInt(step.Seed, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed %q: %w", step.Seed, err)
+		}
+
+		gen.Seed = seed
+	}
+
+	if step.CFGScale != "" {
+		cfg, err := strconv.ParseFloat(step.CFGScale, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cfg_scale %q: %w", step.CFGScale, err)
+		}
+
+		gen.CFGScale = float32(cfg)
+	}
+
+	result, err := r.ctx.generate(runCtx, gen)
+	if err != nil {
+		return nil, err
+	}
+
+	return stepOutput(r.ctx, step.Name, result)
+}
+
+func (r pipelineRunner) edit(step pipeline.StepSpec, operation string, inputs map[string]*pipeline.Output) (*pipeline.Output, error) {
+	source, err := r.source(step, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.ctx.checkPrompt(step.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	negative, err := r.ctx.Config.expandNegative(step.NegativePrompt)
+	if err != nil {
+		return nil, err
+	}
+
+	editor := EditCommand{
+		Operation:      operation,
+		Mask:           r.resolve(step.Mask),
+		Search:         step.Search,
+		NegativePrompt: negative,
+		OutputFormat:   outputFormat(step),
+	}
+
+	result, err := editor.edit(r.ctx, source, step.Prompt, path.Join(r.out, step.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return stepOutput(r.ctx, step.Name, result)
+}
+
+func (r pipelineRunner) upscale(step pipeline.StepSpec, inputs map[string]*pipeline.Output) (*pipeline.Output, error) {
+	source, err := r.source(step, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.ctx.checkPrompt(step.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	upscaler := UpscaleCommand{
+		Mode:         step.Mode,
+		OutputFormat: outputFormat(step),
+		Prompt:       step.Prompt,
+	}
+
+	if upscaler.Mode == "" {
+		upscaler.Mode = "fast"
+	}
+
+	result, err := upscaler.upscale(r.ctx, source, path.Join(r.out, step.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return stepOutput(r.ctx, step.Name, result)
+}
+
+// save copies an image to a path outside the output directory, refusing to
+// overwrite an existing file.
+func (r pipelineRunner) save(step pipeline.StepSpec, inputs map[string]*pipeline.Output) (*pipeline.Output, error) {
+	source, err := r.source(step, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := source.read()
+	if err != nil {
+		return nil, err
+	}
+
+	target := r.resolve(step.Path)
+
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	fd, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fd.Write(data)
+	if err != nil {
+		fd.Close()
+		os.Remove(target)
+
+		return nil, fmt.Errorf("failed to write image: %w", err)
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.ctx.Logger.Info("saved image", zap.String("step", step.Name), zap.String("path", target))
+
+	return &pipeline.Output{
+		Path:   target,
+		Image:  data,
+		Values: map[string]string{"path": target},
+	}, nil
+}
+
+// hook runs a command, e.g. to notify someone or post-process an image.  Its
+// output is available to later steps.
+func (r pipelineRunner) hook(runCtx context.Context, step pipeline.StepSpec) (*pipeline.Output, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.CommandContext(runCtx, step.Command[0], step.Command[1:]...)
+	cmd.Dir = r.dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", step.Command[0], err)
+	}
+
+	r.ctx.Logger.Info("ran hook", zap.String("step", step.Name), zap.Strings("command", step.Command))
+
+	return &pipeline.Output{
+		Values: map[string]string{"output": strings.TrimSpace(stdout.String())},
+	}, nil
+}
@@ -0,0 +1,411 @@
+// Package a1111 implements backend.Backend against the API of a local AUTOMATIC1111
+// Stable Diffusion WebUI instance started with --api.
+package a1111
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/png" // Registers the PNG decoder for init images.
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+const (
+	// DefaultBaseURL is the address the WebUI listens on by default.
+	DefaultBaseURL = "http://127.0.0.1:7860"
+
+	// DefaultUpscaler is the upscaler used when none is configured.
+	DefaultUpscaler = "R-ESRGAN 4x+"
+
+	// defaultResolution is the side length of the square image whose area generated
+	// images should roughly match.
+	defaultResolution = 1024
+)
+
+// Client is a client for the AUTOMATIC1111 WebUI API.  It implements backend.Backend.
+type Client struct {
+	baseURL  string
+	steps    int
+	sampler  string
+	upscaler string
+
+	httpClient *http.Client
+}
+
+type ClientOption func(*Client)
+
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithSteps sets the number of sampling steps.  Zero uses the WebUI's default.
+// WithHTTPClient sets the HTTP client requests are sent with, e.g. for different
+// timeouts.  Defaults to backend.NewHTTPClient().
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func WithSteps(steps int) ClientOption {
+	return func(c *Client) {
+		c.steps = steps
+	}
+}
+
+// WithSampler sets the sampler, e.g. "DPM++ 2M".  An empty string uses the WebUI's default.
+func WithSampler(sampler string) ClientOption {
+	return func(c *Client) {
+		c.sampler = sampler
+	}
+}
+
+// WithUpscaler sets the upscaler used by Upscale, e.g. "R-ESRGAN 4x+".
+func WithUpscaler(upscaler string) ClientOption {
+	return func(c *Client) {
+		c.upscaler = upscaler
+	}
+}
+
+func NewClient(options ...ClientOption) *Client {
+	client := &Client{
+		baseURL:    DefaultBaseURL,
+		upscaler:   DefaultUpscaler,
+		httpClient: backend.NewHTTPClient(),
+	}
+
+	for _, v := range options {
+		v(client)
+	}
+
+	return client
+}
+
+var (
+	_ backend.Backend      = (*Client)(nil)
+	_ backend.MultiSampler = (*Client)(nil)
+)
+
+func (c *Client) Name() string {
+	return "a1111"
+}
+
+func (c *Client) Capabilities() backend.Capabilities {
+	return backend.Capabilities{
+		Operations: []backend.Operation{
+			backend.OperationTextToImage,
+			backend.OperationImageToImage,
+			backend.OperationUpscale,
+			backend.OperationEdit,
+		},
+		AspectRatios:   []string{"16:9", "1:1", "21:9", "2:3", "3:2", "4:5", "5:4", "9:16", "9:21"},
+		OutputFormats:  []string{"png", "jpeg"},
+		UpscaleModes:   []string{"fast"},
+		EditOperations: []string{"inpaint"},
+		MaxSamples:     maxSamples,
+	}
+}
+
+// maxSamples is the most images generated with one request, the largest batch
+// size the WebUI offers.
+const maxSamples = 8
+
+func encodeImage(reader io.Reader) (string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// encodeImageWithSize is like encodeImage, but also returns the image's dimensions.
+func encodeImageWithSize(reader io.Reader) (string, int, int, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(data), cfg.Width, cfg.Height, nil
+}
+
+func (c *Client) post(ctx context.Context, path string, payload any, result any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := backend.ReadBody(resp)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &backend.APIError{StatusCode: resp.StatusCode, URL: path, Body: string(respBody)}
+	}
+
+	err = json.Unmarshal(respBody, result)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+type generateRequest struct {
+	Prompt            string         `json:"prompt"`
+	NegativePrompt    string         `json:"negative_prompt,omitempty"`
+	Width             int            `json:"width"`
+	Height            int            `json:"height"`
+	Steps             int            `json:"steps,omitempty"`
+	SamplerName       string         `json:"sampler_name,omitempty"`
+	Seed              int64          `json:"seed"`
+	CFGScale          float32        `json:"cfg_scale,omitempty"`
+	OverrideSettings  map[string]any `json:"override_settings,omitempty"`
+	InitImages        []string       `json:"init_images,omitempty"`
+	DenoisingStrength float32        `json:"denoising_strength,omitempty"`
+	Mask              string         `json:"mask,omitempty"`
+	BatchSize         int            `json:"batch_size,omitempty"`
+}
+
+type generateResponse struct {
+	Images []string `json:"images"`
+
+	// Info is a JSON document encoded as a string.
+	Info string `json:"info"`
+}
+
+func (c *Client) newGenerateRequest(prompt string, negativePrompt string, model string, ratio string) (generateRequest, error) {
+	width, height, err := backend.Dimensions(ratio, defaultResolution, 64)
+	if err != nil {
+		return generateRequest{}, err
+	}
+
+	req := generateRequest{
+		Prompt:         prompt,
+		NegativePrompt: negativePrompt,
+		Width:          width,
+		Height:         height,
+		Steps:          c.steps,
+		SamplerName:    c.sampler,
+		Seed:           -1,
+	}
+
+	if model != "" {
+		req.OverrideSettings = map[string]any{"sd_model_checkpoint": model}
+	}
+
+	return req, nil
+}
+
+func (c *Client) generate(ctx context.Context, path string, req generateRequest, model string, format string) (*backend.Result, error) {
+	results, err := c.generateSamples(ctx, path, req, model, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return results[0], nil
+}
+
+// generateSamples generates req.BatchSize images, or one if it isn't set.
+func (c *Client) generateSamples(ctx context.Context, path string, req generateRequest, model string, format string) ([]*backend.Result, error) {
+	var resp generateResponse
+
+	err := c.post(ctx, path, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Images) == 0 {
+		return nil, fmt.Errorf("response from %s did not contain any images", path)
+	}
+
+	// When the WebUI is set to return grids, a grid of the batch comes first.
+	images := resp.Images
+	if samples := max(req.BatchSize, 1); len(images) > samples {
+		images = images[len(images)-samples:]
+	}
+
+	var info struct {
+		Seed     int64   `json:"seed"`
+		AllSeeds []int64 `json:"all_seeds"`
+	}
+
+	// The info is only used for the seeds, so don't fail the generation over it.
+	_ = json.Unmarshal([]byte(resp.Info), &info)
+
+	results := make([]*backend.Result, 0, len(images))
+
+	for i, v := range images {
+		png, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image from response: %w", err)
+		}
+
+		converted, err := backend.ConvertImage(png, format)
+		if err != nil {
+			return nil, err
+		}
+
+		seed := info.Seed
+		if i < len(info.AllSeeds) {
+			seed = info.AllSeeds[i]
+		}
+
+		results = append(results, &backend.Result{
+			Image:        converted,
+			Model:        model,
+			Seed:         seed,
+			FinishReason: "SUCCESS",
+		})
+	}
+
+	return results, nil
+}
+
+func (c *Client) Generate(ctx context.Context, req backend.GenerateRequest) (*backend.Result, error) {
+	req.Samples = 1
+
+	results, err := c.GenerateSamples(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return results[0], nil
+}
+
+// GenerateSamples generates req.Samples images with one request, as a batch.
+// Each image gets its own seed, counting up from req.Seed if it is set.
+func (c *Client) GenerateSamples(ctx context.Context, req backend.GenerateRequest) ([]*backend.Result, error) {
+	genReq, err := c.newGenerateRequest(req.Prompt, req.NegativePrompt, req.Model, req.AspectRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Seed != 0 {
+		genReq.Seed = req.Seed
+	}
+
+	if req.Samples > 1 {
+		genReq.BatchSize = req.Samples
+	}
+
+	genReq.CFGScale = req.CFGScale
+
+	if req.Image == nil {
+		return c.generateSamples(ctx, "/sdapi/v1/txt2img", genReq, req.Model, req.OutputFormat)
+	}
+
+	initImage, err := encodeImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	genReq.InitImages = []string{initImage}
+	genReq.DenoisingStrength = req.Strength
+
+	return c.generateSamples(ctx, "/sdapi/v1/img2img", genReq, req.Model, req.OutputFormat)
+}
+
+func (c *Client) Upscale(ctx context.Context, req backend.UpscaleRequest) (*backend.Result, error) {
+	if req.Mode != "fast" {
+		return nil, fmt.Errorf("%w: unknown upscale mode %q", backend.ErrUnsupported, req.Mode)
+	}
+
+	img, err := encodeImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]any{
+		"image":            img,
+		"upscaling_resize": 4,
+		"upscaler_1":       c.upscaler,
+	}
+
+	var resp struct {
+		Image string `json:"image"`
+	}
+
+	err = c.post(ctx, "/sdapi/v1/extra-single-image", payload, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	png, err := base64.StdEncoding.DecodeString(resp.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image from response: %w", err)
+	}
+
+	converted, err := backend.ConvertImage(png, req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.Result{
+		Image:        converted,
+		Model:        c.upscaler,
+		FinishReason: "SUCCESS",
+	}, nil
+}
+
+func (c *Client) Edit(ctx context.Context, req backend.EditRequest) (*backend.Result, error) {
+	if req.Operation != "inpaint" {
+		return nil, fmt.Errorf("%w: unknown edit operation %q", backend.ErrUnsupported, req.Operation)
+	}
+
+	if req.Mask == nil {
+		return nil, fmt.Errorf("inpainting with %s requires a mask", c.Name())
+	}
+
+	initImage, width, height, err := encodeImageWithSize(req.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	mask, err := encodeImage(req.Mask)
+	if err != nil {
+		return nil, err
+	}
+
+	genReq, err := c.newGenerateRequest(req.Prompt, req.NegativePrompt, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the size of the original image rather than forcing a square.
+	genReq.Width = width
+	genReq.Height = height
+	genReq.InitImages = []string{initImage}
+	genReq.Mask = mask
+	genReq.DenoisingStrength = 0.75
+
+	return c.generate(ctx, "/sdapi/v1/img2img", genReq, "", req.OutputFormat)
+}
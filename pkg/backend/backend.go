@@ -0,0 +1,287 @@
+// Package backend defines the interface that image generation providers implement
+// so that sdcli can target providers other than Stability.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ErrUnsupported is returned when a backend is asked to perform an operation it
+// does not support.  Use Capabilities to check for support ahead of time.
+var ErrUnsupported = errors.New("operation not supported by backend")
+
+// ErrContentFiltered is returned when a backend refuses a request, or withholds
+// its result, because of content moderation.
+var ErrContentFiltered = errors.New("blocked by content moderation")
+
+// APIError is returned when a backend's API responds with an unexpected status
+// code.
+type APIError struct {
+	StatusCode int
+
+	// The URL or path of the request.
+	URL string
+
+	// The body of the response, which usually describes the error.
+	Body string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("got unexpected status code %d from %s. Response: %s", e.StatusCode, e.URL, e.Body)
+}
+
+// RateLimited reports whether the API refused the request because too many
+// requests were made.
+func (e *APIError) RateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// Retryable reports whether the request may succeed if it is sent again later,
+// i.e. it was rate limited, timed out, or failed on the server's side.
+func (e *APIError) Retryable() bool {
+	return e.RateLimited() || e.StatusCode == http.StatusRequestTimeout || e.StatusCode >= 500
+}
+
+// Message returns the error message in the body of the response, for the
+// formats the supported APIs respond with, e.g. {"errors": ["..."]} from
+// Stability or {"error": {"message": "..."}} from OpenAI.  It returns the body
+// as is if it isn't in a known format.
+func (e *APIError) Message() string {
+	var body struct {
+		Errors  []string        `json:"errors"`
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+	}
+
+	err := json.Unmarshal([]byte(e.Body), &body)
+	if err != nil {
+		return strings.TrimSpace(e.Body)
+	}
+
+	var nested struct {
+		Message string `json:"message"`
+	}
+
+	var text string
+
+	switch {
+	case len(body.Errors) > 0:
+		return strings.Join(body.Errors, "; ")
+	case json.Unmarshal(body.Error, &nested) == nil && nested.Message != "":
+		return nested.Message
+	case json.Unmarshal(body.Error, &text) == nil && text != "":
+		return text
+	case body.Message != "":
+		return body.Message
+	case json.Unmarshal(body.Detail, &text) == nil && text != "":
+		return text
+	}
+
+	return strings.TrimSpace(e.Body)
+}
+
+// Operation is a kind of operation that a backend may support.
+type Operation string
+
+const (
+	OperationTextToImage  Operation = "txt2img"
+	OperationImageToImage Operation = "img2img"
+	OperationUpscale      Operation = "upscale"
+	OperationEdit         Operation = "edit"
+
+	// Generating in the style of reference images, e.g. Stability's style
+	// control.
+	OperationStyle Operation = "style"
+
+	// Operations that produce other media.  sdcli doesn't have commands for them
+	// yet, but backends can advertise them.
+	OperationVideo Operation = "video"
+	Operation3D    Operation = "3d"
+	OperationAudio Operation = "audio"
+)
+
+// AllOperations lists every kind of operation, in the order they are displayed.
+var AllOperations = []Operation{
+	OperationTextToImage,
+	OperationImageToImage,
+	OperationUpscale,
+	OperationEdit,
+	OperationStyle,
+	OperationVideo,
+	Operation3D,
+	OperationAudio,
+}
+
+// Capabilities describes what a backend supports.
+type Capabilities struct {
+	Operations []Operation
+
+	// The models that can be passed to Generate.  The first model is the default.
+	Models []string
+
+	AspectRatios  []string
+	OutputFormats []string
+
+	// The number of pixels in the largest image Generate returns, roughly.  Zero
+	// if it isn't known, e.g. because it depends on the model.
+	MaxPixels int
+
+	// The limits on the size of images sent to the backend, e.g. initial images
+	// and images to upscale: the most pixels they may have, and the shortest
+	// their sides may be.  Zero if there is no known limit.
+	MaxInputPixels int
+	MinInputSide   int
+
+	// The modes that can be passed to Upscale.
+	UpscaleModes []string
+
+	// The operations that can be passed to Edit.
+	EditOperations []string
+
+	// The longest prompt, in bytes, that the backend accepts.  Zero if there is
+	// no known limit.
+	MaxPromptLength int
+
+	// The most images that can be generated with one request, for backends that
+	// implement MultiSampler.  Zero if they are generated one at a time.
+	MaxSamples int
+}
+
+// Supports returns true if the backend supports the given operation.
+func (c Capabilities) Supports(op Operation) bool {
+	return slices.Contains(c.Operations, op)
+}
+
+// GenerateRequest is a request to generate an image from a prompt, and optionally
+// an initial image.
+type GenerateRequest struct {
+	Prompt         string
+	NegativePrompt string
+	Model          string
+	AspectRatio    string
+	OutputFormat   string
+
+	// The image to use for image-to-image generation.  If this is nil, the
+	// request is a text-to-image request.
+	Image io.Reader
+
+	// How much the result may differ from the initial image, from 0 (identical)
+	// to 1 (the initial image is ignored).
+	Strength float32
+
+	// The seed to generate with, so that a generation can be reproduced.  Zero
+	// picks a random seed.
+	Seed int64
+
+	// How strictly the image follows the prompt.  Zero uses the backend's default.
+	// Backends that don't support it ignore it.
+	CFGScale float32
+
+	// Images whose style to generate in, for backends that support
+	// OperationStyle.  They can't be combined with Image.
+	StyleImages []io.Reader
+
+	// How closely the result follows the style images, from 0 to 1.  Zero uses
+	// the backend's default.
+	StyleFidelity float32
+
+	// The number of images to generate with one request, for MultiSampler.
+	// Generate ignores it, and always generates one.
+	Samples int
+}
+
+// UpscaleRequest is a request to upscale an existing image.
+type UpscaleRequest struct {
+	Image        io.Reader
+	Mode         string
+	Prompt       string
+	OutputFormat string
+}
+
+// EditRequest is a request to edit an existing image.
+type EditRequest struct {
+	Operation      string
+	Image          io.Reader
+	Mask           io.Reader
+	Prompt         string
+	NegativePrompt string
+
+	// The prompt describing the part of the image to replace.  Only used for
+	// search-and-replace style operations.
+	SearchPrompt string
+
+	OutputFormat string
+}
+
+// Result is a generated image.
+type Result struct {
+	Image []byte
+
+	// The model that generated the image, if known.
+	Model string
+
+	// The seed that was used, if known.
+	Seed int64
+
+	// The reason the backend stopped generating, if it provides one.
+	FinishReason string
+
+	// The credits the request cost, if the backend reports them.
+	Credits float64
+}
+
+// Backend is an image generation provider.
+type Backend interface {
+	// Name returns the name of the backend, as used in config and the --backend flag.
+	Name() string
+
+	Capabilities() Capabilities
+
+	Generate(ctx context.Context, req GenerateRequest) (*Result, error)
+	Upscale(ctx context.Context, req UpscaleRequest) (*Result, error)
+	Edit(ctx context.Context, req EditRequest) (*Result, error)
+}
+
+// MultiSampler is implemented by backends that can generate several images with
+// one request, which saves the overhead of a request per image.
+type MultiSampler interface {
+	// GenerateSamples is like Generate, but generates req.Samples images, up to
+	// Capabilities.MaxSamples.
+	GenerateSamples(ctx context.Context, req GenerateRequest) ([]*Result, error)
+}
+
+// GenerateSamples generates req.Samples images with one request if b is a
+// MultiSampler, or one image with Generate if req.Samples is zero or one.  It
+// returns an error wrapping ErrUnsupported if b can't generate that many images
+// at once.
+func GenerateSamples(ctx context.Context, b Backend, req GenerateRequest) ([]*Result, error) {
+	if req.Samples <= 1 {
+		result, err := b.Generate(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*Result{result}, nil
+	}
+
+	sampler, ok := b.(MultiSampler)
+	if !ok || req.Samples > b.Capabilities().MaxSamples {
+		return nil, fmt.Errorf("%w: %s can't generate %d images with one request", ErrUnsupported, b.Name(), req.Samples)
+	}
+
+	return sampler.GenerateSamples(ctx, req)
+}
+
+// Unsupported returns an error wrapping ErrUnsupported for the given backend and
+// operation.
+func Unsupported(b Backend, op Operation) error {
+	return fmt.Errorf("%w: %s does not support %s", ErrUnsupported, b.Name(), op)
+}
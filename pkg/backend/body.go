@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// maxPreallocate caps how much ReadBody allocates up front, so a bogus
+// Content-Length can't exhaust memory.
+const maxPreallocate = 64 << 20
+
+// ReadBody reads an HTTP response body.  Unlike io.ReadAll, the buffer is sized
+// from the Content-Length when it is known, so large images are read into a
+// single allocation instead of being copied each time the buffer grows.
+func ReadBody(resp *http.Response) ([]byte, error) {
+	if resp.ContentLength <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+
+	// ReadFrom grows the buffer whenever it has less than MinRead bytes free, so
+	// leave room for that after the body.
+	buf := bytes.NewBuffer(make([]byte, 0, min(resp.ContentLength, maxPreallocate)+bytes.MinRead))
+
+	_, err := buf.ReadFrom(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SpoolBody reads an HTTP response body by copying it to a temporary file, then
+// reading it back into a buffer of exactly its size.  Unlike ReadBody, a body of
+// unknown length is never held in a buffer that grows by copying itself, and a
+// bogus Content-Length can't make it allocate more than the body.
+//
+// It doesn't keep the body out of memory: it is returned in full, since callers
+// verify, hash, and post-process images before saving them, so memory use
+// still peaks at the size of the body.
+func SpoolBody(resp *http.Response) ([]byte, error) {
+	spool, err := os.CreateTemp("", "sdcli-response-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file for response: %w", err)
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, size)
+
+	_, err = spool.ReadAt(body, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response back: %w", err)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"slices"
+
+	// Registers the BMP, TIFF, and WebP decoders, so those images can be
+	// converted.
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// jpegQuality is the quality used when converting images to JPEG.
+const jpegQuality = 95
+
+// ConvertImage converts an encoded image into the given output format.  It is
+// used by backends that can't return the requested format themselves.  Images
+// that are already in the requested format are returned as is; an empty format
+// means PNG.
+func ConvertImage(data []byte, format string) ([]byte, error) {
+	img, srcFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if srcFormat == format || (format == "" && srcFormat == "png") {
+		return data, nil
+	}
+
+	return EncodeImage(img, format)
+}
+
+// EncodeImage encodes an image in the given output format, either "png" or
+// "jpeg".  An empty format means PNG.
+func EncodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "", "png":
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode image as png: %w", err)
+		}
+
+		return buf.Bytes(), nil
+	case "jpeg":
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode image as jpeg: %w", err)
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("%w: output format %q", ErrUnsupported, format)
+}
+
+// UploadFormats are the formats of initial images that APIs accept as is.
+var UploadFormats = []string{"png", "jpeg", "webp"}
+
+// NormalizeImage converts an initial image that APIs don't accept, e.g. TIFF or
+// BMP, to PNG, returning images in one of UploadFormats as is.  HEIC can't be
+// decoded here, so HEIC images are refused with an error wrapping ErrUnsupported
+// and have to be converted some other way first.
+func NormalizeImage(data []byte) ([]byte, error) {
+	switch format := DetectFormat(data); {
+	case slices.Contains(UploadFormats, format):
+		return data, nil
+	case format == "heic":
+		return nil, fmt.Errorf("%w: decoding HEIC images", ErrUnsupported)
+	case format == "":
+		return nil, errors.New("not an image in a known format")
+	}
+
+	return ConvertImage(data, "png")
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Dimensions converts an aspect ratio like "16:9" into a width and height with
+// roughly the same area as a square with sides of resolution, rounded to a multiple
+// of multiple.  An empty ratio is treated as "1:1".
+//
+// It is used by backends that take explicit sizes rather than aspect ratios.
+func Dimensions(ratio string, resolution int, multiple int) (int, int, error) {
+	if ratio == "" {
+		return resolution, resolution, nil
+	}
+
+	w, h, err := ParseAspectRatio(ratio)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	area := float64(resolution * resolution)
+	width := math.Sqrt(area * float64(w) / float64(h))
+	height := area / width
+
+	round := func(v float64) int {
+		m := float64(multiple)
+		return int(math.Max(m, math.Round(v/m)*m))
+	}
+
+	return round(width), round(height), nil
+}
+
+// NearestAspectRatio returns the ratio in ratios closest to that of an image
+// width by height, e.g. "3:2" for a 1200x800 image.  Ratios are compared by how
+// much the image would have to be stretched to fit them, so 2:1 is as far from
+// 1:1 as 1:2 is.
+func NearestAspectRatio(width int, height int, ratios []string) (string, error) {
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid image size %dx%d", width, height)
+	}
+
+	target := math.Log(float64(width) / float64(height))
+
+	var (
+		nearest  string
+		distance = math.Inf(1)
+	)
+
+	for _, v := range ratios {
+		w, h, err := ParseAspectRatio(v)
+		if err != nil {
+			return "", err
+		}
+
+		d := math.Abs(math.Log(float64(w)/float64(h)) - target)
+		if d < distance {
+			nearest, distance = v, d
+		}
+	}
+
+	if nearest == "" {
+		return "", errors.New("no aspect ratios to choose from")
+	}
+
+	return nearest, nil
+}
+
+// MaxAspectRatioSide is the largest number either side of an aspect ratio may
+// have, e.g. 1000 in "1000:1".  Larger ratios are more likely to be typos than
+// intended, and would overflow the sizes computed from them.
+const MaxAspectRatioSide = 1000
+
+// ParseAspectRatio parses an aspect ratio like "16:9" into its width and height.
+// Both must be whole numbers from 1 to MaxAspectRatioSide, written with digits
+// alone: signs, spaces, and anything after the height are rejected.
+func ParseAspectRatio(ratio string) (int, int, error) {
+	widthPart, heightPart, ok := strings.Cut(ratio, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, must be width:height, e.g. 16:9", ratio)
+	}
+
+	w, err := parseAspectRatioSide(widthPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid width in aspect ratio %q: %w", ratio, err)
+	}
+
+	h, err := parseAspectRatioSide(heightPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid height in aspect ratio %q: %w", ratio, err)
+	}
+
+	return w, h, nil
+}
+
+// parseAspectRatioSide parses the width or height of an aspect ratio.
+func parseAspectRatioSide(side string) (int, error) {
+	if side == "" {
+		return 0, errors.New("it is empty")
+	}
+
+	// strconv.Atoi also accepts signs, and reports overflows of long numbers
+	// rather than that they are too large.
+	for _, v := range side {
+		if v < '0' || v > '9' {
+			return 0, fmt.Errorf("%q is not a whole number", side)
+		}
+	}
+
+	if len(side) > len(strconv.Itoa(MaxAspectRatioSide)) {
+		return 0, fmt.Errorf("it must be at most %d", MaxAspectRatioSide)
+	}
+
+	n, err := strconv.Atoi(side)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 {
+		return 0, errors.New("it must be at least 1")
+	} else if n > MaxAspectRatioSide {
+		return 0, fmt.Errorf("it must be at most %d", MaxAspectRatioSide)
+	}
+
+	return n, nil
+}
+
+// MustParseAspectRatio is like ParseAspectRatio, but panics if the ratio is
+// invalid, e.g. for ratios that are constants or defaults.
+func MustParseAspectRatio(ratio string) (int, int) {
+	w, h, err := ParseAspectRatio(ratio)
+	if err != nil {
+		panic(err)
+	}
+
+	return w, h
+}
@@ -0,0 +1,183 @@
+package backend
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseAspectRatio(t *testing.T) {
+	tests := []struct {
+		ratio  string
+		width  int
+		height int
+		valid  bool
+	}{
+		{"16:9", 16, 9, true},
+		{"1:1", 1, 1, true},
+		{"9:21", 9, 21, true},
+		{"1000:1", 1000, 1, true},
+		{"1:1000", 1, 1000, true},
+		{"016:09", 16, 9, true},
+		{"", 0, 0, false},
+		{"16", 0, 0, false},
+		{"16x9", 0, 0, false},
+		{":", 0, 0, false},
+		{"16:", 0, 0, false},
+		{":9", 0, 0, false},
+		{"0:1", 0, 0, false},
+		{"1:0", 0, 0, false},
+		{"0:0", 0, 0, false},
+		{"-16:9", 0, 0, false},
+		{"16:-9", 0, 0, false},
+		{"+16:9", 0, 0, false},
+		{"1001:1", 0, 0, false},
+		{"1:1001", 0, 0, false},
+		{"99999999999999999999:1", 0, 0, false},
+		{"1:99999999999999999999", 0, 0, false},
+		{" 16:9", 0, 0, false},
+		{"16:9 ", 0, 0, false},
+		{"16 : 9", 0, 0, false},
+		{"16:\t9", 0, 0, false},
+		{"16:9:1", 0, 0, false},
+		{"1.5:1", 0, 0, false},
+		{"1e3:1", 0, 0, false},
+		{"0x10:9", 0, 0, false},
+		{"١٦:٩", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ratio, func(t *testing.T) {
+			w, h, err := ParseAspectRatio(tt.ratio)
+
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("ParseAspectRatio(%q) = %d, %d, expected an error", tt.ratio, w, h)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseAspectRatio(%q) failed: %v", tt.ratio, err)
+			}
+
+			if w != tt.width || h != tt.height {
+				t.Errorf("ParseAspectRatio(%q) = %d, %d, want %d, %d", tt.ratio, w, h, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestMustParseAspectRatio(t *testing.T) {
+	tests := []struct {
+		ratio  string
+		panics bool
+	}{
+		{"16:9", false},
+		{"1000:1000", false},
+		{"1:0", true},
+		{"0:1", true},
+		{"-1:1", true},
+		{"1001:1", true},
+		{"16:9:1", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ratio, func(t *testing.T) {
+			defer func() {
+				if recovered := recover(); (recovered != nil) != tt.panics {
+					t.Errorf("MustParseAspectRatio(%q) panicked with %v, expected a panic: %v", tt.ratio, recovered, tt.panics)
+				}
+			}()
+
+			MustParseAspectRatio(tt.ratio)
+		})
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	tests := []struct {
+		ratio    string
+		multiple int
+		width    int
+		height   int
+	}{
+		{"", 64, 1024, 1024},
+		{"1:1", 64, 1024, 1024},
+		{"16:9", 1, 1365, 768},
+		{"16:9", 64, 1344, 768},
+		{"9:16", 64, 768, 1344},
+		// Sides never round down to nothing.
+		{"1000:1", 64, 32384, 64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ratio, func(t *testing.T) {
+			w, h, err := Dimensions(tt.ratio, 1024, tt.multiple)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w != tt.width || h != tt.height {
+				t.Errorf("Dimensions(%q, 1024, %d) = %dx%d, want %dx%d", tt.ratio, tt.multiple, w, h, tt.width, tt.height)
+			}
+		})
+	}
+
+	_, _, err := Dimensions("1:0", 1024, 64)
+	if err == nil {
+		t.Error("expected an error for a ratio with a zero side")
+	}
+}
+
+func FuzzParseAspectRatio(f *testing.F) {
+	for _, v := range []string{"16:9", "1:1", "1000:1", "0:1", "1:0", "-16:9", "+16:9", " 16:9", "16:9:1", "99999999999999999999:1", ""} {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, ratio string) {
+		w, h, err := ParseAspectRatio(ratio)
+
+		panicked := func() (panicked bool) {
+			defer func() {
+				panicked = recover() != nil
+			}()
+
+			MustParseAspectRatio(ratio)
+
+			return false
+		}()
+
+		if panicked != (err != nil) {
+			t.Fatalf("MustParseAspectRatio(%q) panicked: %v, but ParseAspectRatio returned %v", ratio, panicked, err)
+		}
+
+		if err != nil {
+			return
+		}
+
+		if w < 1 || w > MaxAspectRatioSide || h < 1 || h > MaxAspectRatioSide {
+			t.Fatalf("ParseAspectRatio(%q) = %d, %d, out of range", ratio, w, h)
+		}
+
+		// Valid ratios are exactly two runs of digits, which parse back to the
+		// same sides once leading zeros are dropped.
+		if strings.Trim(ratio, "0123456789:") != "" || strings.Count(ratio, ":") != 1 {
+			t.Fatalf("ParseAspectRatio(%q) accepted characters other than digits and one colon", ratio)
+		}
+
+		canonical := strconv.Itoa(w) + ":" + strconv.Itoa(h)
+
+		w2, h2, err := ParseAspectRatio(canonical)
+		if err != nil || w2 != w || h2 != h {
+			t.Fatalf("ParseAspectRatio(%q) = %d, %d, %v, want %d, %d", canonical, w2, h2, err, w, h)
+		}
+
+		width, height, err := Dimensions(ratio, 1024, 64)
+		if err != nil || width < 64 || height < 64 {
+			t.Fatalf("Dimensions(%q) = %dx%d, %v", ratio, width, height, err)
+		}
+	})
+}
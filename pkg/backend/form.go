@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// sniffLength is the number of bytes DetectFormat needs to recognize every
+// format it knows.
+const sniffLength = 14
+
+// PeekFormat detects the format of the image r reads from its magic bytes, like
+// DetectFormat, without consuming them: the returned reader reads the whole
+// image, from the start.
+func PeekFormat(r io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	header, err := buffered.Peek(sniffLength)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", nil, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	return DetectFormat(header), buffered, nil
+}
+
+// ContentType returns the media type of an image format returned by
+// DetectFormat, e.g. "image/png" for "png", or application/octet-stream if the
+// format isn't known.
+func ContentType(format string) string {
+	if format == "" {
+		return "application/octet-stream"
+	}
+
+	return "image/" + format
+}
+
+// quoteEscaper escapes the quoted parameters of a Content-Disposition header,
+// as multipart.Writer.CreateFormFile does.
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// WriteImagePart adds the image r reads to a multipart form as the file field,
+// with the Content-Type of its actual format and a file name to match, e.g.
+// "mask.png", whatever the file it was read from was called.  APIs reject
+// images whose declared type doesn't match their content.
+func WriteImagePart(writer *multipart.Writer, field string, r io.Reader) error {
+	format, r, err := PeekFormat(r)
+	if err != nil {
+		return err
+	}
+
+	fileName := field
+	if format != "" {
+		fileName += "." + format
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(field), quoteEscaper.Replace(fileName)))
+	header.Set("Content-Type", ContentType(format))
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("failed to create %s field in request: %w", field, err)
+	}
+
+	_, err = io.Copy(part, r)
+	if err != nil {
+		return fmt.Errorf("failed to write %s to request: %w", field, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParsePrompt checks a prompt before it is sent to a backend, and returns it with
+// surrounding whitespace trimmed.  The prompt must not be empty once trimmed,
+// must be valid UTF-8 without control characters other than tabs and line
+// breaks, and must be at most maxLength bytes long, unless maxLength is zero.
+func ParsePrompt(prompt string, maxLength int) (string, error) {
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return "", errors.New("prompt cannot be empty")
+	}
+
+	if !utf8.ValidString(prompt) {
+		return "", errors.New("prompt is not valid UTF-8")
+	}
+
+	for _, v := range prompt {
+		if unicode.IsControl(v) && v != '\t' && v != '\n' && v != '\r' {
+			return "", fmt.Errorf("prompt contains control character %U", v)
+		}
+	}
+
+	if maxLength > 0 && len(prompt) > maxLength {
+		return "", fmt.Errorf("prompt of length %d is too long; must be %d characters or less", len(prompt), maxLength)
+	}
+
+	return prompt, nil
+}
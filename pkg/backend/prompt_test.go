@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestParsePrompt(t *testing.T) {
+	tests := []struct {
+		name      string
+		prompt    string
+		maxLength int
+		want      string
+		valid     bool
+	}{
+		{"plain", "A bear riding a unicycle", 0, "A bear riding a unicycle", true},
+		{"trimmed", "  A bear\n", 0, "A bear", true},
+		{"line breaks and tabs", "A bear,\n\tin space\r\n", 0, "A bear,\n\tin space", true},
+		{"unicode", "Un ours à monocycle, «cinématique»", 0, "Un ours à monocycle, «cinématique»", true},
+		{"at the limit", strings.Repeat("a", 10), 10, strings.Repeat("a", 10), true},
+		{"limit ignores trimmed space", " " + strings.Repeat("a", 10) + " ", 10, strings.Repeat("a", 10), true},
+		{"empty", "", 0, "", false},
+		{"only whitespace", " \t\n", 0, "", false},
+		{"too long", strings.Repeat("a", 11), 10, "", false},
+		{"limit counts bytes", strings.Repeat("é", 6), 10, "", false},
+		{"nul", "A bear\x00", 0, "", false},
+		{"escape", "A \x1b[31mred\x1b[0m bear", 0, "", false},
+		{"invalid utf-8", "A bear \xff", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePrompt(tt.prompt, tt.maxLength)
+
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("ParsePrompt(%q, %d) = %q, expected an error", tt.prompt, tt.maxLength, got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParsePrompt(%q, %d) failed: %v", tt.prompt, tt.maxLength, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("ParsePrompt(%q, %d) = %q, want %q", tt.prompt, tt.maxLength, got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParsePrompt(f *testing.F) {
+	for _, v := range []string{"A bear", "  A bear\n", "A bear,\n\tin space", "«cinématique»", "", " ", "\x00", "\x1b[31m", "\xff"} {
+		f.Add(v, 0)
+		f.Add(v, 8)
+	}
+
+	f.Fuzz(func(t *testing.T, prompt string, maxLength int) {
+		got, err := ParsePrompt(prompt, maxLength)
+		if err != nil {
+			return
+		}
+
+		if got == "" || got != strings.TrimSpace(got) || !strings.Contains(prompt, got) {
+			t.Fatalf("ParsePrompt(%q) = %q, expected the prompt trimmed and not empty", prompt, got)
+		}
+
+		if !utf8.ValidString(got) {
+			t.Fatalf("ParsePrompt(%q) accepted invalid UTF-8", prompt)
+		}
+
+		if maxLength > 0 && len(got) > maxLength {
+			t.Fatalf("ParsePrompt(%q, %d) = %q, longer than the limit", prompt, maxLength, got)
+		}
+
+		for _, v := range got {
+			if unicode.IsControl(v) && !strings.ContainsRune("\t\n\r", v) {
+				t.Fatalf("ParsePrompt(%q) accepted control character %U", prompt, v)
+			}
+		}
+
+		// Parsing is idempotent.
+		again, err := ParsePrompt(got, maxLength)
+		if err != nil || again != got {
+			t.Fatalf("ParsePrompt(%q) = %q, %v, want it unchanged", got, again, err)
+		}
+	})
+}
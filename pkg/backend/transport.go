@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// DialTimeout is how long NewHTTPClient waits to connect to a server.
+	DialTimeout = 30 * time.Second
+
+	// ResponseTimeout is how long NewHTTPClient waits for a server to start
+	// responding once a request is sent.  It is generous, since synchronous
+	// endpoints don't respond until the image is generated, and a local GPU can
+	// take minutes.
+	ResponseTimeout = 10 * time.Minute
+
+	// maxIdleConnsPerHost is how many idle connections to each server are kept
+	// for reuse.  Batches and bots send requests to the same API back to back,
+	// and the default of 2 would make most of them reconnect.
+	maxIdleConnsPerHost = 16
+)
+
+// NewHTTPClient returns an HTTP client tuned for sending many requests to one
+// API: connections are reused, HTTP/2 is used when the server supports it, and
+// requests give up on a dead network instead of hanging forever.  There is no
+// overall timeout, since downloads of large images can take a while on slow
+// connections, so requests should be sent with a context that can be cancelled.
+func NewHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: ResponseTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrUnexpectedContent is returned when a response isn't the image that was
+// requested, e.g. an HTML error page from a misconfigured proxy.  Errors that
+// wrap it are *ContentError.
+var ErrUnexpectedContent = errors.New("response is not the requested image")
+
+// snippetLength is how much of a text response ContentError includes.
+const snippetLength = 120
+
+// ContentError describes a response that isn't the image that was requested.
+type ContentError struct {
+	// The Content-Type of the response, if known.
+	ContentType string
+
+	// The format that was requested, e.g. "png", or empty for any image.
+	Format string
+
+	// The format of the response according to its magic bytes, or empty if it
+	// isn't an image.
+	Detected string
+
+	// The start of the response, if it is text.
+	Snippet string
+}
+
+func (e *ContentError) Error() string {
+	var msg strings.Builder
+
+	msg.WriteString(ErrUnexpectedContent.Error())
+
+	if e.Format != "" {
+		fmt.Fprintf(&msg, ", requested %s", e.Format)
+	}
+
+	if e.ContentType != "" {
+		fmt.Fprintf(&msg, ", got Content-Type %q", e.ContentType)
+	}
+
+	if e.Detected != "" {
+		fmt.Fprintf(&msg, " containing %s", e.Detected)
+	} else {
+		msg.WriteString(" containing no known image format")
+	}
+
+	if e.Snippet != "" {
+		fmt.Fprintf(&msg, ": %q", e.Snippet)
+	}
+
+	return msg.String()
+}
+
+func (e *ContentError) Unwrap() error {
+	return ErrUnexpectedContent
+}
+
+// heicBrands are the brands in the ftyp box of HEIF images, usually photos from
+// phones saved as .heic.
+var heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs", "mif1", "msf1"}
+
+// DetectFormat returns the format of an encoded image from its magic bytes:
+// "png", "jpeg", "webp", "tiff", "bmp", "heic", or empty if it isn't one of
+// them.  Backends only return the first three, but any of them may be given as
+// an initial image.
+func DetectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "webp"
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) >= 14:
+		return "bmp"
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")) && slices.Contains(heicBrands, string(data[8:12])):
+		return "heic"
+	}
+
+	return ""
+}
+
+// VerifyImage returns a *ContentError if data isn't an image in format, or if
+// contentType isn't an image type matching it.  An empty format accepts any
+// image, and an empty or generic contentType, e.g. application/octet-stream, is
+// judged by the magic bytes alone.
+func VerifyImage(data []byte, contentType string, format string) error {
+	detected := DetectFormat(data)
+
+	ok := detected != "" && (format == "" || detected == format)
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType != "application/octet-stream" {
+		subtype, isImage := strings.CutPrefix(mediaType, "image/")
+		if subtype == "jpg" {
+			subtype = "jpeg"
+		}
+
+		ok = ok && isImage && (subtype == "*" || subtype == detected)
+	}
+
+	if ok {
+		return nil
+	}
+
+	contentErr := &ContentError{ContentType: contentType, Format: format, Detected: detected}
+
+	if detected == "" && utf8.Valid(data) {
+		snippet := []rune(strings.TrimSpace(string(data)))
+		contentErr.Snippet = string(snippet[:min(len(snippet), snippetLength)])
+	}
+
+	return contentErr
+}
@@ -0,0 +1,403 @@
+// Package bfl implements backend.Backend against the Black Forest Labs FLUX API.
+//
+// Generation with FLUX is asynchronous: a request is submitted, then polled until
+// the result is ready, and the image is then downloaded from a signed URL.
+package bfl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+const (
+	// DefaultBaseURL is the base URL of the BFL API.
+	DefaultBaseURL = "https://api.bfl.ai/v1"
+
+	// DefaultPollInterval is how often results are polled for by default.
+	DefaultPollInterval = time.Second
+
+	// DefaultMaxWait is how long to wait for a result by default.
+	DefaultMaxWait = 5 * time.Minute
+
+	// DefaultPollBackoff is how much the poll interval is multiplied by after
+	// each poll by default, i.e. results are polled for at a fixed interval.
+	DefaultPollBackoff = 1.0
+
+	// defaultResolution is the side length of the square image whose area generated
+	// images should roughly match.
+	defaultResolution = 1024
+)
+
+// ErrModerated is returned when BFL refuses to generate an image because the
+// request or the result was moderated.  It is backend.ErrContentFiltered, so
+// moderation can be checked for the same way with every backend.
+var ErrModerated = backend.ErrContentFiltered
+
+// ErrNotReady is returned by GetResult when a generation is still queued or in
+// progress.
+var ErrNotReady = errors.New("result is not ready yet")
+
+var models = []string{"flux-pro-1.1", "flux-pro-1.1-ultra", "flux-pro", "flux-dev"}
+
+// Client is a client for the BFL FLUX API.  It implements backend.Backend.
+type Client struct {
+	baseURL      string
+	apiKey       string
+	pollInterval time.Duration
+	pollBackoff  float64
+	maxWait      time.Duration
+	httpClient   *http.Client
+}
+
+type ClientOption func(*Client)
+
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithPolling sets how often to poll for results, and how long to wait for them
+// before giving up.
+func WithPolling(interval time.Duration, maxWait time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pollInterval = interval
+		c.maxWait = maxWait
+	}
+}
+
+// WithPollBackoff sets how much the poll interval is multiplied by after each
+// poll, e.g. 1.5 to poll less often the longer a slow job takes.  Multipliers
+// below 1 are ignored.
+func WithPollBackoff(multiplier float64) ClientOption {
+	return func(c *Client) {
+		c.pollBackoff = max(multiplier, 1)
+	}
+}
+
+// WithHTTPClient sets the HTTP client requests are sent with, e.g. for different
+// timeouts.  Defaults to backend.NewHTTPClient().
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func NewClient(apiKey string, options ...ClientOption) *Client {
+	client := &Client{
+		baseURL:      DefaultBaseURL,
+		apiKey:       apiKey,
+		pollInterval: DefaultPollInterval,
+		pollBackoff:  DefaultPollBackoff,
+		maxWait:      DefaultMaxWait,
+		httpClient:   backend.NewHTTPClient(),
+	}
+
+	for _, v := range options {
+		v(client)
+	}
+
+	return client
+}
+
+var _ backend.Backend = (*Client)(nil)
+
+func (c *Client) Name() string {
+	return "bfl"
+}
+
+func (c *Client) Capabilities() backend.Capabilities {
+	return backend.Capabilities{
+		Operations:    []backend.Operation{backend.OperationTextToImage},
+		Models:        models,
+		AspectRatios:  []string{"16:9", "1:1", "21:9", "2:3", "3:2", "4:5", "5:4", "9:16", "9:21"},
+		OutputFormats: []string{"png", "jpeg"},
+
+		// Ultra generates images of up to 4 megapixels.
+		MaxPixels: 2048 * 2048,
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, reqURL string, body io.Reader, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("x-key", c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := backend.ReadBody(resp)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &backend.APIError{StatusCode: resp.StatusCode, URL: reqURL, Body: string(respBody)}
+	}
+
+	err = json.Unmarshal(respBody, result)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+type submitResponse struct {
+	ID         string `json:"id"`
+	PollingURL string `json:"polling_url"`
+}
+
+type resultResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Result struct {
+		Sample string `json:"sample"`
+		Seed   int64  `json:"seed"`
+	} `json:"result"`
+}
+
+// The statuses a result can have while polling.
+const (
+	statusReady            = "Ready"
+	statusPending          = "Pending"
+	statusRequestModerated = "Request Moderated"
+	statusContentModerated = "Content Moderated"
+)
+
+func (c *Client) submit(ctx context.Context, model string, payload map[string]any) (*submitResponse, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var resp submitResponse
+
+	err = c.do(ctx, http.MethodPost, c.baseURL+"/"+model, bytes.NewReader(body), &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to submit generation: %w", err)
+	}
+
+	if resp.PollingURL == "" {
+		resp.PollingURL = c.baseURL + "/get_result?id=" + resp.ID
+	}
+
+	return &resp, nil
+}
+
+// fetchResult fetches the result of a generation once.  It returns an error
+// wrapping ErrNotReady if the generation hasn't finished yet.
+func (c *Client) fetchResult(ctx context.Context, pollingURL string) (*resultResponse, error) {
+	var resp resultResponse
+
+	err := c.do(ctx, http.MethodGet, pollingURL, nil, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to poll for result: %w", err)
+	}
+
+	switch resp.Status {
+	case statusReady:
+		return &resp, nil
+	case statusRequestModerated, statusContentModerated:
+		return nil, fmt.Errorf("%w: %s", ErrModerated, resp.Status)
+	case statusPending:
+	default:
+		// Other statuses mean the request is still queued or in progress,
+		// unless they are an error.
+		if strings.Contains(strings.ToLower(resp.Status), "error") || resp.Status == "Task not found" {
+			return nil, fmt.Errorf("generation failed with status %q", resp.Status)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNotReady, resp.Status)
+}
+
+func (c *Client) poll(ctx context.Context, pollingURL string) (*resultResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.maxWait)
+	defer cancel()
+
+	interval := c.pollInterval
+
+	for {
+		resp, err := c.fetchResult(ctx, pollingURL)
+		if !errors.Is(err, ErrNotReady) {
+			return resp, err
+		}
+
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("gave up waiting for result: %w", ctx.Err())
+		case <-timer.C:
+		}
+
+		interval = time.Duration(float64(interval) * c.pollBackoff)
+	}
+}
+
+func (c *Client) download(ctx context.Context, sampleURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sampleURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &backend.APIError{StatusCode: resp.StatusCode, URL: "the image download URL"}
+	}
+
+	body, err := backend.ReadBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image from response: %w", err)
+	}
+
+	return body, nil
+}
+
+// Submit submits a generation without waiting for it to finish, and returns its
+// ID, e.g. to be stored and collected later with GetResult.  FLUX doesn't
+// support negative prompts, so NegativePrompt is ignored.
+func (c *Client) Submit(ctx context.Context, req backend.GenerateRequest) (string, error) {
+	submitted, _, err := c.submitRequest(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	return submitted.ID, nil
+}
+
+// GetResult fetches the result of a generation by the ID Submit returned, without
+// waiting for it, e.g. from another process than the one that submitted it.  It
+// returns an error wrapping ErrNotReady if the generation hasn't finished, and
+// one wrapping ErrModerated if it was moderated.  The image is returned as BFL
+// generated it, so its format is the one it was submitted with.
+func (c *Client) GetResult(ctx context.Context, id string) (*backend.Result, error) {
+	result, err := c.fetchResult(ctx, c.baseURL+"/get_result?id="+url.QueryEscape(id))
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := c.download(ctx, result.Result.Sample)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.Result{
+		Image:        img,
+		Seed:         result.Result.Seed,
+		FinishReason: "SUCCESS",
+	}, nil
+}
+
+// submitRequest submits a generation, returning the model it was submitted to.
+func (c *Client) submitRequest(ctx context.Context, req backend.GenerateRequest) (*submitResponse, string, error) {
+	if req.Image != nil {
+		return nil, "", backend.Unsupported(c, backend.OperationImageToImage)
+	}
+
+	model := req.Model
+	if model == "" {
+		model = models[0]
+	}
+
+	payload := map[string]any{"prompt": req.Prompt}
+
+	if req.OutputFormat != "" {
+		payload["output_format"] = req.OutputFormat
+	}
+
+	if req.Seed != 0 {
+		payload["seed"] = req.Seed
+	}
+
+	// FLUX calls the CFG scale guidance.
+	if req.CFGScale != 0 {
+		payload["guidance"] = req.CFGScale
+	}
+
+	// Ultra takes an aspect ratio, while the other models take explicit sizes.
+	if strings.HasSuffix(model, "-ultra") {
+		if req.AspectRatio != "" {
+			payload["aspect_ratio"] = req.AspectRatio
+		}
+	} else {
+		width, height, err := backend.Dimensions(req.AspectRatio, defaultResolution, 32)
+		if err != nil {
+			return nil, "", err
+		}
+
+		payload["width"] = width
+		payload["height"] = height
+	}
+
+	submitted, err := c.submit(ctx, model, payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return submitted, model, nil
+}
+
+// Generate submits a generation and waits for it to finish.  FLUX doesn't support
+// negative prompts, so NegativePrompt is ignored.
+func (c *Client) Generate(ctx context.Context, req backend.GenerateRequest) (*backend.Result, error) {
+	submitted, model, err := c.submitRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.poll(ctx, submitted.PollingURL)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := c.download(ctx, result.Result.Sample)
+	if err != nil {
+		return nil, err
+	}
+
+	converted, err := backend.ConvertImage(img, req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.Result{
+		Image:        converted,
+		Model:        model,
+		Seed:         result.Result.Seed,
+		FinishReason: "SUCCESS",
+	}, nil
+}
+
+func (c *Client) Upscale(_ context.Context, _ backend.UpscaleRequest) (*backend.Result, error) {
+	return nil, backend.Unsupported(c, backend.OperationUpscale)
+}
+
+func (c *Client) Edit(_ context.Context, _ backend.EditRequest) (*backend.Result, error) {
+	return nil, backend.Unsupported(c, backend.OperationEdit)
+}
@@ -0,0 +1,197 @@
+// Package compare compares two images, e.g. the same prompt generated by two
+// models, both visually and with the PSNR and SSIM metrics.
+package compare
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrSizeMismatch is returned when comparing images of different sizes.  Scale
+// one of them with Resize first.
+var ErrSizeMismatch = errors.New("images are different sizes")
+
+// gap is the space between the images of a side-by-side comparison, in pixels.
+const gap = 8
+
+// differenceGain is how much differences are amplified by Difference, so small
+// differences are still visible.
+const differenceGain = 4
+
+// Resize scales img to the given size.
+func Resize(img image.Image, size image.Point) *image.RGBA {
+	resized := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	return resized
+}
+
+// SideBySide draws a and b next to each other on a white background, with their
+// tops aligned.
+func SideBySide(a image.Image, b image.Image) *image.RGBA {
+	ab, bb := a.Bounds(), b.Bounds()
+
+	out := image.NewRGBA(image.Rect(0, 0, ab.Dx()+gap+bb.Dx(), max(ab.Dy(), bb.Dy())))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, image.Rect(0, 0, ab.Dx(), ab.Dy()), a, ab.Min, draw.Src)
+	draw.Draw(out, image.Rect(ab.Dx()+gap, 0, ab.Dx()+gap+bb.Dx(), bb.Dy()), b, bb.Min, draw.Src)
+
+	return out
+}
+
+// Blend mixes a and b evenly, so that whatever differs between them looks like a
+// double exposure.
+func Blend(a image.Image, b image.Image) (*image.RGBA, error) {
+	return combine(a, b, func(x uint8, y uint8) uint8 {
+		return uint8((int(x) + int(y)) / 2)
+	})
+}
+
+// Difference returns the absolute difference of a and b, amplified so that small
+// differences are visible.  Identical areas are black.
+func Difference(a image.Image, b image.Image) (*image.RGBA, error) {
+	return combine(a, b, func(x uint8, y uint8) uint8 {
+		diff := int(x) - int(y)
+		if diff < 0 {
+			diff = -diff
+		}
+
+		return uint8(min(255, diff*differenceGain))
+	})
+}
+
+// PSNR returns the peak signal-to-noise ratio of a and b, in decibels, over
+// their red, green, and blue channels.  Higher is more similar, and identical
+// images return +Inf.
+func PSNR(a image.Image, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, ErrSizeMismatch
+	}
+
+	ra, rb := toRGBA(a), toRGBA(b)
+
+	var sum float64
+
+	samples := 0
+
+	for i := 0; i < len(ra.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			diff := float64(ra.Pix[i+c]) - float64(rb.Pix[i+c])
+			sum += diff * diff
+			samples++
+		}
+	}
+
+	if samples == 0 || sum == 0 {
+		return math.Inf(1), nil
+	}
+
+	mse := sum / float64(samples)
+
+	return 10 * math.Log10(255*255/mse), nil
+}
+
+// ssimWindow is the size of the windows SSIM is computed over, in pixels.
+const ssimWindow = 8
+
+// SSIM returns the mean structural similarity of a and b's luminance, from -1
+// to 1, computed over 8x8 windows.  1 means identical.  Unlike PSNR, it tracks
+// how similar the images look rather than how close their pixels are.
+func SSIM(a image.Image, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, ErrSizeMismatch
+	}
+
+	ga, gb := toGray(a), toGray(b)
+	size := ga.Bounds().Size()
+
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	var (
+		total   float64
+		windows int
+	)
+
+	for top := 0; top < size.Y; top += ssimWindow {
+		for left := 0; left < size.X; left += ssimWindow {
+			bottom, right := min(top+ssimWindow, size.Y), min(left+ssimWindow, size.X)
+			n := float64((bottom - top) * (right - left))
+
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+
+			for y := top; y < bottom; y++ {
+				for x := left; x < right; x++ {
+					pa := float64(ga.GrayAt(x, y).Y)
+					pb := float64(gb.GrayAt(x, y).Y)
+
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covariance := sumAB/n - meanA*meanB
+
+			total += ((2*meanA*meanB + c1) * (2*covariance + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+
+	if windows == 0 {
+		return 1, nil
+	}
+
+	return total / float64(windows), nil
+}
+
+// combine returns an image made by applying fn to each pair of channels of a and
+// b.  The result is fully opaque.
+func combine(a image.Image, b image.Image, fn func(uint8, uint8) uint8) (*image.RGBA, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return nil, ErrSizeMismatch
+	}
+
+	ra, rb := toRGBA(a), toRGBA(b)
+	out := image.NewRGBA(ra.Bounds())
+
+	for i := 0; i < len(out.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			out.Pix[i+c] = fn(ra.Pix[i+c], rb.Pix[i+c])
+		}
+
+		out.Pix[i+3] = 255
+	}
+
+	return out, nil
+}
+
+// toRGBA copies img into an RGBA image with its origin at 0, 0.
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+	return out
+}
+
+// toGray copies img into a grayscale image with its origin at 0, 0.
+func toGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	out := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+	return out
+}
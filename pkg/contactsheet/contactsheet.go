@@ -0,0 +1,153 @@
+// Package contactsheet composes images into a single labeled grid, making a batch
+// of generations easier to review than the individual files.
+package contactsheet
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultCellSize is the default width and height images are scaled to fit in.
+const DefaultCellSize = 256
+
+const (
+	// padding is the space around and between cells, in pixels.
+	padding = 8
+
+	// lineHeight is the height of a line of a label, in pixels.
+	lineHeight = 15
+)
+
+// ErrNoImages is returned by Compose when there are no cells to compose.
+var ErrNoImages = errors.New("no images to compose")
+
+// Cell is an image in a contact sheet, with the lines of text to label it with.
+type Cell struct {
+	Image image.Image
+	Label []string
+}
+
+type options struct {
+	cellSize int
+	columns  int
+}
+
+// Option configures Compose.
+type Option func(*options)
+
+// WithCellSize sets the width and height that images are scaled to fit in.
+func WithCellSize(size int) Option {
+	return func(o *options) {
+		o.cellSize = size
+	}
+}
+
+// WithColumns sets the number of columns in the grid.  By default the grid is as
+// close to square as possible.
+func WithColumns(columns int) Option {
+	return func(o *options) {
+		o.columns = columns
+	}
+}
+
+// Compose draws the cells into a grid, each image scaled to fit in a cell with
+// its label underneath.
+func Compose(cells []Cell, opts ...Option) (*image.RGBA, error) {
+	if len(cells) == 0 {
+		return nil, ErrNoImages
+	}
+
+	o := options{cellSize: DefaultCellSize}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.cellSize <= 0 {
+		o.cellSize = DefaultCellSize
+	}
+
+	if o.columns <= 0 {
+		o.columns = int(math.Ceil(math.Sqrt(float64(len(cells)))))
+	}
+
+	columns := min(o.columns, len(cells))
+	rows := (len(cells) + columns - 1) / columns
+
+	labelLines := 0
+	for _, v := range cells {
+		labelLines = max(labelLines, len(v.Label))
+	}
+
+	cellWidth := o.cellSize
+	cellHeight := o.cellSize + labelLines*lineHeight
+
+	sheet := image.NewRGBA(image.Rect(
+		0,
+		0,
+		columns*(cellWidth+padding)+padding,
+		rows*(cellHeight+padding)+padding))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	drawer := font.Drawer{
+		Dst:  sheet,
+		Src:  image.NewUniform(color.Black),
+		Face: basicfont.Face7x13,
+	}
+
+	for i, cell := range cells {
+		left := padding + (i%columns)*(cellWidth+padding)
+		top := padding + (i/columns)*(cellHeight+padding)
+
+		if cell.Image != nil {
+			target := fit(cell.Image.Bounds(), o.cellSize)
+
+			// Center the image in its cell.
+			target = target.Add(image.Pt(
+				left+(o.cellSize-target.Dx())/2,
+				top+(o.cellSize-target.Dy())/2))
+
+			draw.CatmullRom.Scale(sheet, target, cell.Image, cell.Image.Bounds(), draw.Over, nil)
+		}
+
+		for j, line := range cell.Label {
+			drawer.Dot = fixed.P(left, top+o.cellSize+(j+1)*lineHeight-3)
+			drawer.DrawString(truncate(line, cellWidth/basicfont.Face7x13.Advance))
+		}
+	}
+
+	return sheet, nil
+}
+
+// fit returns the size of bounds scaled to fit in a square of the given size,
+// keeping its aspect ratio.
+func fit(bounds image.Rectangle, size int) image.Rectangle {
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return image.Rectangle{}
+	}
+
+	if width >= height {
+		return image.Rect(0, 0, size, max(1, height*size/width))
+	}
+
+	return image.Rect(0, 0, max(1, width*size/height), size)
+}
+
+// truncate shortens a line to at most length runes so it doesn't overflow its
+// cell.
+func truncate(line string, length int) string {
+	runes := []rune(line)
+	if len(runes) <= length || length < 4 {
+		return line
+	}
+
+	return string(runes[:length-3]) + "..."
+}
@@ -0,0 +1,475 @@
+package imagemeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The values of Params.Backend for images read from other tools' metadata.
+const (
+	BackendA1111   = "a1111"
+	BackendComfyUI = "comfyui"
+	BackendNovelAI = "novelai"
+)
+
+// ReadAny reads the generation metadata from an image made by sdcli or another
+// tool, normalized into Metadata.  It understands:
+//
+//   - sdcli's own Exif metadata.
+//   - AUTOMATIC1111's "parameters" PNG text chunk, or its Exif UserComment in
+//     JPEG and WebP images.
+//   - ComfyUI's "prompt" PNG text chunk, which holds the workflow that made the
+//     image.
+//   - NovelAI's "Description" and "Comment" PNG text chunks.
+//
+// Params.Backend is set to BackendA1111, BackendComfyUI, or BackendNovelAI for
+// images made by those tools.  Settings without a Params field, like the sampler
+// or step count, are returned in Extra.
+func ReadAny(imgBytes []byte) (*Metadata, error) {
+	texts, err := pngText(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if parameters, ok := texts["parameters"]; ok {
+		return parseA1111(parameters), nil
+	}
+
+	if workflow, ok := texts["prompt"]; ok {
+		meta, err := parseComfyUI(workflow)
+		if err != nil {
+			return nil, err
+		}
+
+		return meta, nil
+	}
+
+	if comment, ok := texts["Comment"]; ok && strings.HasPrefix(texts["Software"], "NovelAI") {
+		meta, err := parseNovelAI(texts["Description"], comment, texts["Source"])
+		if err != nil {
+			return nil, err
+		}
+
+		return meta, nil
+	}
+
+	meta, comment, err := readExif(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if isA1111Parameters(comment) {
+		return parseA1111(comment), nil
+	}
+
+	return meta, nil
+}
+
+// pngText returns the text chunks of a PNG image, keyed by keyword.  It returns
+// an empty map for other formats.
+func pngText(imgBytes []byte) (map[string]string, error) {
+	texts := make(map[string]string)
+
+	if !bytes.HasPrefix(imgBytes, []byte("\x89PNG\r\n\x1a\n")) {
+		return texts, nil
+	}
+
+	rest := imgBytes[8:]
+	for len(rest) >= 12 {
+		size := int(binary.BigEndian.Uint32(rest[0:4]))
+		if 12+size > len(rest) {
+			return nil, errors.New("PNG chunk is truncated")
+		}
+
+		chunkType := string(rest[4:8])
+		data := rest[8 : 8+size]
+		rest = rest[12+size:]
+
+		keyword, value, ok := bytes.Cut(data, []byte{0})
+		if !ok {
+			continue
+		}
+
+		switch chunkType {
+		case "tEXt":
+			texts[string(keyword)] = latin1(value)
+		case "zTXt":
+			if len(value) < 1 {
+				continue
+			}
+
+			text, err := inflate(value[1:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress %q text chunk: %w", keyword, err)
+			}
+
+			texts[string(keyword)] = latin1(text)
+		case "iTXt":
+			// Compression flag and method, then the language tag and the
+			// translated keyword, both null-terminated.
+			if len(value) < 2 {
+				continue
+			}
+
+			compressed := value[0] == 1
+
+			parts := bytes.SplitN(value[2:], []byte{0}, 3)
+			if len(parts) != 3 {
+				continue
+			}
+
+			text := parts[2]
+			if compressed {
+				inflated, err := inflate(text)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decompress %q text chunk: %w", keyword, err)
+				}
+
+				text = inflated
+			}
+
+			texts[string(keyword)] = string(text)
+		}
+	}
+
+	return texts, nil
+}
+
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes)
+}
+
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// a1111Setting matches one "Key: value" setting in A1111's settings line.  Values
+// may be quoted to hold commas.
+var a1111Setting = regexp.MustCompile(`\s*(\w[\w \-/]+):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+
+// isA1111Parameters reports whether text looks like A1111's parameters.
+func isA1111Parameters(text string) bool {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+
+	return strings.Contains(lines[len(lines)-1], "Steps: ")
+}
+
+// parseA1111 parses A1111's parameters text: the prompt, then an optional
+// "Negative prompt: " section, then a line of comma-separated settings.
+func parseA1111(text string) *Metadata {
+	meta := &Metadata{
+		Extra:  map[string]string{},
+		Params: Params{Backend: BackendA1111},
+	}
+
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+
+	settings := ""
+	if strings.Contains(lines[len(lines)-1], "Steps: ") {
+		settings = lines[len(lines)-1]
+		lines = lines[:len(lines)-1]
+	}
+
+	var prompt, negative []string
+
+	inNegative := false
+
+	for _, v := range lines {
+		if after, ok := strings.CutPrefix(v, "Negative prompt: "); ok && !inNegative {
+			inNegative = true
+			v = after
+		}
+
+		if inNegative {
+			negative = append(negative, v)
+		} else {
+			prompt = append(prompt, v)
+		}
+	}
+
+	meta.Prompt = strings.TrimSpace(strings.Join(prompt, "\n"))
+	meta.Params.NegativePrompt = strings.TrimSpace(strings.Join(negative, "\n"))
+
+	for _, match := range a1111Setting.FindAllStringSubmatch(settings, -1) {
+		key := strings.TrimSpace(match[1])
+
+		value := strings.TrimSpace(match[2])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		switch key {
+		case "Seed":
+			meta.Params.Seed, _ = strconv.ParseInt(value, 10, 64)
+		case "Model":
+			meta.Params.Model = value
+		case "Size":
+			meta.Params.AspectRatio = aspectRatio(value)
+			meta.Extra[key] = value
+		default:
+			meta.Extra[key] = value
+		}
+	}
+
+	return meta
+}
+
+// aspectRatio reduces a "WIDTHxHEIGHT" size to an aspect ratio, e.g. "512x768"
+// becomes "2:3".  It returns an empty string if size can't be parsed.
+func aspectRatio(size string) string {
+	widthStr, heightStr, ok := strings.Cut(size, "x")
+	if !ok {
+		return ""
+	}
+
+	width, err := strconv.Atoi(widthStr)
+	if err != nil {
+		return ""
+	}
+
+	height, err := strconv.Atoi(heightStr)
+	if err != nil {
+		return ""
+	}
+
+	return ratioOf(width, height)
+}
+
+func ratioOf(width int, height int) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return fmt.Sprintf("%d:%d", width/a, height/a)
+}
+
+// comfyNode is a node in a ComfyUI workflow, in its API format.  Inputs are
+// either values, or links to other nodes as [node ID, output index].
+type comfyNode struct {
+	ClassType string         `json:"class_type"`
+	Inputs    map[string]any `json:"inputs"`
+}
+
+type comfyWorkflow map[string]comfyNode
+
+// link returns the node an input links to.
+func (w comfyWorkflow) link(node comfyNode, input string) (comfyNode, bool) {
+	linked, ok := node.Inputs[input].([]any)
+	if !ok || len(linked) != 2 {
+		return comfyNode{}, false
+	}
+
+	id, ok := linked[0].(string)
+	if !ok {
+		return comfyNode{}, false
+	}
+
+	target, ok := w[id]
+
+	return target, ok
+}
+
+// find follows the links from node until it finds a node with one of the given
+// inputs as a value, and returns that value.  Links are followed depth first, and
+// only a few levels deep, since workflows can have cycles through reroutes.
+func (w comfyWorkflow) find(node comfyNode, inputs []string, depth int) (any, bool) {
+	for _, v := range inputs {
+		if value, ok := node.Inputs[v]; ok {
+			if _, isLink := value.([]any); !isLink {
+				return value, true
+			}
+		}
+	}
+
+	if depth == 0 {
+		return nil, false
+	}
+
+	inputNames := make([]string, 0, len(node.Inputs))
+	for k := range node.Inputs {
+		inputNames = append(inputNames, k)
+	}
+
+	sort.Strings(inputNames)
+
+	for _, input := range inputNames {
+		if linked, ok := w.link(node, input); ok {
+			if value, ok := w.find(linked, inputs, depth-1); ok {
+				return value, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// parseComfyUI parses the metadata out of a ComfyUI workflow, from its first
+// sampler node.
+func parseComfyUI(workflowJSON string) (*Metadata, error) {
+	var workflow comfyWorkflow
+
+	err := json.Unmarshal([]byte(workflowJSON), &workflow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ComfyUI workflow: %w", err)
+	}
+
+	meta := &Metadata{
+		Extra:  map[string]string{},
+		Params: Params{Backend: BackendComfyUI},
+	}
+
+	var sampler comfyNode
+
+	found := false
+
+	// Node IDs are usually numbers, so sort them that way to pick the first
+	// sampler.
+	ids := make([]string, 0, len(workflow))
+	for k := range workflow {
+		ids = append(ids, k)
+	}
+
+	slices.SortFunc(ids, func(a string, b string) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	for _, id := range ids {
+		if strings.Contains(workflow[id].ClassType, "Sampler") {
+			sampler = workflow[id]
+			found = true
+
+			break
+		}
+	}
+
+	if !found {
+		return meta, nil
+	}
+
+	const maxDepth = 5
+
+	text := func(input string) string {
+		linked, ok := workflow.link(sampler, input)
+		if !ok {
+			return ""
+		}
+
+		value, _ := workflow.find(linked, []string{"text", "text_g"}, maxDepth)
+		s, _ := value.(string)
+
+		return s
+	}
+
+	meta.Prompt = text("positive")
+	meta.Params.NegativePrompt = text("negative")
+
+	if seed, ok := workflow.find(sampler, []string{"seed", "noise_seed"}, maxDepth); ok {
+		if f, ok := seed.(float64); ok {
+			meta.Params.Seed = int64(f)
+		}
+	}
+
+	if model, ok := workflow.find(sampler, []string{"ckpt_name", "unet_name"}, maxDepth); ok {
+		meta.Params.Model, _ = model.(string)
+	}
+
+	if latent, ok := workflow.link(sampler, "latent_image"); ok {
+		width, _ := latent.Inputs["width"].(float64)
+		height, _ := latent.Inputs["height"].(float64)
+		meta.Params.AspectRatio = ratioOf(int(width), int(height))
+	}
+
+	for _, v := range []string{"steps", "cfg", "sampler_name", "scheduler", "denoise"} {
+		if value, ok := sampler.Inputs[v]; ok {
+			if _, isLink := value.([]any); !isLink {
+				meta.Extra[v] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// novelAIComment is the JSON NovelAI writes to the "Comment" text chunk.
+type novelAIComment struct {
+	Prompt   string  `json:"prompt"`
+	Negative string  `json:"uc"`
+	Seed     int64   `json:"seed"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Steps    int     `json:"steps"`
+	Scale    float64 `json:"scale"`
+	Sampler  string  `json:"sampler"`
+}
+
+// parseNovelAI parses NovelAI's metadata from its "Description", "Comment", and
+// "Source" text chunks.
+func parseNovelAI(description string, commentJSON string, source string) (*Metadata, error) {
+	var comment novelAIComment
+
+	err := json.Unmarshal([]byte(commentJSON), &comment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse NovelAI metadata: %w", err)
+	}
+
+	prompt := comment.Prompt
+	if prompt == "" {
+		prompt = description
+	}
+
+	meta := &Metadata{
+		Prompt: prompt,
+		Extra:  map[string]string{},
+		Params: Params{
+			Backend:        BackendNovelAI,
+			NegativePrompt: comment.Negative,
+			Seed:           comment.Seed,
+			Model:          source,
+			AspectRatio:    ratioOf(comment.Width, comment.Height),
+		},
+	}
+
+	if comment.Steps != 0 {
+		meta.Extra["steps"] = strconv.Itoa(comment.Steps)
+	}
+
+	if comment.Scale != 0 {
+		meta.Extra["scale"] = strconv.FormatFloat(comment.Scale, 'f', -1, 64)
+	}
+
+	if comment.Sampler != "" {
+		meta.Extra["sampler"] = comment.Sampler
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,162 @@
+// Package imagemeta reads and writes the metadata that sdcli embeds in generated
+// images, so other programs can parse and stamp sdcli-style metadata.
+//
+// Metadata is stored in standard Exif tags where one exists: the prompt is the
+// ImageDescription, and the artist, copyright, software, timestamps, and keywords
+// use their respective tags.  Generation parameters and any extra values that
+// have no standard tag are stored in the UserComment as "Key: value" lines.
+// Keywords are also written to XMP.
+package imagemeta
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultArtist is the Artist written when Metadata.Artist is empty.
+const DefaultArtist = "Stable Diffusion"
+
+// The keys generation parameters are stored under in the UserComment.
+const (
+	keyNegativePrompt = "Negative prompt"
+	keyOriginalPrompt = "Original prompt"
+	keySeasoning      = "Seasoning"
+	keyBackend        = "Backend"
+	keyModel          = "Model"
+	keySeed           = "Seed"
+	keyAspectRatio    = "Aspect ratio"
+	keyEdit           = "Edit"
+)
+
+// Params are the parameters an image was generated with.
+type Params struct {
+	NegativePrompt string
+	Backend        string
+	Model          string
+	Seed           int64
+	AspectRatio    string
+
+	// The prompt as it was given, if the prompt was expanded before generating,
+	// e.g. by an LLM.
+	OriginalPrompt string
+
+	// Tokens that were appended to the prompt at random, e.g. "cinematic".  They
+	// are stored on a single UserComment line, separated by commas.
+	Seasoning []string
+
+	// The upscales and edits made to the generated image, oldest first, e.g.
+	// "upscale fast".  Each is stored on its own UserComment line.
+	Edits []string
+}
+
+// Metadata is the metadata written to, or read from, an image.
+type Metadata struct {
+	// The prompt, written as the ImageDescription.
+	Prompt string
+
+	// The Artist tag.  Defaults to DefaultArtist when writing.
+	Artist string
+
+	// The Copyright tag.  Not written if empty.
+	Copyright string
+
+	// The Software tag, e.g. "sdcli v1.2.3".  Not written if empty.
+	Software string
+
+	// When the image was generated.  Written in UTC as DateTime, DateTimeOriginal,
+	// and DateTimeDigitized (also known as CreateDate), along with the matching
+	// offset tags.  Not written if zero.
+	CreatedAt time.Time
+
+	// The parameters the image was generated with.  Zero values are not written.
+	Params Params
+
+	// Keywords describing the image, e.g. from Keywords.  They are written to the
+	// XPKeywords tag, and to XMP as dc:subject so that Lightroom and other asset
+	// managers can search by them.  Not written if empty.
+	Keywords []string
+
+	// A JPEG thumbnail to embed in the Exif, e.g. from Thumbnail, so file managers
+	// can show a preview without decoding the whole image.  Not written if empty.
+	// This is not filled in when reading.
+	Thumbnail []byte
+
+	// Extra tags to write.  Keys that are the names of standard text tags in IFD0,
+	// e.g. "Software" or "DocumentName", are written as those tags.  Any other keys
+	// are written to the UserComment as "key: value" lines.
+	//
+	// When reading, this holds any UserComment lines that aren't parameters.
+	Extra map[string]string
+}
+
+// singleLine replaces newlines so that a value fits on one UserComment line.
+func singleLine(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, "\r", ""), "\n", " ")
+}
+
+// lines returns the UserComment lines for the non-zero parameters.
+func (p Params) lines() []string {
+	var lines []string
+
+	add := func(key string, value string) {
+		if value != "" {
+			lines = append(lines, key+": "+singleLine(value))
+		}
+	}
+
+	add(keyNegativePrompt, p.NegativePrompt)
+	add(keyOriginalPrompt, p.OriginalPrompt)
+	add(keyBackend, p.Backend)
+	add(keyModel, p.Model)
+
+	if p.Seed != 0 {
+		add(keySeed, strconv.FormatInt(p.Seed, 10))
+	}
+
+	add(keyAspectRatio, p.AspectRatio)
+	add(keySeasoning, strings.Join(p.Seasoning, ", "))
+
+	for _, v := range p.Edits {
+		add(keyEdit, v)
+	}
+
+	return lines
+}
+
+// parseComment splits a UserComment into parameters and extra values.
+func parseComment(comment string) (Params, map[string]string) {
+	var params Params
+
+	extra := make(map[string]string)
+
+	for _, line := range strings.Split(comment, "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case keyNegativePrompt:
+			params.NegativePrompt = value
+		case keyOriginalPrompt:
+			params.OriginalPrompt = value
+		case keySeasoning:
+			params.Seasoning = strings.Split(value, ", ")
+		case keyBackend:
+			params.Backend = value
+		case keyModel:
+			params.Model = value
+		case keySeed:
+			params.Seed, _ = strconv.ParseInt(value, 10, 64)
+		case keyAspectRatio:
+			params.AspectRatio = value
+		case keyEdit:
+			params.Edits = append(params.Edits, value)
+		default:
+			extra[key] = value
+		}
+	}
+
+	return params, extra
+}
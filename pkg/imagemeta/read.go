@@ -0,0 +1,140 @@
+package imagemeta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	exifundefined "github.com/dsoprea/go-exif/v3/undefined"
+)
+
+// ErrNoMetadata is returned when an image has no Exif metadata.
+var ErrNoMetadata = errors.New("image has no Exif metadata")
+
+// Read reads the metadata from an encoded PNG or JPEG image.
+func Read(imgBytes []byte) (*Metadata, error) {
+	meta, _, err := readExif(imgBytes)
+
+	return meta, err
+}
+
+// readExif reads the metadata from an image's Exif, along with the full text of
+// its UserComment.
+func readExif(imgBytes []byte) (*Metadata, string, error) {
+	rawExif, err := exif.SearchAndExtractExif(imgBytes)
+	if err != nil {
+		if errors.Is(err, exif.ErrNoExif) {
+			return nil, "", ErrNoMetadata
+		}
+
+		return nil, "", fmt.Errorf("failed to find Exif in image: %w", err)
+	}
+
+	entries, _, err := exif.GetFlatExifData(rawExif, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse Exif: %w", err)
+	}
+
+	var comment string
+
+	meta := &Metadata{Extra: map[string]string{}}
+
+	for _, entry := range entries {
+		switch entry.TagName {
+		case "ImageDescription":
+			meta.Prompt = stringValue(entry)
+		case "Artist":
+			meta.Artist = stringValue(entry)
+		case "Copyright":
+			meta.Copyright = stringValue(entry)
+		case "Software":
+			meta.Software = stringValue(entry)
+		case "DateTimeOriginal":
+			createdAt, err := exifcommon.ParseExifFullTimestamp(stringValue(entry))
+			if err == nil {
+				meta.CreatedAt = createdAt.In(time.UTC)
+			}
+		case "XPKeywords":
+			if raw, ok := entry.Value.([]uint8); ok {
+				meta.Keywords = parseXPKeywords(raw)
+			}
+		case "UserComment":
+			userComment, ok := entry.Value.(exifundefined.Tag9286UserComment)
+			if !ok {
+				continue
+			}
+
+			comment = decodeUserComment(userComment)
+			meta.Params, meta.Extra = parseComment(comment)
+		}
+	}
+
+	return meta, comment, nil
+}
+
+// decodeUserComment decodes the text of a UserComment.  Unicode comments are
+// UTF-16, and tools disagree on the byte order, so it is guessed from where the
+// zero bytes of ASCII characters fall.
+func decodeUserComment(comment exifundefined.Tag9286UserComment) string {
+	raw := comment.EncodingBytes
+
+	if comment.EncodingType != exifundefined.TagUndefinedType_9286_UserComment_Encoding_UNICODE {
+		return strings.TrimRight(string(raw), "\x00")
+	}
+
+	var evenZeros, oddZeros int
+
+	for i, b := range raw {
+		if b == 0 && i%2 == 0 {
+			evenZeros++
+		} else if b == 0 {
+			oddZeros++
+		}
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if oddZeros > evenZeros {
+		order = binary.LittleEndian
+	}
+
+	encoded := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		encoded = append(encoded, order.Uint16(raw[i:i+2]))
+	}
+
+	return strings.TrimRight(string(utf16.Decode(encoded)), "\x00")
+}
+
+func stringValue(entry exif.ExifTag) string {
+	if s, ok := entry.Value.(string); ok {
+		return strings.TrimRight(s, "\x00")
+	}
+
+	return entry.FormattedFirst
+}
+
+// ExtractPrompt returns the prompt embedded in an encoded PNG or JPEG image.
+func ExtractPrompt(imgBytes []byte) (string, error) {
+	meta, err := Read(imgBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return meta.Prompt, nil
+}
+
+// ExtractParams returns the generation parameters embedded in an encoded PNG or
+// JPEG image.
+func ExtractParams(imgBytes []byte) (*Params, error) {
+	meta, err := Read(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta.Params, nil
+}
@@ -0,0 +1,206 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dsoprea/go-exif/v3"
+)
+
+// JPEG markers that StreamJPEG needs to recognize.
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+)
+
+// exifJPEGPrefix starts the data of an APP1 segment holding Exif.
+const exifJPEGPrefix = "Exif\x00\x00"
+
+// maxSegmentData is the most data a JPEG segment can hold, since its length,
+// which counts itself, is two bytes.
+const maxSegmentData = 0xffff - 2
+
+// ErrNotJPEG is returned by StreamJPEG when its input isn't a JPEG image.
+var ErrNotJPEG = errors.New("not a JPEG image")
+
+// StreamJPEG copies a JPEG image from r to w with meta embedded, like AddToJPEG,
+// but without holding the image in memory.  The metadata segments are inserted
+// after any leading APP0 (JFIF) segments as the headers are copied, and the
+// compressed image data is then copied as is, so only one segment is buffered
+// at a time.  Existing Exif is dropped, as is existing XMP if meta has keywords.
+//
+// Unlike Write, the result isn't verified, since it is never held in memory.
+func StreamJPEG(w io.Writer, r io.Reader, meta Metadata) error {
+	segments, err := metadataSegments(meta)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+
+	_, err = io.ReadFull(br, soi[:])
+	if err != nil || soi != [2]byte{0xff, markerSOI} {
+		return ErrNotJPEG
+	}
+
+	_, err = w.Write(soi[:])
+	if err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	inserted := false
+
+	for {
+		marker, err := readMarker(br)
+		if err != nil {
+			return err
+		}
+
+		if !inserted && marker != markerAPP0 {
+			for _, v := range segments {
+				err = writeSegment(w, markerAPP1, v)
+				if err != nil {
+					return err
+				}
+			}
+
+			inserted = true
+		}
+
+		// The compressed image data follows the start of scan, and isn't split
+		// into segments, so the rest of the image is copied as is.
+		if marker == markerSOS || marker == markerEOI {
+			_, err = w.Write([]byte{0xff, marker})
+			if err != nil {
+				return fmt.Errorf("failed to write image: %w", err)
+			}
+
+			_, err = io.Copy(w, br)
+			if err != nil {
+				return fmt.Errorf("failed to copy image: %w", err)
+			}
+
+			return nil
+		}
+
+		data, err := readSegment(br)
+		if err != nil {
+			return err
+		}
+
+		if marker == markerAPP1 && replacedBy(data, meta) {
+			continue
+		}
+
+		err = writeSegment(w, marker, data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// metadataSegments returns the data of the APP1 segments holding meta: its Exif,
+// then its XMP if it has keywords.
+func metadataSegments(meta Metadata) ([][]byte, error) {
+	ib, err := buildExif(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	exifData, err := exif.NewIfdByteEncoder().EncodeToExif(ib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Exif: %w", err)
+	}
+
+	segments := [][]byte{append([]byte(exifJPEGPrefix), exifData...)}
+
+	if len(meta.Keywords) > 0 {
+		segments = append(segments, append([]byte(xmpJPEGNamespace), xmpPacket(meta.Keywords)...))
+	}
+
+	for _, v := range segments {
+		if len(v) > maxSegmentData {
+			return nil, fmt.Errorf("metadata is too large for a JPEG segment: %d bytes", len(v))
+		}
+	}
+
+	return segments, nil
+}
+
+// replacedBy reports whether the data of an APP1 segment is metadata that meta
+// replaces.
+func replacedBy(data []byte, meta Metadata) bool {
+	return bytes.HasPrefix(data, []byte(exifJPEGPrefix)) ||
+		(len(meta.Keywords) > 0 && bytes.HasPrefix(data, []byte(xmpJPEGNamespace)))
+}
+
+// readMarker reads the next marker, skipping the fill bytes that may precede it.
+func readMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read marker: %w", err)
+	}
+
+	if b != 0xff {
+		return 0, fmt.Errorf("%w: expected a marker, got 0x%02x", ErrNotJPEG, b)
+	}
+
+	for b == 0xff {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read marker: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+// readSegment reads the data of the segment whose marker was just read.
+func readSegment(r io.Reader) ([]byte, error) {
+	var length [2]byte
+
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment length: %w", err)
+	}
+
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size < 2 {
+		return nil, fmt.Errorf("invalid segment length %d", size)
+	}
+
+	data := make([]byte, size-2)
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment: %w", err)
+	}
+
+	return data, nil
+}
+
+// writeSegment writes a segment with its marker and length.
+func writeSegment(w io.Writer, marker byte, data []byte) error {
+	header := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(data)+2))
+
+	_, err := w.Write(header)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write segment: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	pis "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+// JPEG markers that Strip keeps or drops, in addition to those StreamJPEG
+// recognizes.
+const (
+	markerAPP2  = 0xe2
+	markerAPP14 = 0xee
+	markerAPP15 = 0xef
+	markerCOM   = 0xfe
+)
+
+// strippedPNGChunks are the PNG chunks that hold metadata rather than pixels.
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// ErrUnsupportedStrip is returned by Strip for images in formats it can't strip.
+var ErrUnsupportedStrip = errors.New("stripping metadata is only supported for JPEG, PNG, and WebP images")
+
+// Strip removes the metadata from an encoded JPEG, PNG, or WebP image without
+// re-encoding it, e.g. the GPS position, camera serial number, and capture time
+// in a phone photo's Exif.  Only the Exif Orientation is kept, so that rotated
+// photos are still upright.  Color profiles are kept too, since they change how
+// the image looks rather than describe it.
+func Strip(imgBytes []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(imgBytes, []byte{0xff, markerSOI}):
+		return stripInMemory(imgBytes, stripJPEG)
+	case bytes.HasPrefix(imgBytes, []byte(pis.PngSignature[:])):
+		return stripInMemory(imgBytes, stripPNG)
+	case len(imgBytes) >= 12 && string(imgBytes[0:4]) == "RIFF" && string(imgBytes[8:12]) == "WEBP":
+		return stripWebP(imgBytes)
+	}
+
+	return nil, ErrUnsupportedStrip
+}
+
+// StripTo strips the metadata from a JPEG or PNG image read from r, like Strip,
+// writing the result to w as it is read.  Only the JPEG headers or a PNG chunk
+// at a time are held in memory, rather than the whole image.  Other formats
+// return ErrUnsupportedStrip, and have to be stripped in memory with Strip.
+func StripTo(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	header, err := br.Peek(len(pis.PngSignature))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, markerSOI}):
+		return stripJPEG(w, br)
+	case bytes.HasPrefix(header, pis.PngSignature[:]):
+		return stripPNG(w, br)
+	}
+
+	return ErrUnsupportedStrip
+}
+
+// stripInMemory strips an image with strip, which writes it as StripTo does.
+func stripInMemory(imgBytes []byte, strip func(w io.Writer, r *bufio.Reader) error) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(imgBytes)))
+
+	err := strip(out, bufio.NewReader(bytes.NewReader(imgBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// stripJPEG drops every application segment but JFIF (APP0), ICC profiles
+// (APP2), and Adobe's color transform (APP14), along with comments.  The
+// segments before the compressed image data are read first, to find the
+// orientation, and the data is then copied as is.
+func stripJPEG(w io.Writer, r *bufio.Reader) error {
+	type segment struct {
+		marker byte
+		data   []byte
+	}
+
+	var soi [2]byte
+
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil || soi != [2]byte{0xff, markerSOI} {
+		return ErrNotJPEG
+	}
+
+	var (
+		orientation uint16
+		segments    []segment
+		last        byte
+	)
+
+	for {
+		marker, err := readMarker(r)
+		if err != nil {
+			return err
+		}
+
+		// The compressed image data follows the start of scan, and isn't split
+		// into segments, so the rest of the image is copied as is.
+		if marker == markerSOS || marker == markerEOI {
+			last = marker
+			break
+		}
+
+		data, err := readSegment(r)
+		if err != nil {
+			return err
+		}
+
+		if marker == markerAPP1 && bytes.HasPrefix(data, []byte(exifJPEGPrefix)) && orientation == 0 {
+			orientation = exifOrientation(data[len(exifJPEGPrefix):])
+		}
+
+		isApp := marker >= markerAPP0 && marker <= markerAPP15
+		if marker == markerCOM || (isApp && marker != markerAPP0 && marker != markerAPP2 && marker != markerAPP14) {
+			continue
+		}
+
+		segments = append(segments, segment{marker: marker, data: data})
+	}
+
+	_, err = w.Write(soi[:])
+	if err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	// Like StreamJPEG, the Exif goes after any leading APP0 (JFIF) segments.
+	inserted := orientation <= 1
+
+	for _, v := range segments {
+		if !inserted && v.marker != markerAPP0 {
+			err := writeOrientationSegment(w, orientation)
+			if err != nil {
+				return err
+			}
+
+			inserted = true
+		}
+
+		err := writeSegment(w, v.marker, v.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !inserted {
+		err := writeOrientationSegment(w, orientation)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write([]byte{0xff, last})
+	if err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+
+	return nil
+}
+
+// writeOrientationSegment writes an APP1 segment holding Exif with only an
+// Orientation tag.
+func writeOrientationSegment(w io.Writer, orientation uint16) error {
+	data, err := orientationExif(orientation)
+	if err != nil {
+		return err
+	}
+
+	return writeSegment(w, markerAPP1, append([]byte(exifJPEGPrefix), data...))
+}
+
+// maxPNGChunkLength is the longest a PNG chunk's data can be.
+const maxPNGChunkLength = 1<<31 - 1
+
+// stripPNG drops the chunks holding text, Exif, and timestamps, copying the
+// rest a chunk at a time.  If the Exif had an orientation, it is replaced with
+// Exif holding only that.
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	signature := make([]byte, len(pis.PngSignature))
+
+	_, err := io.ReadFull(r, signature)
+	if err != nil || !bytes.Equal(signature, pis.PngSignature[:]) {
+		return errors.New("failed to parse PNG: bad signature")
+	}
+
+	_, err = w.Write(signature)
+	if err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	exifSeen := false
+
+	for {
+		var header [8]byte
+
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			return fmt.Errorf("failed to parse PNG: failed to read chunk: %w", err)
+		}
+
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:])
+
+		if length > maxPNGChunkLength {
+			return fmt.Errorf("failed to parse PNG: invalid length %d for %q chunk", length, chunkType)
+		}
+
+		switch {
+		case chunkType == "eXIf" && !exifSeen:
+			exifSeen = true
+
+			err = replacePNGExif(w, r, length)
+		case strippedPNGChunks[chunkType]:
+			_, err = r.Discard(int(length) + crc32.Size)
+		default:
+			_, err = w.Write(header[:])
+			if err == nil {
+				_, err = io.CopyN(w, r, int64(length)+crc32.Size)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to copy %q chunk: %w", chunkType, err)
+		}
+
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// replacePNGExif reads the data and CRC of an eXIf chunk, and writes an eXIf
+// chunk holding only its orientation in its place, if it has one.
+func replacePNGExif(w io.Writer, r io.Reader, length uint32) error {
+	data := make([]byte, int(length)+crc32.Size)
+
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+
+	orientation := exifOrientation(data[:length])
+	if orientation <= 1 {
+		return nil
+	}
+
+	exifData, err := orientationExif(orientation)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 8, 8+len(exifData)+crc32.Size)
+	binary.BigEndian.PutUint32(chunk, uint32(len(exifData)))
+	copy(chunk[4:], "eXIf")
+	chunk = append(chunk, exifData...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	_, err = w.Write(chunk)
+
+	return err
+}
+
+// stripWebP drops the Exif and XMP chunks, and clears their flags.  WebP
+// decoders ignore the Exif Orientation, so it isn't kept.
+func stripWebP(imgBytes []byte) ([]byte, error) {
+	chunks, err := parseWebP(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]riffChunk, 0, len(chunks))
+
+	for _, v := range chunks {
+		switch v.id {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if len(v.data) > 0 {
+				data := bytes.Clone(v.data)
+				data[0] &^= vp8xFlagExif | vp8xFlagXMP
+				v.data = data
+			}
+		}
+
+		kept = append(kept, v)
+	}
+
+	return writeWebP(kept), nil
+}
+
+// exifOrientation returns the Orientation tag in raw Exif, or zero if it has
+// none or can't be parsed.
+func exifOrientation(rawExif []byte) uint16 {
+	entries, _, err := exif.GetFlatExifData(rawExif, nil)
+	if err != nil {
+		return 0
+	}
+
+	for _, v := range entries {
+		if v.TagName != "Orientation" || v.IfdPath != exifcommon.IfdStandardIfdIdentity.UnindexedString() {
+			continue
+		}
+
+		if values, ok := v.Value.([]uint16); ok && len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return 0
+}
+
+// orientationIfd builds a root IFD holding only an Orientation tag.
+func orientationIfd(orientation uint16) (*exif.IfdBuilder, error) {
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new exif mapping: %w", err)
+	}
+
+	ib := exif.NewIfdBuilder(im, exif.NewTagIndex(), exifcommon.IfdStandardIfdIdentity, exifcommon.TestDefaultByteOrder)
+
+	err = ib.AddStandardWithName("Orientation", []uint16{orientation})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set Orientation tag: %w", err)
+	}
+
+	return ib, nil
+}
+
+// orientationExif encodes Exif holding only an Orientation tag.
+func orientationExif(orientation uint16) ([]byte, error) {
+	ib, err := orientationIfd(orientation)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := exif.NewIfdByteEncoder().EncodeToExif(ib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Exif: %w", err)
+	}
+
+	return data, nil
+}
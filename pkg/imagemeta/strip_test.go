@@ -0,0 +1,181 @@
+package imagemeta
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/SethCurry/sdcli/internal/testutil"
+	pis "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+// rotatedJPEG returns a JPEG with Exif holding the orientation, followed by a
+// comment that Strip drops.
+func rotatedJPEG(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+
+	data, err := orientationExif(orientation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	buf.Write([]byte{0xff, markerSOI})
+	writeSegment(&buf, markerAPP1, append([]byte(exifJPEGPrefix), data...))
+	writeSegment(&buf, markerCOM, []byte("taken at 51.5N 0.1W"))
+	buf.Write(testutil.JPEG(16, 16)[2:])
+
+	return buf.Bytes()
+}
+
+// rotatedPNG returns a PNG with Exif holding the orientation, and a text chunk
+// that Strip drops.
+func rotatedPNG(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+
+	withText, err := AddToPNG(testutil.PNG(16, 16), Metadata{Prompt: "A bear"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := pis.NewPngMediaParser().ParseBytes(withText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ib, err := orientationIfd(orientation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl := &wrappedChunkSlice{parsed.(*pis.ChunkSlice)}
+
+	err = sl.SetExif(ib)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	err = sl.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestStripTo(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       []byte
+		orientation uint16
+	}{
+		{"jpeg with metadata", mustAddToJPEG(t, testutil.JPEG(16, 16)), 0},
+		{"rotated jpeg", rotatedJPEG(t, 6), 6},
+		{"upright jpeg", rotatedJPEG(t, 1), 0},
+		{"rotated png", rotatedPNG(t, 8), 8},
+		{"plain png", testutil.PNG(16, 16), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streamed bytes.Buffer
+
+			err := StripTo(&streamed, bytes.NewReader(tt.image))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			inMemory, err := Strip(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(streamed.Bytes(), inMemory) {
+				t.Error("expected StripTo and Strip to agree")
+			}
+
+			_, _, err = image.Decode(bytes.NewReader(streamed.Bytes()))
+			if err != nil {
+				t.Fatalf("failed to decode stripped image: %v", err)
+			}
+
+			meta, err := Read(streamed.Bytes())
+			if err == nil && meta.Prompt != "" {
+				t.Errorf("expected the prompt to be stripped, got %q", meta.Prompt)
+			}
+
+			if bytes.Contains(streamed.Bytes(), []byte("51.5N")) {
+				t.Error("expected the comment to be stripped")
+			}
+
+			if got := orientationOf(streamed.Bytes()); got != tt.orientation {
+				t.Errorf("orientation = %d, want %d", got, tt.orientation)
+			}
+		})
+	}
+}
+
+func TestStripToErrors(t *testing.T) {
+	jpeg := mustAddToJPEG(t, testutil.JPEG(16, 16))
+
+	tests := []struct {
+		name  string
+		image []byte
+		want  error
+	}{
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), ErrUnsupportedStrip},
+		{"empty", nil, ErrUnsupportedStrip},
+		{"truncated jpeg", jpeg[:40], nil},
+		{"truncated png", testutil.PNG(16, 16)[:20], nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			err := StripTo(&out, bytes.NewReader(tt.image))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func mustAddToJPEG(t *testing.T, img []byte) []byte {
+	t.Helper()
+
+	withMeta, err := AddToJPEG(img, Metadata{Prompt: "A bear", Keywords: []string{"bear"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return withMeta
+}
+
+// orientationOf returns the Exif orientation of a stripped JPEG or PNG image, or
+// zero if it has none.
+func orientationOf(img []byte) uint16 {
+	if bytes.HasPrefix(img, []byte{0xff, markerSOI}) {
+		i := bytes.Index(img, []byte(exifJPEGPrefix))
+		if i < 0 {
+			return 0
+		}
+
+		return exifOrientation(img[i+len(exifJPEGPrefix):])
+	}
+
+	i := bytes.Index(img, []byte("eXIf"))
+	if i < 0 {
+		return 0
+	}
+
+	return exifOrientation(img[i+4:])
+}
@@ -0,0 +1,75 @@
+package imagemeta
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// ThumbnailSize is the largest width or height of thumbnails made by Thumbnail.
+const ThumbnailSize = 160
+
+// thumbnailQuality is the JPEG quality of thumbnails.  The whole Exif block,
+// including the thumbnail, must fit in 64KiB.
+const thumbnailQuality = 75
+
+// Thumbnail makes a JPEG thumbnail of img that fits within ThumbnailSize pixels,
+// for Metadata.Thumbnail.
+func Thumbnail(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("image is empty")
+	}
+
+	scale := float64(ThumbnailSize) / float64(max(width, height))
+	if scale > 1 {
+		scale = 1
+	}
+
+	thumbWidth := max(1, int(float64(width)*scale))
+	thumbHeight := max(1, int(float64(height)*scale))
+
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+
+	// Average the source pixels covered by each thumbnail pixel.
+	for ty := 0; ty < thumbHeight; ty++ {
+		y0 := bounds.Min.Y + ty*height/thumbHeight
+		y1 := max(y0+1, bounds.Min.Y+(ty+1)*height/thumbHeight)
+
+		for tx := 0; tx < thumbWidth; tx++ {
+			x0 := bounds.Min.X + tx*width/thumbWidth
+			x1 := max(x0+1, bounds.Min.X+(tx+1)*width/thumbWidth)
+
+			var r, g, b, a, n uint64
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+
+			i := thumb.PixOffset(tx, ty)
+			thumb.Pix[i+0] = uint8(r / n >> 8)
+			thumb.Pix[i+1] = uint8(g / n >> 8)
+			thumb.Pix[i+2] = uint8(b / n >> 8)
+			thumb.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
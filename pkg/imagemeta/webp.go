@@ -0,0 +1,193 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dsoprea/go-exif/v3"
+)
+
+// Flags in the VP8X chunk of an extended WebP file.
+const (
+	vp8xFlagAlpha = 0x10
+	vp8xFlagExif  = 0x08
+	vp8xFlagXMP   = 0x04
+)
+
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+func parseWebP(imgBytes []byte) ([]riffChunk, error) {
+	if len(imgBytes) < 12 || string(imgBytes[0:4]) != "RIFF" || string(imgBytes[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+
+	var chunks []riffChunk
+
+	rest := imgBytes[12:]
+	for len(rest) >= 8 {
+		id := string(rest[0:4])
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+
+		if 8+size > len(rest) {
+			return nil, fmt.Errorf("WebP chunk %q is truncated", id)
+		}
+
+		chunks = append(chunks, riffChunk{id: id, data: rest[8 : 8+size]})
+
+		// Chunks are padded to an even size.
+		rest = rest[min(len(rest), 8+size+size%2):]
+	}
+
+	return chunks, nil
+}
+
+func writeWebP(chunks []riffChunk) []byte {
+	size := 4
+	for _, v := range chunks {
+		size += 8 + len(v.data) + len(v.data)%2
+	}
+
+	out := make([]byte, 0, 8+size)
+	out = append(out, "RIFF"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	out = append(out, "WEBP"...)
+
+	for _, v := range chunks {
+		out = append(out, v.id...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(v.data)))
+		out = append(out, v.data...)
+
+		// Chunks are padded to an even size.
+		if len(v.data)%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+
+	return out
+}
+
+// webpCanvas returns the canvas size of a simple (VP8 or VP8L) WebP image, and
+// whether it has alpha.
+func webpCanvas(chunk riffChunk) (int, int, bool, error) {
+	switch chunk.id {
+	case "VP8 ":
+		if len(chunk.data) < 10 {
+			return 0, 0, false, errors.New("VP8 chunk is too short")
+		}
+
+		width := int(binary.LittleEndian.Uint16(chunk.data[6:8]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(chunk.data[8:10]) & 0x3fff)
+
+		return width, height, false, nil
+	case "VP8L":
+		if len(chunk.data) < 5 {
+			return 0, 0, false, errors.New("VP8L chunk is too short")
+		}
+
+		bits := binary.LittleEndian.Uint32(chunk.data[1:5])
+		width := int(bits&0x3fff) + 1
+		height := int((bits>>14)&0x3fff) + 1
+		alpha := (bits>>28)&1 == 1
+
+		return width, height, alpha, nil
+	}
+
+	return 0, 0, false, fmt.Errorf("unexpected WebP chunk %q", chunk.id)
+}
+
+func newVP8X(width int, height int, flags byte) riffChunk {
+	data := make([]byte, 10)
+	data[0] = flags
+
+	putUint24 := func(b []byte, v int) {
+		b[0] = byte(v)
+		b[1] = byte(v >> 8)
+		b[2] = byte(v >> 16)
+	}
+
+	putUint24(data[4:7], width-1)
+	putUint24(data[7:10], height-1)
+
+	return riffChunk{id: "VP8X", data: data}
+}
+
+// AddToWebP embeds meta into a WebP image, replacing any existing Exif, and any
+// existing XMP if meta has keywords.  Simple
+// WebP images are converted to the extended format, since only it can hold Exif.
+func AddToWebP(imgBytes []byte, meta Metadata) ([]byte, error) {
+	chunks, err := parseWebP(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chunks) == 0 {
+		return nil, errors.New("WebP image has no chunks")
+	}
+
+	ib, err := buildExif(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	rawExif, err := exif.NewIfdByteEncoder().EncodeToExif(ib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Exif: %w", err)
+	}
+
+	if chunks[0].id != "VP8X" {
+		width, height, alpha, err := webpCanvas(chunks[0])
+		if err != nil {
+			return nil, err
+		}
+
+		var flags byte
+		if alpha {
+			flags |= vp8xFlagAlpha
+		}
+
+		chunks = append([]riffChunk{newVP8X(width, height, flags)}, chunks...)
+	}
+
+	chunks[0].data = bytes.Clone(chunks[0].data)
+	chunks[0].data[0] |= vp8xFlagExif
+
+	metaChunks := []riffChunk{{id: "EXIF", data: rawExif}}
+
+	if len(meta.Keywords) > 0 {
+		chunks[0].data[0] |= vp8xFlagXMP
+		metaChunks = append(metaChunks, riffChunk{id: "XMP ", data: xmpPacket(meta.Keywords)})
+	}
+
+	// The Exif and XMP chunks go after the image data, but before unknown chunks,
+	// so replace any existing ones in place or append them after the image data.
+	updated := make([]riffChunk, 0, len(chunks)+len(metaChunks))
+	inserted := false
+
+	for _, v := range chunks {
+		replaced := v.id == "EXIF" || (v.id == "XMP " && len(meta.Keywords) > 0)
+		if !replaced && v.id != "XMP " {
+			updated = append(updated, v)
+			continue
+		}
+
+		if !inserted {
+			updated = append(updated, metaChunks...)
+			inserted = true
+		}
+
+		if !replaced {
+			updated = append(updated, v)
+		}
+	}
+
+	if !inserted {
+		updated = append(updated, metaChunks...)
+	}
+
+	return writeWebP(updated), nil
+}
@@ -0,0 +1,415 @@
+package imagemeta
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Registers the JPEG decoder for Verify.
+	_ "image/png"  // Registers the PNG decoder for Verify.
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	exifundefined "github.com/dsoprea/go-exif/v3/undefined"
+	pis "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+type exifWriter interface {
+	SetExif(*exif.IfdBuilder) error
+	SetXMP([]byte) error
+	Write(io.Writer) error
+}
+
+type wrappedChunkSlice struct {
+	*pis.ChunkSlice
+}
+
+func (w *wrappedChunkSlice) Write(to io.Writer) error {
+	return w.WriteTo(to)
+}
+
+// SetXMP replaces any XMP in the image with an iTXt chunk holding packet.
+func (w *wrappedChunkSlice) SetXMP(packet []byte) error {
+	chunks := make([]*pis.Chunk, 0, len(w.Chunks())+1)
+
+	for _, v := range w.Chunks() {
+		if v.Type == "iTXt" && bytes.HasPrefix(v.Data, []byte(xmpPNGKeyword+"\x00")) {
+			continue
+		}
+
+		if v.Type == "IEND" {
+			// Keyword, then no compression, no language tag, and no translated
+			// keyword.
+			data := append([]byte(xmpPNGKeyword+"\x00\x00\x00\x00\x00"), packet...)
+
+			itxt := &pis.Chunk{Type: "iTXt", Data: data, Length: uint32(len(data))}
+			itxt.UpdateCrc32()
+
+			chunks = append(chunks, itxt)
+		}
+
+		chunks = append(chunks, v)
+	}
+
+	w.ChunkSlice = pis.NewChunkSlice(chunks)
+
+	return nil
+}
+
+type exifExtractor func([]byte) (exifWriter, error)
+
+// metadataSizeHint is roughly how much room metadata takes up in an image.
+const metadataSizeHint = 16 << 10
+
+// buildExif builds the root IFD holding meta.
+func buildExif(meta Metadata) (*exif.IfdBuilder, error) {
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new exif mapping: %w", err)
+	}
+
+	ti := exif.NewTagIndex()
+	ib := exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.TestDefaultByteOrder)
+
+	err = addMetadata(ib, ti, meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build new Exif metadata: %w", err)
+	}
+
+	if len(meta.Thumbnail) > 0 {
+		// Thumbnails live in IFD1, which follows IFD0.
+		ifd1Ib := exif.NewIfdBuilder(im, ti, exifcommon.Ifd1StandardIfdIdentity, exifcommon.TestDefaultByteOrder)
+
+		err = ifd1Ib.AddStandardWithName("Compression", []uint16{6})
+		if err != nil {
+			return nil, fmt.Errorf("failed to set thumbnail Compression tag: %w", err)
+		}
+
+		err = ifd1Ib.SetThumbnail(meta.Thumbnail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set thumbnail: %w", err)
+		}
+
+		err = ib.SetNextIb(ifd1Ib)
+		if err != nil {
+			return nil, fmt.Errorf("failed to link thumbnail IFD: %w", err)
+		}
+	}
+
+	return ib, nil
+}
+
+func addExifToImage(imgBytes []byte, extractor exifExtractor, meta Metadata) ([]byte, error) {
+	parsedImage, err := extractor(imgBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image with Exif extractor: %w", err)
+	}
+
+	ib, err := buildExif(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parsedImage.SetExif(ib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set new Exif on image: %w", err)
+	}
+
+	if len(meta.Keywords) > 0 {
+		err = parsedImage.SetXMP(xmpPacket(meta.Keywords))
+		if err != nil {
+			return nil, fmt.Errorf("failed to set new XMP on image: %w", err)
+		}
+	}
+
+	// The output is the input plus the metadata, so size the buffer up front
+	// rather than letting it grow, which copies the whole image each time.
+	buf := bytes.NewBuffer(make([]byte, 0, len(imgBytes)+metadataSizeHint))
+
+	err = parsedImage.Write(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write image back to buffer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ErrUnsupportedFormat is returned by Write for image formats that metadata can't
+// be embedded in, e.g. "avif".  Callers should store the metadata elsewhere, such
+// as a sidecar file.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// ErrCorrupted is returned by Write when the image it wrote can't be decoded, or
+// its metadata can't be read back.
+var ErrCorrupted = errors.New("image was corrupted while writing metadata")
+
+// WriteOption changes how Write embeds metadata.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	headerOnly bool
+}
+
+// WithHeaderOnlyVerify makes Write only decode the header of the image it wrote
+// when verifying it, rather than the whole image, which takes several times the
+// memory of the encoded image.
+func WithHeaderOnlyVerify() WriteOption {
+	return func(o *writeOptions) {
+		o.headerOnly = true
+	}
+}
+
+// Write embeds meta into an encoded image in the given format: "png", "jpeg", or
+// "webp".  The result is verified before it is returned; see Verify.
+func Write(imgBytes []byte, format string, meta Metadata, options ...WriteOption) ([]byte, error) {
+	var (
+		out  []byte
+		err  error
+		opts writeOptions
+	)
+
+	for _, v := range options {
+		v(&opts)
+	}
+
+	switch format {
+	case "png":
+		out, err = AddToPNG(imgBytes, meta)
+	case "jpeg":
+		out, err = AddToJPEG(imgBytes, meta)
+	case "webp":
+		out, err = AddToWebP(imgBytes, meta)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedFormat, format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = verify(out, format, meta, opts.headerOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Verify checks that an image written by Write still decodes, and that meta can
+// be read back from it.  It returns an error wrapping ErrCorrupted if not.
+//
+// WebP images can't be decoded by the standard library, so only their structure
+// is checked.
+func Verify(imgBytes []byte, format string, meta Metadata) error {
+	return verify(imgBytes, format, meta, false)
+}
+
+// verify is Verify, but only decodes the header of PNG and JPEG images if
+// headerOnly is set.
+func verify(imgBytes []byte, format string, meta Metadata, headerOnly bool) error {
+	switch format {
+	case "png", "jpeg":
+		decode := func(r io.Reader) (string, error) {
+			_, decodedFormat, err := image.Decode(r)
+			return decodedFormat, err
+		}
+
+		if headerOnly {
+			decode = func(r io.Reader) (string, error) {
+				_, decodedFormat, err := image.DecodeConfig(r)
+				return decodedFormat, err
+			}
+		}
+
+		decodedFormat, err := decode(bytes.NewReader(imgBytes))
+		if err != nil {
+			return fmt.Errorf("%w: failed to decode image: %w", ErrCorrupted, err)
+		}
+
+		if decodedFormat != format {
+			return fmt.Errorf("%w: expected a %s image, got %s", ErrCorrupted, format, decodedFormat)
+		}
+	case "webp":
+		_, err := parseWebP(imgBytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+	}
+
+	got, err := Read(imgBytes)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read metadata back: %w", ErrCorrupted, err)
+	}
+
+	if got.Prompt != meta.Prompt {
+		return fmt.Errorf("%w: wrote prompt %q, but read back %q", ErrCorrupted, meta.Prompt, got.Prompt)
+	}
+
+	if got.Params.Seed != meta.Params.Seed || got.Params.Model != singleLine(meta.Params.Model) {
+		return fmt.Errorf("%w: parameters were not read back as written", ErrCorrupted)
+	}
+
+	return nil
+}
+
+// AddToPNG embeds meta into a PNG image, replacing any existing Exif.  If meta
+// has keywords, any existing XMP is replaced as well.
+func AddToPNG(imgBytes []byte, meta Metadata) ([]byte, error) {
+	return addExifToImage(imgBytes, func(gotBytes []byte) (exifWriter, error) {
+		parsed, err := pis.NewPngMediaParser().ParseBytes(gotBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		sl, ok := parsed.(*pis.ChunkSlice)
+		if !ok {
+			return nil, fmt.Errorf("failed to convert parsed png to ChunkSlice: unexpected type %T", parsed)
+		}
+
+		return &wrappedChunkSlice{sl}, nil
+	}, meta)
+}
+
+// AddToJPEG embeds meta into a JPEG image, replacing any existing Exif.  If meta
+// has keywords, any existing XMP is replaced as well.
+func AddToJPEG(imgBytes []byte, meta Metadata) ([]byte, error) {
+	// Stream the image into a buffer sized up front, rather than parsing it into
+	// segments and writing them back out, which holds another copy of the image.
+	buf := bytes.NewBuffer(make([]byte, 0, len(imgBytes)+metadataSizeHint))
+
+	err := StreamJPEG(buf, bytes.NewReader(imgBytes), meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add metadata to JPEG: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func addMetadata(ib *exif.IfdBuilder, ti *exif.TagIndex, meta Metadata) error {
+	ifd0Ib, err := exif.GetOrCreateIbFromRootIb(ib, "IFD0")
+	if err != nil {
+		return fmt.Errorf("failed to create IFD0 ib: %w", err)
+	}
+
+	artist := meta.Artist
+	if artist == "" {
+		artist = DefaultArtist
+	}
+
+	err = ifd0Ib.AddStandardWithName("Artist", artist)
+	if err != nil {
+		return fmt.Errorf("failed to set Artist tag: %w", err)
+	}
+
+	err = ifd0Ib.AddStandardWithName("ImageDescription", meta.Prompt)
+	if err != nil {
+		return fmt.Errorf("failed to set ImageDescription tag: %w", err)
+	}
+
+	if meta.Copyright != "" {
+		err = ifd0Ib.AddStandardWithName("Copyright", meta.Copyright)
+		if err != nil {
+			return fmt.Errorf("failed to set Copyright tag: %w", err)
+		}
+	}
+
+	if meta.Software != "" {
+		err = ifd0Ib.AddStandardWithName("Software", meta.Software)
+		if err != nil {
+			return fmt.Errorf("failed to set Software tag: %w", err)
+		}
+	}
+
+	if len(meta.Keywords) > 0 {
+		err = ifd0Ib.AddStandardWithName("XPKeywords", xpKeywords(meta.Keywords))
+		if err != nil {
+			return fmt.Errorf("failed to set XPKeywords tag: %w", err)
+		}
+	}
+
+	if !meta.CreatedAt.IsZero() {
+		err = addTimestamps(ib, ifd0Ib, meta.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(meta.Extra))
+	for k := range meta.Extra {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	comment := meta.Params.lines()
+
+	for _, k := range keys {
+		it, err := ti.GetWithName(exifcommon.IfdStandardIfdIdentity, k)
+		if err != nil || !it.DoesSupportType(exifcommon.TypeAscii) {
+			comment = append(comment, k+": "+singleLine(meta.Extra[k]))
+			continue
+		}
+
+		err = ifd0Ib.SetStandardWithName(k, meta.Extra[k])
+		if err != nil {
+			return fmt.Errorf("failed to set %s tag: %w", k, err)
+		}
+	}
+
+	if len(comment) > 0 {
+		exifIb, err := exif.GetOrCreateIbFromRootIb(ib, "IFD/Exif")
+		if err != nil {
+			return fmt.Errorf("failed to create Exif ib: %w", err)
+		}
+
+		err = exifIb.AddStandardWithName("UserComment", exifundefined.Tag9286UserComment{
+			EncodingType:  exifundefined.TagUndefinedType_9286_UserComment_Encoding_ASCII,
+			EncodingBytes: []byte(strings.Join(comment, "\n")),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set UserComment tag: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func addTimestamps(ib *exif.IfdBuilder, ifd0Ib *exif.IfdBuilder, createdAt time.Time) error {
+	timestamp := exifcommon.ExifFullTimestampString(createdAt)
+
+	err := ifd0Ib.AddStandardWithName("DateTime", timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to set DateTime tag: %w", err)
+	}
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(ib, "IFD/Exif")
+	if err != nil {
+		return fmt.Errorf("failed to create Exif ib: %w", err)
+	}
+
+	// ExifFullTimestampString always formats in UTC, so record that the
+	// timestamps have no offset.
+	tags := []struct {
+		name  string
+		value string
+	}{
+		{"DateTimeOriginal", timestamp},
+		{"DateTimeDigitized", timestamp},
+		{"OffsetTime", "+00:00"},
+		{"OffsetTimeOriginal", "+00:00"},
+		{"OffsetTimeDigitized", "+00:00"},
+	}
+
+	for _, v := range tags {
+		err = exifIb.AddStandardWithName(v.name, v.value)
+		if err != nil {
+			return fmt.Errorf("failed to set %s tag: %w", v.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package imagemeta
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/testutil"
+)
+
+// fullMetadata returns metadata with every field that is read back set.
+func fullMetadata() Metadata {
+	return Metadata{
+		Prompt:    "A bear riding a unicycle in space, «cinematic»",
+		Artist:    "sdcli tests",
+		Copyright: "CC0",
+		Software:  "sdcli v1.2.3",
+		CreatedAt: time.Date(2024, 6, 19, 18, 40, 0, 0, time.UTC),
+		Params: Params{
+			NegativePrompt: "blurry",
+			OriginalPrompt: "a bear",
+			Backend:        "stability",
+			Model:          "sd3-large",
+			Seed:           1234,
+			AspectRatio:    "16:9",
+			Seasoning:      []string{"cinematic", "golden hour"},
+			Edits:          []string{"upscale fast", "edit erase"},
+		},
+		Keywords: []string{"bear", "unicycle", "space"},
+		Extra:    map[string]string{"Batch": "7"},
+	}
+}
+
+var fixtures = []struct {
+	format string
+	image  func(width int, height int) []byte
+}{
+	{"png", testutil.PNG},
+	{"jpeg", testutil.JPEG},
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	for _, fixture := range fixtures {
+		t.Run(fixture.format, func(t *testing.T) {
+			want := fullMetadata()
+
+			written, err := Write(fixture.image(48, 32), fixture.format, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, format, err := image.DecodeConfig(bytes.NewReader(written))
+			if err != nil {
+				t.Fatalf("failed to decode written image: %v", err)
+			}
+
+			if format != fixture.format || config.Width != 48 || config.Height != 32 {
+				t.Errorf("got a %dx%d %s image, want a 48x32 %s image", config.Width, config.Height, format, fixture.format)
+			}
+
+			got, err := Read(written)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Prompt != want.Prompt || got.Artist != want.Artist || got.Copyright != want.Copyright || got.Software != want.Software {
+				t.Errorf("read back %q by %q (%q, %q), want %q by %q (%q, %q)",
+					got.Prompt, got.Artist, got.Copyright, got.Software, want.Prompt, want.Artist, want.Copyright, want.Software)
+			}
+
+			if !got.CreatedAt.Equal(want.CreatedAt) {
+				t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, want.CreatedAt)
+			}
+
+			if !reflect.DeepEqual(got.Params, want.Params) {
+				t.Errorf("Params = %+v, want %+v", got.Params, want.Params)
+			}
+
+			if !reflect.DeepEqual(got.Keywords, want.Keywords) {
+				t.Errorf("Keywords = %q, want %q", got.Keywords, want.Keywords)
+			}
+
+			if got.Extra["Batch"] != "7" {
+				t.Errorf("Extra = %v, want Batch: 7", got.Extra)
+			}
+
+			prompt, err := ExtractPrompt(written)
+			if err != nil || prompt != want.Prompt {
+				t.Errorf("ExtractPrompt() = %q, %v", prompt, err)
+			}
+		})
+	}
+}
+
+func TestWriteReplacesMetadata(t *testing.T) {
+	for _, fixture := range fixtures {
+		t.Run(fixture.format, func(t *testing.T) {
+			first, err := Write(fixture.image(16, 16), fixture.format, fullMetadata())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := Write(first, fixture.format, Metadata{Prompt: "A fox", Params: Params{Seed: 5}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Read(second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Prompt != "A fox" || got.Params.Seed != 5 || got.Params.Model != "" {
+				t.Errorf("expected only the new metadata, got %+v", got)
+			}
+
+			if got.Artist != DefaultArtist {
+				t.Errorf("Artist = %q, want the default %q", got.Artist, DefaultArtist)
+			}
+		})
+	}
+}
+
+func TestStripRemovesWrittenMetadata(t *testing.T) {
+	for _, fixture := range fixtures {
+		t.Run(fixture.format, func(t *testing.T) {
+			written, err := Write(fixture.image(16, 16), fixture.format, fullMetadata())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stripped, err := Strip(written)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = Read(stripped)
+			if !errors.Is(err, ErrNoMetadata) {
+				t.Errorf("expected ErrNoMetadata after stripping, got %v", err)
+			}
+
+			if bytes.Contains(stripped, []byte("unicycle")) {
+				t.Error("expected the prompt and keywords to be stripped")
+			}
+
+			_, _, err = image.Decode(bytes.NewReader(stripped))
+			if err != nil {
+				t.Errorf("failed to decode stripped image: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadWithoutMetadata(t *testing.T) {
+	for _, fixture := range fixtures {
+		t.Run(fixture.format, func(t *testing.T) {
+			_, err := Read(fixture.image(16, 16))
+			if !errors.Is(err, ErrNoMetadata) {
+				t.Errorf("expected ErrNoMetadata, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteBrokenImages(t *testing.T) {
+	tests := []struct {
+		name   string
+		image  []byte
+		format string
+
+		// Whether the image is only broken past its header, so that
+		// WithHeaderOnlyVerify accepts it.
+		headerOK bool
+	}{
+		{"truncated png", testutil.Truncated(testutil.PNG(64, 64)), "png", true},
+		{"png with a bad checksum", testutil.BadPNGChecksum(16, 16), "png", false},
+		{"png with bad magic", testutil.BadMagic(testutil.PNG(16, 16)), "png", false},
+		{"truncated jpeg", testutil.Truncated(testutil.JPEG(256, 256)), "jpeg", true},
+		{"jpeg without EOI", testutil.JPEGWithoutEOI(16, 16), "jpeg", true},
+		{"jpeg with bad magic", testutil.BadMagic(testutil.JPEG(16, 16)), "jpeg", false},
+	}
+
+	meta := Metadata{Prompt: "A bear"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Write(tt.image, tt.format, meta)
+			if err == nil {
+				t.Fatal("expected an error")
+			} else if tt.headerOK && !errors.Is(err, ErrCorrupted) {
+				t.Errorf("expected ErrCorrupted once the image is decoded, got %v", err)
+			}
+
+			_, err = Write(tt.image, tt.format, meta, WithHeaderOnlyVerify())
+			if tt.headerOK && err != nil {
+				t.Errorf("expected the header-only check to pass, got %v", err)
+			} else if !tt.headerOK && err == nil {
+				t.Error("expected the header-only check to fail")
+			}
+		})
+	}
+}
+
+func TestWriteUnsupportedFormat(t *testing.T) {
+	_, err := Write(testutil.PNG(16, 16), "gif", Metadata{Prompt: "A bear"})
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// The identifier that starts a JPEG APP1 segment holding XMP.
+const xmpJPEGNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+
+// The keyword of a PNG iTXt chunk holding XMP.
+const xmpPNGKeyword = "XML:com.adobe.xmp"
+
+// promptWeight matches the weight suffix of a weighted prompt phrase, e.g. the
+// ":1.2" in "(masterpiece:1.2)".
+var promptWeight = regexp.MustCompile(`:\s*[0-9.]+$`)
+
+// Keywords splits a prompt into keywords on commas, e.g. "a castle, oil painting"
+// becomes "a castle" and "oil painting".  Prompt weighting like "(detailed:1.2)"
+// is removed, and duplicates are dropped.
+func Keywords(prompt string) []string {
+	var keywords []string
+
+	seen := make(map[string]bool)
+
+	for _, v := range strings.Split(prompt, ",") {
+		v = strings.Trim(strings.TrimSpace(v), "()[]{}")
+		v = strings.TrimSpace(promptWeight.ReplaceAllString(v, ""))
+
+		if v == "" || seen[strings.ToLower(v)] {
+			continue
+		}
+
+		seen[strings.ToLower(v)] = true
+		keywords = append(keywords, v)
+	}
+
+	return keywords
+}
+
+// xpKeywords encodes keywords as the Windows XPKeywords tag, which is a
+// semicolon-separated, null-terminated UTF-16LE string.
+func xpKeywords(keywords []string) []byte {
+	encoded := utf16.Encode([]rune(strings.Join(keywords, ";")))
+
+	buf := make([]byte, 0, len(encoded)*2+2)
+	for _, v := range encoded {
+		buf = binary.LittleEndian.AppendUint16(buf, v)
+	}
+
+	return append(buf, 0, 0)
+}
+
+// parseXPKeywords decodes the Windows XPKeywords tag.
+func parseXPKeywords(raw []byte) []string {
+	encoded := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		encoded = append(encoded, binary.LittleEndian.Uint16(raw[i:i+2]))
+	}
+
+	var keywords []string
+
+	for _, v := range strings.Split(strings.TrimRight(string(utf16.Decode(encoded)), "\x00"), ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			keywords = append(keywords, v)
+		}
+	}
+
+	return keywords
+}
+
+// xmpPacket returns an XMP packet holding keywords as dc:subject, which is where
+// IPTC Core keywords are stored.
+func xmpPacket(keywords []string) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` + "\n")
+	buf.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n")
+	buf.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n")
+	buf.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">` + "\n")
+	buf.WriteString("<dc:subject><rdf:Bag>\n")
+
+	for _, v := range keywords {
+		buf.WriteString("<rdf:li>")
+		_ = xml.EscapeText(&buf, []byte(v))
+		buf.WriteString("</rdf:li>\n")
+	}
+
+	buf.WriteString("</rdf:Bag></dc:subject>\n")
+	buf.WriteString("</rdf:Description>\n</rdf:RDF>\n</x:xmpmeta>\n")
+	buf.WriteString(`<?xpacket end="w"?>`)
+
+	return buf.Bytes()
+}
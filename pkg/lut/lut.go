@@ -0,0 +1,201 @@
+// Package lut applies 3D color lookup tables to images, e.g. to give a batch of
+// generations a consistent color grade.
+package lut
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxSize is the largest LUT_3D_SIZE accepted, to bound memory use.
+const maxSize = 256
+
+// LUT is a 3D color lookup table.
+type LUT struct {
+	// The number of entries along each axis.
+	size int
+
+	// The output colors, from 0 to 1, with red changing fastest, then green,
+	// then blue, as in .cube files.
+	table [][3]float64
+
+	// The input values mapped to the first and last entries of each axis.
+	domainMin [3]float64
+	domainMax [3]float64
+}
+
+// ParseCube parses a 3D LUT in the Adobe .cube format, as exported by most
+// color grading tools.
+func ParseCube(r io.Reader) (*LUT, error) {
+	lut := &LUT{domainMax: [3]float64{1, 1, 1}}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "TITLE":
+			continue
+		case "LUT_1D_SIZE":
+			return nil, errors.New("1D LUTs are not supported")
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: LUT_3D_SIZE must have one value", line)
+			}
+
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > maxSize {
+				return nil, fmt.Errorf("line %d: invalid LUT_3D_SIZE %q, must be 2 to %d", line, fields[1], maxSize)
+			}
+
+			lut.size = size
+			lut.table = make([][3]float64, 0, size*size*size)
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			values, err := parseTriple(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			if fields[0] == "DOMAIN_MIN" {
+				lut.domainMin = values
+			} else {
+				lut.domainMax = values
+			}
+		default:
+			if lut.size == 0 {
+				return nil, fmt.Errorf("line %d: LUT_3D_SIZE must come before the table", line)
+			}
+
+			values, err := parseTriple(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			lut.table = append(lut.table, values)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read LUT: %w", err)
+	}
+
+	if lut.size == 0 {
+		return nil, errors.New("LUT_3D_SIZE is missing")
+	}
+
+	if len(lut.table) != lut.size*lut.size*lut.size {
+		return nil, fmt.Errorf("LUT has %d entries, LUT_3D_SIZE %d needs %d", len(lut.table), lut.size, lut.size*lut.size*lut.size)
+	}
+
+	for i := range lut.domainMin {
+		if lut.domainMax[i] <= lut.domainMin[i] {
+			return nil, errors.New("DOMAIN_MAX must be greater than DOMAIN_MIN")
+		}
+	}
+
+	return lut, nil
+}
+
+// Apply returns a copy of img with the LUT applied to every pixel, interpolating
+// between the table's entries.  Transparency is kept as is.
+func (l *LUT) Apply(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+	for i := 0; i < len(out.Pix); i += 4 {
+		var in [3]float64
+		for c := range in {
+			in[c] = float64(out.Pix[i+c]) / 255
+		}
+
+		mapped := l.lookup(in)
+		for c := range mapped {
+			out.Pix[i+c] = uint8(math.Round(clamp(mapped[c]) * 255))
+		}
+	}
+
+	return out
+}
+
+// lookup maps a color, with channels from 0 to 1, through the table with
+// trilinear interpolation.
+func (l *LUT) lookup(in [3]float64) [3]float64 {
+	var (
+		low  [3]int
+		frac [3]float64
+	)
+
+	last := float64(l.size - 1)
+
+	for c := range in {
+		position := clamp((in[c]-l.domainMin[c])/(l.domainMax[c]-l.domainMin[c])) * last
+
+		low[c] = min(int(position), l.size-2)
+		frac[c] = position - float64(low[c])
+	}
+
+	var out [3]float64
+
+	for corner := 0; corner < 8; corner++ {
+		weight := 1.0
+
+		var index [3]int
+
+		for c := range index {
+			if corner&(1<<c) != 0 {
+				index[c] = low[c] + 1
+				weight *= frac[c]
+			} else {
+				index[c] = low[c]
+				weight *= 1 - frac[c]
+			}
+		}
+
+		entry := l.table[index[0]+index[1]*l.size+index[2]*l.size*l.size]
+		for c := range out {
+			out[c] += entry[c] * weight
+		}
+	}
+
+	return out
+}
+
+// parseTriple parses three numbers.
+func parseTriple(fields []string) ([3]float64, error) {
+	var values [3]float64
+
+	if len(fields) != 3 {
+		return values, fmt.Errorf("expected 3 values, got %d", len(fields))
+	}
+
+	for i, v := range fields {
+		value, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return values, fmt.Errorf("invalid value %q", v)
+		}
+
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+// clamp limits v to 0 to 1.
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,151 @@
+// Package mask builds inpainting masks from images, so the inpaint and erase
+// edits can be used without an image editor.
+//
+// Masks are grayscale images of the same size as the image they were built from.
+// White areas are edited, and black areas are kept.
+package mask
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// FromAlpha builds a mask from an image's alpha channel.  Transparent pixels,
+// i.e. those less than half opaque, are edited.  It returns an error if the
+// image is fully opaque, since the mask would be empty.
+func FromAlpha(img image.Image) (*image.Gray, error) {
+	found := false
+
+	mask := build(img, func(c color.Color) bool {
+		_, _, _, a := c.RGBA()
+
+		transparent := a < 0x8000
+		found = found || transparent
+
+		return transparent
+	})
+
+	if !found {
+		return nil, errors.New("image has no transparent pixels")
+	}
+
+	return mask, nil
+}
+
+// FromColorKey builds a mask from the pixels close to a key color, e.g. a green
+// screen or a flat color painted over the area to edit.  tolerance is the largest
+// difference, from 0 to 255, allowed in each of the red, green, and blue channels.
+func FromColorKey(img image.Image, key color.Color, tolerance uint8) *image.Gray {
+	kr, kg, kb, _ := key.RGBA()
+
+	return build(img, func(c color.Color) bool {
+		r, g, b, _ := c.RGBA()
+
+		return within(r, kr, tolerance) && within(g, kg, tolerance) && within(b, kb, tolerance)
+	})
+}
+
+// FromThreshold builds a mask from the pixels whose luminance is at least
+// threshold, from 0 to 255, e.g. to edit the light areas of a rough sketch.
+func FromThreshold(img image.Image, threshold uint8) *image.Gray {
+	return build(img, func(c color.Color) bool {
+		return color.GrayModel.Convert(c).(color.Gray).Y >= threshold
+	})
+}
+
+// FromRectangles builds a mask of width by height pixels that edits the given
+// rectangles, e.g. to mark a rough area to edit without an image editor.
+// Rectangles are clipped to the mask.
+func FromRectangles(width int, height int, rects ...image.Rectangle) *image.Gray {
+	mask := image.NewGray(image.Rect(0, 0, width, height))
+
+	for _, r := range rects {
+		r = r.Intersect(mask.Bounds())
+
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				mask.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	return mask
+}
+
+// Invert swaps the edited and kept areas of a mask.
+func Invert(mask *image.Gray) {
+	for i, v := range mask.Pix {
+		mask.Pix[i] = 255 - v
+	}
+}
+
+// Coverage returns the fraction of a mask, from 0 to 1, that is edited.
+func Coverage(mask *image.Gray) float64 {
+	bounds := mask.Bounds()
+	if bounds.Empty() {
+		return 0
+	}
+
+	edited := 0
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if mask.GrayAt(x, y).Y >= 128 {
+				edited++
+			}
+		}
+	}
+
+	return float64(edited) / float64(bounds.Dx()*bounds.Dy())
+}
+
+// ParseColor parses a hex color, e.g. "#00ff00" or "0f0".
+func ParseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, must be a hex color like #00ff00", s)
+	}
+
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, must be a hex color like #00ff00", s)
+	}
+
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 255}, nil
+}
+
+// build makes a mask that is white wherever edit returns true.
+func build(img image.Image, edit func(color.Color) bool) *image.Gray {
+	bounds := img.Bounds()
+	mask := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if edit(img.At(x, y)) {
+				mask.SetGray(x-bounds.Min.X, y-bounds.Min.Y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	return mask
+}
+
+// within reports whether two 16-bit color channels differ by at most tolerance,
+// given in 8 bits.
+func within(a uint32, b uint32, tolerance uint8) bool {
+	diff := int(a>>8) - int(b>>8)
+	if diff < 0 {
+		diff = -diff
+	}
+
+	return diff <= int(tolerance)
+}
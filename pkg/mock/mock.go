@@ -0,0 +1,315 @@
+// Package mock implements backend.Backend without calling any API.  It renders
+// placeholder images locally, a solid color with the prompt drawn on, so demos,
+// hooks, and templates can be tried out without spending credits.
+package mock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// defaultResolution is the side length of the square image whose area
+	// placeholder images roughly match.
+	defaultResolution = 512
+
+	// textScale is how much the text drawn on placeholders is scaled up, since the
+	// built in font is tiny.
+	textScale = 2
+
+	// upscaleFactor is how much Upscale enlarges images.
+	upscaleFactor = 2
+
+	// model is the model reported for generated images.
+	model = "mock"
+
+	// maxSamples is the most placeholders generated with one request.
+	maxSamples = 10
+)
+
+// Client renders placeholder images.  It implements backend.Backend.
+type Client struct{}
+
+func NewClient() *Client {
+	return &Client{}
+}
+
+var (
+	_ backend.Backend      = (*Client)(nil)
+	_ backend.MultiSampler = (*Client)(nil)
+)
+
+func (c *Client) Name() string {
+	return "mock"
+}
+
+func (c *Client) Capabilities() backend.Capabilities {
+	return backend.Capabilities{
+		Operations: []backend.Operation{
+			backend.OperationTextToImage,
+			backend.OperationImageToImage,
+			backend.OperationUpscale,
+			backend.OperationEdit,
+			backend.OperationStyle,
+		},
+		Models:         []string{model},
+		AspectRatios:   []string{"16:9", "1:1", "21:9", "2:3", "3:2", "4:5", "5:4", "9:16", "9:21"},
+		OutputFormats:  []string{"png", "jpeg"},
+		MaxPixels:      defaultResolution * defaultResolution,
+		UpscaleModes:   []string{"fast"},
+		EditOperations: []string{"inpaint", "erase", "search-and-replace", "remove-background"},
+		MaxSamples:     maxSamples,
+	}
+}
+
+// Generate renders a placeholder in a color derived from the seed, or from the
+// prompt if no seed is given, so the same prompt always gives the same image.
+// Placeholders generated in the style of images are their average color instead.
+func (c *Client) Generate(ctx context.Context, req backend.GenerateRequest) (*backend.Result, error) {
+	req.Samples = 1
+
+	results, err := c.GenerateSamples(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return results[0], nil
+}
+
+// GenerateSamples renders req.Samples placeholders like Generate, with seeds
+// counting up from the first.
+func (c *Client) GenerateSamples(ctx context.Context, req backend.GenerateRequest) ([]*backend.Result, error) {
+	width, height, err := backend.Dimensions(req.AspectRatio, defaultResolution, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := req.Seed
+	if seed == 0 {
+		seed = promptSeed(req.Prompt)
+	}
+
+	var style color.Color
+
+	if len(req.StyleImages) > 0 {
+		style, err = averageColor(req.StyleImages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]*backend.Result, 0, max(req.Samples, 1))
+
+	for i := 0; i < max(req.Samples, 1); i++ {
+		background := style
+		if background == nil {
+			background = seedColor(seed + int64(i))
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+		drawText(img, req.Prompt)
+
+		data, err := backend.EncodeImage(img, req.OutputFormat)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, &backend.Result{Image: data, Model: model, Seed: seed + int64(i), FinishReason: "SUCCESS"})
+	}
+
+	return results, nil
+}
+
+// Upscale enlarges the image without adding any detail.
+func (c *Client) Upscale(ctx context.Context, req backend.UpscaleRequest) (*backend.Result, error) {
+	src, err := decode(req.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*upscaleFactor, bounds.Dy()*upscaleFactor))
+	draw.CatmullRom.Scale(img, img.Bounds(), src, bounds, draw.Src, nil)
+
+	data, err := backend.EncodeImage(img, req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.Result{Image: data, Model: model, FinishReason: "SUCCESS"}, nil
+}
+
+// Edit draws the operation and prompt over the image.
+func (c *Client) Edit(ctx context.Context, req backend.EditRequest) (*backend.Result, error) {
+	src, err := decode(req.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	text := req.Operation
+	if req.Prompt != "" {
+		text += ": " + req.Prompt
+	}
+
+	drawText(img, text)
+
+	data, err := backend.EncodeImage(img, req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.Result{Image: data, Model: model, FinishReason: "SUCCESS"}, nil
+}
+
+func decode(r io.Reader) (image.Image, error) {
+	if r == nil {
+		return nil, fmt.Errorf("no image given")
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return img, nil
+}
+
+// promptSeed hashes a prompt into a seed, so the same prompt renders the same
+// placeholder.
+func promptSeed(prompt string) int64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(prompt))
+
+	return int64(h.Sum32())
+}
+
+// seedColor picks a mid-toned color from a seed, dark enough for white text to be
+// readable on it.
+func seedColor(seed int64) color.RGBA {
+	return color.RGBA{
+		R: uint8(32 + seed%128),
+		G: uint8(32 + (seed>>8)%128),
+		B: uint8(32 + (seed>>16)%128),
+		A: 255,
+	}
+}
+
+// averageColor returns the average color of the pixels of images.
+func averageColor(images []io.Reader) (color.RGBA, error) {
+	var r, g, b, count uint64
+
+	for _, v := range images {
+		img, err := decode(v)
+		if err != nil {
+			return color.RGBA{}, err
+		}
+
+		bounds := img.Bounds()
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				pr, pg, pb, _ := img.At(x, y).RGBA()
+				r, g, b = r+uint64(pr>>8), g+uint64(pg>>8), b+uint64(pb>>8)
+				count++
+			}
+		}
+	}
+
+	if count == 0 {
+		return color.RGBA{A: 255}, nil
+	}
+
+	return color.RGBA{R: uint8(r / count), G: uint8(g / count), B: uint8(b / count), A: 255}, nil
+}
+
+// drawText draws text in white over the top of an image, wrapped to its width.
+func drawText(img *image.RGBA, text string) {
+	bounds := img.Bounds()
+
+	// Draw the text at the font's size on a smaller layer, then scale it up onto
+	// the image.
+	layer := image.NewRGBA(image.Rect(0, 0, bounds.Dx()/textScale, bounds.Dy()/textScale))
+
+	face := basicfont.Face7x13
+	const margin = 4
+
+	drawer := font.Drawer{
+		Dst:  layer,
+		Src:  image.NewUniform(color.White),
+		Face: face,
+	}
+
+	lines := wrap(text, (layer.Bounds().Dx()-2*margin)/face.Advance)
+
+	for i, line := range lines {
+		top := margin + (i+1)*face.Height
+		if top > layer.Bounds().Dy()-margin {
+			break
+		}
+
+		drawer.Dot = fixed.P(margin, top)
+		drawer.DrawString(line)
+	}
+
+	draw.NearestNeighbor.Scale(img, bounds, layer, layer.Bounds(), draw.Over, nil)
+}
+
+// wrap splits text into lines of at most width runes, breaking between words
+// where possible.
+func wrap(text string, width int) []string {
+	if width <= 0 {
+		return nil
+	}
+
+	var lines []string
+
+	var line []rune
+
+	for _, word := range strings.Fields(text) {
+		runes := []rune(word)
+
+		if len(line) > 0 && len(line)+1+len(runes) > width {
+			lines = append(lines, string(line))
+			line = nil
+		}
+
+		if len(line) > 0 {
+			line = append(line, ' ')
+		}
+
+		line = append(line, runes...)
+
+		for len(line) > width {
+			lines = append(lines, string(line[:width]))
+			line = line[width:]
+		}
+	}
+
+	if len(line) > 0 {
+		lines = append(lines, string(line))
+	}
+
+	return lines
+}
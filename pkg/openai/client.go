@@ -0,0 +1,332 @@
+// Package openai implements backend.Backend against the OpenAI Images API.
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// DefaultBaseURL is the base URL of the OpenAI API.
+const DefaultBaseURL = "https://api.openai.com/v1"
+
+var models = []string{"gpt-image-1", "dall-e-3", "dall-e-2"}
+
+// Client is a client for the OpenAI Images API.  It implements backend.Backend.
+type Client struct {
+	baseURL      string
+	apiKey       string
+	organization string
+
+	httpClient *http.Client
+}
+
+type ClientOption func(*Client)
+
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithOrganization sets the OpenAI-Organization header on every request.
+func WithOrganization(organization string) ClientOption {
+	return func(c *Client) {
+		c.organization = organization
+	}
+}
+
+// WithHTTPClient sets the HTTP client requests are sent with, e.g. for different
+// timeouts.  Defaults to backend.NewHTTPClient().
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+func NewClient(apiKey string, options ...ClientOption) *Client {
+	client := &Client{
+		baseURL:    DefaultBaseURL,
+		apiKey:     apiKey,
+		httpClient: backend.NewHTTPClient(),
+	}
+
+	for _, v := range options {
+		v(client)
+	}
+
+	return client
+}
+
+var (
+	_ backend.Backend      = (*Client)(nil)
+	_ backend.MultiSampler = (*Client)(nil)
+)
+
+func (c *Client) Name() string {
+	return "openai"
+}
+
+func (c *Client) Capabilities() backend.Capabilities {
+	return backend.Capabilities{
+		Operations: []backend.Operation{
+			backend.OperationTextToImage,
+			backend.OperationEdit,
+		},
+		Models:         models,
+		AspectRatios:   []string{"1:1", "3:2", "2:3", "16:9", "9:16"},
+		OutputFormats:  []string{"png", "jpeg"},
+		MaxPixels:      1792 * 1024,
+		EditOperations: []string{"inpaint"},
+
+		// dall-e-3 only generates one image per request.
+		MaxSamples: maxSamples,
+	}
+}
+
+// maxSamples is the most images gpt-image-1 and dall-e-2 generate per request.
+const maxSamples = 10
+
+// size picks the closest size the model supports for an aspect ratio.  Only the
+// orientation of the ratio matters, since each model supports exactly one
+// landscape and one portrait size.
+func size(model string, ratio string) (string, error) {
+	orientation := 0
+
+	if ratio != "" {
+		widthPart, heightPart, ok := strings.Cut(ratio, ":")
+		if !ok {
+			return "", fmt.Errorf("invalid aspect ratio %q", ratio)
+		}
+
+		w, err := strconv.Atoi(widthPart)
+		if err != nil {
+			return "", fmt.Errorf("invalid width in aspect ratio %q", ratio)
+		}
+
+		h, err := strconv.Atoi(heightPart)
+		if err != nil {
+			return "", fmt.Errorf("invalid height in aspect ratio %q", ratio)
+		}
+
+		switch {
+		case w > h:
+			orientation = 1
+		case w < h:
+			orientation = -1
+		}
+	}
+
+	switch model {
+	case "dall-e-2":
+		return "1024x1024", nil
+	case "dall-e-3":
+		return [...]string{"1024x1792", "1024x1024", "1792x1024"}[orientation+1], nil
+	}
+
+	return [...]string{"1024x1536", "1024x1024", "1536x1024"}[orientation+1], nil
+}
+
+type imagesResponse struct {
+	Data []struct {
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+}
+
+func (c *Client) send(ctx context.Context, path string, contentType string, body io.Reader, format string, model string) ([]*backend.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	if c.organization != "" {
+		req.Header.Set("OpenAI-Organization", c.organization)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := backend.ReadBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &backend.APIError{StatusCode: resp.StatusCode, URL: path, Body: string(respBody)}
+
+		if resp.StatusCode == http.StatusBadRequest && moderated(respBody) {
+			return nil, fmt.Errorf("%w: %w", backend.ErrContentFiltered, apiErr)
+		}
+
+		return nil, apiErr
+	}
+
+	var parsed imagesResponse
+
+	err = json.Unmarshal(respBody, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if len(parsed.Data) == 0 {
+		return nil, fmt.Errorf("response from %s did not contain any images", path)
+	}
+
+	results := make([]*backend.Result, 0, len(parsed.Data))
+
+	for _, v := range parsed.Data {
+		img, err := base64.StdEncoding.DecodeString(v.B64JSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image from response: %w", err)
+		}
+
+		converted, err := backend.ConvertImage(img, format)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, &backend.Result{
+			Image:        converted,
+			Model:        model,
+			FinishReason: "SUCCESS",
+		})
+	}
+
+	return results, nil
+}
+
+// Generate generates an image from a prompt.  OpenAI does not support negative
+// prompts, seeds, or CFG scales, so NegativePrompt, Seed, and CFGScale are ignored.
+func (c *Client) Generate(ctx context.Context, req backend.GenerateRequest) (*backend.Result, error) {
+	results, err := c.generate(ctx, req, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return results[0], nil
+}
+
+// GenerateSamples generates req.Samples images from a prompt with one request,
+// like Generate.  dall-e-3 only generates one image per request.
+func (c *Client) GenerateSamples(ctx context.Context, req backend.GenerateRequest) ([]*backend.Result, error) {
+	return c.generate(ctx, req, req.Samples)
+}
+
+func (c *Client) generate(ctx context.Context, req backend.GenerateRequest, samples int) ([]*backend.Result, error) {
+	if req.Image != nil {
+		return nil, backend.Unsupported(c, backend.OperationImageToImage)
+	}
+
+	model := req.Model
+	if model == "" {
+		model = models[0]
+	}
+
+	if samples > 1 && model == "dall-e-3" {
+		return nil, fmt.Errorf("%w: dall-e-3 can't generate %d images with one request", backend.ErrUnsupported, samples)
+	}
+
+	imgSize, err := size(model, req.AspectRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]any{
+		"model":  model,
+		"prompt": req.Prompt,
+		"n":      samples,
+		"size":   imgSize,
+	}
+
+	// gpt-image-1 always returns base64, and rejects response_format.
+	if model != "gpt-image-1" {
+		payload["response_format"] = "b64_json"
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	return c.send(ctx, "/images/generations", "application/json", bytes.NewReader(body), req.OutputFormat, model)
+}
+
+func (c *Client) Upscale(_ context.Context, _ backend.UpscaleRequest) (*backend.Result, error) {
+	return nil, backend.Unsupported(c, backend.OperationUpscale)
+}
+
+// Edit edits an image with gpt-image-1.  Only the "inpaint" operation is supported;
+// the mask's transparent areas are the ones that get edited.
+func (c *Client) Edit(ctx context.Context, req backend.EditRequest) (*backend.Result, error) {
+	if req.Operation != "inpaint" {
+		return nil, fmt.Errorf("%w: unknown edit operation %q", backend.ErrUnsupported, req.Operation)
+	}
+
+	model := models[0]
+
+	var formBuf bytes.Buffer
+
+	writer := multipart.NewWriter(&formBuf)
+
+	for k, v := range map[string]string{"model": model, "prompt": req.Prompt, "n": "1"} {
+		err := writer.WriteField(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write field %q to request: %w", k, err)
+		}
+	}
+
+	files := map[string]io.Reader{"image": req.Image}
+	if req.Mask != nil {
+		files["mask"] = req.Mask
+	}
+
+	for field, reader := range files {
+		err := backend.WriteImagePart(writer, field, reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	results, err := c.send(ctx, "/images/edits", writer.FormDataContentType(), &formBuf, req.OutputFormat, model)
+	if err != nil {
+		return nil, err
+	}
+
+	return results[0], nil
+}
+
+// moderated reports whether an error response says the request was blocked by
+// OpenAI's content moderation.
+func moderated(body []byte) bool {
+	var parsed struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+
+	if json.Unmarshal(body, &parsed) != nil {
+		return false
+	}
+
+	return parsed.Error.Code == "moderation_blocked" || parsed.Error.Code == "content_policy_violation"
+}
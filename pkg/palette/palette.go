@@ -0,0 +1,143 @@
+// Package palette restricts images to a fixed set of colors, e.g. for pixel art
+// or to keep to a brand's colors.
+package palette
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/mask"
+)
+
+// ErrEmpty is returned when a palette has no colors.
+var ErrEmpty = errors.New("palette has no colors")
+
+// Parse parses a comma-separated list of hex colors, e.g.
+// "#000000,#ffffff,#ff0044".
+func Parse(spec string) (color.Palette, error) {
+	var palette color.Palette
+
+	for _, v := range strings.Split(spec, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		c, err := mask.ParseColor(v)
+		if err != nil {
+			return nil, err
+		}
+
+		palette = append(palette, c)
+	}
+
+	if len(palette) == 0 {
+		return nil, ErrEmpty
+	}
+
+	return palette, nil
+}
+
+// Read reads a palette file, either a list of hex colors, one per line, as
+// exported by Lospec, or a GIMP palette, with a line of red, green, and blue
+// values from 0 to 255 per color.  Blank lines, comments starting with #, and
+// the header of GIMP palettes are skipped.
+func Read(r io.Reader) (color.Palette, error) {
+	var palette color.Palette
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case text == "", strings.HasPrefix(text, "#") && !isHex(text[1:]):
+			continue
+		case text == "GIMP Palette", strings.HasPrefix(text, "Name:"), strings.HasPrefix(text, "Columns:"):
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		if len(fields) >= 3 {
+			c, err := parseRGB(fields[:3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			palette = append(palette, c)
+
+			continue
+		}
+
+		c, err := mask.ParseColor(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		palette = append(palette, c)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read palette: %w", err)
+	}
+
+	if len(palette) == 0 {
+		return nil, ErrEmpty
+	}
+
+	return palette, nil
+}
+
+// Quantize returns img with every pixel replaced by the closest color in the
+// palette.  With dither, the error is spread to neighboring pixels with
+// Floyd-Steinberg dithering, which keeps gradients at the cost of noise.
+func Quantize(img image.Image, palette color.Palette, dither bool) *image.Paletted {
+	bounds := img.Bounds()
+	quantized := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+
+	if dither {
+		draw.FloydSteinberg.Draw(quantized, quantized.Bounds(), img, bounds.Min)
+	} else {
+		draw.Draw(quantized, quantized.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	return quantized
+}
+
+// parseRGB parses the red, green, and blue values of a color in a GIMP palette.
+func parseRGB(fields []string) (color.RGBA, error) {
+	var channels [3]uint8
+
+	for i, v := range fields {
+		value, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return color.RGBA{}, fmt.Errorf("invalid color value %q, must be 0 to 255", v)
+		}
+
+		channels[i] = uint8(value)
+	}
+
+	return color.RGBA{R: channels[0], G: channels[1], B: channels[2], A: 255}, nil
+}
+
+// isHex reports whether s is a 3 or 6 digit hex color without the #.
+func isHex(s string) bool {
+	if len(s) != 3 && len(s) != 6 {
+		return false
+	}
+
+	_, err := strconv.ParseUint(s, 16, 32)
+
+	return err == nil
+}
@@ -0,0 +1,357 @@
+package stability
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// DefaultBaseURL is the base URL of the Stability API.
+const DefaultBaseURL = "https://api.stability.ai"
+
+// StyleModel is the model recorded for images generated with style control, and
+// the key of its cost for EstimateCredits.
+const StyleModel = "control/style"
+
+// maxPixels is the size of the largest SD3 image, a 1024x1024 square.
+const maxPixels = 1024 * 1024
+
+// The limits on the size of images sent to the API.
+const (
+	maxInputPixels = 9_437_184
+	minInputSide   = 64
+)
+
+// Client is a client for the Stability API.  It implements backend.Backend.
+type Client struct {
+	baseURL string
+	apiKey  string
+
+	organization  string
+	clientID      string
+	clientVersion string
+
+	httpClient *http.Client
+	lowMemory  bool
+}
+
+type ClientOption func(*Client)
+
+// WithOrganization sets the Organization header on every request, for keys that
+// belong to an organization that requires it.
+func WithOrganization(organization string) ClientOption {
+	return func(c *Client) {
+		c.organization = organization
+	}
+}
+
+// WithClientID identifies the application making requests, with the
+// Stability-Client-ID and Stability-Client-Version headers.
+func WithClientID(id string, version string) ClientOption {
+	return func(c *Client) {
+		c.clientID = id
+		c.clientVersion = version
+	}
+}
+
+// headers returns the headers to send with every request, besides authorization.
+func (c *Client) headers() http.Header {
+	headers := make(http.Header)
+
+	if c.organization != "" {
+		headers.Set("Organization", c.organization)
+	}
+
+	if c.clientID != "" {
+		headers.Set("Stability-Client-ID", c.clientID)
+	}
+
+	if c.clientVersion != "" {
+		headers.Set("Stability-Client-Version", c.clientVersion)
+	}
+
+	return headers
+}
+
+// endpoint returns what send needs to send requests for the client.
+func (c *Client) endpoint() endpoint {
+	return endpoint{
+		httpClient: c.httpClient,
+		baseURL:    c.baseURL,
+		apiKey:     c.apiKey,
+		headers:    c.headers(),
+		lowMemory:  c.lowMemory,
+	}
+}
+
+// WithLowMemory builds request forms in temporary files rather than in memory,
+// for hosts with little memory.  Responses are read through a temporary file
+// with SpoolBody, but are still returned in memory in full.
+func WithLowMemory() ClientOption {
+	return func(c *Client) {
+		c.lowMemory = true
+	}
+}
+
+// WithHTTPClient sets the HTTP client requests are sent with, e.g. for different
+// timeouts.  Defaults to backend.NewHTTPClient().
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBaseURL overrides the base URL of the API, e.g. to route requests through a proxy.
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+func NewClient(apiKey string, options ...ClientOption) *Client {
+	client := &Client{
+		baseURL:    DefaultBaseURL,
+		apiKey:     apiKey,
+		httpClient: backend.NewHTTPClient(),
+	}
+
+	for _, v := range options {
+		v(client)
+	}
+
+	return client
+}
+
+var _ backend.Backend = (*Client)(nil)
+
+func (c *Client) Name() string {
+	return "stability"
+}
+
+func (c *Client) Capabilities() backend.Capabilities {
+	return backend.Capabilities{
+		Operations: []backend.Operation{
+			backend.OperationTextToImage,
+			backend.OperationImageToImage,
+			backend.OperationUpscale,
+			backend.OperationEdit,
+			backend.OperationStyle,
+		},
+		Models:         models,
+		AspectRatios:   aspectRatios,
+		OutputFormats:  outputFormats,
+		MaxPixels:      maxPixels,
+		MaxInputPixels: maxInputPixels,
+		MinInputSide:   minInputSide,
+		UpscaleModes:   upscaleModes,
+		EditOperations: editOperations,
+
+		MaxPromptLength: maxPromptLength,
+	}
+}
+
+func toBackendResult(result *ImageResult, model string) *backend.Result {
+	return &backend.Result{
+		Image:        result.Image,
+		Model:        model,
+		Seed:         result.Seed,
+		FinishReason: result.FinishReason,
+		Credits:      result.Credits,
+	}
+}
+
+func (c *Client) Generate(ctx context.Context, req backend.GenerateRequest) (*backend.Result, error) {
+	if len(req.StyleImages) > 0 {
+		return c.generateStyle(ctx, req)
+	}
+
+	model := req.Model
+	if model == "" {
+		model = models[0]
+	}
+
+	// The aspect ratio of image-to-image results is the initial image's.
+	ratio := req.AspectRatio
+	if req.Image != nil {
+		ratio = ""
+	}
+
+	endpoint, err := lookupEndpoint(model)
+	if err != nil {
+		return nil, err
+	}
+
+	err = endpoint.check(req.Prompt, ratio, req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []FormOption{WithPrompt(req.Prompt)}
+
+	if ratio != "" {
+		opts = append(opts, WithAspectRatio(ratio))
+	}
+
+	if req.Model != "" {
+		opts = append(opts, WithModel(req.Model))
+	}
+
+	if req.OutputFormat != "" {
+		opts = append(opts, WithOutputFormat(req.OutputFormat))
+	}
+
+	if req.NegativePrompt != "" {
+		opts = append(opts, WithNegativePrompt(req.NegativePrompt))
+	}
+
+	if req.Seed != 0 {
+		opts = append(opts, WithSeed(req.Seed))
+	}
+
+	if req.CFGScale != 0 {
+		opts = append(opts, WithCFGScale(req.CFGScale))
+	}
+
+	if req.Image != nil {
+		opts = append(opts, WithImage(req.Image), WithMode("image-to-image"))
+
+		if req.Strength != 0 {
+			opts = append(opts, WithStrength(req.Strength))
+		}
+	}
+
+	result, err := sendForm(ctx, c.endpoint(), endpoint.Path, req.OutputFormat, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return toBackendResult(result, model), nil
+}
+
+// generateStyle generates an image in the style of req.StyleImages with the
+// style control endpoint, which has no choice of model.
+func (c *Client) generateStyle(ctx context.Context, req backend.GenerateRequest) (*backend.Result, error) {
+	if req.Image != nil {
+		return nil, fmt.Errorf("%w: style control with an initial image", backend.ErrUnsupported)
+	}
+
+	endpoint, err := lookupEndpoint(StyleModel)
+	if err != nil {
+		return nil, err
+	}
+
+	err = endpoint.check(req.Prompt, req.AspectRatio, req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []FormOption{WithPrompt(req.Prompt), WithImages(req.StyleImages...)}
+
+	if req.AspectRatio != "" {
+		opts = append(opts, WithAspectRatio(req.AspectRatio))
+	}
+
+	if req.OutputFormat != "" {
+		opts = append(opts, WithOutputFormat(req.OutputFormat))
+	}
+
+	if req.NegativePrompt != "" {
+		opts = append(opts, WithNegativePrompt(req.NegativePrompt))
+	}
+
+	if req.Seed != 0 {
+		opts = append(opts, WithSeed(req.Seed))
+	}
+
+	if req.StyleFidelity != 0 {
+		opts = append(opts, WithFidelity(req.StyleFidelity))
+	}
+
+	result, err := sendForm(ctx, c.endpoint(), endpoint.Path, req.OutputFormat, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return toBackendResult(result, StyleModel), nil
+}
+
+func (c *Client) Upscale(ctx context.Context, req backend.UpscaleRequest) (*backend.Result, error) {
+	if !slices.Contains(upscaleModes, req.Mode) {
+		return nil, fmt.Errorf("%w: unknown upscale mode %q", backend.ErrUnsupported, req.Mode)
+	}
+
+	endpoint, err := lookupEndpoint("upscale/" + req.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = endpoint.check(req.Prompt, "", req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []FormOption{WithImage(req.Image)}
+
+	if req.Prompt != "" && endpoint.MaxPromptLength > 0 {
+		opts = append(opts, WithPrompt(req.Prompt))
+	}
+
+	if req.OutputFormat != "" {
+		opts = append(opts, WithOutputFormat(req.OutputFormat))
+	}
+
+	result, err := sendForm(ctx, c.endpoint(), endpoint.Path, req.OutputFormat, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return toBackendResult(result, endpoint.Name), nil
+}
+
+func (c *Client) Edit(ctx context.Context, req backend.EditRequest) (*backend.Result, error) {
+	if !slices.Contains(editOperations, req.Operation) {
+		return nil, fmt.Errorf("%w: unknown edit operation %q", backend.ErrUnsupported, req.Operation)
+	}
+
+	endpoint, err := lookupEndpoint("edit/" + req.Operation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = endpoint.check(req.Prompt, "", req.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []FormOption{WithImage(req.Image)}
+
+	if req.Mask != nil {
+		opts = append(opts, WithMask(req.Mask))
+	}
+
+	if req.Prompt != "" && endpoint.MaxPromptLength > 0 {
+		opts = append(opts, WithPrompt(req.Prompt))
+	}
+
+	if req.NegativePrompt != "" && endpoint.MaxPromptLength > 0 {
+		opts = append(opts, WithNegativePrompt(req.NegativePrompt))
+	}
+
+	if req.SearchPrompt != "" {
+		opts = append(opts, WithSearchPrompt(req.SearchPrompt))
+	}
+
+	if req.OutputFormat != "" {
+		opts = append(opts, WithOutputFormat(req.OutputFormat))
+	}
+
+	result, err := sendForm(ctx, c.endpoint(), endpoint.Path, req.OutputFormat, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return toBackendResult(result, endpoint.Name), nil
+}
@@ -0,0 +1,58 @@
+package stability
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// balancePath is the path of the endpoint that returns the account's balance.
+const balancePath = "/v1/user/balance"
+
+type balanceResponse struct {
+	Credits float64 `json:"credits"`
+}
+
+// Balance returns the number of credits left on the account.
+func (c *Client) Balance(ctx context.Context) (float64, error) {
+	reqURL := c.baseURL + balancePath
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	for k, v := range c.headers() {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := backend.ReadBody(resp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, &backend.APIError{StatusCode: resp.StatusCode, URL: balancePath, Body: string(body)}
+	}
+
+	var balance balanceResponse
+
+	err = json.Unmarshal(body, &balance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return balance.Credits, nil
+}
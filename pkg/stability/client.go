@@ -3,13 +3,15 @@ package stability
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
 )
 
 type Generate3Request struct {
@@ -22,139 +24,381 @@ type Generate3Request struct {
 	Image          []byte  `json:"image"`
 }
 
-func validateAspectRatio(ratio string) error {
-	parts := strings.Split(ratio, ":")
+func (g Generate3Request) Validate() error {
+	if _, err := backend.ParsePrompt(g.Prompt, maxPromptLength); err != nil {
+		return err
+	}
 
-	if len(parts) != 2 {
-		return errors.New("invalid number of semi-colons in aspect ratio")
+	model := g.Model
+	if model == "" {
+		model = models[0]
 	}
 
-	if _, err := strconv.Atoi(parts[0]); err != nil {
-		return fmt.Errorf("width ratio is not an integer: %w", err)
+	endpoint, err := lookupEndpoint(model)
+	if err != nil {
+		return err
 	}
 
-	if _, err := strconv.Atoi(parts[1]); err != nil {
-		return fmt.Errorf("height ratio is not an integer: %w", err)
+	if endpoint.Path != generate3Path {
+		return fmt.Errorf("%w: %q is not a Stable Diffusion 3 model", backend.ErrUnsupported, model)
 	}
 
-	return nil
+	return endpoint.check(g.Prompt, g.AspectRatio, g.OutputFormat)
 }
 
-func (g Generate3Request) Validate() error {
-	if g.Prompt == "" {
-		return fmt.Errorf("prompt cannot be empty")
+// FormOption sets a field on the multipart form sent to the API.
+type FormOption func(*multipart.Writer) error
+
+// Generate3Option is an option for Generate3.
+type Generate3Option = FormOption
+
+func WithAspectRatio(ratio string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("aspect_ratio", ratio)
 	}
+}
 
-	if len(g.Prompt) > 10000 {
-		return fmt.Errorf("prompt of length %d is too long; must be 10,000 characters or less", len(g.Prompt))
+func WithPrompt(prompt string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("prompt", prompt)
 	}
+}
 
-	if g.Model != "sd3" && g.Model != "sd3turbo" {
-		return fmt.Errorf("model %q is invalid; must be either \"sd3\" or \"sd3turbo\"", g.Model)
+func WithModel(model string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("model", model)
 	}
+}
 
-	if g.AspectRatio != "" {
-		if err := validateAspectRatio(g.AspectRatio); err != nil {
-			return fmt.Errorf("invalid aspect ratio %q: %w", g.AspectRatio, err)
-		}
+// WithMode sets the generation mode, either "text-to-image" or "image-to-image".
+func WithMode(mode string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("mode", mode)
 	}
+}
 
-	return nil
+func WithOutputFormat(format string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("output_format", format)
+	}
 }
 
-type Generate3Option func(*multipart.Writer) error
+func WithNegativePrompt(prompt string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("negative_prompt", prompt)
+	}
+}
 
-func WithAspectRatio(ratio string) Generate3Option {
+func WithStrength(strength float32) FormOption {
 	return func(req *multipart.Writer) error {
-		return req.WriteField("aspect_ratio", ratio)
+		return req.WriteField("strength", strconv.FormatFloat(float64(strength), 'f', 2, 32))
 	}
 }
 
-func WithPrompt(prompt string) Generate3Option {
+// WithSeed sets the seed, so that a generation can be reproduced.
+func WithSeed(seed int64) FormOption {
 	return func(req *multipart.Writer) error {
-		return req.WriteField("prompt", prompt)
+		return req.WriteField("seed", strconv.FormatInt(seed, 10))
 	}
 }
 
-func WithModel(model string) Generate3Option {
+// WithCFGScale sets how strictly the image follows the prompt.
+func WithCFGScale(scale float32) FormOption {
 	return func(req *multipart.Writer) error {
-		return req.WriteField("model", model)
+		return req.WriteField("cfg_scale", strconv.FormatFloat(float64(scale), 'f', -1, 32))
 	}
 }
 
-func WithOutputFormat(format string) Generate3Option {
+// WithImage adds the image to edit or start from, with the Content-Type of its
+// format, detected from its content.
+func WithImage(reader io.Reader) FormOption {
 	return func(req *multipart.Writer) error {
-		return req.WriteField("output_format", format)
+		return backend.WriteImagePart(req, "image", reader)
 	}
 }
 
-func WithNegativePrompt(prompt string) Generate3Option {
+// WithImages adds several images to the form, as repeated image fields, e.g.
+// the references for style control.
+func WithImages(readers ...io.Reader) FormOption {
 	return func(req *multipart.Writer) error {
-		return req.WriteField("negative_prompt", prompt)
+		for _, v := range readers {
+			err := backend.WriteImagePart(req, "image", v)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
 	}
 }
 
-func WithStrength(strength float32) Generate3Option {
+// WithFidelity sets how closely a style control result follows the style of its
+// reference image, from 0 to 1.
+func WithFidelity(fidelity float32) FormOption {
 	return func(req *multipart.Writer) error {
-		return req.WriteField("strength", strconv.FormatFloat(float64(strength), 'f', 2, 32))
+		return req.WriteField("fidelity", strconv.FormatFloat(float64(fidelity), 'f', -1, 32))
 	}
 }
 
-func WithImage(reader io.Reader) Generate3Option {
+func WithMask(reader io.Reader) FormOption {
 	return func(req *multipart.Writer) error {
-		writer, err := req.CreateFormField("image")
+		return backend.WriteImagePart(req, "mask", reader)
+	}
+}
+
+func WithSearchPrompt(prompt string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField("search_prompt", prompt)
+	}
+}
+
+// ImageResult is the result of a successful call to one of the image endpoints.
+type ImageResult struct {
+	// The raw bytes of the generated image.
+	Image []byte
+
+	// The seed that was used to generate the image.
+	Seed int64
+
+	// The reason generation finished, e.g. "SUCCESS" or "CONTENT_FILTERED".
+	FinishReason string
+
+	// The credits the request consumed, or zero if the response didn't say.
+	Credits float64
+}
+
+// creditHeaders are the response headers the API may report the credits a
+// request consumed in, in order of preference.
+var creditHeaders = []string{"credits-consumed", "x-credits-consumed"}
+
+// parseCredits returns the credits reported in a response's headers, or zero if
+// there are none.  Malformed values are ignored rather than failing a request
+// that has already been paid for.
+func parseCredits(header http.Header) float64 {
+	for _, v := range creditHeaders {
+		credits, err := strconv.ParseFloat(strings.TrimSpace(header.Get(v)), 64)
+		if err == nil && credits > 0 {
+			return credits
+		}
+	}
+
+	return 0
+}
+
+// generate3Path is the path of the Stable Diffusion 3 endpoint.
+const generate3Path = "/v2beta/stable-image/generate/sd3"
+
+// controlStylePath is the path of the style control endpoint, which generates
+// in the style of a reference image.
+const controlStylePath = "/v2beta/stable-image/control/style"
+
+func Generate3(ctx context.Context, baseURL string, apiKey string, options ...Generate3Option) (*ImageResult, error) {
+	return sendForm(ctx, endpoint{httpClient: defaultHTTPClient, baseURL: baseURL, apiKey: apiKey}, generate3Path, "", options...)
+}
+
+// defaultHTTPClient sends the requests of functions that aren't methods of a
+// Client, e.g. Generate3.
+var defaultHTTPClient = backend.NewHTTPClient()
+
+// sendForm sends a multipart form with the given options to an image endpoint, and
+// returns the image from the response.  headers are sent along with the request's
+// own headers.  The response must be an image in format, or any image if format
+// is empty, so that e.g. an HTML page from a proxy isn't saved as an image.
+func sendForm(ctx context.Context, e endpoint, path string, format string, options ...FormOption) (*ImageResult, error) {
+	resp, err := send(ctx, e, http.MethodPost, path, "image/*", options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		apiErr := &backend.APIError{StatusCode: resp.StatusCode, URL: path, Body: string(resp.Body)}
+
+		// Stability responds with 403 Forbidden when a request is flagged by its
+		// content moderation.
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("%w: %w", backend.ErrContentFiltered, apiErr)
+		}
+
+		return nil, apiErr
+	}
+
+	err = backend.VerifyImage(resp.Body, resp.Header.Get("Content-Type"), format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", path, err)
+	}
+
+	result := &ImageResult{
+		Image:        resp.Body,
+		FinishReason: resp.Header.Get("finish-reason"),
+		Credits:      parseCredits(resp.Header),
+	}
+
+	if seed := resp.Header.Get("seed"); seed != "" {
+		result.Seed, err = strconv.ParseInt(seed, 10, 64)
 		if err != nil {
-			return fmt.Errorf("failed to create image field in request: %w", err)
+			return nil, fmt.Errorf("failed to parse seed %q from response: %w", seed, err)
 		}
+	}
 
-		_, err = io.Copy(writer, reader)
+	return result, nil
+}
 
-		return err
+// RawResponse is a response from the API, as returned by Do.
+type RawResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// WithField sets any field on the form, e.g. a parameter of an endpoint that
+// sdcli doesn't support yet.
+func WithField(name string, value string) FormOption {
+	return func(req *multipart.Writer) error {
+		return req.WriteField(name, value)
 	}
 }
 
-func Generate3(ctx context.Context, baseURL string, apiKey string, options ...Generate3Option) ([]byte, error) {
-	reqURL := fmt.Sprintf("%s/v2beta/stable-image/generate/sd3", baseURL)
+// WithFile adds a file to the form under any field.  Images are sent with the
+// Content-Type of their format, and other files as application/octet-stream.
+func WithFile(field string, reader io.Reader) FormOption {
+	return func(req *multipart.Writer) error {
+		return backend.WriteImagePart(req, field, reader)
+	}
+}
+
+// Do sends a request to any endpoint of the API, e.g. "/v2beta/stable-image/
+// generate/ultra", and returns the response as is, so new endpoints can be used
+// before sdcli supports them.  accept is the Accept header, e.g. "image/*" or
+// "application/json".  The options are sent as a multipart form, unless there are
+// none.  Unlike the other methods, non-200 responses aren't errors.
+func (c *Client) Do(ctx context.Context, method string, path string, accept string, options ...FormOption) (*RawResponse, error) {
+	return send(ctx, c.endpoint(), method, path, accept, options...)
+}
+
+// endpoint holds what is needed to send requests to the API.
+type endpoint struct {
+	httpClient *http.Client
+	baseURL    string
+	apiKey     string
 
-	var formBuf bytes.Buffer
+	// Sent along with each request's own headers.
+	headers http.Header
 
-	writer := multipart.NewWriter(&formBuf)
+	// Whether to build forms and read responses through temporary files.
+	lowMemory bool
+}
+
+// send sends a request to the API and reads the response.  The options are sent
+// as a multipart form, unless there are none.
+func send(ctx context.Context, e endpoint, method string, path string, accept string, options ...FormOption) (*RawResponse, error) {
+	reqURL := e.baseURL + path
+
+	var (
+		body        io.Reader
+		length      int64
+		contentType string
+	)
+
+	if len(options) > 0 {
+		var (
+			form    io.ReadWriter = &bytes.Buffer{}
+			cleanup               = func() {}
+		)
+
+		if e.lowMemory {
+			spool, err := os.CreateTemp("", "sdcli-form-*")
+			if err != nil {
+				return nil, fmt.Errorf("failed to create temporary file for form: %w", err)
+			}
+
+			form = spool
+			cleanup = func() {
+				spool.Close()
+				os.Remove(spool.Name())
+			}
+		}
+		defer cleanup()
+
+		writer := multipart.NewWriter(form)
+
+		for _, v := range options {
+			err := v(writer)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := writer.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to close multipart writer: %w", err)
+		}
 
-	for _, v := range options {
-		err := v(writer)
+		body, length, err = rewind(form)
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	err := writer.Close()
-	if err != nil {
-		return nil, fmt.Errorf("failed to close multipart writer: %w", err)
+		contentType = writer.FormDataContentType()
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, &formBuf)
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Accept", "image/*")
+	// The length of forms read from a file isn't known to NewRequest, and
+	// they would otherwise be sent chunked.
+	req.ContentLength = length
+
+	for k, v := range e.headers {
+		req.Header[k] = v
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	req.Header.Set("Accept", accept)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := e.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read image from response: %w", err)
+	readBody := backend.ReadBody
+	if e.lowMemory {
+		readBody = backend.SpoolBody
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("got unexpected status code %d while generating image. Response: %s", resp.StatusCode, string(body))
+	respBody, err := readBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	return body, nil
+	return &RawResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody}, nil
+}
+
+// rewind returns a form that has been written, ready to be read as a request
+// body, along with its length.
+func rewind(form io.ReadWriter) (io.Reader, int64, error) {
+	switch v := form.(type) {
+	case *bytes.Buffer:
+		return v, int64(v.Len()), nil
+	case *os.File:
+		length, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to measure form: %w", err)
+		}
+
+		_, err = v.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to rewind form: %w", err)
+		}
+
+		return v, length, nil
+	default:
+		return nil, 0, fmt.Errorf("unexpected form type %T", form)
+	}
 }
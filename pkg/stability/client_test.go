@@ -0,0 +1,178 @@
+package stability
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SethCurry/sdcli/internal/testutil"
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// uploadedImage is an image part of a form received by a test server.
+type uploadedImage struct {
+	fileName    string
+	contentType string
+	data        []byte
+}
+
+// imageServer returns a server that responds to every request with a PNG, and
+// records the image parts of the forms it receives in uploads.
+func imageServer(t *testing.T, uploads *[]uploadedImage) *httptest.Server {
+	t.Helper()
+
+	response := testutil.PNG(8, 8)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("expected a multipart form: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("failed to read form: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+
+				return
+			}
+
+			if part.FormName() != "image" {
+				continue
+			}
+
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Errorf("failed to read image part: %v", err)
+			}
+
+			*uploads = append(*uploads, uploadedImage{
+				fileName:    part.FileName(),
+				contentType: part.Header.Get("Content-Type"),
+				data:        data,
+			})
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("finish-reason", "SUCCESS")
+		w.Header().Set("seed", "42")
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestGenerateUploadsInitImage(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       []byte
+		fileName    string
+		contentType string
+		options     []ClientOption
+	}{
+		{"jpeg", testutil.JPEG(32, 32), "image.jpeg", "image/jpeg", nil},
+		{"png", testutil.PNG(32, 32), "image.png", "image/png", nil},
+		{"jpeg in low memory mode", testutil.JPEG(32, 32), "image.jpeg", "image/jpeg", []ClientOption{WithLowMemory()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var uploads []uploadedImage
+
+			server := imageServer(t, &uploads)
+			client := NewClient("key", append([]ClientOption{WithBaseURL(server.URL)}, tt.options...)...)
+
+			result, err := client.Generate(context.Background(), backend.GenerateRequest{
+				Prompt:   "A bear",
+				Model:    "sd3-large",
+				Image:    bytes.NewReader(tt.image),
+				Strength: 0.5,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(uploads) != 1 {
+				t.Fatalf("expected one image to be uploaded, got %d", len(uploads))
+			}
+
+			got := uploads[0]
+
+			if got.fileName != tt.fileName || got.contentType != tt.contentType {
+				t.Errorf("uploaded %q as %s, want %q as %s", got.fileName, got.contentType, tt.fileName, tt.contentType)
+			}
+
+			if !bytes.Equal(got.data, tt.image) {
+				t.Error("expected the initial image to be uploaded unchanged")
+			}
+
+			if result.Seed != 42 || result.FinishReason != "SUCCESS" {
+				t.Errorf("got seed %d and finish reason %q, want 42 and SUCCESS", result.Seed, result.FinishReason)
+			}
+		})
+	}
+}
+
+func TestGenerate3RequestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   Generate3Request
+		valid bool
+	}{
+		{"default model", Generate3Request{Prompt: "A bear"}, true},
+		{"supported model, ratio, and format", Generate3Request{Prompt: "A bear", Model: "sd3-large-turbo", AspectRatio: "21:9", OutputFormat: "jpeg"}, true},
+		{"old model name", Generate3Request{Prompt: "A bear", Model: "sd3turbo"}, false},
+		{"operation rather than model", Generate3Request{Prompt: "A bear", Model: "upscale/fast"}, false},
+		{"style model", Generate3Request{Prompt: "A bear", Model: StyleModel}, false},
+		{"unsupported ratio", Generate3Request{Prompt: "A bear", AspectRatio: "7:3"}, false},
+		{"unsupported format", Generate3Request{Prompt: "A bear", OutputFormat: "gif"}, false},
+		{"empty prompt", Generate3Request{Model: "sd3-large"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGenerateReportsModel(t *testing.T) {
+	var uploads []uploadedImage
+
+	server := imageServer(t, &uploads)
+	client := NewClient("key", WithBaseURL(server.URL))
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"", models[0]},
+		{"sd3-medium", "sd3-medium"},
+	}
+
+	for _, tt := range tests {
+		result, err := client.Generate(context.Background(), backend.GenerateRequest{Prompt: "A bear", Model: tt.model})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Model != tt.want {
+			t.Errorf("Generate with model %q reported model %q, want %q", tt.model, result.Model, tt.want)
+		}
+	}
+}
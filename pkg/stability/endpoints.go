@@ -0,0 +1,162 @@
+package stability
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// Endpoint describes a model or operation of the API: where it is sent, what it
+// accepts, and what it costs.  The CLI's validation, cost estimates, and listing
+// of engines are all derived from Endpoints.
+type Endpoint struct {
+	// The name of the model or operation, e.g. "sd3-large" or "upscale/fast".
+	// Upscale, edit, and control operations are named by their path under
+	// /v2beta/stable-image.
+	Name string
+
+	// The path of the endpoint.  The SD3 models share one endpoint, and are
+	// picked with the model field.
+	Path string
+
+	// The operation the endpoint performs.
+	Operation backend.Operation
+
+	// The aspect ratios that can be requested, or none if the result has the
+	// aspect ratio of the image sent.
+	AspectRatios []string
+
+	// The formats the result can be returned in.
+	OutputFormats []string
+
+	// The longest prompt, in bytes, or zero if the endpoint takes no prompt, in
+	// which case prompts aren't sent to it.
+	MaxPromptLength int
+
+	// The number of credits each image costs.
+	Credits float64
+
+	// Whether the endpoint responds with an ID to poll for the result, rather
+	// than the result itself.
+	Async bool
+}
+
+// maxPromptLength is the longest prompt the endpoints that take one accept.
+const maxPromptLength = 10000
+
+var (
+	aspectRatios  = []string{"16:9", "1:1", "21:9", "2:3", "3:2", "4:5", "5:4", "9:16", "9:21"}
+	outputFormats = []string{"png", "jpeg", "webp"}
+)
+
+var endpoints = []Endpoint{
+	{Name: "sd3-large", Path: generate3Path, Operation: backend.OperationTextToImage, AspectRatios: aspectRatios, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 6.5},
+	{Name: "sd3-large-turbo", Path: generate3Path, Operation: backend.OperationTextToImage, AspectRatios: aspectRatios, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 4},
+	{Name: "sd3-medium", Path: generate3Path, Operation: backend.OperationTextToImage, AspectRatios: aspectRatios, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 3.5},
+	{Name: "upscale/fast", Path: "/v2beta/stable-image/upscale/fast", Operation: backend.OperationUpscale, OutputFormats: outputFormats, Credits: 1},
+	{Name: "upscale/conservative", Path: "/v2beta/stable-image/upscale/conservative", Operation: backend.OperationUpscale, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 25},
+	{Name: "edit/inpaint", Path: "/v2beta/stable-image/edit/inpaint", Operation: backend.OperationEdit, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 3},
+	{Name: "edit/erase", Path: "/v2beta/stable-image/edit/erase", Operation: backend.OperationEdit, OutputFormats: outputFormats, Credits: 3},
+	{Name: "edit/search-and-replace", Path: "/v2beta/stable-image/edit/search-and-replace", Operation: backend.OperationEdit, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 4},
+	{Name: "edit/remove-background", Path: "/v2beta/stable-image/edit/remove-background", Operation: backend.OperationEdit, OutputFormats: []string{"png", "webp"}, Credits: 2},
+	{Name: StyleModel, Path: controlStylePath, Operation: backend.OperationStyle, AspectRatios: aspectRatios, OutputFormats: outputFormats, MaxPromptLength: maxPromptLength, Credits: 4},
+}
+
+// The models and operations of the client's capabilities, from endpoints.
+var (
+	models         = endpointNames(backend.OperationTextToImage, "")
+	upscaleModes   = endpointNames(backend.OperationUpscale, "upscale/")
+	editOperations = endpointNames(backend.OperationEdit, "edit/")
+)
+
+// endpointNames returns the names of the endpoints that perform op, in the
+// order they are listed, with prefix trimmed from them.
+func endpointNames(op backend.Operation, prefix string) []string {
+	var names []string
+
+	for _, v := range endpoints {
+		if v.Operation == op {
+			names = append(names, strings.TrimPrefix(v.Name, prefix))
+		}
+	}
+
+	return names
+}
+
+// Endpoints returns the models and operations the client supports.
+func Endpoints() []Endpoint {
+	return slices.Clone(endpoints)
+}
+
+// LookupEndpoint returns the model or operation with the given name, e.g.
+// "sd3-large" or "upscale/fast".  The second return value is false if there is
+// no such model or operation.
+func LookupEndpoint(name string) (Endpoint, bool) {
+	i := slices.IndexFunc(endpoints, func(v Endpoint) bool {
+		return v.Name == name
+	})
+	if i < 0 {
+		return Endpoint{}, false
+	}
+
+	return endpoints[i], true
+}
+
+// DollarsPerCredit is the price of a credit, in US dollars.
+const DollarsPerCredit = 0.01
+
+// CreditedOperations returns the models and operations that EstimateCredits knows
+// the cost of, sorted by name.
+func CreditedOperations() []string {
+	names := make([]string, 0, len(endpoints))
+	for _, v := range endpoints {
+		names = append(names, v.Name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// EstimateCredits returns the number of credits a single image costs with the
+// given model, or upscale or edit operation (e.g. "upscale/fast").  The second
+// return value is false if it is unknown.
+func EstimateCredits(modelOrOperation string) (float64, bool) {
+	endpoint, ok := LookupEndpoint(modelOrOperation)
+
+	return endpoint.Credits, ok
+}
+
+// check returns an error wrapping backend.ErrUnsupported if the endpoint doesn't
+// accept the prompt, aspect ratio, or output format, so that a request that
+// would be refused isn't sent.  Empty values are left to the API's defaults.
+func (e Endpoint) check(prompt string, ratio string, format string) error {
+	if e.MaxPromptLength > 0 && len(prompt) > e.MaxPromptLength {
+		return fmt.Errorf("%w: prompt of length %d is too long for %s, it must be %d characters or less",
+			backend.ErrUnsupported, len(prompt), e.Name, e.MaxPromptLength)
+	}
+
+	if ratio != "" && !slices.Contains(e.AspectRatios, ratio) {
+		return fmt.Errorf("%w: aspect ratio %q with %s", backend.ErrUnsupported, ratio, e.Name)
+	}
+
+	if format != "" && !slices.Contains(e.OutputFormats, format) {
+		return fmt.Errorf("%w: output format %q with %s", backend.ErrUnsupported, format, e.Name)
+	}
+
+	return nil
+}
+
+// lookupEndpoint returns the model or operation with the given name, or an
+// error wrapping backend.ErrUnsupported if there is none.
+func lookupEndpoint(name string) (Endpoint, error) {
+	endpoint, ok := LookupEndpoint(name)
+	if !ok {
+		return Endpoint{}, fmt.Errorf("%w: unknown model or operation %q", backend.ErrUnsupported, name)
+	}
+
+	return endpoint, nil
+}
@@ -0,0 +1,83 @@
+package stability
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// IsRetryable reports whether a request that failed with err may succeed if it
+// is sent again later: it was rate limited, timed out, failed on the server's
+// side, or the connection to the API was refused or dropped.  Requests that were
+// canceled, and failures that will happen again, e.g. an invalid base URL or an
+// untrusted certificate, aren't retryable.
+func IsRetryable(err error) bool {
+	var (
+		apiErr *backend.APIError
+		netErr net.Error
+		opErr  *net.OpError
+		dnsErr *net.DNSError
+	)
+
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &apiErr):
+		return apiErr.Retryable()
+	case isCertificateError(err):
+		return false
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		// The host in the base URL doesn't exist.
+		return false
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.As(err, &opErr):
+		// Failing to dial or use a connection, e.g. because the network is down.
+		return true
+	}
+
+	return false
+}
+
+// isCertificateError reports whether err is the API's TLS certificate failing
+// verification, e.g. because it is self-signed or for another host.
+func isCertificateError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// IsContentFiltered reports whether err is a request refused by content
+// moderation.  Sending it again won't help, but rewording the prompt may.
+func IsContentFiltered(err error) bool {
+	return errors.Is(err, backend.ErrContentFiltered)
+}
+
+// IsAuthError reports whether err is a request refused because the API key is
+// missing, invalid, or not allowed to use the endpoint.
+//
+// The API also responds with 403 Forbidden to requests flagged by content
+// moderation, which aren't auth errors; see IsContentFiltered.
+func IsAuthError(err error) bool {
+	var apiErr *backend.APIError
+
+	if !errors.As(err, &apiErr) || IsContentFiltered(err) {
+		return false
+	}
+
+	return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,107 @@
+package stability
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// requestError returns the error sending a GET request to url fails with.
+func requestError(t *testing.T, client *http.Client, url string) error {
+	t.Helper()
+
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected request to %s to fail", url)
+	}
+
+	return err
+}
+
+// closedAddress returns the address of a port nothing is listening on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
+func TestIsRetryable(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	client := &http.Client{Timeout: time.Second}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"rate limited", &backend.APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server error", fmt.Errorf("wrapped: %w", &backend.APIError{StatusCode: http.StatusBadGateway}), true},
+		{"bad request", &backend.APIError{StatusCode: http.StatusBadRequest}, false},
+		{"canceled", fmt.Errorf("failed to send request: %w", context.Canceled), false},
+		{"connection refused", requestError(t, client, "http://"+closedAddress(t)), true},
+		{"timeout", requestError(t, &http.Client{Timeout: 50 * time.Millisecond}, hanging.URL), true},
+		{"unsupported scheme", requestError(t, client, "htp://api.stability.ai"), false},
+		{"untrusted certificate", requestError(t, client, tlsServer.URL), false},
+		{"unknown host", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "api.stabilty.ai", IsNotFound: true}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	forbidden := &backend.APIError{StatusCode: http.StatusForbidden}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unauthorized", fmt.Errorf("wrapped: %w", &backend.APIError{StatusCode: http.StatusUnauthorized}), true},
+		{"forbidden", forbidden, true},
+		{"content filtered", fmt.Errorf("%w: %w", backend.ErrContentFiltered, forbidden), false},
+		{"server error", &backend.APIError{StatusCode: http.StatusInternalServerError}, false},
+		{"not an API error", errors.New("failed"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsAuthError(tt.err); got != tt.want {
+				t.Errorf("IsAuthError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+
+			if got := IsContentFiltered(tt.err); got != (tt.name == "content filtered") {
+				t.Errorf("IsContentFiltered(%v) = %v", tt.err, got)
+			}
+		})
+	}
+}
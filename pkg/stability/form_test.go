@@ -0,0 +1,200 @@
+package stability
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/SethCurry/sdcli/internal/testutil"
+	"github.com/SethCurry/sdcli/pkg/backend"
+)
+
+// formInputs are the files the form tests send.
+var formInputs = testutil.Inputs{
+	"jpeg": testutil.JPEG(16, 16),
+	"png":  testutil.PNG(16, 16),
+}
+
+// captureServer returns a client for a server that responds to every request
+// with a PNG, and a function returning the canonical form of the last request
+// it received.
+func captureServer(t *testing.T) (*Client, func() []byte) {
+	t.Helper()
+
+	var captured []byte
+
+	response := testutil.PNG(8, 8)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		form, err := testutil.CaptureRequest(r, formInputs)
+		if err != nil {
+			t.Errorf("failed to capture request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		captured = form
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return NewClient("key", WithBaseURL(server.URL)), func() []byte { return captured }
+}
+
+func golden(name string) string {
+	return filepath.Join("testdata", name+".golden")
+}
+
+func TestRequestForms(t *testing.T) {
+	image := func() io.Reader { return bytes.NewReader(formInputs["jpeg"]) }
+	mask := func() io.Reader { return bytes.NewReader(formInputs["png"]) }
+
+	tests := []struct {
+		name string
+		send func(ctx context.Context, c *Client) error
+	}{
+		{"generate", func(ctx context.Context, c *Client) error {
+			_, err := c.Generate(ctx, backend.GenerateRequest{
+				Prompt:         "A bear riding a unicycle",
+				NegativePrompt: "blurry",
+				Model:          "sd3-large-turbo",
+				AspectRatio:    "16:9",
+				OutputFormat:   "png",
+				Seed:           1234,
+				CFGScale:       4.5,
+			})
+			return err
+		}},
+		{"generate_default_model", func(ctx context.Context, c *Client) error {
+			_, err := c.Generate(ctx, backend.GenerateRequest{Prompt: "A bear"})
+			return err
+		}},
+		{"generate_image_to_image", func(ctx context.Context, c *Client) error {
+			_, err := c.Generate(ctx, backend.GenerateRequest{
+				Prompt:       "A bear riding a unicycle",
+				Model:        "sd3-medium",
+				AspectRatio:  "16:9",
+				OutputFormat: "png",
+				Image:        image(),
+				Strength:     0.7,
+			})
+			return err
+		}},
+		{"generate_style", func(ctx context.Context, c *Client) error {
+			_, err := c.Generate(ctx, backend.GenerateRequest{
+				Prompt:        "A bear riding a unicycle",
+				AspectRatio:   "1:1",
+				OutputFormat:  "png",
+				Seed:          7,
+				StyleImages:   []io.Reader{image()},
+				StyleFidelity: 0.8,
+			})
+			return err
+		}},
+		{"upscale_fast", func(ctx context.Context, c *Client) error {
+			_, err := c.Upscale(ctx, backend.UpscaleRequest{
+				Image:        image(),
+				Mode:         "fast",
+				Prompt:       "ignored by the fast upscaler",
+				OutputFormat: "png",
+			})
+			return err
+		}},
+		{"upscale_conservative", func(ctx context.Context, c *Client) error {
+			_, err := c.Upscale(ctx, backend.UpscaleRequest{
+				Image:        image(),
+				Mode:         "conservative",
+				Prompt:       "A bear riding a unicycle",
+				OutputFormat: "png",
+			})
+			return err
+		}},
+		{"edit_inpaint", func(ctx context.Context, c *Client) error {
+			_, err := c.Edit(ctx, backend.EditRequest{
+				Operation:      "inpaint",
+				Image:          image(),
+				Mask:           mask(),
+				Prompt:         "A fox",
+				NegativePrompt: "blurry",
+				OutputFormat:   "png",
+			})
+			return err
+		}},
+		{"edit_erase", func(ctx context.Context, c *Client) error {
+			_, err := c.Edit(ctx, backend.EditRequest{
+				Operation:    "erase",
+				Image:        image(),
+				Mask:         mask(),
+				Prompt:       "ignored by erase",
+				OutputFormat: "png",
+			})
+			return err
+		}},
+		{"edit_search_and_replace", func(ctx context.Context, c *Client) error {
+			_, err := c.Edit(ctx, backend.EditRequest{
+				Operation:    "search-and-replace",
+				Image:        image(),
+				Prompt:       "A fox",
+				SearchPrompt: "the bear",
+				OutputFormat: "png",
+			})
+			return err
+		}},
+		{"edit_remove_background", func(ctx context.Context, c *Client) error {
+			_, err := c.Edit(ctx, backend.EditRequest{
+				Operation:    "remove-background",
+				Image:        image(),
+				OutputFormat: "png",
+			})
+			return err
+		}},
+		{"do", func(ctx context.Context, c *Client) error {
+			_, err := c.Do(ctx, http.MethodPost, "/v2beta/stable-image/generate/ultra", "image/*",
+				WithField("prompt", "A bear"),
+				WithField("style_preset", "photographic"),
+				WithFile("image", image()),
+				WithFile("notes", bytes.NewReader([]byte("not an image"))))
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, captured := captureServer(t)
+
+			err := tt.send(context.Background(), client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testutil.Golden(t, golden(tt.name), captured())
+		})
+	}
+}
+
+func TestGenerate3Form(t *testing.T) {
+	form, err := testutil.CaptureForm(formInputs,
+		WithPrompt("A bear riding a unicycle"),
+		WithNegativePrompt("blurry"),
+		WithModel("sd3-large"),
+		WithAspectRatio("21:9"),
+		WithOutputFormat("jpeg"),
+		WithSeed(99),
+		WithCFGScale(7),
+		WithMode("image-to-image"),
+		WithImage(bytes.NewReader(formInputs["png"])),
+		WithStrength(0.35),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.Golden(t, golden("generate3_options"), form)
+}
@@ -0,0 +1,102 @@
+// Package tile checks whether images tile seamlessly, e.g. textures for games.
+package tile
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Offset returns a copy of img shifted by half its width and height, wrapping
+// around the edges.  The image's edges meet in a cross through the middle of the
+// copy, so any seam is easy to see there.
+func Offset(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dx, dy := width/2, height/2
+
+	shifted := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			shifted.Set((x+dx)%width, (y+dy)%height, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return shifted
+}
+
+// Repeat returns img tiled n times in each direction.
+func Repeat(img image.Image, n int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	tiled := image.NewRGBA(image.Rect(0, 0, width*n, height*n))
+
+	for row := 0; row < n; row++ {
+		for col := 0; col < n; col++ {
+			rect := image.Rect(col*width, row*height, (col+1)*width, (row+1)*height)
+			draw.Draw(tiled, rect, img, bounds.Min, draw.Src)
+		}
+	}
+
+	return tiled
+}
+
+// SeamScore measures how visible the seams are when img is tiled.  It compares
+// the difference between opposite edges, which meet when tiled, to the typical
+// difference between neighboring pixels inside the image.  A score around 1
+// means the seams blend in like any other pair of neighbors; higher scores mean
+// more visible seams.
+func SeamScore(img image.Image) float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width < 2 || height < 2 {
+		return 0
+	}
+
+	at := func(x int, y int) color.Color {
+		return img.At(bounds.Min.X+x, bounds.Min.Y+y)
+	}
+
+	var seam, inner float64
+
+	for y := 0; y < height; y++ {
+		seam += distance(at(width-1, y), at(0, y))
+		inner += distance(at(width/2-1, y), at(width/2, y))
+	}
+
+	for x := 0; x < width; x++ {
+		seam += distance(at(x, height-1), at(x, 0))
+		inner += distance(at(x, height/2-1), at(x, height/2))
+	}
+
+	// Avoid dividing by zero for flat images, which tile perfectly anyway.
+	if inner == 0 {
+		if seam == 0 {
+			return 1
+		}
+
+		inner = 1
+	}
+
+	return seam / inner
+}
+
+// distance returns the mean absolute difference of the red, green, and blue
+// channels of two colors, from 0 to 255.
+func distance(a color.Color, b color.Color) float64 {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+
+	diff := func(x uint32, y uint32) float64 {
+		if x > y {
+			return float64(x-y) / 257
+		}
+
+		return float64(y-x) / 257
+	}
+
+	return (diff(ar, br) + diff(ag, bg) + diff(ab, bb)) / 3
+}
@@ -0,0 +1,241 @@
+// Package watermark embeds and detects an invisible watermark that marks images
+// as AI-generated.
+//
+// The watermark is a 64-bit ID spread across the image's 8x8 pixel blocks.  Each
+// block carries one bit, stored in the relative size of two mid-frequency DCT
+// coefficients of its luminance, so the watermark can't be seen but survives
+// high-quality JPEG compression.  The payload is repeated across the whole image
+// and decoded by majority vote, so small edits don't remove it.  Resizing or
+// cropping the image does.
+package watermark
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// DefaultStrength is the default difference enforced between the two DCT
+// coefficients of each block.  Higher values survive more compression, but are
+// more likely to be visible.
+const DefaultStrength = 16
+
+// ErrNotFound is returned by Detect when an image has no watermark.
+var ErrNotFound = errors.New("no watermark found")
+
+// ErrTooSmall is returned by Embed when an image is too small to hold a watermark.
+var ErrTooSmall = errors.New("image is too small to watermark")
+
+const (
+	blockSize = 8
+
+	// The magic byte that starts every payload, used to tell a watermark from noise.
+	magic = 0xa5
+
+	// The payload is the magic byte, the 8 byte ID, and a checksum byte.
+	payloadBits = (1 + 8 + 1) * 8
+)
+
+// The DCT coefficients that carry the watermark.
+var (
+	coefficientA = [2]int{2, 3}
+	coefficientB = [2]int{3, 2}
+)
+
+// cosines holds cos((2x+1)uπ/16) for every x and u in a block.
+var cosines = func() [blockSize][blockSize]float64 {
+	var c [blockSize][blockSize]float64
+
+	for x := 0; x < blockSize; x++ {
+		for u := 0; u < blockSize; u++ {
+			c[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * blockSize))
+		}
+	}
+
+	return c
+}()
+
+func alpha(u int) float64 {
+	if u == 0 {
+		return 1 / math.Sqrt2
+	}
+
+	return 1
+}
+
+// basis returns the contribution of DCT coefficient (u, v) to pixel (x, y).
+func basis(u int, v int, x int, y int) float64 {
+	return alpha(u) * alpha(v) * cosines[x][u] * cosines[y][v] / 4
+}
+
+// luminance returns the luminance of a pixel, as in the JPEG YCbCr conversion.
+func luminance(c color.RGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+}
+
+// coefficient returns DCT coefficient (u, v) of the luminance of the block at
+// (bx, by).
+func coefficient(img *image.RGBA, bx int, by int, uv [2]int) float64 {
+	var sum float64
+
+	for y := 0; y < blockSize; y++ {
+		for x := 0; x < blockSize; x++ {
+			sum += luminance(img.RGBAAt(bx+x, by+y)) * basis(uv[0], uv[1], x, y)
+		}
+	}
+
+	return sum
+}
+
+func payload(id uint64) []bool {
+	data := make([]byte, 0, payloadBits/8)
+	data = append(data, magic)
+
+	for i := 7; i >= 0; i-- {
+		data = append(data, byte(id>>(8*i)))
+	}
+
+	data = append(data, checksum(data))
+
+	bits := make([]bool, 0, payloadBits)
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, b&(1<<i) != 0)
+		}
+	}
+
+	return bits
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum = sum*31 + b
+	}
+
+	return sum
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+	return out
+}
+
+func clamp(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// blocks returns the number of whole blocks in an image.
+func blocks(bounds image.Rectangle) int {
+	return (bounds.Dx() / blockSize) * (bounds.Dy() / blockSize)
+}
+
+// Embed returns a copy of img with id embedded as an invisible watermark.  A
+// strength of 0 means DefaultStrength.
+func Embed(img image.Image, id uint64, strength float64) (*image.RGBA, error) {
+	if blocks(img.Bounds()) < payloadBits {
+		return nil, ErrTooSmall
+	}
+
+	if strength <= 0 {
+		strength = DefaultStrength
+	}
+
+	out := toRGBA(img)
+	bits := payload(id)
+	bounds := out.Bounds()
+
+	i := 0
+
+	for by := 0; by+blockSize <= bounds.Dy(); by += blockSize {
+		for bx := 0; bx+blockSize <= bounds.Dx(); bx += blockSize {
+			bit := bits[i%len(bits)]
+			i++
+
+			a := coefficient(out, bx, by, coefficientA)
+			b := coefficient(out, bx, by, coefficientB)
+
+			// A one is stored as a exceeding b by at least strength, and a zero
+			// as the reverse.
+			diff := a - b
+			if (bit && diff >= strength) || (!bit && -diff >= strength) {
+				continue
+			}
+
+			target := strength
+			if !bit {
+				target = -strength
+			}
+
+			// Move both coefficients by the same amount towards the target, and
+			// apply the change to every channel so the colour is unchanged.
+			change := (target - diff) / 2
+
+			for y := 0; y < blockSize; y++ {
+				for x := 0; x < blockSize; x++ {
+					delta := change*basis(coefficientA[0], coefficientA[1], x, y) -
+						change*basis(coefficientB[0], coefficientB[1], x, y)
+
+					c := out.RGBAAt(bx+x, by+y)
+					out.SetRGBA(bx+x, by+y, color.RGBA{
+						R: clamp(float64(c.R) + delta),
+						G: clamp(float64(c.G) + delta),
+						B: clamp(float64(c.B) + delta),
+						A: c.A,
+					})
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// Detect returns the ID embedded in img by Embed, or ErrNotFound if it has no
+// watermark.
+func Detect(img image.Image) (uint64, error) {
+	if blocks(img.Bounds()) < payloadBits {
+		return 0, ErrNotFound
+	}
+
+	rgba := toRGBA(img)
+	bounds := rgba.Bounds()
+
+	votes := make([]int, payloadBits)
+	i := 0
+
+	for by := 0; by+blockSize <= bounds.Dy(); by += blockSize {
+		for bx := 0; bx+blockSize <= bounds.Dx(); bx += blockSize {
+			if coefficient(rgba, bx, by, coefficientA) > coefficient(rgba, bx, by, coefficientB) {
+				votes[i%payloadBits]++
+			} else {
+				votes[i%payloadBits]--
+			}
+
+			i++
+		}
+	}
+
+	data := make([]byte, payloadBits/8)
+	for bit, v := range votes {
+		if v > 0 {
+			data[bit/8] |= 1 << (7 - bit%8)
+		}
+	}
+
+	if data[0] != magic || checksum(data[:len(data)-1]) != data[len(data)-1] {
+		return 0, ErrNotFound
+	}
+
+	var id uint64
+	for _, b := range data[1:9] {
+		id = id<<8 | uint64(b)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkPrompt checks a prompt against the prompt policy before it is sent,
+// printing a warning for each warn rule it matches.  It returns an error
+// wrapping policy.ErrBlocked if it matches a block rule.
+func (c *Context) checkPrompt(prompt string) error {
+	if c.Policy == nil || prompt == "" {
+		return nil
+	}
+
+	warnings, err := c.Policy.Check(prompt)
+
+	for _, v := range warnings {
+		fmt.Fprintf(os.Stderr, "WARNING: prompt matches %s, which may be blocked by content moderation\n", v)
+	}
+
+	return err
+}
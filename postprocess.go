@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/lut"
+	"github.com/SethCurry/sdcli/pkg/palette"
+	"github.com/mitchellh/go-homedir"
+)
+
+type PostProcessConfig struct {
+	// Quantize every image to a palette, e.g. for pixel art or brand colors.
+	// This is either a comma-separated list of hex colors, e.g.
+	// "#1a1c2c,#5d275d,#b13e53", or the path to a palette file with a hex color
+	// per line, as exported by Lospec, or a GIMP .gpl palette.
+	Palette string `json:"palette"`
+
+	// Spread the error of quantizing to a palette to neighboring pixels, which
+	// keeps gradients at the cost of noise.
+	Dither bool `json:"dither"`
+
+	// The path to a 3D LUT in .cube format to apply to every image, e.g. a color
+	// grade exported from an editor.  It is applied before quantizing to Palette.
+	LUT string `json:"lut"`
+}
+
+// postProcessor applies the configured post-processing to images before they
+// are saved.
+type postProcessor struct {
+	palette color.Palette
+	dither  bool
+	lut     *lut.LUT
+
+	// Describes the post-processing for the image's metadata, e.g.
+	// "lut film.cube, palette of 16 colors".
+	description string
+}
+
+// newPostProcessor loads the palette and LUT in config.  It returns nil if no
+// post-processing is configured.
+func newPostProcessor(config PostProcessConfig) (*postProcessor, error) {
+	if config.Palette == "" && config.LUT == "" {
+		return nil, nil
+	}
+
+	processor := &postProcessor{dither: config.Dither}
+
+	var steps []string
+
+	if config.LUT != "" {
+		table, err := loadLUT(config.LUT)
+		if err != nil {
+			return nil, err
+		}
+
+		processor.lut = table
+		steps = append(steps, "lut "+filepath.Base(config.LUT))
+	}
+
+	if config.Palette != "" {
+		colors, err := loadPalette(config.Palette)
+		if err != nil {
+			return nil, err
+		}
+
+		processor.palette = colors
+
+		step := fmt.Sprintf("palette of %d colors", len(colors))
+		if config.Dither {
+			step += ", dithered"
+		}
+
+		steps = append(steps, step)
+	}
+
+	processor.description = strings.Join(steps, ", ")
+
+	return processor, nil
+}
+
+// loadPalette loads a palette from a file, or parses it as a list of hex colors
+// if it isn't one.
+func loadPalette(spec string) (color.Palette, error) {
+	path, err := homedir.Expand(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand %q: %w", spec, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !strings.ContainsAny(spec, `/\`) {
+		colors, err := palette.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid palette, must be hex colors or a palette file: %w", err)
+		}
+
+		return colors, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read palette: %w", err)
+	}
+
+	colors, err := palette.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid palette %s: %w", path, err)
+	}
+
+	return colors, nil
+}
+
+// loadLUT loads a .cube LUT.
+func loadLUT(name string) (*lut.LUT, error) {
+	path, err := homedir.Expand(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand %q: %w", name, err)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LUT: %w", err)
+	}
+	defer fd.Close()
+
+	table, err := lut.ParseCube(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LUT %s: %w", path, err)
+	}
+
+	return table, nil
+}
+
+// apply post-processes an encoded image, returning it re-encoded in the same
+// format.
+func (p *postProcessor) apply(data []byte, format string) ([]byte, error) {
+	if format != "png" && format != "jpeg" {
+		return nil, fmt.Errorf("unable to post-process %s images", format)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if p.lut != nil {
+		img = p.lut.Apply(img)
+	}
+
+	if p.palette != nil {
+		img = palette.Quantize(img, p.palette, p.dither)
+	}
+
+	return backend.EncodeImage(img, format)
+}
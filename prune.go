@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/history"
+	"github.com/SethCurry/sdcli/internal/objectstore"
+	"github.com/SethCurry/sdcli/internal/units"
+	"go.uber.org/zap"
+)
+
+type PruneCommand struct {
+	OlderThan     units.Duration `optional:"older-than" help:"Delete images older than this, e.g. 30d, 2w, or 12h."`
+	MaxSize       units.Size     `optional:"max-size" help:"Delete the oldest images until the output directory is no larger than this, e.g. 10GB.  Defaults to max_directory_size from the config."`
+	KeepFavorites bool           `optional:"keep-favorites" help:"Don't delete favorite images."`
+	KeepTagged    bool           `optional:"keep-tagged" help:"Don't delete tagged images."`
+	DryRun        bool           `optional:"dry-run" help:"List the images that would be deleted without deleting them."`
+}
+
+func (p PruneCommand) Run(ctx *Context) error {
+	opts := pruneOptions{
+		KeepFavorites: p.KeepFavorites,
+		KeepTagged:    p.KeepTagged,
+		DryRun:        p.DryRun,
+	}
+
+	if p.OlderThan > 0 {
+		opts.OlderThan = time.Now().Add(-time.Duration(p.OlderThan))
+	}
+
+	opts.MaxSize = int64(p.MaxSize)
+	if opts.MaxSize == 0 {
+		opts.MaxSize = int64(ctx.Config.MaxDirectorySize)
+	}
+
+	if opts.OlderThan.IsZero() && opts.MaxSize == 0 {
+		ctx.Logger.Fatal("nothing to prune, pass --older-than or --max-size")
+	}
+
+	pruned, err := ctx.pruneImages(opts)
+	if err != nil {
+		ctx.Logger.Fatal("failed to prune images", zap.Error(err))
+	}
+
+	if p.DryRun {
+		// Duplicates share an image, so only list each image once.
+		listed := make(map[string]bool, len(pruned))
+
+		for _, v := range pruned {
+			if !listed[v.Path] {
+				fmt.Println(v.Path)
+				listed[v.Path] = true
+			}
+		}
+	}
+
+	ctx.Logger.Info("pruned images", zap.Int("images", len(pruned)), zap.Bool("dry_run", p.DryRun))
+
+	return nil
+}
+
+type pruneOptions struct {
+	// Delete images created before this, unless it is zero.
+	OlderThan time.Time
+
+	// Delete the oldest images until the output directory is no larger than this
+	// many bytes, unless it is zero.
+	MaxSize int64
+
+	KeepFavorites bool
+	KeepTagged    bool
+
+	// A path that is never deleted, e.g. the image that was just saved.
+	Keep string
+
+	DryRun bool
+}
+
+// prunableImage is an image in the output directory, along with every history
+// entry for it.  Duplicates share an image, so there may be several.
+type prunableImage struct {
+	Path      string
+	CreatedAt time.Time
+	Entries   []history.Entry
+}
+
+// keep reports whether the options protect the image from being deleted.
+func (p prunableImage) keep(opts pruneOptions) bool {
+	if p.Path == opts.Keep {
+		return true
+	}
+
+	for _, v := range p.Entries {
+		if (opts.KeepFavorites && v.Favorite) || (opts.KeepTagged && len(v.Tags) > 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneImages deletes images in the output directory, along with their sidecars
+// and history entries, oldest first.  Only images recorded in the history are
+// deleted, so other files in the output directory are left alone.  It returns the
+// entries of the deleted images.
+func (c *Context) pruneImages(opts pruneOptions) ([]history.Entry, error) {
+	if objectstore.IsURL(c.Config.OutputDirectory) {
+		return nil, errors.New("unable to prune images in object storage")
+	}
+
+	outputDir, err := filepath.Abs(c.Config.OutputDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+
+	entries, err := c.History.List()
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]*prunableImage)
+	images := make([]*prunableImage, 0, len(entries))
+
+	// The number of images saved somewhere else, e.g. with --out-dir, or before
+	// the output directory was changed.
+	outside := 0
+
+	for _, v := range entries {
+		// Older versions recorded paths relative to the working directory when the
+		// output directory was, which is the same directory outputDir is resolved
+		// against.
+		imagePath, err := filepath.Abs(v.Path)
+		if err != nil {
+			c.Logger.Warn("skipping history entry with an unresolvable path", zap.String("path", v.Path), zap.Error(err))
+
+			continue
+		}
+
+		rel, err := filepath.Rel(outputDir, imagePath)
+		if err != nil {
+			c.Logger.Warn("skipping history entry", zap.String("path", v.Path), zap.Error(err))
+
+			continue
+		} else if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			outside++
+
+			continue
+		}
+
+		v.Path = imagePath
+
+		img, ok := byPath[v.Path]
+		if !ok {
+			img = &prunableImage{Path: v.Path, CreatedAt: v.CreatedAt}
+			byPath[v.Path] = img
+			images = append(images, img)
+		}
+
+		img.Entries = append(img.Entries, v)
+
+		if v.CreatedAt.Before(img.CreatedAt) {
+			img.CreatedAt = v.CreatedAt
+		}
+	}
+
+	if outside > 0 {
+		c.Logger.Debug("skipped images outside the output directory", zap.Int("images", outside), zap.String("output_directory", outputDir))
+	}
+
+	sort.SliceStable(images, func(i int, j int) bool {
+		return images[i].CreatedAt.Before(images[j].CreatedAt)
+	})
+
+	var size int64
+
+	if opts.MaxSize > 0 {
+		size, err = directorySize(outputDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var pruned []history.Entry
+
+	for _, img := range images {
+		tooOld := !opts.OlderThan.IsZero() && img.CreatedAt.Before(opts.OlderThan)
+		tooBig := opts.MaxSize > 0 && size > opts.MaxSize
+
+		if !tooOld && !tooBig {
+			// Images are oldest first and the size only shrinks, so none of the
+			// rest need deleting either.
+			break
+		}
+
+		if img.keep(opts) {
+			continue
+		}
+
+		freed, err := removeImage(img.Path, opts.DryRun)
+		if err != nil {
+			return pruned, err
+		}
+
+		size -= freed
+		pruned = append(pruned, img.Entries...)
+	}
+
+	if opts.DryRun || len(pruned) == 0 {
+		return pruned, nil
+	}
+
+	ids := make([]int64, 0, len(pruned))
+	for _, v := range pruned {
+		ids = append(ids, v.ID)
+	}
+
+	err = c.History.Remove(ids...)
+	if err != nil {
+		return pruned, fmt.Errorf("failed to remove pruned images from history: %w", err)
+	}
+
+	return pruned, nil
+}
+
+// removeImage deletes an image and its sidecar, if it has one, returning the
+// number of bytes freed.  Files that no longer exist are ignored.
+func removeImage(imagePath string, dryRun bool) (int64, error) {
+	var freed int64
+
+	for _, v := range []string{imagePath, sidecarName(imagePath)} {
+		info, err := os.Stat(v)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return freed, fmt.Errorf("failed to check %q: %w", v, err)
+		}
+
+		if !dryRun {
+			err = os.Remove(v)
+			if err != nil {
+				return freed, fmt.Errorf("failed to delete %q: %w", v, err)
+			}
+		}
+
+		freed += info.Size()
+	}
+
+	return freed, nil
+}
+
+// directorySize returns the total size of the files in a directory and its
+// subdirectories.
+func directorySize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %q: %w", dir, err)
+	}
+
+	return size, nil
+}
+
+// trimOutputDirectory deletes the oldest images once the output directory grows
+// past max_directory_size.  Favorite and tagged images, and the image that was
+// just saved, are kept.  Failures are logged rather than returned, since the
+// image has already been saved.
+func (c *Context) trimOutputDirectory(saved string) {
+	if c.Config.MaxDirectorySize == 0 || c.History == nil || objectstore.IsURL(c.Config.OutputDirectory) || c.Config.HTTPOutput.uploadOnly() {
+		return
+	}
+
+	pruned, err := c.pruneImages(pruneOptions{
+		MaxSize:       int64(c.Config.MaxDirectorySize),
+		KeepFavorites: true,
+		KeepTagged:    true,
+		Keep:          saved,
+	})
+	if err != nil {
+		c.Logger.Error("failed to trim output directory", zap.Error(err))
+	}
+
+	if len(pruned) > 0 {
+		c.Logger.Info("deleted old images to stay under max_directory_size", zap.Int("images", len(pruned)))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/stability"
+	"go.uber.org/zap"
+)
+
+var errRawOutputRequired = errors.New("no --output for the image")
+
+type RawCommand struct {
+	Method string            `optional:"method" default:"POST" enum:"GET,POST" help:"The HTTP method to use."`
+	Accept string            `optional:"accept" default:"image/*" help:"The Accept header to send, e.g. application/json to get the image base64-encoded in JSON."`
+	Field  map[string]string `optional:"field" help:"A form field to send, as name=value."`
+	File   map[string]string `optional:"file" help:"A file to send, as field=path, e.g. image=photo.png."`
+	Output string            `optional:"output" short:"o" type:"path" help:"Where to save the response body.  By default it is printed, unless it is binary."`
+	Path   string            `arg:"" help:"The path of the endpoint, e.g. /v2beta/stable-image/generate/ultra."`
+}
+
+func (r RawCommand) Run(ctx *Context) error {
+	// Images can't be printed, so don't pay for one that can't be saved.
+	if r.Output == "" && strings.HasPrefix(r.Accept, "image/") {
+		ctx.Logger.Fatal("--output is required when accepting images", zap.Error(invalid(errRawOutputRequired)))
+	}
+
+	client, err := stabilityClient(ctx)
+	if err != nil {
+		ctx.Logger.Fatal("failed to create Stability client", zap.Error(err))
+	}
+
+	var opts []stability.FormOption
+
+	// Sort the fields so requests are sent the same way every time.
+	fields := make([]string, 0, len(r.Field))
+	for k := range r.Field {
+		fields = append(fields, k)
+	}
+
+	sort.Strings(fields)
+
+	for _, v := range fields {
+		opts = append(opts, stability.WithField(v, r.Field[v]))
+	}
+
+	files := make([]string, 0, len(r.File))
+	for k := range r.File {
+		files = append(files, k)
+	}
+
+	sort.Strings(files)
+
+	for _, v := range files {
+		fd, err := os.Open(r.File[v])
+		if err != nil {
+			ctx.Logger.Fatal("failed to open file", zap.String("field", v), zap.Error(err))
+		}
+		defer fd.Close()
+
+		opts = append(opts, stability.WithFile(v, fd))
+	}
+
+	resp, err := client.Do(ctx.Ctx, r.Method, r.Path, r.Accept, opts...)
+	if err != nil && ctx.Ctx.Err() != nil {
+		return ctx.Ctx.Err()
+	} else if err != nil {
+		ctx.Logger.Fatal("failed to send request", zap.Error(err))
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		ctx.Logger.Fatal("request failed", zap.Error(&backend.APIError{StatusCode: resp.StatusCode, URL: r.Path, Body: string(resp.Body)}))
+	}
+
+	ctx.Logger.Info(
+		"request succeeded",
+		zap.Int("status", resp.StatusCode),
+		zap.String("content_type", resp.Header.Get("Content-Type")),
+		zap.String("seed", resp.Header.Get("seed")),
+		zap.String("finish_reason", resp.Header.Get("finish-reason")))
+
+	if r.Output != "" {
+		err = os.WriteFile(r.Output, resp.Body, 0o644)
+		if err != nil {
+			ctx.Logger.Fatal("failed to save response", zap.String("path", r.Output), zap.Error(err))
+		}
+
+		ctx.Logger.Info("saved response", zap.String("path", r.Output))
+
+		return nil
+	}
+
+	if !utf8.Valid(resp.Body) {
+		ctx.Logger.Fatal("response is binary, use --output to save it", zap.Int("bytes", len(resp.Body)))
+	}
+
+	_, err = os.Stdout.Write(resp.Body)
+
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/pipeline"
+	"go.uber.org/zap"
+)
+
+type RefineCommand struct {
+	Name           string   `optional:"name" help:"The name of the directory under refine/ in the output directory to save the images in.  Defaults to the current time."`
+	Model          string   `optional:"model" help:"The model to generate the image with."`
+	Ratio          string   `optional:"ratio" default:"1:1" help:"The aspect ratio of the generated image."`
+	NegativePrompt string   `optional:"negative" help:"The negative prompt to use during generation."`
+	OutputFormat   string   `optional:"format" default:"png" help:"The format of the returned images.  Must be one the backend supports, as listed by sdcli engines."`
+	UpscaleMode    string   `optional:"upscale-mode" default:"conservative" help:"The upscaler to use, e.g. fast or conservative.  The conservative upscaler keeps faces and other details of the subject."`
+	Search         string   `optional:"search" help:"What to replace in the upscaled image, e.g. \"hat\".  The replacement is described by --replace.  The image isn't edited if empty."`
+	Replace        string   `optional:"replace" help:"What to replace --search with, e.g. \"red beret\"."`
+	PromptParts    []string `arg:"" help:"The prompt to generate the image with."`
+}
+
+func (r RefineCommand) Run(ctx *Context) error {
+	prompt := strings.Join(r.PromptParts, " ")
+	if prompt == "" {
+		ctx.Logger.Fatal("prompt is empty, exiting")
+	}
+
+	if (r.Search == "") != (r.Replace == "") {
+		ctx.Logger.Fatal("unable to refine", zap.Error(invalid(errors.New("--search and --replace must be given together"))))
+	}
+
+	// Check everything the later steps need before paying for the generation.
+	err := r.checkBackend(ctx)
+	if err != nil {
+		ctx.Logger.Fatal("unable to refine", zap.Error(err))
+	}
+
+	// The prompt is checked by the generation, before anything is paid for.
+	err = ctx.checkPrompt(r.Replace)
+	if err != nil {
+		ctx.Logger.Fatal("unable to refine", zap.Error(err))
+	}
+
+	r.NegativePrompt, err = ctx.Config.expandNegative(r.NegativePrompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to refine", zap.Error(err))
+	}
+
+	name := r.Name
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+
+	dir := path.Join("refine", name)
+
+	steps, err := pipeline.New(r.steps(ctx, prompt, dir)...)
+	if err != nil {
+		ctx.Logger.Fatal("failed to build pipeline", zap.Error(err))
+	}
+
+	ctx.Logger.Info("refining image", zap.String("directory", dir), zap.Strings("steps", steps.Steps()))
+
+	outputs, err := steps.Run(ctx.Ctx)
+	if err != nil && ctx.Ctx.Err() != nil {
+		return ctx.Ctx.Err()
+	} else if err != nil {
+		// The images of the steps that succeeded are kept, so the refinement can
+		// be finished by hand.
+		for _, v := range steps.Steps() {
+			if output, ok := outputs[v]; ok {
+				ctx.Logger.Info("kept intermediate image", zap.String("step", v), zap.String("path", output.Path))
+			}
+		}
+
+		ctx.Logger.Fatal("failed to refine image", zap.Error(err))
+	}
+
+	final := outputs[steps.Steps()[len(steps.Steps())-1]]
+
+	ctx.runPostGenerationCommand(final.Path)
+
+	return nil
+}
+
+// checkBackend returns an error if the backend can't run every step of the
+// refinement.
+func (r RefineCommand) checkBackend(ctx *Context) error {
+	if r.Model != "" {
+		err := ctx.requireModel(r.Model)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ctx.requireOutputFormat(r.OutputFormat)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.requireUpscaleMode(r.UpscaleMode)
+	if err != nil {
+		return err
+	}
+
+	if r.Search == "" {
+		return nil
+	}
+
+	return ctx.requireEditOperation("search-and-replace")
+}
+
+// steps returns the steps of the refinement, which save their images in dir.
+func (r RefineCommand) steps(ctx *Context, prompt string, dir string) []pipeline.Step {
+	model := r.Model
+	if model == "" {
+		model = defaultModel(ctx.Backend.Capabilities())
+	}
+
+	steps := []pipeline.Step{
+		{
+			Name: "generate",
+			Run: func(runCtx context.Context, _ map[string]*pipeline.Output) (*pipeline.Output, error) {
+				result, err := ctx.generate(runCtx, generation{
+					Prompt:         prompt,
+					NegativePrompt: r.NegativePrompt,
+					Model:          model,
+					Ratio:          r.Ratio,
+					OutputFormat:   r.OutputFormat,
+					OutputName:     path.Join(dir, "1-generate"),
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				return stepOutput(ctx, "generate", result)
+			},
+		},
+		{
+			Name:  "upscale",
+			Needs: []string{"generate"},
+			Run: func(_ context.Context, inputs map[string]*pipeline.Output) (*pipeline.Output, error) {
+				upscaler := UpscaleCommand{
+					Mode:         r.UpscaleMode,
+					OutputFormat: r.OutputFormat,
+					Prompt:       prompt,
+				}
+
+				result, err := upscaler.upscale(ctx, outputSource(inputs["generate"]), path.Join(dir, "2-upscale"))
+				if err != nil {
+					return nil, err
+				}
+
+				return stepOutput(ctx, "upscale", result)
+			},
+		},
+	}
+
+	if r.Search != "" {
+		steps = append(steps, pipeline.Step{
+			Name:  "search-and-replace",
+			Needs: []string{"upscale"},
+			Run: func(_ context.Context, inputs map[string]*pipeline.Output) (*pipeline.Output, error) {
+				editor := EditCommand{
+					Operation:      "search-and-replace",
+					Search:         r.Search,
+					NegativePrompt: r.NegativePrompt,
+					OutputFormat:   r.OutputFormat,
+				}
+
+				result, err := editor.edit(ctx, outputSource(inputs["upscale"]), r.Replace, path.Join(dir, "3-search-and-replace"))
+				if err != nil {
+					return nil, err
+				}
+
+				return stepOutput(ctx, "search-and-replace", result)
+			},
+		})
+	}
+
+	return steps
+}
+
+// stepOutput logs the image saved by a step and returns it as the step's output.
+func stepOutput(ctx *Context, step string, result *generationResult) (*pipeline.Output, error) {
+	ctx.Logger.Info("saved image", zap.String("step", step), zap.String("path", result.Path))
+
+	err := filteredError(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pipeline.Output{
+		Path:  result.Path,
+		Image: result.Image,
+		Values: map[string]string{
+			"prompt": result.Prompt,
+			"model":  result.Model,
+			"seed":   fmt.Sprint(result.Seed),
+			"path":   result.Path,
+		},
+	}, nil
+}
+
+// outputSource returns the image saved by an earlier step, to be used as the
+// input of the next one.
+func outputSource(output *pipeline.Output) imageSource {
+	return imageSource{Path: output.Path, Data: output.Image}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/runlog"
+)
+
+// runRecorder collects what happens during an invocation, and appends it to the
+// run log once it finishes.  A nil runRecorder records nothing.
+type runRecorder struct {
+	log *runlog.Log
+
+	mu       sync.Mutex
+	entry    runlog.Entry
+	finished bool
+}
+
+// newRunRecorder starts recording an invocation of a command.
+func newRunRecorder(log *runlog.Log, entry runlog.Entry) *runRecorder {
+	entry.StartedAt = time.Now()
+
+	if current, err := user.Current(); err == nil {
+		entry.User = current.Username
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		entry.Host = host
+	}
+
+	return &runRecorder{log: log, entry: entry}
+}
+
+// addResult records an image that was saved.
+func (r *runRecorder) addResult(result *generationResult) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entry.Results = append(r.entry.Results, runlog.Result{
+		Path:           result.Path,
+		Operation:      result.Operation,
+		Prompt:         result.Prompt,
+		NegativePrompt: result.NegativePrompt,
+		OriginalPrompt: result.OriginalPrompt,
+		Backend:        result.Backend,
+		Model:          result.Model,
+		Seed:           result.Seed,
+		AspectRatio:    result.AspectRatio,
+		Credits:        result.Credits,
+	})
+}
+
+// finish appends the invocation to the run log, along with the error it failed
+// with, if any.  Only the first call has any effect.
+func (r *runRecorder) finish(err error) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.finished {
+		return nil
+	}
+
+	r.finished = true
+
+	r.entry.Duration = time.Since(r.entry.StartedAt).Seconds()
+
+	if err != nil {
+		r.entry.Error = err.Error()
+	}
+
+	return r.log.Append(r.entry)
+}
+
+// forRequest returns a copy of the context that records a single bot request in
+// the run log as an invocation of its own, since the bot itself runs until it is
+// stopped.  Call finish on the copy's Run once the request is done.
+func (c *Context) forRequest(command string, requester string, args ...string) *Context {
+	if c.Run == nil {
+		return c
+	}
+
+	reqCtx := *c
+	reqCtx.Run = newRunRecorder(c.Run.log, runlog.Entry{
+		Command:   command,
+		Args:      args,
+		Requester: requester,
+		Profile:   c.Run.entry.Profile,
+		Backend:   c.Run.entry.Backend,
+	})
+
+	return &reqCtx
+}
@@ -3,190 +3,917 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
-	"time"
 
-	"github.com/SethCurry/sdcli/internal/exif"
+	"github.com/SethCurry/sdcli/internal/balance"
+	"github.com/SethCurry/sdcli/internal/budget"
+	"github.com/SethCurry/sdcli/internal/history"
+	"github.com/SethCurry/sdcli/internal/policy"
+	"github.com/SethCurry/sdcli/internal/runlog"
+	"github.com/SethCurry/sdcli/internal/units"
+	"github.com/SethCurry/sdcli/internal/webhook"
+	"github.com/SethCurry/sdcli/pkg/backend"
 	"github.com/SethCurry/sdcli/pkg/stability"
 	"github.com/alecthomas/kong"
 	"github.com/mitchellh/go-homedir"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-const defaultBaseURL = "https://api.stability.ai"
-
-func getExifAdder(format string) (func([]byte, string) ([]byte, error), error) {
-	switch format {
-	case "jpeg":
-		return exif.AddToJPEG, nil
-	case "png":
-		return exif.AddToPNG, nil
-	}
-
-	return nil, fmt.Errorf("unknown output format %q", format)
-}
-
 type Gen3Command struct {
-	Model          string   `optional:"model" default:"sd3-large" enum:"sd3-large,sd3-large-turbo,sd3-medium" help:"The model to use."`
-	Ratio          string   `optional:"ratio" default:"1:1" enum:"16:9,1:1,21:9,2:3,3:2,4:5,5:4,9:16,9:21" help:"The aspect ratio to use when generating."`
-	OutputFormat   string   `optional:"format" default:"png" enum:"png,jpeg" help:"The format of the returned image.  Must be either png or jpeg."`
-	NegativePrompt string   `optional:"negative" help:"The negative prompt to use during generation."`
+	Model          string   `optional:"model" help:"The model to use.  Defaults to the backend's default model, e.g. sd3-large for Stability."`
+	Ratio          string   `optional:"ratio" aliases:"aspect_ratio,aspect-ratio" default:"" help:"The aspect ratio to use when generating, e.g. 16:9.  Must be one the backend supports, as listed by sdcli engines.  Defaults to the ratio nearest the initial image's when generating from an image, and 1:1 otherwise."`
+	OutputFormat   string   `optional:"format" aliases:"output_format" default:"png" help:"The format of the returned image.  Must be one the backend supports, as listed by sdcli engines."`
+	NegativePrompt string   `optional:"negative" aliases:"negative_prompt" help:"The negative prompt to use during generation."`
 	Strength       float32  `optional:"strength" help:"The strength to use when doing image-to-image generation."`
-	Image          string   `optional:"image" type:"path" help:"The image to use for image-to-image generation."`
-	PromptParts    []string `arg:"" help:"The prompt to use for generation."`
+	Image          string   `optional:"image" type:"path" xor:"image" help:"The image to use for image-to-image generation."`
+	ImageDir       string   `optional:"image-dir" type:"existingdir" xor:"image" help:"Generate from every image in this directory and its subdirectories, saving the results in the same structure in the output directory."`
+	SaveAs         string   `optional:"save-as" enum:",png,jpeg" default:"" help:"Convert the image to this format before saving it, e.g. to request a lossless png and save a smaller jpeg.  Must be png or jpeg."`
+	Count          int      `optional:"count" default:"1" help:"The number of images to generate."`
+	Samples        int      `optional:"samples" default:"1" help:"The number of images to generate with each request, for backends that can generate several at once, e.g. a1111 and openai.  --count 2 --samples 4 generates 8 images with 2 requests."`
+	Grid           bool     `optional:"grid" help:"Also save a contact sheet of the images, labeled with their seeds, when generating more than one."`
+	Enhance        *bool    `optional:"enhance" negatable:"" help:"Expand the prompt with the configured prompt enhancer before generating.  Defaults to prompt_enhancer.enabled."`
+	TileCheck      bool     `optional:"tile-check" help:"Also save a preview of each image tiled and offset by half a tile, and report how visible its seams are, for seamless textures."`
+	Seasoning      bool     `optional:"seasoning" help:"Append a random token from each seasoning pool in the config to the prompt of every image, for more varied batches."`
+	Palette        string   `optional:"palette" help:"Quantize the images to a palette, given as comma-separated hex colors or a palette file.  Overrides post_process.palette in the config."`
+	Dither         *bool    `optional:"dither" negatable:"" help:"Dither when quantizing to the palette.  Defaults to post_process.dither."`
+	LUT            string   `optional:"lut" type:"existingfile" help:"Apply a 3D LUT in .cube format to the images.  Overrides post_process.lut in the config."`
+	Upscale        string   `optional:"upscale" default:"" help:"Also upscale every image with this upscaler, saving both versions, e.g. fast or conservative.  Must be one the backend supports."`
+	Ref            []string `optional:"ref" type:"existingfile" help:"Generate in the style of this image instead of from a model.  Can be given more than once, with --ref-strategy deciding how the images are used."`
+	RefStrategy    string   `optional:"ref-strategy" default:"cycle" enum:"cycle,random,average,all" help:"How to use several --ref images: cycle through them, one per image, pick one at random for each image, average them into one, or send them all with every request."`
+	Fidelity       float32  `optional:"fidelity" help:"How closely to follow the style of --ref, from 0 to 1.  Defaults to the backend's default."`
+	RetryFiltered  *int     `optional:"retry-filtered" help:"Retry filtered images up to this many times with a rewritten prompt.  Defaults to filter_retry.attempts."`
+	SaveSession    string   `optional:"save-session" type:"path" help:"Save every parameter of the run, including resolved defaults, seeds, and the sdcli version, to this session file, so it can be reproduced with --from-session."`
+	FromSession    string   `optional:"from-session" type:"existingfile" help:"Reproduce the generations in a session file saved with --save-session.  The prompt and the other generation flags are left out."`
+	Stdin          bool     `optional:"stdin" help:"Read prompts from stdin, one per line, and generate --count images for each with the other flags.  The prompt argument is left out."`
+	PromptParts    []string `arg:"" optional:"" help:"The prompt to use for generation."`
 }
 
 func (g Gen3Command) Run(ctx *Context) error {
+	if g.FromSession != "" {
+		return g.runSession(ctx)
+	}
+
 	prompt := strings.Join(g.PromptParts, " ")
 
-	if prompt == "" {
+	if g.Stdin && (prompt != "" || g.ImageDir != "") {
+		ctx.Logger.Fatal("unable to generate", zap.Error(invalid(errStdinFlags)))
+	} else if prompt == "" && !g.Stdin {
 		ctx.Logger.Fatal("prompt is empty, exiting")
 	}
 
-	opts := []stability.Generate3Option{stability.WithPrompt(prompt)}
+	model := g.Model
+
+	if model == "" {
+		model = defaultModel(ctx.Backend.Capabilities())
+	} else if err := ctx.requireModel(model); err != nil {
+		ctx.Logger.Fatal("unknown model", zap.Error(err))
+	}
+
+	err := ctx.requireOutputFormat(g.OutputFormat)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
+	}
 
 	if g.Ratio != "" {
-		opts = append(opts, stability.WithAspectRatio(g.Ratio))
+		err = ctx.requireAspectRatio(g.Ratio)
+		if err != nil {
+			ctx.Logger.Fatal("unable to generate", zap.Error(err))
+		}
 	}
 
-	if g.Model != "" {
-		opts = append(opts, stability.WithModel(g.Model))
+	err = ctx.requirePromptLength(prompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
 	}
 
-	if g.OutputFormat != "" {
-		opts = append(opts, stability.WithOutputFormat(g.OutputFormat))
+	if g.Count < 1 {
+		ctx.Logger.Fatal("count must be at least 1", zap.Int("count", g.Count))
 	}
 
-	if g.NegativePrompt != "" {
-		opts = append(opts, stability.WithNegativePrompt(g.NegativePrompt))
+	if g.Samples < 1 {
+		ctx.Logger.Fatal("samples must be at least 1", zap.Int("samples", g.Samples))
+	} else if err := ctx.requireSamples(g.Samples); err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
 	}
 
-	if g.Strength != 0 {
-		opts = append(opts, stability.WithStrength(g.Strength))
+	g.NegativePrompt, err = ctx.Config.expandNegative(g.NegativePrompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
 	}
 
-	if g.Image != "" {
-		fd, err := os.Open(g.Image)
+	if g.Upscale != "" {
+		err = ctx.requireUpscaleMode(g.Upscale)
 		if err != nil {
-			ctx.Logger.Fatal("failed to open image", zap.String("path", g.Image), zap.Error(err))
+			ctx.Logger.Fatal("unable to upscale", zap.Error(err))
 		}
-		defer fd.Close()
+	}
+
+	postProcess := ctx.Config.PostProcess
 
-		opts = append(opts, stability.WithImage(fd))
+	if g.Palette != "" || g.Dither != nil || g.LUT != "" {
+		if g.Palette != "" {
+			postProcess.Palette = g.Palette
+		}
+
+		if g.Dither != nil {
+			postProcess.Dither = *g.Dither
+		}
+
+		if g.LUT != "" {
+			postProcess.LUT = g.LUT
+		}
+
+		ctx.PostProcess, err = newPostProcessor(postProcess)
+		if err != nil {
+			ctx.Logger.Fatal("invalid post-processing", zap.Error(invalid(err)))
+		}
 	}
 
-	gotImage, err := stability.Generate3(context.Background(), defaultBaseURL, ctx.Config.APIKey, opts...)
-	if err != nil {
-		ctx.Logger.Fatal("failed to generate image", zap.Error(err))
+	if len(g.Ref) > 0 {
+		err = g.checkStyle(ctx)
+		if err != nil {
+			ctx.Logger.Fatal("unable to generate in the style of --ref", zap.Error(err))
+		}
 	}
 
-	exifAdder, err := getExifAdder(g.OutputFormat)
-	if err != nil {
-		ctx.Logger.Fatal("failed to find Exif adder", zap.Error(err))
+	if g.RetryFiltered != nil {
+		ctx.Config.FilterRetry.Attempts = *g.RetryFiltered
+
+		err = ctx.Config.FilterRetry.validate(ctx.Config.PromptEnhancer)
+		if err != nil {
+			ctx.Logger.Fatal("unable to retry filtered images", zap.Error(invalid(err)))
+		}
 	}
 
-	imageWithNewExif, err := exifAdder(gotImage, prompt)
-	if err != nil {
-		ctx.Logger.Fatal("failed to add new exif metadata", zap.Error(err))
+	enhance := ctx.Config.PromptEnhancer.Enabled
+	if g.Enhance != nil {
+		enhance = *g.Enhance
+	}
+
+	// The original prompt is kept in the metadata, so the image can be traced back
+	// to what was asked for.
+	originalPrompt := ""
+
+	// setPrompt sets the prompt of the generations, enhancing it if asked to.
+	// With --stdin it is called for every prompt read.
+	setPrompt := func(given string) error {
+		prompt, originalPrompt = given, ""
+
+		if !enhance {
+			return nil
+		}
+
+		enhanced, err := ctx.enhancePrompt(ctx.Ctx, given)
+		if err != nil {
+			return fmt.Errorf("failed to enhance prompt: %w", err)
+		}
+
+		ctx.Logger.Info("enhanced prompt", zap.String("prompt", enhanced))
+
+		originalPrompt, prompt = given, enhanced
+
+		return nil
+	}
+
+	// Image-to-image generations use the initial image's ratio, which is only
+	// known once it is read.
+	ratio := g.Ratio
+	if ratio == "" && g.Image == "" && g.ImageDir == "" {
+		ratio = "1:1"
 	}
 
-	currentTime := strconv.FormatInt(time.Now().Unix(), 10)
+	// The number of generations so far, to cycle through the --ref images.
+	generated := 0
+
+	newGeneration := func(image string) generation {
+		gen := generation{
+			Prompt:         prompt,
+			OriginalPrompt: originalPrompt,
+			NegativePrompt: g.NegativePrompt,
+			Model:          model,
+			Ratio:          ratio,
+			OutputFormat:   g.OutputFormat,
+			Strength:       g.Strength,
+			Image:          image,
+			SaveAs:         g.SaveAs,
+			Samples:        g.Samples,
+		}
+
+		if len(g.Ref) > 0 {
+			gen.StyleReferences, gen.AverageStyle = g.pickStyleReferences(generated)
+			gen.Fidelity = g.Fidelity
+		}
+
+		generated++
+
+		if g.Seasoning {
+			gen.Prompt, gen.Seasoning = season(prompt, ctx.Config.seasoningPools())
+		}
 
-	outputFile := filepath.Join(ctx.Config.OutputDirectory, fmt.Sprintf("%s.%s", currentTime, g.OutputFormat))
-	if _, err := os.Stat(outputFile); err == nil {
-		ctx.Logger.Fatal("output file already exists", zap.String("path", outputFile))
+		return gen
 	}
 
-	err = os.WriteFile(outputFile, imageWithNewExif, 0o644)
+	if g.Stdin {
+		return g.runStdin(ctx, os.Stdin, setPrompt, newGeneration, postProcess)
+	}
+
+	err = setPrompt(prompt)
 	if err != nil {
-		ctx.Logger.Fatal("failed while writing to output file", zap.String("path", outputFile), zap.Error(err))
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
+	}
+
+	if g.ImageDir != "" {
+		return g.runImageDir(ctx, newGeneration, postProcess)
 	}
 
-	if ctx.Config.PostGenerationCommand != "" {
-		cmd := exec.Command(ctx.Config.PostGenerationCommand, outputFile)
-		err = cmd.Run()
+	results := make([]*generationResult, 0, g.Count)
+
+	// Set if the batch stopped at fail_below_credits, in which case the images
+	// generated so far are still finished.
+	var lowBalance error
+
+	for i := 0; i < g.Count && ctx.Ctx.Err() == nil; i++ {
+		result, err := ctx.generate(ctx.Ctx, newGeneration(g.Image))
+		if result != nil {
+			results = append(results, result.withSamples()...)
+		}
+
+		if err != nil && ctx.Ctx.Err() != nil {
+			break
+		} else if errors.Is(err, balance.ErrTooLow) {
+			lowBalance = err
+
+			break
+		} else if err != nil {
+			ctx.Logger.Fatal("failed to generate image", zap.Error(err), zap.Int("generated", len(results)))
+		}
+	}
+
+	if g.SaveSession != "" {
+		err = g.saveSession(ctx, results, postProcess)
 		if err != nil {
-			ctx.Logger.Error(
-				"post-generation command failed",
-				zap.String("command", fmt.Sprintf("%s %q", ctx.Config.PostGenerationCommand, outputFile)))
+			ctx.Logger.Error("failed to save session", zap.Error(err))
+		}
+	}
+
+	if lowBalance != nil {
+		return g.finishLowBalance(ctx, results, lowBalance)
+	}
+
+	return g.finish(ctx, results)
+}
+
+// finishLowBalance finishes the images generated before a batch stopped at
+// fail_below_credits, and exits with a summary of them.
+func (g Gen3Command) finishLowBalance(ctx *Context, results []*generationResult, lowBalance error) error {
+	if len(results) > 0 {
+		err := g.finish(ctx, results)
+		if err != nil && ctx.Ctx.Err() != nil {
+			return err
 		}
 	}
 
+	var (
+		credits float64
+		saved   = make([]string, 0, len(results))
+	)
+
+	for _, v := range results {
+		credits += v.Credits
+		saved = append(saved, v.Path)
+	}
+
+	ctx.Logger.Fatal(
+		"stopped before the credit balance dropped below fail_below_credits",
+		zap.Error(lowBalance),
+		zap.Int("generated", len(results)),
+		zap.Int("count", g.Count*g.Samples),
+		zap.Float64("credits", credits),
+		zap.Strings("saved", saved))
+
 	return nil
 }
 
+// finish upscales, checks, and opens the generated images, as the flags ask.
+func (g Gen3Command) finish(ctx *Context, results []*generationResult) error {
+	var upscaled []*generationResult
+
+	if g.Upscale != "" && ctx.Ctx.Err() == nil {
+		var err error
+
+		upscaled, err = ctx.upscaleGenerated(results, g.Upscale, g.OutputFormat, g.SaveAs)
+		if err != nil && ctx.Ctx.Err() == nil {
+			ctx.Logger.Fatal("failed to upscale image", zap.Error(err), zap.Int("upscaled", len(upscaled)))
+		}
+	}
+
+	// The images that were generated before an interrupt have been saved, but
+	// don't go on to make a grid or open them.
+	if err := ctx.Ctx.Err(); err != nil {
+		ctx.Logger.Warn("stopped early", zap.Int("generated", len(results)), zap.Int("count", g.Count))
+
+		return err
+	}
+
+	if g.TileCheck {
+		ctx.checkTiling(ctx.Ctx, results)
+	}
+
+	if g.Grid && len(results) > 1 {
+		grid, err := ctx.saveContactSheet(ctx.Ctx, results)
+		if err != nil {
+			ctx.Logger.Error("failed to save contact sheet", zap.Error(err))
+		} else {
+			ctx.Logger.Info("saved contact sheet", zap.String("path", grid))
+
+			// Open the grid rather than every image in it.
+			ctx.runPostGenerationCommand(grid)
+
+			return filteredError(results...)
+		}
+	}
+
+	// Open the upscaled images rather than the originals.
+	opened := results
+	if len(upscaled) > 0 {
+		opened = upscaled
+	}
+
+	for _, v := range opened {
+		ctx.runPostGenerationCommand(v.Path)
+	}
+
+	return filteredError(results...)
+}
+
+// runImageDir generates --count images from every image in --image-dir.  The
+// post-generation command isn't run, since it would be run for every image.
+func (g Gen3Command) runImageDir(ctx *Context, newGeneration func(image string) generation, postProcess PostProcessConfig) error {
+	err := ctx.requireOperation(backend.OperationImageToImage)
+	if err != nil {
+		ctx.Logger.Fatal("unable to generate", zap.Error(err))
+	}
+
+	results, err := ctx.forEachImage(g.ImageDir, func(imagePath string, outputName string) ([]*generationResult, error) {
+		results := make([]*generationResult, 0, g.Count)
+
+		for i := 0; i < g.Count; i++ {
+			gen := newGeneration(imagePath)
+			gen.OutputName = outputName
+
+			result, err := ctx.generate(ctx.Ctx, gen)
+			if result != nil {
+				results = append(results, result.withSamples()...)
+			}
+
+			if err != nil {
+				return results, err
+			}
+		}
+
+		if g.Upscale == "" {
+			return results, nil
+		}
+
+		upscaled, err := ctx.upscaleGenerated(results, g.Upscale, g.OutputFormat, g.SaveAs)
+
+		return append(results, upscaled...), err
+	})
+
+	if g.SaveSession != "" {
+		sessionErr := g.saveSession(ctx, results, postProcess)
+		if sessionErr != nil {
+			ctx.Logger.Error("failed to save session", zap.Error(sessionErr))
+		}
+	}
+
+	if g.TileCheck {
+		generated := make([]*generationResult, 0, len(results))
+		for _, v := range results {
+			if v.Operation == "generate" {
+				generated = append(generated, v)
+			}
+		}
+
+		ctx.checkTiling(context.WithoutCancel(ctx.Ctx), generated)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return filteredError(results...)
+}
+
+// backendCommands are the commands that send requests with the backend, and so
+// need its API key.
+var backendCommands = []string{"gen-3", "upscale", "edit", "bot", "experiment", "refine", "pipeline", "raw", "bench"}
+
+// version is the version of sdcli.  It is set at build time for releases with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
 type CLI struct {
-	Gen3 Gen3Command `cmd:"" help:"Generate an image with Stable Diffusion 3"`
+	Config            string            `optional:"config" type:"path" env:"SDCLI_CONFIG" help:"The config file to use.  Defaults to config.json in %APPDATA%\\sdcli on Windows, and $XDG_CONFIG_HOME/sdcli or ~/.config/sdcli elsewhere."`
+	Profile           string            `optional:"profile" env:"SDCLI_PROFILE" help:"The profile in the config to use."`
+	BaseURL           string            `optional:"base-url" help:"The base URL of the backend's API, e.g. a proxy or a local mock.  Overrides the base URL in the config."`
+	Backend           string            `optional:"backend" help:"The backend to generate images with.  Overrides the backend in the config."`
+	Mock              bool              `optional:"mock" help:"Render placeholder images locally instead of calling the API.  The same as --backend mock."`
+	LowMemory         bool              `optional:"low-memory" help:"Send images through temporary files, and avoid decoding whole images, to use less memory.  Generated images are still held in memory while they are saved.  The same as low_memory in the config."`
+	KeepInputMetadata bool              `optional:"keep-input-metadata" help:"Send initial images, masks, and style references with their metadata, e.g. GPS positions, instead of stripping it.  The same as keep_input_metadata in the config."`
+	PollInterval      units.Duration    `optional:"poll-interval" help:"How long to wait before polling for an asynchronous result, e.g. 5s.  Overrides polling.interval in the config."`
+	MaxWait           units.Duration    `optional:"max-wait" help:"How long to wait for an asynchronous result before giving up, e.g. 15m.  Overrides polling.max_wait in the config."`
+	PollBackoff       float64           `optional:"poll-backoff" help:"How much to multiply the poll interval by after each poll, e.g. 1.5.  Overrides polling.backoff in the config."`
+	JSON              bool              `optional:"json" help:"Write errors to stdout as JSON objects, one per line, instead of logging them, so other programs can parse failures."`
+	OutDir            string            `optional:"out-dir" help:"Save images to this directory, or object storage URL, instead of the configured output directory, creating it if needed."`
+	Artist            string            `optional:"artist" help:"The Exif Artist tag to write.  Overrides the artist in the config."`
+	Copyright         string            `optional:"copyright" help:"The Exif Copyright tag to write.  Overrides the copyright in the config."`
+	ExifTag           map[string]string `optional:"exif-tag" help:"Extra Exif tags to write, as key=value.  Merged over the extra tags in the config."`
+
+	Gen3    Gen3Command    `cmd:"" help:"Generate an image with Stable Diffusion 3"`
+	Upscale UpscaleCommand `cmd:"" help:"Upscale an existing image."`
+	Edit    EditCommand    `cmd:"" help:"Edit an existing image."`
+	Bot     BotCommand     `cmd:"" help:"Run a chat bot that generates images."`
+
+	Experiment ExperimentCommand `cmd:"" help:"Generate an image for every combination of a grid of parameters, with a CSV manifest."`
+	Refine     RefineCommand     `cmd:"" help:"Generate an image, upscale it, and optionally replace part of it, keeping every step's image."`
+	Pipeline   PipelineCommand   `cmd:"" help:"Run workflows of several steps declared in pipeline files."`
+	Raw        RawCommand        `cmd:"" help:"Send a request to any Stability API endpoint and print or save the raw response."`
+
+	Watermark WatermarkCommand `cmd:"" help:"Print the ID of the invisible watermark in an image."`
+	Mask      MaskCommand      `cmd:"" help:"Build inpainting masks from images."`
+	Diff      DiffCommand      `cmd:"" help:"Compare two images side by side, blended, or as their difference, with PSNR and SSIM."`
+	Inspect   InspectCommand   `cmd:"" help:"Print the size, format, and metadata of images, and how they fit the backend's limits."`
+	History   HistoryCommand   `cmd:"" help:"Browse and manage the history of generated images."`
+	Tag       TagCommand       `cmd:"" help:"Tag an image in the history."`
+	Fav       FavCommand       `cmd:"" help:"Mark an image in the history as a favorite."`
+	Prune     PruneCommand     `cmd:"" help:"Delete old images from the output directory."`
+	Usage     UsageCommand     `cmd:"" help:"Summarize the images generated and the credits they cost."`
+	Estimate  EstimateCommand  `cmd:"" help:"Estimate the credits and cost of a planned run, without contacting the API."`
+	Bench     BenchCommand     `cmd:"" help:"Measure the latency and throughput of the API, to tell a slow API from a slow network."`
+	Engines   EnginesCommand   `cmd:"" help:"List the operations and constraints of each configured backend."`
+	Auth      AuthCommand      `cmd:"" help:"Manage the API key stored in the OS keyring."`
 }
 
 type Context struct {
-	Logger *zap.Logger
-	Config Config
+	// Cancelled when sdcli is interrupted, e.g. with Ctrl-C.
+	Ctx context.Context
+
+	Logger  *zap.Logger
+	Config  Config
+	Budget  *budget.Guard
+	Backend backend.Backend
+	Output  outputDestination
+
+	// The webhook to notify after generations, or nil if none is configured.
+	Webhook *webhook.Client
+
+	// The history that saved images are recorded in.
+	History *history.Store
+
+	// The invocation being recorded in the run log, or nil if run_log isn't set.
+	Run *runRecorder
+
+	// The cached balance of the Stability account, or nil if neither
+	// warn_below_credits nor fail_below_credits is set.
+	Balance *balance.Cache
+
+	// The policy prompts are checked against, or nil if prompt_policy is empty.
+	Policy *policy.Policy
+
+	// The post-processing applied to images before they are saved, or nil if
+	// none is configured.
+	PostProcess *postProcessor
 }
 
 type Config struct {
+	// The version of the config's layout.  Older configs are migrated to the
+	// current version automatically, keeping a backup of the original.
+	Version int `json:"version"`
+
 	// The Stability API key to use for generating images.
 	APIKey string `json:"api_key"`
 
-	// The directory to output images to.  This can be an absolute or relative path,
-	// but it will not expand tilde for home directories nor will it interpret environment
-	// variables.
+	// Read the API key from a file, e.g. a Docker or systemd secret, instead of
+	// keeping it in this file.
+	APIKeyFile string `json:"api_key_file"`
+
+	// Read the API key from the first line of a command's output, e.g.
+	// "pass show stability", instead of keeping it in this file.  The command is
+	// run with the shell.
+	APIKeyCommand string `json:"api_key_command"`
+
+	// Read the API key from the OS keyring, where it is stored by sdcli auth
+	// login, instead of keeping it in this file.
+	APIKeyKeyring bool `json:"api_key_keyring"`
+
+	// The base URL of the Stability API, e.g. to route requests through an API
+	// gateway or to a local mock.  Defaults to https://api.stability.ai.
+	BaseURL string `json:"base_url"`
+
+	// The Stability organization to bill requests to, sent in the Organization
+	// header, for keys that require it.
+	Organization string `json:"organization"`
+
+	// Identifies the application to Stability, with the Stability-Client-ID and
+	// Stability-Client-Version headers.  Defaults to "sdcli" and its version.
+	ClientID      string `json:"client_id"`
+	ClientVersion string `json:"client_version"`
+
+	// The directory to output images to.  This can be an absolute or relative path.
+	// A leading ~ is expanded to the home directory, and environment variables,
+	// e.g. $XDG_PICTURES_DIR, are expanded.  The directory is created when the
+	// first image is saved if it doesn't exist, unless NoCreateOutputDirectory is
+	// set.
+	//
+	// This may also be an s3:// or gs:// URL, in which case images are uploaded to
+	// object storage using the settings in ObjectStorage.
 	//
-	// Images will be saved by Unix timestamp with an appropriate file ending.
+	// Images will be saved by Unix timestamp with an appropriate file ending.  If
+	// a file with that name already exists, a suffix is added, e.g.
+	// "1718822400-1.png".
 	OutputDirectory string `json:"output_directory"`
 
+	// Fail instead of creating OutputDirectory if it doesn't exist, e.g. to avoid
+	// filling up the local disk when a network drive isn't mounted.
+	NoCreateOutputDirectory bool `json:"no_create_output_directory"`
+
+	// The octal modes to create images and directories in OutputDirectory with,
+	// e.g. "0664" and "2775" for a directory shared with a group.  When set, the
+	// modes are applied exactly, ignoring the umask.  Default to "0644" and
+	// "0755", with the umask applied.
+	OutputFileMode      string `json:"output_file_mode"`
+	OutputDirectoryMode string `json:"output_directory_mode"`
+
+	// Organizes images into subdirectories of OutputDirectory by date.  This is a Go
+	// time layout, e.g. "2006/01/02" saves to "2024/06/19/1718822400.png".
+	// Subdirectories are created as needed.  Images are saved directly in
+	// OutputDirectory if empty.
+	OutputLayout string `json:"output_layout"`
+
+	// Name images only by the time they were saved, e.g. "1718822400.png", instead
+	// of adding the first few words of the prompt and the seed, e.g.
+	// "1718822400-castle-in-fog-s1234.png".
+	TimestampFilenames bool `json:"timestamp_filenames"`
+
+	// Don't save images identical to one already saved, e.g. from re-running a
+	// seeded generation.  The duplicate is recorded in the history, pointing at
+	// the existing image.
+	Deduplicate bool `json:"deduplicate"`
+
+	// Use as little memory as possible, for small hosts like a Raspberry Pi:
+	// requests to Stability are built through temporary files, and images aren't
+	// decoded in full to check their metadata.  Generated images are still held
+	// in memory in full while they are saved.  Can be enabled for a single run
+	// with --low-memory.
+	LowMemory bool `json:"low_memory"`
+
+	// Send initial images, masks, and style references as they are.  By default
+	// their metadata, e.g. the GPS position and camera serial number in a
+	// photo's Exif, is stripped before they are uploaded, keeping only the
+	// orientation and color profile.  Can be enabled for a single run with
+	// --keep-input-metadata.
+	KeepInputMetadata bool `json:"keep_input_metadata"`
+
+	// The maximum size of OutputDirectory, e.g. "20GB" or a number of bytes.  When
+	// it grows past this, the oldest images are deleted after each save, except
+	// favorite and tagged ones.  Only images in the history are deleted.
+	MaxDirectorySize units.Size `json:"max_directory_size"`
+
+	// The Exif tags to write to generated images.
+	Exif ExifConfig `json:"exif"`
+
+	// Settings for embedding an invisible watermark in generated images.
+	Watermark WatermarkConfig `json:"watermark"`
+
+	// Post-processing applied locally to every image before it is saved, e.g.
+	// quantizing to a palette for pixel art.
+	PostProcess PostProcessConfig `json:"post_process"`
+
+	// Whether to write a JSON sidecar next to every image with the full request
+	// parameters, seed, finish reason, latency, and sdcli version.  The sidecar has
+	// the same name as the image, with a .json extension.
+	Sidecars bool `json:"sidecars"`
+
+	// Settings for uploading to object storage when OutputDirectory is an s3:// or
+	// gs:// URL.
+	ObjectStorage ObjectStorageConfig `json:"object_storage"`
+
+	// Uploads every image to a URL with a PUT or POST request, instead of or as
+	// well as saving it to OutputDirectory, e.g. to hand images to an asset
+	// server.
+	HTTPOutput HTTPOutputConfig `json:"http_output"`
+
 	// The command to run after generating an image.  This command will be invoked with
 	// the path to the image as an argument.  E.g. putting "firefox" in here will result
 	// in "firefox /path/to/image" being called after the image is generated.
 	PostGenerationCommand string `json:"post_generation_command"`
-}
-
-func getConfigDir() (string, error) {
-	home, err := homedir.Dir()
-	if err != nil {
-		return "", fmt.Errorf("failed to get user home directory: %w", err)
-	}
 
-	return filepath.Join(home, ".config", "sdcli"), nil
+	// The image editor to paint masks in for edit --draw-mask, e.g. "gimp".  It's
+	// invoked with the path to a copy of the image, and sdcli waits for it to exit.
+	// Areas painted pure green (#00ff00) are edited.
+	MaskEditor string `json:"mask_editor"`
+
+	// The backend to generate images with.  Defaults to "stability".
+	Backend string `json:"backend"`
+
+	// Settings for the AUTOMATIC1111 WebUI backend.  Only used when the backend is "a1111".
+	A1111 A1111Config `json:"a1111"`
+
+	// Settings for the OpenAI Images backend.  Only used when the backend is "openai".
+	OpenAI OpenAIConfig `json:"openai"`
+
+	// Settings for the Black Forest Labs FLUX backend.  Only used when the backend is "bfl".
+	BFL BFLConfig `json:"bfl"`
+
+	// How to poll for the results of backends that generate asynchronously, e.g.
+	// bfl.  Can be overridden for a single run with --poll-interval, --max-wait,
+	// and --poll-backoff.
+	Polling PollingConfig `json:"polling"`
+
+	// The maximum number of credits to spend per calendar month.  Generations that
+	// would exceed the budget are refused.  Zero or less disables the budget.
+	CreditBudget float64 `json:"credit_budget"`
+
+	// Print a warning before generating with Stability if the account has fewer
+	// credits than this left.  Zero disables the warning.
+	WarnBelowCredits float64 `json:"warn_below_credits"`
+
+	// Refuse to generate with Stability if the account would have fewer credits
+	// than this left afterwards.  Batches stop at the first image that would cross
+	// it, keeping the images generated so far.  Zero disables the check.
+	FailBelowCredits float64 `json:"fail_below_credits"`
+
+	// Rather than stopping when fail_below_credits would be crossed, wait for the
+	// account to be topped up, checking its balance every balance_check_interval.
+	WaitForCredits bool `json:"wait_for_credits"`
+
+	// How long the account's balance is cached for before it is fetched again, e.g.
+	// "15m" or a number of seconds.  Defaults to 15 minutes.
+	BalanceCheckInterval *units.Duration `json:"balance_check_interval"`
+
+	// A file to append a JSON line to for every invocation, recording its
+	// parameters, the images it saved, any error, and how long it took.  Unlike the
+	// history it is never pruned, so it can be used for auditing.  Not written if
+	// empty.
+	RunLog string `json:"run_log"`
+
+	// An LLM that expands short prompts into detailed ones before generating.
+	PromptEnhancer PromptEnhancerConfig `json:"prompt_enhancer"`
+
+	// Retry generations that content moderation filtered, with prompts rewritten
+	// by a command or the prompt enhancer.
+	FilterRetry FilterRetryConfig `json:"filter_retry"`
+
+	// Words, phrases, and regular expressions that prompts are checked for before
+	// they are sent, e.g. to avoid paying for prompts that content moderation would
+	// filter.  Prompts matching a "block" rule are refused, and ones matching a
+	// "warn" rule are sent with a warning.
+	PromptPolicy []policy.Rule `json:"prompt_policy"`
+
+	// Named pools of tokens for gen-3 --seasoning, which appends a random token from
+	// each pool to the prompt of every image, e.g.
+	// {"style": ["cinematic", "oil painting"], "lighting": ["golden hour"]}.
+	// Defaults to pools of common quality, lighting, and style tokens.
+	Seasoning map[string][]string `json:"seasoning"`
+
+	// Named negative prompts, referenced from --negative with an @, e.g.
+	// {"photo": "blurry, low contrast", "anime": "extra fingers"} for
+	// --negative "@photo, watermark".
+	Negatives map[string]string `json:"negatives"`
+
+	// A webhook to notify after every generation.
+	Webhook WebhookConfig `json:"webhook"`
+
+	// Settings for the Discord bot.  Only required for "sdcli bot discord".
+	Discord DiscordConfig `json:"discord"`
+
+	// Settings for the Telegram bot.  Only required for "sdcli bot telegram".
+	Telegram TelegramConfig `json:"telegram"`
+
+	// Named sets of settings that override the rest of the config when selected
+	// with --profile, e.g. a different API key and output directory for client
+	// work.  Profiles can hold any setting except other profiles.
+	Profiles map[string]json.RawMessage `json:"profiles"`
+
+	// Default flag values for each command, keyed by the command and then the flag,
+	// e.g. {"gen-3": {"ratio": "3:2", "negative": "blurry"}}.  Flags passed on the
+	// command line take precedence.
+	Defaults map[string]map[string]any `json:"defaults"`
 }
 
 func main() {
-	logger, err := zap.NewDevelopment()
+	logger, err := zap.NewDevelopment(zap.WithFatalHook(fatalHook{}))
 	if err != nil {
 		panic(fmt.Errorf("failed to create logger: %w", err))
 	}
 
+	cli := &CLI{}
+	loader := &configLoader{}
+
+	ctx := kong.Parse(
+		cli,
+		kong.Resolvers(loader.defaultsResolver()),
+		kong.Exit(func(code int) {
+			// Kong only fails when the arguments are invalid.
+			if code != 0 {
+				code = exitInvalid
+			}
+
+			os.Exit(code)
+		}))
+
+	if cli.JSON {
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return newJSONErrorCore(core, os.Stdout)
+		}))
+	}
+
 	configDir, err := getConfigDir()
 	if err != nil {
 		logger.Fatal("failed to get config directory", zap.Error(err))
 	}
 
-	configData, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	// The config itself is optional, but the history and budget are kept here.
+	err = os.MkdirAll(configDir, 0o700)
 	if err != nil {
-		logger.Fatal("failed to read config data", zap.Error(err))
+		logger.Fatal("failed to create config directory", zap.Error(err))
 	}
 
-	var config Config
+	config, configPath, err := loader.load(cli.Config, cli.Profile)
+	if err != nil {
+		logger.Fatal("failed to load config", zap.String("path", configPath), zap.Error(invalid(err)))
+	}
 
-	err = json.Unmarshal(configData, &config)
+	// This isn't fatal, since the key may not be needed, e.g. to run auth login.
+	err = config.resolveAPIKey()
 	if err != nil {
-		logger.Fatal("failed to unmarshal config JSON", zap.Error(err))
+		logger.Warn("failed to read API key", zap.Error(err))
 	}
 
-	cli := &CLI{}
+	if cli.Artist != "" {
+		config.Exif.Artist = cli.Artist
+	}
 
-	ctx := kong.Parse(cli)
+	if cli.Copyright != "" {
+		config.Exif.Copyright = cli.Copyright
+	}
 
-	err = ctx.Run(&Context{
-		Logger: logger,
-		Config: config,
-	})
+	if len(cli.ExifTag) > 0 {
+		if config.Exif.Extra == nil {
+			config.Exif.Extra = make(map[string]string, len(cli.ExifTag))
+		}
+
+		for k, v := range cli.ExifTag {
+			config.Exif.Extra[k] = v
+		}
+	}
+
+	if cli.LowMemory {
+		config.LowMemory = true
+	}
+
+	if cli.KeepInputMetadata {
+		config.KeepInputMetadata = true
+	}
+
+	if cli.PollInterval > 0 {
+		config.Polling.Interval = cli.PollInterval
+	}
+
+	if cli.MaxWait > 0 {
+		config.Polling.MaxWait = cli.MaxWait
+	}
+
+	if cli.PollBackoff != 0 {
+		config.Polling.Backoff = cli.PollBackoff
+	}
+
+	// A directory given for one invocation, e.g. a project's assets, is always
+	// created, and never trimmed to max_directory_size, since it isn't the
+	// directory sdcli manages.
+	if cli.OutDir != "" {
+		config.OutputDirectory = cli.OutDir
+		config.NoCreateOutputDirectory = false
+		config.MaxDirectorySize = 0
+	}
+
+	backendName := cli.Backend
+	if cli.Mock {
+		backendName = "mock"
+	} else if backendName == "" {
+		backendName = config.Backend
+	}
+
+	var run *runRecorder
+
+	if config.RunLog != "" {
+		runLogPath, err := homedir.Expand(config.RunLog)
+		if err != nil {
+			logger.Fatal("failed to expand run log path", zap.Error(err))
+		}
+
+		run = newRunRecorder(runlog.New(runLogPath), runlog.Entry{
+			Command: commandPath(ctx.Command()),
+			Args:    os.Args[1:],
+			Profile: cli.Profile,
+			Backend: backendName,
+		})
+
+		logger = logger.WithOptions(zap.WithFatalHook(fatalHook{run: run}))
+	}
+
+	if cli.BaseURL != "" {
+		err = overrideBaseURL(&config, backendName, cli.BaseURL)
+		if err != nil {
+			logger.Fatal("failed to override base URL", zap.Error(invalid(err)))
+		}
+	}
+
+	selectedBackend, err := newBackend(backendName, config)
+	if err != nil {
+		logger.Fatal("failed to create backend", zap.Error(invalid(err)))
+	}
+
+	config.OutputDirectory, err = expandOutputDirectory(config.OutputDirectory)
+	if err != nil {
+		logger.Fatal("failed to expand output directory", zap.Error(err))
+	}
+
+	output, err := newOutputDestination(config)
 	if err != nil {
+		logger.Fatal("failed to set up output directory", zap.Error(err))
+	}
+
+	err = config.validate(backendName, slices.Contains(backendCommands, strings.Fields(ctx.Command())[0]))
+	if err != nil {
+		logger.Fatal("invalid config", zap.String("path", configPath), zap.Error(invalid(err)))
+	}
+
+	appCtx := &Context{
+		Ctx:     cancelOnInterrupt(logger),
+		Logger:  logger,
+		Config:  config,
+		Budget:  budget.NewGuard(filepath.Join(configDir, "budget.json"), config.CreditBudget),
+		Backend: selectedBackend,
+		Output:  output,
+		History: history.NewStore(filepath.Join(configDir, "history.json")),
+		Run:     run,
+	}
+
+	if config.Webhook.URL != "" {
+		appCtx.Webhook = webhook.New(config.Webhook.URL, config.Webhook.Secret, config.Webhook.Headers)
+	}
+
+	if len(config.PromptPolicy) > 0 {
+		// The rules were checked by validate.
+		appCtx.Policy, _ = policy.New(config.PromptPolicy)
+	}
+
+	// The palette and LUT were checked by validate.
+	appCtx.PostProcess, _ = newPostProcessor(config.PostProcess)
+
+	client, isStability := selectedBackend.(*stability.Client)
+	if isStability && (config.WarnBelowCredits > 0 || config.FailBelowCredits > 0) {
+		appCtx.Balance = balance.NewCache(filepath.Join(configDir, "balance.json"), config.balanceCheckInterval(), client.Balance)
+	}
+
+	err = ctx.Run(appCtx)
+	if errors.Is(err, context.Canceled) && appCtx.Ctx.Err() != nil {
+		if runErr := run.finish(errors.New("interrupted")); runErr != nil {
+			logger.Error("failed to write run log", zap.Error(runErr))
+		}
+
+		os.Exit(exitInterrupted)
+	} else if err != nil {
 		logger.Fatal("failed to execute command", zap.Error(err))
 	}
+
+	err = run.finish(nil)
+	if err != nil {
+		logger.Error("failed to write run log", zap.Error(err))
+	}
+}
+
+// commandPath returns the names of the commands in a kong command, without its
+// arguments, e.g. "history list" for "history list" and "gen-3" for
+// "gen-3 <prompt-parts>".
+func commandPath(command string) string {
+	var names []string
+
+	for _, v := range strings.Fields(command) {
+		if strings.HasPrefix(v, "<") || strings.HasPrefix(v, "[") {
+			break
+		}
+
+		names = append(names, v)
+	}
+
+	return strings.Join(names, " ")
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sort"
+	"strings"
+)
+
+// defaultSeasoning are the pools of tokens used for --seasoning when seasoning
+// isn't configured.
+var defaultSeasoning = map[string][]string{
+	"quality":  {"highly detailed", "sharp focus", "intricate details", "masterpiece", "best quality"},
+	"lighting": {"soft lighting", "golden hour", "dramatic lighting", "studio lighting", "volumetric light"},
+	"style":    {"cinematic", "photorealistic", "concept art", "oil painting", "digital illustration"},
+}
+
+// seasoningPools returns the configured pools of seasoning tokens, or the
+// default ones if none are configured.
+func (c Config) seasoningPools() map[string][]string {
+	if len(c.Seasoning) == 0 {
+		return defaultSeasoning
+	}
+
+	return c.Seasoning
+}
+
+// season appends a random token from each pool to a prompt, and returns the
+// seasoned prompt along with the tokens that were picked.  Pools are used in
+// order of their names, so prompts seasoned with the same tokens read the same.
+func season(prompt string, pools map[string][]string) (string, []string) {
+	names := make([]string, 0, len(pools))
+	for k, v := range pools {
+		if len(v) > 0 {
+			names = append(names, k)
+		}
+	}
+
+	sort.Strings(names)
+
+	tokens := make([]string, 0, len(names))
+	for _, v := range names {
+		pool := pools[v]
+		tokens = append(tokens, pool[rand.IntN(len(pool))])
+	}
+
+	if len(tokens) == 0 {
+		return prompt, nil
+	}
+
+	return strings.TrimRight(prompt, " ,") + ", " + strings.Join(tokens, ", "), tokens
+}
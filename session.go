@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sessionVersion is the version of the session file layout.  Sessions saved by
+// a newer sdcli are refused rather than misread.
+const sessionVersion = 1
+
+// session is everything needed to reproduce a gen-3 run, saved with
+// --save-session and replayed with --from-session.
+type session struct {
+	Version      int       `json:"version"`
+	SdcliVersion string    `json:"sdcli_version"`
+	CreatedAt    time.Time `json:"created_at"`
+	Backend      string    `json:"backend"`
+
+	// The local steps applied to the generated images.
+	Upscale     string            `json:"upscale,omitempty"`
+	Grid        bool              `json:"grid,omitempty"`
+	TileCheck   bool              `json:"tile_check,omitempty"`
+	PostProcess PostProcessConfig `json:"post_process"`
+
+	// The hex SHA-256 of the files the run read, e.g. initial images and style
+	// references, by path, so a reproduction can tell if its copies differ.
+	Inputs map[string]string `json:"inputs,omitempty"`
+
+	Generations []sessionGeneration `json:"generations"`
+}
+
+// sessionGeneration is a generation as it was sent, with the defaults resolved
+// and the seed the backend picked.
+type sessionGeneration struct {
+	generation
+
+	// The name the image was saved under, if it wasn't the default, e.g. to keep
+	// the structure of --image-dir.
+	OutputName string `json:"output_name,omitempty"`
+}
+
+// saveSession writes the generations in results, and the local steps applied to
+// them, to the --save-session file.
+func (g Gen3Command) saveSession(ctx *Context, results []*generationResult, postProcess PostProcessConfig) error {
+	saved := session{
+		Version:      sessionVersion,
+		SdcliVersion: version,
+		CreatedAt:    time.Now().UTC(),
+		Backend:      ctx.Backend.Name(),
+		Upscale:      g.Upscale,
+		Grid:         g.Grid,
+		TileCheck:    g.TileCheck,
+		PostProcess:  postProcess,
+		Inputs:       map[string]string{},
+	}
+
+	inputs := []string{postProcess.LUT, postProcess.Palette}
+
+	for _, v := range results {
+		// The other samples of a request are generated again with the first.
+		gen, ok := v.Parameters.(generation)
+		if !ok || v.Operation != "generate" || v.sampleIndex > 0 {
+			continue
+		}
+
+		gen.Seed = v.Seed
+		gen.Model = v.Model
+
+		saved.Generations = append(saved.Generations, sessionGeneration{generation: gen, OutputName: v.outputName})
+
+		inputs = append(inputs, gen.Image)
+		inputs = append(inputs, gen.StyleReferences...)
+	}
+
+	for _, v := range inputs {
+		// The palette is usually a list of colors rather than a file.
+		if v == "" || saved.Inputs[v] != "" {
+			continue
+		}
+
+		hash, err := hashFile(v)
+		if err == nil {
+			saved.Inputs[v] = hash
+		}
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	err = os.WriteFile(g.SaveSession, append(data, '\n'), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+
+	ctx.Logger.Info("saved session", zap.String("path", g.SaveSession), zap.Int("generations", len(saved.Generations)))
+
+	return nil
+}
+
+// loadSession reads a session file saved with --save-session.
+func loadSession(path string) (*session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	var loaded session
+
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return nil, invalid(fmt.Errorf("failed to parse session %q: %w", path, err))
+	}
+
+	if loaded.Version > sessionVersion {
+		return nil, invalid(fmt.Errorf("session %q was saved by a newer sdcli (%s), upgrade to reproduce it", path, loaded.SdcliVersion))
+	}
+
+	if len(loaded.Generations) == 0 {
+		return nil, invalid(fmt.Errorf("session %q has no generations", path))
+	}
+
+	return &loaded, nil
+}
+
+// runSession reproduces the generations in the --from-session file, followed by
+// the local steps that were applied to them.
+func (g Gen3Command) runSession(ctx *Context) error {
+	loaded, err := loadSession(g.FromSession)
+	if err != nil {
+		ctx.Logger.Fatal("failed to load session", zap.Error(err))
+	}
+
+	if loaded.Backend != ctx.Backend.Name() {
+		ctx.Logger.Warn("session was generated with a different backend, so the images will differ",
+			zap.String("session", loaded.Backend), zap.String("backend", ctx.Backend.Name()))
+	}
+
+	if loaded.SdcliVersion != version {
+		ctx.Logger.Warn("session was saved by a different version of sdcli",
+			zap.String("session", loaded.SdcliVersion), zap.String("version", version))
+	}
+
+	checkSessionInputs(ctx, loaded.Inputs)
+
+	ctx.PostProcess, err = newPostProcessor(loaded.PostProcess)
+	if err != nil {
+		ctx.Logger.Fatal("invalid post-processing in session", zap.Error(invalid(err)))
+	}
+
+	g.Upscale, g.Grid, g.TileCheck = loaded.Upscale, loaded.Grid, loaded.TileCheck
+	g.OutputFormat, g.SaveAs = loaded.Generations[0].OutputFormat, loaded.Generations[0].SaveAs
+	g.Count = len(loaded.Generations)
+
+	if g.Upscale != "" {
+		err = ctx.requireUpscaleMode(g.Upscale)
+		if err != nil {
+			ctx.Logger.Fatal("unable to upscale", zap.Error(err))
+		}
+	}
+
+	ctx.Logger.Info("reproducing session", zap.String("path", g.FromSession), zap.Int("generations", g.Count))
+
+	results := make([]*generationResult, 0, g.Count)
+
+	for _, v := range loaded.Generations {
+		if ctx.Ctx.Err() != nil {
+			break
+		}
+
+		gen := v.generation
+		gen.OutputName = v.OutputName
+
+		result, err := ctx.generate(ctx.Ctx, gen)
+		if result != nil {
+			results = append(results, result.withSamples()...)
+		}
+
+		if err != nil && ctx.Ctx.Err() != nil {
+			break
+		} else if err != nil {
+			ctx.Logger.Fatal("failed to generate image", zap.Error(err), zap.Int("generated", len(results)))
+		}
+	}
+
+	if g.SaveSession != "" {
+		err = g.saveSession(ctx, results, loaded.PostProcess)
+		if err != nil {
+			ctx.Logger.Error("failed to save session", zap.Error(err))
+		}
+	}
+
+	return g.finish(ctx, results)
+}
+
+// checkSessionInputs warns about the files a session read that are missing or
+// differ from the ones it was saved with.
+func checkSessionInputs(ctx *Context, inputs map[string]string) {
+	paths := make([]string, 0, len(inputs))
+	for k := range inputs {
+		paths = append(paths, k)
+	}
+
+	sort.Strings(paths)
+
+	for _, v := range paths {
+		hash, err := hashFile(v)
+		if errors.Is(err, os.ErrNotExist) {
+			ctx.Logger.Warn("session input is missing", zap.String("path", v))
+		} else if err != nil {
+			ctx.Logger.Warn("failed to read session input", zap.String("path", v), zap.Error(err))
+		} else if hash != inputs[v] {
+			ctx.Logger.Warn("session input differs from the one it was saved with, so the images will differ", zap.String("path", v))
+		}
+	}
+}
+
+// hashFile returns the hex SHA-256 of a file.
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
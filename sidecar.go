@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// sidecar is the JSON document written next to an image when sidecars are enabled.
+type sidecar struct {
+	// The file name of the image the sidecar describes.
+	Image string `json:"image"`
+
+	Operation    string    `json:"operation"`
+	Backend      string    `json:"backend"`
+	Model        string    `json:"model"`
+	Seed         int64     `json:"seed"`
+	FinishReason string    `json:"finish_reason"`
+	LatencyMS    int64     `json:"latency_ms"`
+	Credits      float64   `json:"credits"`
+	CreatedAt    time.Time `json:"created_at"`
+	Version      string    `json:"sdcli_version"`
+	WatermarkID  string    `json:"watermark_id,omitempty"`
+
+	// Describes the post-processing applied to the image, if any.
+	PostProcessing string `json:"post_processing,omitempty"`
+
+	// The full parameters of the request.
+	Request any `json:"request"`
+}
+
+// outputBaseName returns the file name of a saved image, which may be a local
+// path or an object storage URL.
+func outputBaseName(imagePath string) string {
+	return path.Base(strings.ReplaceAll(imagePath, "\\", "/"))
+}
+
+// sidecarName returns the name of the sidecar for an image, i.e. the image's
+// name with its extension replaced by ".json".  name is relative to the output
+// directory, so the sidecar is written to the same subdirectory as the image.
+func sidecarName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".json"
+}
+
+// writeSidecar writes a JSON sidecar describing result next to its image.
+func (c *Context) writeSidecar(ctx context.Context, result *generationResult) error {
+	data, err := json.MarshalIndent(sidecar{
+		Image:          outputBaseName(result.Path),
+		Operation:      result.Operation,
+		Backend:        result.Backend,
+		Model:          result.Model,
+		Seed:           result.Seed,
+		FinishReason:   result.FinishReason,
+		LatencyMS:      result.Duration.Milliseconds(),
+		Credits:        result.Credits,
+		CreatedAt:      result.CreatedAt,
+		Version:        version,
+		WatermarkID:    result.WatermarkID,
+		PostProcessing: result.PostProcessing,
+		Request:        result.Parameters,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sidecar: %w", err)
+	}
+
+	_, err = c.Output.Write(ctx, sidecarName(result.Name), data)
+	if err != nil {
+		return fmt.Errorf("failed to write sidecar: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// cancelOnInterrupt returns a context that is cancelled when sdcli is interrupted,
+// e.g. with Ctrl-C, so requests in flight are abandoned while images that were
+// already generated still get saved.  A second interrupt exits immediately.
+func cancelOnInterrupt(logger *zap.Logger) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-interrupts
+
+		// Restore the default behaviour, so interrupting again kills sdcli.
+		signal.Stop(interrupts)
+
+		logger.Warn("interrupted, finishing up; interrupt again to quit immediately")
+
+		cancel()
+	}()
+
+	return ctx
+}
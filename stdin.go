@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/SethCurry/sdcli/internal/policy"
+	"go.uber.org/zap"
+)
+
+// maxStdinPromptLength is the longest line accepted as a prompt with --stdin.
+const maxStdinPromptLength = 1 << 20
+
+var errStdinFlags = errors.New("--stdin can't be combined with a prompt argument or --image-dir")
+
+// runStdin generates --count images for every line read from r, e.g. prompts
+// piped from another program, as the lines are read.  Blank lines are skipped.
+// A failed prompt doesn't stop the rest, but is logged and included in the
+// returned error once the input ends.
+//
+// setPrompt sets the prompt that newGeneration uses.
+func (g Gen3Command) runStdin(
+	ctx *Context,
+	r io.Reader,
+	setPrompt func(prompt string) error,
+	newGeneration func(image string) generation,
+	postProcess PostProcessConfig,
+) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxStdinPromptLength)
+
+	var (
+		results []*generationResult
+		failed  []error
+		prompts int
+		line    int
+	)
+
+	for ctx.Ctx.Err() == nil && scanner.Scan() {
+		line++
+
+		prompt := strings.TrimSpace(scanner.Text())
+		if prompt == "" {
+			continue
+		}
+
+		prompts++
+
+		err := setPrompt(prompt)
+
+		for i := 0; err == nil && i < g.Count && ctx.Ctx.Err() == nil; i++ {
+			var result *generationResult
+
+			result, err = ctx.generate(ctx.Ctx, newGeneration(g.Image))
+			if result != nil {
+				results = append(results, result.withSamples()...)
+			}
+		}
+
+		if err != nil && ctx.Ctx.Err() != nil {
+			break
+		} else if err != nil {
+			ctx.Logger.Error("failed to generate prompt", zap.Int("line", line), zap.String("prompt", prompt), zap.Error(err))
+
+			failed = append(failed, fmt.Errorf("line %d: %w", line, err))
+
+			// Every line has its own prompt, so only running out of credits stops
+			// the rest.
+			if stopsBatch(err) && !errors.Is(err, policy.ErrBlocked) {
+				break
+			}
+		}
+	}
+
+	if g.SaveSession != "" {
+		err := g.saveSession(ctx, results, postProcess)
+		if err != nil {
+			ctx.Logger.Error("failed to save session", zap.Error(err))
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read prompts from stdin: %w", err)
+	}
+
+	if prompts == 0 && ctx.Ctx.Err() == nil {
+		return invalid(errors.New("no prompts were read from stdin"))
+	}
+
+	err = g.finish(ctx, results)
+
+	if len(failed) > 0 && ctx.Ctx.Err() == nil {
+		return fmt.Errorf("%d of %d prompts failed: %w", len(failed), prompts, errors.Join(failed...))
+	}
+
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math/rand/v2"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"golang.org/x/image/draw"
+)
+
+var errStyleWithImage = errors.New("--ref can't be combined with --image or --image-dir")
+
+// checkStyle returns an error if the backend can't generate in the style of the
+// --ref images with the given flags.
+func (g Gen3Command) checkStyle(ctx *Context) error {
+	if g.Image != "" || g.ImageDir != "" {
+		return invalid(errStyleWithImage)
+	}
+
+	if g.Fidelity < 0 || g.Fidelity > 1 {
+		return invalid(fmt.Errorf("fidelity must be between 0 and 1, got %v", g.Fidelity))
+	}
+
+	return ctx.requireOperation(backend.OperationStyle)
+}
+
+// pickStyleReferences returns the --ref images to use for the nth image, by
+// --ref-strategy, and whether they are to be averaged into one.
+func (g Gen3Command) pickStyleReferences(n int) ([]string, bool) {
+	switch g.RefStrategy {
+	case "random":
+		return []string{g.Ref[rand.IntN(len(g.Ref))]}, false
+	case "average":
+		return g.Ref, len(g.Ref) > 1
+	case "all":
+		return g.Ref, false
+	}
+
+	return []string{g.Ref[n%len(g.Ref)]}, false
+}
+
+// openStyleReferences opens the style references of a generation to send to the
+// backend, averaging them into one image if gen.AverageStyle is set.  The
+// returned closer must be called once they have been sent.
+func (c *Context) openStyleReferences(ctx context.Context, gen generation) ([]io.Reader, io.Closer, error) {
+	if gen.AverageStyle {
+		images := make([][]byte, 0, len(gen.StyleReferences))
+
+		for _, v := range gen.StyleReferences {
+			data, err := imageSource{Path: v}.read()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			data, err = c.prepareUpload(ctx, v, data)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			images = append(images, data)
+		}
+
+		blended, err := blendImages(images)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reader := bytes.NewReader(blended)
+
+		return []io.Reader{reader}, io.NopCloser(reader), nil
+	}
+
+	var (
+		readers = make([]io.Reader, 0, len(gen.StyleReferences))
+		closers closerList
+	)
+
+	for _, v := range gen.StyleReferences {
+		reader, closer, err := c.openInitImage(ctx, v)
+		if err != nil {
+			closers.Close()
+			return nil, nil, err
+		}
+
+		readers = append(readers, reader)
+		closers = append(closers, closer)
+	}
+
+	return readers, closers, nil
+}
+
+// closerList closes several closers at once.
+type closerList []io.Closer
+
+func (c closerList) Close() error {
+	var errs []error
+
+	for _, v := range c {
+		errs = append(errs, v.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// blendImages averages images pixel by pixel, after scaling them to the size of
+// the first, and returns the result as a PNG.
+func blendImages(images [][]byte) ([]byte, error) {
+	var (
+		bounds image.Rectangle
+		sums   []uint32
+		scaled *image.RGBA
+	)
+
+	for i, v := range images {
+		img, _, err := image.Decode(bytes.NewReader(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode style reference: %w", err)
+		}
+
+		if i == 0 {
+			bounds = image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+			sums = make([]uint32, bounds.Dx()*bounds.Dy()*4)
+			scaled = image.NewRGBA(bounds)
+		}
+
+		draw.ApproxBiLinear.Scale(scaled, bounds, img, img.Bounds(), draw.Src, nil)
+
+		for j, p := range scaled.Pix {
+			sums[j] += uint32(p)
+		}
+	}
+
+	if scaled == nil {
+		return nil, errors.New("no style references to blend")
+	}
+
+	for j, sum := range sums {
+		scaled.Pix[j] = uint8(sum / uint32(len(images)))
+	}
+
+	return backend.EncodeImage(scaled, "png")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+)
+
+// suggest returns the candidates closest to a mistyped value, for "did you mean"
+// hints, e.g. sd3-large for "sd3-lrage".  Candidates further from the value than
+// a third of its length, or two edits for short values, aren't suggested.
+func suggest(value string, candidates []string) []string {
+	value = strings.ToLower(value)
+	limit := max(2, len(value)/3)
+
+	var (
+		suggestions []string
+		best        = limit + 1
+	)
+
+	for _, v := range candidates {
+		distance := editDistance(value, strings.ToLower(v))
+
+		switch {
+		case distance > limit:
+			continue
+		case distance < best:
+			best = distance
+			suggestions = []string{v}
+		case distance == best:
+			suggestions = append(suggestions, v)
+		}
+	}
+
+	return suggestions
+}
+
+// editDistance returns the Damerau-Levenshtein distance between a and b: the
+// number of insertions, deletions, substitutions, and swaps of adjacent
+// characters needed to turn one into the other.
+func editDistance(a string, b string) int {
+	x, y := []rune(a), []rune(b)
+
+	// Only the last two rows of the table are needed to compute the next.
+	prev2 := make([]int, len(y)+1)
+	prev := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(prev[j]+1, current[j-1]+1, prev[j-1]+cost)
+
+			if i > 1 && j > 1 && x[i-1] == y[j-2] && x[i-2] == y[j-1] {
+				current[j] = min(current[j], prev2[j-2]+1)
+			}
+		}
+
+		prev2, prev, current = prev, current, prev2
+	}
+
+	return prev[len(y)]
+}
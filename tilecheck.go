@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"path"
+	"strings"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/tile"
+	"go.uber.org/zap"
+)
+
+// visibleSeamScore is the seam score above which the seams of a tiled image are
+// likely to be visible.
+const visibleSeamScore = 2
+
+// saveTileCheck saves a preview of a result's image tiled 2x2 and offset by half
+// a tile, so any seams run through the middle of each tile, next to the image.
+// It returns the path or URL the preview was saved to, and the image's seam
+// score.
+func (c *Context) saveTileCheck(ctx context.Context, result *generationResult) (string, float64, error) {
+	img, _, err := image.Decode(bytes.NewReader(result.Image))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to decode %q: %w", result.Path, err)
+	}
+
+	data, err := backend.EncodeImage(tile.Repeat(tile.Offset(img), 2), "png")
+	if err != nil {
+		return "", 0, err
+	}
+
+	name := strings.TrimSuffix(result.Name, path.Ext(result.Name)) + "-tile.png"
+
+	preview, err := c.Output.Write(ctx, name, data)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return preview, tile.SeamScore(img), nil
+}
+
+// checkTiling saves tiling previews of results and reports how visible their
+// seams are.  Failures are logged, since the images have already been saved.
+func (c *Context) checkTiling(ctx context.Context, results []*generationResult) {
+	for _, v := range results {
+		preview, score, err := c.saveTileCheck(ctx, v)
+		if err != nil {
+			c.Logger.Error("failed to save tiling preview", zap.String("path", v.Path), zap.Error(err))
+			continue
+		}
+
+		fields := []zap.Field{zap.String("path", v.Path), zap.String("preview", preview), zap.Float64("seam_score", score)}
+
+		if score > visibleSeamScore {
+			c.Logger.Warn("image has visible seams when tiled", fields...)
+		} else {
+			c.Logger.Info("image tiles seamlessly", fields...)
+		}
+	}
+}
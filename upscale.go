@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"go.uber.org/zap"
+)
+
+type UpscaleCommand struct {
+	Mode         string `optional:"mode" default:"fast" help:"The upscaler to use, e.g. fast or conservative.  Must be one the backend supports."`
+	OutputFormat string `optional:"format" default:"png" help:"The format of the returned image.  Must be one the backend supports, as listed by sdcli engines."`
+	Prompt       string `optional:"prompt" help:"A prompt describing the image.  Required by the conservative upscaler."`
+	SaveAs       string `optional:"save-as" enum:",png,jpeg" default:"" help:"Convert the image to this format before saving it, e.g. to request a lossless png and save a smaller jpeg.  Must be png or jpeg."`
+	Image        string `arg:"" type:"path" help:"The image to upscale."`
+}
+
+// upscaleParameters are the parameters of an upscale, as written to sidecars.
+type upscaleParameters struct {
+	Image        string `json:"image"`
+	Mode         string `json:"mode"`
+	Prompt       string `json:"prompt,omitempty"`
+	OutputFormat string `json:"output_format"`
+	SaveAs       string `json:"save_as,omitempty"`
+}
+
+func (u UpscaleCommand) Run(ctx *Context) error {
+	err := ctx.requireUpscaleMode(u.Mode)
+	if err != nil {
+		ctx.Logger.Fatal("unable to upscale", zap.Error(err))
+	}
+
+	err = ctx.requireOutputFormat(u.OutputFormat)
+	if err != nil {
+		ctx.Logger.Fatal("unable to upscale", zap.Error(err))
+	}
+
+	err = ctx.checkPrompt(u.Prompt)
+	if err != nil {
+		ctx.Logger.Fatal("unable to upscale", zap.Error(err))
+	}
+
+	saved, err := u.upscale(ctx, imageSource{Path: u.Image}, "")
+	if err != nil && ctx.Ctx.Err() != nil {
+		return ctx.Ctx.Err()
+	} else if err != nil {
+		ctx.Logger.Fatal("failed to upscale image", zap.Error(err))
+	}
+
+	ctx.runPostGenerationCommand(saved.Path)
+
+	return filteredError(saved)
+}
+
+// upscale upscales a single image and saves the result under outputName, or the
+// default name if it is empty.
+func (u UpscaleCommand) upscale(ctx *Context, source imageSource, outputName string) (*generationResult, error) {
+	original, err := source.read()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ctx.prepareUpload(ctx.Ctx, source.Path, original)
+	if err != nil {
+		return nil, err
+	}
+
+	credits, release, err := ctx.reserveCredits("upscale/" + u.Mode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve credits: %w", err)
+	}
+
+	started := time.Now()
+
+	result, err := ctx.Backend.Upscale(ctx.Ctx, backend.UpscaleRequest{
+		Image:        bytes.NewReader(data),
+		Mode:         u.Mode,
+		Prompt:       u.Prompt,
+		OutputFormat: u.OutputFormat,
+	})
+	if err != nil {
+		release()
+
+		return nil, err
+	}
+
+	saved := &generationResult{
+		Operation:       "upscale",
+		Prompt:          u.Prompt,
+		Backend:         ctx.Backend.Name(),
+		Model:           result.Model,
+		Seed:            result.Seed,
+		FinishReason:    result.FinishReason,
+		Duration:        time.Since(started),
+		Credits:         ctx.settleCredits(credits, result),
+		CreditsReported: result.Credits > 0,
+		Edit:            describeEdit("upscale "+u.Mode, u.Prompt),
+		Source:          ctx.readSourceMetadata(source.Path, original),
+		Parameters: upscaleParameters{
+			Image:        source.Path,
+			Mode:         u.Mode,
+			Prompt:       u.Prompt,
+			OutputFormat: u.OutputFormat,
+			SaveAs:       u.SaveAs,
+		},
+		outputName: outputName,
+	}
+
+	converted, format, err := convertForSaving(result.Image, u.OutputFormat, u.SaveAs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+
+	// The image has been paid for, so save it even if sdcli is being interrupted.
+	err = ctx.saveResult(context.WithoutCancel(ctx.Ctx), converted, format, saved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+
+	return saved, nil
+}
+
+// upscaleGenerated upscales images that were just generated, for gen-3
+// --upscale.  Each is saved next to the original, with -upscaled added to its
+// name.  Images blurred by content moderation aren't upscaled.
+func (c *Context) upscaleGenerated(results []*generationResult, mode string, outputFormat string, saveAs string) ([]*generationResult, error) {
+	upscaled := make([]*generationResult, 0, len(results))
+
+	for _, v := range results {
+		if v.FinishReason == finishReasonFiltered {
+			c.Logger.Warn("not upscaling an image that was filtered", zap.String("path", v.Path))
+			continue
+		}
+
+		// Duplicates aren't saved, so they don't have a name of their own.
+		name := v.Name
+		if name == "" {
+			name = outputBaseName(v.Path)
+		}
+
+		upscaler := UpscaleCommand{
+			Mode:         mode,
+			OutputFormat: outputFormat,
+			Prompt:       v.Prompt,
+			SaveAs:       saveAs,
+		}
+
+		result, err := upscaler.upscale(c, imageSource{Path: v.Path, Data: v.Image}, strings.TrimSuffix(name, path.Ext(name))+"-upscaled")
+		if err != nil {
+			return upscaled, fmt.Errorf("failed to upscale %s: %w", v.Path, err)
+		}
+
+		c.Logger.Info("upscaled image", zap.String("path", result.Path))
+
+		upscaled = append(upscaled, result)
+	}
+
+	return upscaled, nil
+}
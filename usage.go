@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/history"
+	"github.com/SethCurry/sdcli/internal/units"
+	"github.com/SethCurry/sdcli/pkg/stability"
+	"go.uber.org/zap"
+)
+
+type UsageCommand struct {
+	Since   units.Duration `optional:"since" default:"30d" help:"Only count images generated in this period, e.g. 30d, 2w, or 12h."`
+	By      string         `optional:"by" default:"day" enum:"day,model" help:"Summarize by day and model, or by model alone."`
+	Balance bool           `optional:"balance" help:"Also fetch the credits left on the Stability account, to reconcile the estimates against."`
+}
+
+// usageKey is a row of the usage report.
+type usageKey struct {
+	Day   string
+	Model string
+}
+
+// usageTotal is the number of images, and the credits they cost, in a row of the
+// usage report.
+type usageTotal struct {
+	Images  int
+	Credits float64
+}
+
+// summarizeUsage totals the images and estimated credits of the entries created
+// after since, by day and model or, if byDay is false, by model alone.  Imported
+// images weren't generated by sdcli, so aren't counted.
+func summarizeUsage(entries []history.Entry, since time.Time, byDay bool) map[usageKey]*usageTotal {
+	totals := make(map[usageKey]*usageTotal)
+
+	for _, v := range entries {
+		if v.Imported || v.CreatedAt.Before(since) {
+			continue
+		}
+
+		key := usageKey{Model: v.Model}
+		if key.Model == "" {
+			key.Model = v.Backend
+		}
+
+		if byDay {
+			key.Day = v.CreatedAt.Local().Format("2006-01-02")
+		}
+
+		total, ok := totals[key]
+		if !ok {
+			total = &usageTotal{}
+			totals[key] = total
+		}
+
+		total.Images++
+		total.Credits += v.Credits
+	}
+
+	return totals
+}
+
+func (u UsageCommand) Run(ctx *Context) error {
+	entries, err := ctx.History.List()
+	if err != nil {
+		ctx.Logger.Fatal("failed to read history", zap.Error(err))
+	}
+
+	byDay := u.By == "day"
+	totals := summarizeUsage(entries, time.Now().Add(-time.Duration(u.Since)), byDay)
+
+	keys := make([]usageKey, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i int, j int) bool {
+		if keys[i].Day != keys[j].Day {
+			return keys[i].Day < keys[j].Day
+		}
+
+		return keys[i].Model < keys[j].Model
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	if byDay {
+		fmt.Fprintln(writer, "DAY\tMODEL\tIMAGES\tCREDITS")
+	} else {
+		fmt.Fprintln(writer, "MODEL\tIMAGES\tCREDITS")
+	}
+
+	var sum usageTotal
+
+	for _, k := range keys {
+		total := totals[k]
+
+		if byDay {
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%g\n", k.Day, k.Model, total.Images, total.Credits)
+		} else {
+			fmt.Fprintf(writer, "%s\t%d\t%g\n", k.Model, total.Images, total.Credits)
+		}
+
+		sum.Images += total.Images
+		sum.Credits += total.Credits
+	}
+
+	if byDay {
+		fmt.Fprintf(writer, "TOTAL\t\t%d\t%g\n", sum.Images, sum.Credits)
+	} else {
+		fmt.Fprintf(writer, "TOTAL\t%d\t%g\n", sum.Images, sum.Credits)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if !u.Balance {
+		return nil
+	}
+
+	balance, err := stabilityBalance(ctx)
+	if err != nil {
+		ctx.Logger.Fatal("failed to fetch balance", zap.Error(err))
+	}
+
+	fmt.Printf("\nEstimated credits spent since %s: %g\n", time.Now().Add(-time.Duration(u.Since)).Local().Format("2006-01-02"), sum.Credits)
+	fmt.Printf("Credits left on the Stability account: %g\n", balance)
+
+	return nil
+}
+
+// stabilityBalance fetches the credits left on the Stability account, whichever
+// backend is selected.
+func stabilityBalance(ctx *Context) (float64, error) {
+	client, err := stabilityClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return client.Balance(ctx.Ctx)
+}
+
+// stabilityClient returns a client for the Stability API, whichever backend is
+// selected.
+func stabilityClient(ctx *Context) (*stability.Client, error) {
+	if client, ok := ctx.Backend.(*stability.Client); ok {
+		return client, nil
+	}
+
+	created, err := newBackend("stability", ctx.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return created.(*stability.Client), nil
+}
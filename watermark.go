@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/SethCurry/sdcli/pkg/backend"
+	"github.com/SethCurry/sdcli/pkg/watermark"
+	"go.uber.org/zap"
+)
+
+type WatermarkConfig struct {
+	// Whether to embed an invisible watermark in every image, marking it as
+	// AI-generated.  The watermark holds a random ID, which is also written to the
+	// image's metadata and sidecar so the image can be traced back to its request.
+	Enabled bool `json:"enabled"`
+
+	// How strongly to embed the watermark.  Higher values survive more compression,
+	// but are more likely to be visible.  Defaults to 16.
+	Strength float64 `json:"strength"`
+}
+
+type WatermarkCommand struct {
+	Image string `arg:"" type:"existingfile" help:"The image to check for a watermark."`
+}
+
+func (w WatermarkCommand) Run(ctx *Context) error {
+	fd, err := os.Open(w.Image)
+	if err != nil {
+		ctx.Logger.Fatal("failed to open image", zap.String("path", w.Image), zap.Error(err))
+	}
+	defer fd.Close()
+
+	img, _, err := image.Decode(fd)
+	if err != nil {
+		ctx.Logger.Fatal("failed to decode image", zap.String("path", w.Image), zap.Error(err))
+	}
+
+	id, err := watermark.Detect(img)
+	if err != nil {
+		ctx.Logger.Fatal("failed to detect watermark", zap.String("path", w.Image), zap.Error(err))
+	}
+
+	formatted := formatWatermarkID(id)
+
+	ctx.Logger.Info("found watermark", zap.String("path", w.Image), zap.String("id", formatted))
+
+	entries, err := ctx.History.List()
+	if err != nil {
+		ctx.Logger.Fatal("failed to read history", zap.Error(err))
+	}
+
+	for _, v := range entries {
+		if v.WatermarkID == formatted {
+			ctx.Logger.Info(
+				"watermark matches an image in the history",
+				zap.Int64("id", v.ID),
+				zap.String("path", v.Path),
+				zap.String("prompt", v.Prompt),
+				zap.Time("created_at", v.CreatedAt))
+		}
+	}
+
+	return nil
+}
+
+// formatWatermarkID formats a watermark ID as it is written to metadata and
+// sidecars.
+func formatWatermarkID(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// errWatermarkUnsupported is returned by addWatermark for formats the image can't
+// be re-encoded in after watermarking.
+var errWatermarkUnsupported = errors.New("unable to watermark this format")
+
+// addWatermark embeds an invisible watermark with a random ID in an encoded image,
+// returning the re-encoded image and the ID.
+func (c *Context) addWatermark(data []byte, format string) ([]byte, string, error) {
+	if format != "png" && format != "jpeg" {
+		return nil, "", fmt.Errorf("%w %q", errWatermarkUnsupported, format)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	var rawID [8]byte
+
+	_, err = rand.Read(rawID[:])
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate watermark ID: %w", err)
+	}
+
+	id := binary.BigEndian.Uint64(rawID[:])
+
+	embedded, err := watermark.Embed(img, id, c.Config.Watermark.Strength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	watermarked, err := backend.EncodeImage(embedded, format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return watermarked, formatWatermarkID(id), nil
+}
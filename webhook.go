@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/SethCurry/sdcli/internal/units"
+	"go.uber.org/zap"
+)
+
+// defaultWebhookTimeout is how long a webhook may take to respond when
+// webhook.timeout isn't set.
+const defaultWebhookTimeout = 10 * time.Second
+
+type WebhookConfig struct {
+	// The URL to POST a JSON payload to after every generation.
+	URL string `json:"url"`
+
+	// The secret used to sign payloads.  When set, the HMAC-SHA256 of the
+	// X-Sdcli-Timestamp header, a ".", and the body is sent in the
+	// X-Sdcli-Signature header as "sha256=<hex>".
+	Secret string `json:"secret"`
+
+	// Extra headers to send with every request, e.g. for authentication.
+	Headers map[string]string `json:"headers"`
+
+	// How long the webhook may take to respond before delivery is abandoned,
+	// e.g. "30s".  Defaults to 10 seconds.
+	Timeout units.Duration `json:"timeout"`
+}
+
+// timeout returns the configured delivery timeout, or defaultWebhookTimeout if
+// none is configured.
+func (w WebhookConfig) timeout() time.Duration {
+	if w.Timeout == 0 {
+		return defaultWebhookTimeout
+	}
+
+	return time.Duration(w.Timeout)
+}
+
+type webhookImage struct {
+	Path           string  `json:"path"`
+	Operation      string  `json:"operation"`
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	Backend        string  `json:"backend"`
+	Model          string  `json:"model"`
+	Seed           int64   `json:"seed"`
+	FinishReason   string  `json:"finish_reason"`
+	DurationMS     int64   `json:"duration_ms"`
+	Credits        float64 `json:"credits"`
+}
+
+type webhookPayload struct {
+	Event string `json:"event"`
+
+	// The images that were produced.  This holds a single image for now, but is a
+	// list so that batches can be reported in one payload.
+	Images []webhookImage `json:"images"`
+
+	// The total duration and credits of all images.
+	DurationMS int64   `json:"duration_ms"`
+	Credits    float64 `json:"credits"`
+}
+
+// notifyWebhook sends the results to the configured webhook, if any.  Failures
+// are logged rather than returned, since the images have already been saved.
+func (c *Context) notifyWebhook(ctx context.Context, results ...*generationResult) {
+	if c.Webhook == nil {
+		return
+	}
+
+	payload := webhookPayload{Event: "generation.completed"}
+
+	for _, v := range results {
+		payload.Images = append(payload.Images, webhookImage{
+			Path:           v.Path,
+			Operation:      v.Operation,
+			Prompt:         v.Prompt,
+			NegativePrompt: v.NegativePrompt,
+			Backend:        v.Backend,
+			Model:          v.Model,
+			Seed:           v.Seed,
+			FinishReason:   v.FinishReason,
+			DurationMS:     v.Duration.Milliseconds(),
+			Credits:        v.Credits,
+		})
+
+		payload.DurationMS += v.Duration.Milliseconds()
+		payload.Credits += v.Credits
+	}
+
+	// The images are saved even if the command was interrupted, so the webhook is
+	// still sent, but a slow or unreachable receiver mustn't hold up the run.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.Config.Webhook.timeout())
+	defer cancel()
+
+	err := c.Webhook.Send(ctx, payload)
+	if err != nil {
+		c.Logger.Error("failed to send webhook", zap.Error(err))
+	}
+}